@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ban represents a temporary restriction placed on an identity
+type Ban struct {
+	Identity  string    `json:"identity"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Offenses  int       `json:"offenses"`
+}
+
+const (
+	actionThrottle = "throttle"
+	actionBlock    = "block"
+)
+
+// Phrases commonly used in attempts to override the system prompt
+var jailbreakPattern = regexp.MustCompile(`(?i)(ignore (all |any )?(previous|prior|above) (instructions|prompts)|disregard (your|the) (rules|instructions)|developer mode|\bDAN\b|do anything now|jailbreak|pretend (you are|to be) (an? )?(unfiltered|uncensored)|system prompt)`)
+
+type abuseEvent struct {
+	at        time.Time
+	prompt    string
+	jailbreak bool
+}
+
+// abuseDetector tracks recent requests per identity and client IP
+type abuseDetector struct {
+	window           time.Duration
+	duplicateLimit   int
+	jailbreakLimit   int
+	identityLimit    int
+	banDuration      time.Duration
+	throttleInterval time.Duration
+	// offenseTTL is how long past offenses still make the next ban longer
+	offenseTTL time.Duration
+
+	mu          sync.Mutex
+	events      map[string][]abuseEvent
+	ipIdentity  map[string]map[string]time.Time
+	bans        map[string]*Ban
+	offenses    map[string]int
+	lastOffense map[string]time.Time
+	lastRequest map[string]time.Time
+	swept       time.Time
+}
+
+var abuse *abuseDetector
+
+func configureAbuse() {
+	abuse = &abuseDetector{
+		window:           envDuration("ABUSE_WINDOW", time.Minute),
+		duplicateLimit:   envInt("ABUSE_DUPLICATE_LIMIT", 5),
+		jailbreakLimit:   envInt("ABUSE_JAILBREAK_LIMIT", 3),
+		identityLimit:    envInt("ABUSE_IDENTITIES_PER_IP", 5),
+		banDuration:      envDuration("ABUSE_BAN_DURATION", 15*time.Minute),
+		throttleInterval: envDuration("ABUSE_THROTTLE_INTERVAL", 10*time.Second),
+		offenseTTL:       envDuration("ABUSE_OFFENSE_TTL", 24*time.Hour),
+		events:           map[string][]abuseEvent{},
+		ipIdentity:       map[string]map[string]time.Time{},
+		bans:             map[string]*Ban{},
+		offenses:         map[string]int{},
+		lastOffense:      map[string]time.Time{},
+		lastRequest:      map[string]time.Time{},
+	}
+}
+
+// inspect records the request and reports whether it must be rejected,
+// along with how long the caller should wait before retrying
+func (d *abuseDetector) inspect(identity, clientIP, prompt string, now time.Time) (bool, time.Duration, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.swept) >= d.window {
+		d.sweep(now)
+	}
+	if ban, ok := d.bans[identity]; ok {
+		if now.After(ban.ExpiresAt) {
+			delete(d.bans, identity)
+		} else if ban.Action == actionBlock {
+			return true, ban.ExpiresAt.Sub(now), ban.Reason
+		} else if wait := d.lastRequest[identity].Add(d.throttleInterval).Sub(now); wait > 0 {
+			return true, wait, ban.Reason
+		}
+	}
+	d.lastRequest[identity] = now
+
+	cutoff := now.Add(-d.window)
+	normalized := strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+	events := d.events[identity][:0]
+	duplicates, jailbreaks := 0, 0
+	for _, e := range d.events[identity] {
+		if e.at.Before(cutoff) {
+			continue
+		}
+		events = append(events, e)
+		if e.prompt == normalized {
+			duplicates++
+		}
+		if e.jailbreak {
+			jailbreaks++
+		}
+	}
+	event := abuseEvent{at: now, prompt: normalized, jailbreak: jailbreakPattern.MatchString(prompt)}
+	events = append(events, event)
+	d.events[identity] = events
+	duplicates++
+	if event.jailbreak {
+		jailbreaks++
+	}
+
+	identities := d.ipIdentity[clientIP]
+	if identities == nil {
+		identities = map[string]time.Time{}
+		d.ipIdentity[clientIP] = identities
+	}
+	identities[identity] = now
+	for id, seen := range identities {
+		if seen.Before(cutoff) {
+			delete(identities, id)
+		}
+	}
+
+	var reason string
+	switch {
+	case d.duplicateLimit > 0 && duplicates >= d.duplicateLimit:
+		reason = fmt.Sprintf("%d identical prompts within %s", duplicates, d.window)
+	case d.jailbreakLimit > 0 && jailbreaks >= d.jailbreakLimit:
+		reason = fmt.Sprintf("%d jailbreak attempts within %s", jailbreaks, d.window)
+	case d.identityLimit > 0 && len(identities) > d.identityLimit:
+		reason = fmt.Sprintf("%d identities used from %s within %s", len(identities), clientIP, d.window)
+	default:
+		return false, 0, ""
+	}
+
+	ban := d.restrict(identity, reason, now)
+	delete(d.events, identity)
+	if ban.Action == actionBlock {
+		return true, ban.ExpiresAt.Sub(now), reason
+	}
+	return false, 0, ""
+}
+
+// restrict throttles first-time offenders and blocks repeat offenders, doubling
+// the block duration on every further offense
+func (d *abuseDetector) restrict(identity, reason string, now time.Time) *Ban {
+	d.offenses[identity]++
+	d.lastOffense[identity] = now
+	offenses := d.offenses[identity]
+
+	ban := &Ban{Identity: identity, Reason: reason, CreatedAt: now, Offenses: offenses, Action: actionThrottle}
+	duration := d.banDuration
+	if offenses > 1 {
+		ban.Action = actionBlock
+		duration = time.Duration(float64(d.banDuration) * math.Pow(2, float64(offenses-2)))
+	}
+	ban.ExpiresAt = now.Add(duration)
+	d.bans[identity] = ban
+
+	notify(Alert{
+		Type:     "abuse",
+		Severity: "warning",
+		Message:  fmt.Sprintf("Identity %s %sd until %s: %s", identity, ban.Action, ban.ExpiresAt.Format(time.RFC3339), reason),
+		Details:  map[string]interface{}{"identity": identity, "action": ban.Action, "offenses": offenses},
+	})
+	return ban
+}
+
+// sweep forgets requests outside the window, expired bans, and offenses
+// older than ABUSE_OFFENSE_TTL of identities no longer banned. The caller
+// holds d.mu.
+func (d *abuseDetector) sweep(now time.Time) {
+	d.swept = now
+	cutoff := now.Add(-d.window)
+	for identity, events := range d.events {
+		if len(events) == 0 || events[len(events)-1].at.Before(cutoff) {
+			delete(d.events, identity)
+		}
+	}
+	for ip, identities := range d.ipIdentity {
+		for identity, seen := range identities {
+			if seen.Before(cutoff) {
+				delete(identities, identity)
+			}
+		}
+		if len(identities) == 0 {
+			delete(d.ipIdentity, ip)
+		}
+	}
+	for identity, ban := range d.bans {
+		if now.After(ban.ExpiresAt) {
+			delete(d.bans, identity)
+		}
+	}
+	for identity, at := range d.lastRequest {
+		// Throttled identities need their last request until the ban ends
+		if _, banned := d.bans[identity]; !banned && at.Before(cutoff) {
+			delete(d.lastRequest, identity)
+		}
+	}
+	for identity := range d.offenses {
+		if _, banned := d.bans[identity]; !banned && d.offenseTTL > 0 && now.Sub(d.lastOffense[identity]) > d.offenseTTL {
+			delete(d.offenses, identity)
+			delete(d.lastOffense, identity)
+		}
+	}
+}
+
+func (d *abuseDetector) activeBans(now time.Time) []Ban {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	bans := []Ban{}
+	for identity, ban := range d.bans {
+		if now.After(ban.ExpiresAt) {
+			delete(d.bans, identity)
+			continue
+		}
+		bans = append(bans, *ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.Before(bans[j].CreatedAt) })
+	return bans
+}
+
+// lift removes a ban and forgives previous offenses
+func (d *abuseDetector) lift(identity string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := d.bans[identity]
+	delete(d.bans, identity)
+	delete(d.offenses, identity)
+	delete(d.lastOffense, identity)
+	delete(d.events, identity)
+	return ok
+}
+
+// restoreBans reinstates bans from a backup, skipping any that have expired
+func (d *abuseDetector) restoreBans(bans []Ban, now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	restored := 0
+	for _, ban := range bans {
+		if ban.Identity == "" || now.After(ban.ExpiresAt) {
+			continue
+		}
+		ban := ban
+		d.bans[ban.Identity] = &ban
+		if d.offenses[ban.Identity] < ban.Offenses {
+			d.offenses[ban.Identity] = ban.Offenses
+		}
+		if d.lastOffense[ban.Identity].Before(ban.CreatedAt) {
+			d.lastOffense[ban.Identity] = ban.CreatedAt
+		}
+		restored++
+	}
+	return restored
+}
+
+// rejectAbusive aborts the request when the caller is banned or just tripped
+// a detection rule, and reports whether it did
+func rejectAbusive(c *gin.Context, prompt string) bool {
+	rejected, retryAfter, reason := abuse.inspect(requestUser(c), c.ClientIP(), prompt, time.Now())
+	if !rejected {
+		return false
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Temporarily restricted due to unusual activity: " + reason, "retry_after": seconds})
+	return true
+}
+
+func handleListBans(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"bans": abuse.activeBans(time.Now())})
+}
+
+func handleLiftBan(c *gin.Context) {
+	identity := c.Param("identity")
+	if !abuse.lift(identity) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active ban for identity"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"identity": identity, "lifted": true})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAbuseDetectorSweep(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newDetector := func() *abuseDetector {
+		return &abuseDetector{window: time.Minute, duplicateLimit: 2, banDuration: time.Minute, throttleInterval: time.Second,
+			offenseTTL: time.Hour, events: map[string][]abuseEvent{}, ipIdentity: map[string]map[string]time.Time{},
+			bans: map[string]*Ban{}, offenses: map[string]int{}, lastOffense: map[string]time.Time{}, lastRequest: map[string]time.Time{}}
+	}
+
+	tests := []struct {
+		name string
+		// later is when the sweep runs, after one request and one offense
+		// by "alice" at start
+		later        time.Duration
+		wantEvents   int
+		wantBans     int
+		wantOffenses int
+	}{
+		{name: "within the window", later: 30 * time.Second, wantEvents: 1, wantBans: 1, wantOffenses: 1},
+		{name: "ban still active", later: 50 * time.Second, wantEvents: 1, wantBans: 1, wantOffenses: 1},
+		{name: "ban expired, offense remembered", later: 10 * time.Minute, wantOffenses: 1},
+		{name: "offense forgotten", later: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDetector()
+			d.inspect("bob", "10.0.0.1", "hello", start)
+			d.restrict("alice", "test", start)
+			d.sweep(start.Add(tt.later))
+			if len(d.events) != tt.wantEvents || len(d.ipIdentity) != tt.wantEvents || len(d.lastRequest) != tt.wantEvents {
+				t.Fatalf("%d events, %d IPs, %d last requests, want %d", len(d.events), len(d.ipIdentity), len(d.lastRequest), tt.wantEvents)
+			}
+			if len(d.bans) != tt.wantBans {
+				t.Fatalf("%d bans, want %d", len(d.bans), tt.wantBans)
+			}
+			if len(d.offenses) != tt.wantOffenses || len(d.lastOffense) != tt.wantOffenses {
+				t.Fatalf("%d offenses, want %d", len(d.offenses), tt.wantOffenses)
+			}
+		})
+	}
+}
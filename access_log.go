@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Access log sinks
+const (
+	accessLogStdout = "stdout"
+	accessLogFile   = "file"
+	accessLogSyslog = "syslog"
+)
+
+// accessLogOutput is where access log lines go, apart from application logs
+// when a file or syslog sink is configured
+var accessLogOutput io.Writer = os.Stdout
+
+// configureAccessLogSink reads ACCESS_LOG_SINK. The file sink writes
+// ACCESS_LOG_FILE, rotating it at ACCESS_LOG_MAX_SIZE and every
+// ACCESS_LOG_ROTATE_INTERVAL; syslog writes to the local daemon or
+// ACCESS_LOG_SYSLOG_ADDR.
+func configureAccessLogSink() {
+	accessLogOutput = os.Stdout
+	switch sink := envString("ACCESS_LOG_SINK", accessLogStdout); sink {
+	case accessLogStdout:
+	case accessLogFile:
+		path := envString("ACCESS_LOG_FILE", "access.log")
+		f, err := openRotatingFile(path, envSize("ACCESS_LOG_MAX_SIZE", 100<<20), envDuration("ACCESS_LOG_ROTATE_INTERVAL", 0), envInt("ACCESS_LOG_MAX_FILES", 7))
+		if err != nil {
+			configWarn("failed to open access log %s: %v; logging requests to stdout", path, err)
+			return
+		}
+		accessLogOutput = f
+		log.Printf("Access log: %s", path)
+	case accessLogSyslog:
+		w, err := dialSyslog(envString("ACCESS_LOG_SYSLOG_ADDR", ""), envString("ACCESS_LOG_SYSLOG_TAG", "chatbot-access"))
+		if err != nil {
+			configWarn("failed to connect to syslog: %v; logging requests to stdout", err)
+			return
+		}
+		accessLogOutput = w
+	default:
+		configWarn("ACCESS_LOG_SINK must be stdout, file or syslog, got %q; using stdout", sink)
+	}
+	accessLogOutput = scrubbingWriter{w: accessLogOutput, sink: "access_log"}
+}
+
+// dialSyslog connects to addr, e.g. udp://logs.example.com:514, or the local
+// daemon when addr is empty. Lines are sent with the info severity of the
+// local0 facility.
+func dialSyslog(addr, tag string) (io.Writer, error) {
+	priority := syslog.LOG_INFO | syslog.LOG_LOCAL0
+	if addr == "" {
+		return syslog.New(priority, tag)
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_SYSLOG_ADDR %q, want e.g. udp://host:514", addr)
+	}
+	return syslog.Dial(u.Scheme, u.Host, priority, tag)
+}
+
+// rotatingFile is a log file that is renamed with a timestamp suffix and
+// started afresh when it grows past maxSize or gets older than interval.
+// Only the newest maxFiles rotated files are kept.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	maxFiles int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, interval: interval, maxFiles: maxFiles}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) || (r.interval > 0 && time.Since(r.opened) >= r.interval)) {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the current file rather than lose lines
+			log.Printf("Failed to rotate %s: %v", r.path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	rotated := r.path + "." + time.Now().UTC().Format("20060102-150405")
+	if _, err := os.Stat(rotated); err == nil {
+		rotated += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	r.f.Close()
+	if err := r.open(); err != nil {
+		// Reopen the renamed file so writes still land somewhere
+		if f, reopenErr := os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0o644); reopenErr == nil {
+			r.f = f
+		}
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune deletes the oldest rotated files beyond maxFiles
+func (r *rotatingFile) prune() {
+	if r.maxFiles <= 0 {
+		return
+	}
+	rotated, _ := filepath.Glob(r.path + ".*")
+	if len(rotated) <= r.maxFiles {
+		return
+	}
+	// The timestamp suffix sorts oldest first
+	sort.Strings(rotated)
+	for _, old := range rotated[:len(rotated)-r.maxFiles] {
+		if err := os.Remove(old); err != nil {
+			log.Printf("Failed to remove old access log %s: %v", old, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PendingAction is a call to a tool with side effects, held until the user
+// confirms or rejects it
+type PendingAction struct {
+	ID             string          `json:"id"`
+	User           string          `json:"user"`
+	ConversationID string          `json:"conversation_id,omitempty"`
+	Tool           string          `json:"tool"`
+	Arguments      json.RawMessage `json:"arguments"`
+	Summary        string          `json:"summary"`
+	Status         string          `json:"status"` // pending, running, completed, failed, rejected
+	Result         string          `json:"result,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	ExpiresAt      time.Time       `json:"expires_at"`
+}
+
+var (
+	actionConfirmTTL time.Duration
+
+	actionsMu      sync.Mutex
+	pendingActions = map[string]*PendingAction{}
+
+	actionOutcomes *counterVec
+)
+
+// configureActions reads ACTION_CONFIRM_TTL, how long a held tool call can be
+// confirmed for
+func configureActions() {
+	actionConfirmTTL = envDuration("ACTION_CONFIRM_TTL", 15*time.Minute)
+	actionOutcomes = newCounterVec("chatbot_tool_actions_total", "Tool calls held for confirmation, by outcome", "tool", "outcome")
+}
+
+// holdToolCall records a call to t for the user of session to confirm
+func holdToolCall(session *toolSession, t Tool, arguments json.RawMessage) (PendingAction, error) {
+	if session == nil || session.user == "" {
+		return PendingAction{}, errors.New("this tool needs the user's confirmation, which cannot be asked for here")
+	}
+	summary := string(arguments)
+	if t.describe != nil {
+		var err error
+		if summary, err = t.describe(arguments); err != nil {
+			return PendingAction{}, err
+		}
+	}
+	now := time.Now()
+	action := PendingAction{
+		ID:             newID(),
+		User:           session.user,
+		ConversationID: session.conversationID,
+		Tool:           t.Name,
+		Arguments:      arguments,
+		Summary:        summary,
+		Status:         "pending",
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(actionConfirmTTL),
+	}
+	actionsMu.Lock()
+	pruneActionsLocked(now)
+	stored := action
+	pendingActions[action.ID] = &stored
+	actionsMu.Unlock()
+	session.pending = append(session.pending, action)
+	actionOutcomes.inc(t.Name, "held")
+	return action, nil
+}
+
+// pruneActionsLocked drops actions past their expiry, answered or not
+func pruneActionsLocked(now time.Time) {
+	for id, a := range pendingActions {
+		if now.After(a.ExpiresAt) {
+			if a.Status == "pending" {
+				actionOutcomes.inc(a.Tool, "expired")
+			}
+			delete(pendingActions, id)
+		}
+	}
+}
+
+// userAction returns the caller's action with the id in the path, or writes a
+// 404 and returns nil; actionsMu must be held
+func userAction(c *gin.Context) *PendingAction {
+	a, ok := pendingActions[c.Param("id")]
+	if !ok || a.User != requestUser(c) || time.Now().After(a.ExpiresAt) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Action not found or expired"})
+		return nil
+	}
+	return a
+}
+
+func handleListActions(c *gin.Context) {
+	user := requestUser(c)
+	actionsMu.Lock()
+	pruneActionsLocked(time.Now())
+	out := []PendingAction{}
+	for _, a := range pendingActions {
+		if a.User == user && a.Status == "pending" {
+			out = append(out, *a)
+		}
+	}
+	actionsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"actions": out})
+}
+
+// handleConfirmAction runs a held tool call, with the arguments the user
+// edited it to when the body has them. The result is added to the
+// conversation as an assistant message, so the model sees it on the next turn.
+func handleConfirmAction(c *gin.Context) {
+	var edit struct {
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := c.ShouldBindJSON(&edit); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	actionsMu.Lock()
+	a := userAction(c)
+	if a == nil {
+		actionsMu.Unlock()
+		return
+	}
+	if a.Status != "pending" {
+		actionsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Action was already " + a.Status})
+		return
+	}
+	toolsMu.RLock()
+	t, ok := tools[a.Tool]
+	toolsMu.RUnlock()
+	if len(edit.Arguments) > 0 {
+		summary := string(edit.Arguments)
+		if ok && t.describe != nil {
+			var err error
+			if summary, err = t.describe(edit.Arguments); err != nil {
+				actionsMu.Unlock()
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		a.Arguments, a.Summary = edit.Arguments, summary
+	}
+	// Claimed before running, so a double click cannot run it twice
+	a.Status = "running"
+	action := *a
+	actionsMu.Unlock()
+
+	var out string
+	var err error
+	if !ok {
+		err = fmt.Errorf("tool %s is no longer available", action.Tool)
+	} else if t.callAs != nil {
+		out, err = t.callAs(action.User, action.Arguments)
+	} else {
+		out, err = t.call(action.Arguments)
+	}
+
+	action.Status, action.Result = "completed", out
+	if err != nil {
+		log.Printf("Confirmed tool %s failed: %v", action.Tool, err)
+		action.Status, action.Result = "failed", err.Error()
+	}
+	actionsMu.Lock()
+	*a = action
+	actionsMu.Unlock()
+	actionOutcomes.inc(action.Tool, action.Status)
+
+	if action.ConversationID != "" {
+		content := action.Result
+		if action.Status == "failed" {
+			content = fmt.Sprintf("Could not %s: %s", action.Summary, action.Result)
+		}
+		conversationStore.Update(action.ConversationID, func(conv *Conversation) {
+			conv.Messages = append(conv.Messages, Message{ID: newID(), Role: "assistant", Content: content, CreatedAt: time.Now(), Status: messageCompleted})
+		})
+	}
+	status := http.StatusOK
+	if action.Status == "failed" {
+		status = http.StatusBadGateway
+	}
+	c.JSON(status, action)
+}
+
+func handleRejectAction(c *gin.Context) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	a := userAction(c)
+	if a == nil {
+		return
+	}
+	if a.Status != "pending" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Action was already " + a.Status})
+		return
+	}
+	a.Status = "rejected"
+	actionOutcomes.inc(a.Tool, "rejected")
+	c.JSON(http.StatusOK, *a)
+}
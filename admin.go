@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Users allowed to call admin routes, matched against the forwarded identity
+var adminUsers []string
+
+func configureAdmin() {
+	adminUsers = envList("ADMIN_USERS")
+}
+
+// requireAdmin rejects requests whose forwarded identity is not in ADMIN_USERS
+// or an admin group
+func requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(adminUsers) == 0 && len(currentEntitlements().AdminGroups) == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access is not configured"})
+			return
+		}
+		if !isAdmin(c) {
+			accessDenied(c, authAdmin, requestUser(c), "not an admin")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isAdmin reports whether the forwarded user is an admin. Callers with a
+// service token are not, whatever headers they send along: without the
+// workspace proxy in front those headers are theirs to choose.
+func isAdmin(c *gin.Context) bool {
+	if c.GetString(serviceIdentityKey) != "" {
+		return false
+	}
+	email := c.GetHeader("X-Forwarded-Email")
+	username := c.GetHeader("X-Forwarded-Preferred-Username")
+	for _, user := range adminUsers {
+		if (email != "" && strings.EqualFold(user, email)) || (username != "" && strings.EqualFold(user, username)) {
+			return true
+		}
+	}
+	return inAdminGroup(c)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LeaderboardQuery represents the analytics period and result size
+type LeaderboardQuery struct {
+	Period string `form:"period"`
+	Limit  int    `form:"limit" binding:"omitempty,gt=0,lte=100"`
+}
+
+// UserStat summarizes one user's volume in the period
+type UserStat struct {
+	User     string  `json:"user"`
+	Requests int     `json:"requests"`
+	Tokens   int     `json:"tokens"`
+	Cost     float64 `json:"cost"`
+}
+
+// CountStat is a generic name/count pair
+type CountStat struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// TrafficWindow is an hourly window and its request count
+type TrafficWindow struct {
+	Start    time.Time `json:"start"`
+	Requests int       `json:"requests"`
+}
+
+// LeaderboardResponse represents the admin analytics summary
+type LeaderboardResponse struct {
+	From          time.Time       `json:"from"`
+	To            time.Time       `json:"to"`
+	TotalRequests int             `json:"total_requests"`
+	TopUsers      []UserStat      `json:"top_users"`
+	Categories    []CountStat     `json:"categories"`
+	TopKeywords   []CountStat     `json:"top_keywords"`
+	PeakWindows   []TrafficWindow `json:"peak_windows"`
+	HourOfDay     [24]int         `json:"hour_of_day"`
+}
+
+// Keyword lists used to bucket prompts into coarse categories
+var promptCategories = []struct {
+	name     string
+	keywords []string
+}{
+	{"sql", []string{"sql", "select", "query", "table", "join", "warehouse", "delta"}},
+	{"code", []string{"code", "function", "python", "golang", "error", "bug", "script", "regex", "api"}},
+	{"data", []string{"data", "dataset", "pandas", "spark", "dataframe", "csv", "chart", "analysis"}},
+	{"writing", []string{"write", "email", "summarize", "summary", "draft", "rewrite", "translate", "bio"}},
+	{"planning", []string{"plan", "schedule", "trip", "travel", "itinerary", "recommend"}},
+}
+
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"can": true, "do": true, "for": true, "from": true, "how": true, "i": true, "in": true, "is": true,
+	"it": true, "me": true, "my": true, "of": true, "on": true, "or": true, "please": true, "that": true,
+	"the": true, "this": true, "to": true, "what": true, "with": true, "you": true, "your": true,
+	"about": true, "give": true, "tell": true, "make": true, "some": true, "there": true, "we": true,
+}
+
+func handleLeaderboard(c *gin.Context) {
+	var q LeaderboardQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if q.Period == "" {
+		q.Period = "7d"
+	}
+	if q.Limit == 0 {
+		q.Limit = 10
+	}
+
+	period, err := parsePeriod(q.Period)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-period)
+	c.JSON(http.StatusOK, buildLeaderboard(auditStore.List(from, to), from, to, q.Limit))
+}
+
+func buildLeaderboard(records []AuditRecord, from, to time.Time, limit int) LeaderboardResponse {
+	resp := LeaderboardResponse{From: from, To: to, TotalRequests: len(records)}
+
+	users := map[string]*UserStat{}
+	categories := map[string]int{}
+	keywords := map[string]int{}
+	windows := map[time.Time]int{}
+
+	for _, r := range records {
+		u := users[r.User]
+		if u == nil {
+			u = &UserStat{User: r.User}
+			users[r.User] = u
+		}
+		u.Requests++
+		u.Tokens += r.PromptTokens + r.CompletionTokens
+		u.Cost += r.Cost
+
+		words := promptKeywords(r.Prompt)
+		categories[categorizePrompt(words)]++
+		for _, w := range uniqueStrings(words) {
+			keywords[w]++
+		}
+
+		windows[r.Timestamp.UTC().Truncate(time.Hour)]++
+		resp.HourOfDay[r.Timestamp.UTC().Hour()]++
+	}
+
+	for _, u := range users {
+		resp.TopUsers = append(resp.TopUsers, *u)
+	}
+	sort.Slice(resp.TopUsers, func(i, j int) bool {
+		if resp.TopUsers[i].Requests != resp.TopUsers[j].Requests {
+			return resp.TopUsers[i].Requests > resp.TopUsers[j].Requests
+		}
+		return resp.TopUsers[i].User < resp.TopUsers[j].User
+	})
+	if len(resp.TopUsers) > limit {
+		resp.TopUsers = resp.TopUsers[:limit]
+	}
+
+	resp.Categories = topCounts(categories, limit)
+	resp.TopKeywords = topCounts(keywords, limit)
+
+	for start, count := range windows {
+		resp.PeakWindows = append(resp.PeakWindows, TrafficWindow{Start: start, Requests: count})
+	}
+	sort.Slice(resp.PeakWindows, func(i, j int) bool {
+		if resp.PeakWindows[i].Requests != resp.PeakWindows[j].Requests {
+			return resp.PeakWindows[i].Requests > resp.PeakWindows[j].Requests
+		}
+		return resp.PeakWindows[i].Start.Before(resp.PeakWindows[j].Start)
+	})
+	if len(resp.PeakWindows) > 5 {
+		resp.PeakWindows = resp.PeakWindows[:5]
+	}
+
+	return resp
+}
+
+// promptKeywords lowercases the prompt and drops punctuation and stopwords
+func promptKeywords(prompt string) []string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(prompt), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(w) > 2 && !stopwords[w] {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func categorizePrompt(words []string) string {
+	best, bestScore := "general", 0
+	for _, category := range promptCategories {
+		score := 0
+		for _, w := range words {
+			for _, k := range category.keywords {
+				if w == k {
+					score++
+				}
+			}
+		}
+		if score > bestScore {
+			best, bestScore = category.name, score
+		}
+	}
+	return best
+}
+
+func topCounts(counts map[string]int, limit int) []CountStat {
+	stats := []CountStat{}
+	for name, count := range counts {
+		stats = append(stats, CountStat{Name: name, Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
+
+func uniqueStrings(values []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parsePeriod accepts Go durations plus a "d" suffix for days, e.g. "7d"
+func parsePeriod(period string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(period, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(period, "d"))
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(period)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", period)
+	}
+	return d, nil
+}
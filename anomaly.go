@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// anomalyDetector compares the most recent window of traffic to a rolling
+// baseline built from the preceding windows
+type anomalyDetector struct {
+	window      time.Duration
+	baseline    time.Duration
+	factor      float64
+	minRequests int
+	cooldown    time.Duration
+
+	mu         sync.Mutex
+	lastAlerts map[string]time.Time
+}
+
+// windowStats summarizes the audit records in one window
+type windowStats struct {
+	requests    int
+	errors      int
+	latencySum  time.Duration
+	userVolumes map[string]int
+}
+
+func (s windowStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+func (s windowStats) meanLatency() time.Duration {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.latencySum / time.Duration(s.requests)
+}
+
+// anomalies is nil when ANOMALY_DETECTION_ENABLED is false
+var anomalies *anomalyDetector
+
+func configureAnomalyDetection() {
+	anomalies = nil
+	if !envBool("ANOMALY_DETECTION_ENABLED", true) {
+		return
+	}
+
+	d := &anomalyDetector{
+		window:      envDuration("ANOMALY_WINDOW", 5*time.Minute),
+		baseline:    envDuration("ANOMALY_BASELINE", time.Hour),
+		factor:      envFloat("ANOMALY_SPIKE_FACTOR", 3),
+		minRequests: envInt("ANOMALY_MIN_REQUESTS", 20),
+		cooldown:    envDuration("ANOMALY_ALERT_COOLDOWN", 15*time.Minute),
+		lastAlerts:  map[string]time.Time{},
+	}
+	// The window is the check interval, which must be positive
+	if d.window <= 0 {
+		configWarn("ANOMALY_WINDOW must be positive, got %s; using 5m", d.window)
+		d.window = 5 * time.Minute
+	}
+	anomalies = d
+}
+
+func startAnomalyDetector() {
+	d := anomalies
+	if d == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(d.window)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			d.check(now)
+		}
+	}()
+}
+
+func (d *anomalyDetector) check(now time.Time) {
+	current := summarizeWindow(auditStore.List(now.Add(-d.window), now))
+	if current.requests < d.minRequests {
+		return
+	}
+
+	windows := int(d.baseline / d.window)
+	if windows < 1 {
+		return
+	}
+	base := summarizeWindow(auditStore.List(now.Add(-d.window-d.baseline), now.Add(-d.window)))
+	if base.requests == 0 {
+		return
+	}
+
+	if rate, baseRate := current.errorRate(), base.errorRate(); rate >= 0.05 && rate > baseRate*d.factor {
+		d.raise(now, "error_rate", fmt.Sprintf("Error rate %.1f%% over the last %s (baseline %.1f%%)", rate*100, d.window, baseRate*100),
+			map[string]interface{}{"error_rate": rate, "baseline_error_rate": baseRate, "requests": current.requests})
+	}
+
+	if latency, baseLatency := current.meanLatency(), base.meanLatency(); baseLatency > 0 && float64(latency) > float64(baseLatency)*d.factor {
+		d.raise(now, "latency", fmt.Sprintf("Mean latency %s over the last %s (baseline %s)", latency, d.window, baseLatency),
+			map[string]interface{}{"mean_latency_ms": latency.Milliseconds(), "baseline_mean_latency_ms": baseLatency.Milliseconds()})
+	}
+
+	for user, volume := range current.userVolumes {
+		baseVolume := float64(base.userVolumes[user]) / float64(windows)
+		if volume >= d.minRequests && float64(volume) > baseVolume*d.factor {
+			d.raise(now, "user_volume:"+user, fmt.Sprintf("User %s sent %d requests in the last %s (baseline %.1f)", user, volume, d.window, baseVolume),
+				map[string]interface{}{"user": user, "requests": volume, "baseline_requests": baseVolume})
+		}
+	}
+}
+
+// raise sends an alert unless the same kind was raised within the cooldown
+func (d *anomalyDetector) raise(now time.Time, key, message string, details map[string]interface{}) {
+	d.mu.Lock()
+	if last, ok := d.lastAlerts[key]; ok && now.Sub(last) < d.cooldown {
+		d.mu.Unlock()
+		return
+	}
+	d.lastAlerts[key] = now
+	d.mu.Unlock()
+
+	notify(Alert{Type: "anomaly", Severity: "warning", Message: message, Details: details, Timestamp: now})
+}
+
+func summarizeWindow(records []AuditRecord) windowStats {
+	stats := windowStats{userVolumes: map[string]int{}}
+	for _, r := range records {
+		stats.requests++
+		if r.StatusCode != http.StatusOK {
+			stats.errors++
+		}
+		stats.latencySum += r.Latency
+		stats.userVolumes[r.User]++
+	}
+	return stats
+}
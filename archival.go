@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	archiveAfter    time.Duration
+	archiveInterval time.Duration
+	archiveBatch    int
+	archiveMaxSize  int64
+
+	conversationsArchived *counterVec
+)
+
+func configureArchival() {
+	archiveAfter = envDuration("CONVERSATION_ARCHIVE_AFTER", 0)
+	archiveInterval = envDuration("CONVERSATION_ARCHIVE_INTERVAL", time.Hour)
+	archiveBatch = envInt("CONVERSATION_ARCHIVE_BATCH", 500)
+	archiveMaxSize = envSize("CONVERSATION_ARCHIVE_MAX_BYTES", 64<<20)
+	conversationsArchived = newCounterVec("chatbot_conversations_archived_total", "Conversations moved to or restored from cold storage", "direction")
+}
+
+// archiveKey is where an archived conversation is kept in the blob store
+func archiveKey(id string) string {
+	return "conversation-" + id + ".json.gz"
+}
+
+// startConversationArchiver moves conversations that have been inactive for
+// CONVERSATION_ARCHIVE_AFTER to the artifact blob store every
+// CONVERSATION_ARCHIVE_INTERVAL
+func startConversationArchiver() {
+	if archiveAfter <= 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(archiveInterval)
+			if n := archiveInactiveConversations(time.Now().Add(-archiveAfter)); n > 0 {
+				log.Printf("Archived %d conversations inactive since %s", n, archiveAfter)
+			}
+		}
+	}()
+}
+
+// archiveInactiveConversations archives up to one batch of conversations
+// last updated before the cutoff and returns how many it moved
+func archiveInactiveConversations(before time.Time) int {
+	archived := 0
+	for _, conv := range conversationStore.Inactive(before, archiveBatch) {
+		if err := archiveConversation(conv); err != nil {
+			log.Printf("Failed to archive conversation %s: %v", conv.ID, err)
+			continue
+		}
+		archived++
+	}
+	return archived
+}
+
+// archiveConversation writes conv to cold storage, then removes it from the
+// store unless it was updated in the meantime
+func archiveConversation(conv Conversation) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(conv); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := blobStore.Put(archiveKey(conv.ID), buf.Bytes()); err != nil {
+		return err
+	}
+	if !conversationLog.deleteUnchanged(conv.ID, conv.UpdatedAt) {
+		return fmt.Errorf("updated while archiving, kept in the store")
+	}
+	conversationsArchived.inc("archived")
+	return nil
+}
+
+// loadArchivedConversation reads a conversation back from cold storage
+func loadArchivedConversation(id string) (Conversation, error) {
+	var conv Conversation
+	body, err := blobStore.Get(archiveKey(id))
+	if err != nil {
+		return conv, err
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return conv, err
+	}
+	// A small blob can inflate to far more than any conversation
+	data, err := io.ReadAll(io.LimitReader(zr, archiveMaxSize+1))
+	if err != nil {
+		return conv, err
+	}
+	if int64(len(data)) > archiveMaxSize {
+		return conv, fmt.Errorf("archived conversation %s is larger than %d bytes", id, archiveMaxSize)
+	}
+	return conv, json.Unmarshal(data, &conv)
+}
+
+// isArchived reports whether the caller's conversation is in cold storage
+func isArchived(c *gin.Context, id string) bool {
+	conv, err := loadArchivedConversation(id)
+	return err == nil && conv.User == requestUser(c)
+}
+
+// handleRehydrateConversation moves an archived conversation back into the
+// store, counting as activity so it is not archived again straight away
+func handleRehydrateConversation(c *gin.Context) {
+	id := c.Param("id")
+	if conv, ok := conversationStore.Get(id); ok && conv.User == requestUser(c) {
+		c.JSON(http.StatusOK, conv)
+		return
+	}
+	conv, err := loadArchivedConversation(id)
+	if err == errBlobNotFound || (err == nil && conv.User != requestUser(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to rehydrate conversation %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read archived conversation"})
+		return
+	}
+	conv.UpdatedAt = time.Now()
+	conversationStore.Put(conv)
+	conversationsArchived.inc("rehydrated")
+	c.JSON(http.StatusOK, conv)
+}
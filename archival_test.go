@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// racingStore runs race once, right after the next Get has read the
+// conversation
+type racingStore struct {
+	ConversationStore
+	race func()
+}
+
+func (s *racingStore) Get(id string) (Conversation, bool) {
+	conv, ok := s.ConversationStore.Get(id)
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return conv, ok
+}
+
+func TestArchiveConversationRacingUpdate(t *testing.T) {
+	blobs, store, events := blobStore, conversationStore, conversationLog
+	t.Cleanup(func() { blobStore, conversationStore, conversationLog = blobs, store, events })
+	blobStore = &localBlobStore{dir: t.TempDir()}
+
+	projection := &racingStore{ConversationStore: newMemoryConversationStore(0)}
+	conversationLog = &eventLogConversationStore{ConversationStore: projection, events: &memoryConversationEventStore{}}
+	conversationStore = conversationLog
+	conv := conversationStore.Create("user@example.com")
+
+	// The user writes just as the archiver has checked the conversation is
+	// unchanged. The update must wait for the archiver, then find the
+	// conversation gone, rather than land in a conversation about to be
+	// deleted.
+	updated := make(chan bool, 1)
+	projection.race = func() {
+		go func() {
+			updated <- conversationStore.Update(conv.ID, func(c *Conversation) {
+				c.Messages = append(c.Messages, Message{ID: newID(), Role: "user", Content: "late"})
+			})
+		}()
+		select {
+		case ok := <-updated:
+			updated <- ok
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if err := archiveConversation(conv); err != nil {
+		t.Fatal(err)
+	}
+	if <-updated {
+		t.Fatal("update applied to a conversation that was then archived")
+	}
+	if _, ok := conversationStore.Get(conv.ID); ok {
+		t.Fatal("archived conversation is still in the store")
+	}
+	archived, err := loadArchivedConversation(conv.ID)
+	if err != nil || archived.ID != conv.ID {
+		t.Fatalf("archived conversation = %+v, %v", archived, err)
+	}
+}
+
+func TestDeleteUnchanged(t *testing.T) {
+	store := &eventLogConversationStore{ConversationStore: newMemoryConversationStore(0), events: &memoryConversationEventStore{}}
+	conv := store.Create("user@example.com")
+	if store.deleteUnchanged(conv.ID, conv.UpdatedAt.Add(-time.Second)) {
+		t.Fatal("deleted a conversation updated since")
+	}
+	if !store.deleteUnchanged(conv.ID, conv.UpdatedAt) {
+		t.Fatal("did not delete an unchanged conversation")
+	}
+	if _, ok := store.Get(conv.ID); ok {
+		t.Fatal("conversation still stored")
+	}
+	if store.deleteUnchanged(conv.ID, conv.UpdatedAt) {
+		t.Fatal("deleted a missing conversation")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BlobStore stores large artifacts outside of API responses
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) (io.ReadCloser, error)
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// localBlobStore keeps artifacts in a directory on local disk
+type localBlobStore struct {
+	dir string
+}
+
+func (s *localBlobStore) Put(key string, data []byte) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.dir, key), data, 0o644)
+}
+
+func (s *localBlobStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+// volumeBlobStore keeps artifacts in a Unity Catalog Volume or DBFS path
+// through the workspace Files API
+type volumeBlobStore struct {
+	root string
+}
+
+func (s *volumeBlobStore) fileURL(key string) string {
+	return filesAPIURL("files", path.Join(s.root, key))
+}
+
+func (s *volumeBlobStore) Put(key string, data []byte) error {
+	httpReq, err := http.NewRequest("PUT", s.fileURL(key)+"?overwrite=true", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", databricksToken()))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("files API returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+	}
+	return nil
+}
+
+func (s *volumeBlobStore) Get(key string) (io.ReadCloser, error) {
+	httpReq, err := http.NewRequest("GET", s.fileURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", databricksToken()))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("files API returned %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+var (
+	blobStore         BlobStore
+	artifactURLTTL    time.Duration
+	artifactInlineMax int
+)
+
+func configureArtifacts() {
+	var err error
+	blobStore = nil
+	switch backend := envString("ARTIFACT_BACKEND", "local"); backend {
+	case "local":
+	case "volume":
+		blobStore = &volumeBlobStore{root: envString("ARTIFACT_VOLUME_PATH", "")}
+	case "s3":
+		if blobStore, err = newS3BlobStore(); err != nil {
+			configWarn("cannot use S3 artifact storage, using local disk: %v", err)
+		}
+	case "azure":
+		if blobStore, err = newAzureBlobStore(); err != nil {
+			configWarn("cannot use Azure artifact storage, using local disk: %v", err)
+		}
+	default:
+		configWarn("unknown ARTIFACT_BACKEND %q, using local disk", backend)
+	}
+	if blobStore == nil {
+		blobStore = &localBlobStore{dir: envString("ARTIFACT_DIR", filepath.Join(os.TempDir(), "chatbot-artifacts"))}
+	}
+
+	key := []byte(lookupEnv("ARTIFACT_SIGNING_KEY", ""))
+	if len(key) == 0 {
+		// Signed URLs won't survive a restart or work across replicas
+		log.Printf("Warning: ARTIFACT_SIGNING_KEY not set, using a random key")
+		key = []byte(newID())
+	}
+	setArtifactKey(key)
+	artifactURLTTL = envDuration("ARTIFACT_URL_TTL", time.Hour)
+	artifactInlineMax = int(envSize("ARTIFACT_INLINE_LIMIT", 1<<20))
+}
+
+// storeArtifact saves the data and returns an expiring signed download URL
+func storeArtifact(data []byte, ext string) (string, time.Time, error) {
+	key := newID() + ext
+	if err := blobStore.Put(key, data); err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(artifactURLTTL)
+	return signedArtifactURL(key, expires), expires, nil
+}
+
+func signedArtifactURL(key string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return fmt.Sprintf("/api/artifacts/%s?expires=%s&signature=%s", key, exp, artifactSignature(key, exp))
+}
+
+func artifactSignature(key, expires string) string {
+	mac := hmac.New(sha256.New, artifactKey())
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func handleGetArtifact(c *gin.Context) {
+	key := c.Param("key")
+	expires := c.Query("expires")
+	signature := c.Query("signature")
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(artifactSignature(key, expires))) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if time.Now().Unix() > exp {
+		c.JSON(http.StatusGone, gin.H{"error": "Link has expired"})
+		return
+	}
+
+	body, err := blobStore.Get(key)
+	if err == errBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Artifact not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read artifact %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read artifact"})
+		return
+	}
+	defer body.Close()
+
+	contentType := mime.TypeByExtension(filepath.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", key))
+	c.DataFromReader(http.StatusOK, -1, contentType, body, nil)
+}
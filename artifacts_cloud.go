@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// blobPutTimeout bounds a single upload to object storage
+const blobPutTimeout = 2 * time.Minute
+
+// s3BlobStore keeps artifacts in an S3 bucket, or an S3-compatible store
+// when an endpoint is set. Credentials come from the standard AWS chain:
+// environment, shared config and profiles, web identity or instance role.
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3BlobStore() (BlobStore, error) {
+	bucket := envString("ARTIFACT_S3_BUCKET", "")
+	if bucket == "" {
+		return nil, errors.New("ARTIFACT_S3_BUCKET is not set")
+	}
+
+	var opts []func(*config.LoadOptions) error
+	if region := envString("ARTIFACT_S3_REGION", ""); region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := envString("ARTIFACT_S3_ENDPOINT", "")
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &s3BlobStore{client: client, bucket: bucket, prefix: envString("ARTIFACT_S3_PREFIX", "")}, nil
+}
+
+func (s *s3BlobStore) Put(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), blobPutTimeout)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, key)),
+	})
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// azureBlobStore keeps artifacts in an Azure Blob Storage container, using
+// AZURE_STORAGE_CONNECTION_STRING when set and otherwise the default Azure
+// credential chain: environment, workload identity, managed identity or the
+// Azure CLI login.
+type azureBlobStore struct {
+	client    *azblob.Client
+	container string
+	prefix    string
+}
+
+func newAzureBlobStore() (BlobStore, error) {
+	container := envString("ARTIFACT_AZURE_CONTAINER", "")
+	if container == "" {
+		return nil, errors.New("ARTIFACT_AZURE_CONTAINER is not set")
+	}
+
+	var client *azblob.Client
+	var err error
+	if conn := lookupEnv("AZURE_STORAGE_CONNECTION_STRING", ""); conn != "" {
+		client, err = azblob.NewClientFromConnectionString(conn, nil)
+	} else {
+		accountURL := envString("ARTIFACT_AZURE_ACCOUNT_URL", "")
+		if accountURL == "" {
+			return nil, errors.New("ARTIFACT_AZURE_ACCOUNT_URL or AZURE_STORAGE_CONNECTION_STRING is required")
+		}
+		cred, credErr := azidentity.NewDefaultAzureCredential(nil)
+		if credErr != nil {
+			return nil, fmt.Errorf("azure credentials: %v", credErr)
+		}
+		client, err = azblob.NewClient(accountURL, cred, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &azureBlobStore{client: client, container: container, prefix: envString("ARTIFACT_AZURE_PREFIX", "")}, nil
+}
+
+func (s *azureBlobStore) Put(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), blobPutTimeout)
+	defer cancel()
+	_, err := s.client.UploadBuffer(ctx, s.container, path.Join(s.prefix, key), data, nil)
+	return err
+}
+
+func (s *azureBlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.client.DownloadStream(context.Background(), s.container, path.Join(s.prefix, key), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AsyncChatResult is the answer of a chat turn run as a job
+type AsyncChatResult struct {
+	ConversationID   string          `json:"conversation_id,omitempty"`
+	MessageID        string          `json:"message_id,omitempty"`
+	Content          string          `json:"content"`
+	Truncated        bool            `json:"truncated,omitempty"`
+	Policy           string          `json:"policy,omitempty"`
+	PolicyMessage    string          `json:"policy_message,omitempty"`
+	PromptTokens     int             `json:"prompt_tokens,omitempty"`
+	CompletionTokens int             `json:"completion_tokens,omitempty"`
+	PendingActions   []PendingAction `json:"pending_actions,omitempty"`
+}
+
+var (
+	asyncChatTimeout time.Duration
+	asyncChatMaxBody int64
+)
+
+func configureAsyncChat() {
+	asyncChatTimeout = envDuration("ASYNC_CHAT_TIMEOUT", 30*time.Minute)
+	asyncChatMaxBody = envSize("ASYNC_CHAT_MAX_BODY", 1<<20)
+}
+
+// handleSubmitAsyncChat takes the same body as /api/chat, plus an optional
+// webhook_url, and answers 202 with the job that generates the answer. The
+// turn is streamed in the background, which no upstream timeout cuts short,
+// and the user is notified when it finishes.
+func handleSubmitAsyncChat(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, asyncChatMaxBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body is larger than %d bytes", asyncChatMaxBody)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Message    string `json:"message"`
+		WebhookURL string `json:"webhook_url"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is required"})
+		return
+	}
+	if err := validateWebhookURL(req.WebhookURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// The stream runs as the caller
+	header := c.Request.Header.Clone()
+	job := jobs.submit(Job{
+		Type:       "chat",
+		User:       requestUser(c),
+		Total:      1,
+		WebhookURL: req.WebhookURL,
+	}, asyncChatRunner(body, header, c.Request.RemoteAddr))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// asyncChatRunner runs the turn through /api/chat/stream, collecting its
+// events as a poll session does. The job's ID is the turn's request ID, so
+// its audit record can be found from the job; the caller's X-Request-Id is
+// kept as its client request ID.
+func asyncChatRunner(body []byte, header http.Header, remoteAddr string) jobFunc {
+	return func(id string) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), asyncChatTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(context.WithValue(ctx, requestIDKey{}, id), http.MethodPost,
+			"/api/chat/stream", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header = header.Clone()
+		req.RemoteAddr = remoteAddr
+
+		session := &pollSession{header: http.Header{}, changed: make(chan struct{}), lastPoll: time.Now()}
+		pollRouter.ServeHTTP(session, req)
+		session.finish()
+		resp, _ := session.snapshot(0)
+
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return nil, fmt.Errorf("the answer took longer than %s", asyncChatTimeout)
+		case resp.StatusCode != http.StatusOK && resp.Error != "":
+			return nil, errors.New(resp.Error)
+		case resp.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("the chat request failed with status %d", resp.StatusCode)
+		case resp.Error != "":
+			return nil, errors.New(resp.Error)
+		}
+		jobs.update(id, func(j *Job) { j.Progress = 1 })
+		return AsyncChatResult{
+			ConversationID:   resp.ConversationID,
+			MessageID:        resp.MessageID,
+			Content:          resp.Content,
+			Truncated:        resp.Truncated,
+			Policy:           resp.Policy,
+			PolicyMessage:    resp.PolicyMessage,
+			PromptTokens:     resp.PromptTokens,
+			CompletionTokens: resp.CompletionTokens,
+			PendingActions:   resp.PendingActions,
+		}, nil
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// AuditRecord captures a single chat request and its upstream outcome
+type AuditRecord struct {
+	ID               string        `json:"id"`
+	ClientRequestID  string        `json:"client_request_id,omitempty"`
+	Timestamp        time.Time     `json:"timestamp"`
+	User             string        `json:"user"`
+	Model            string        `json:"model"`
+	Prompt           string        `json:"prompt"`
+	Response         string        `json:"response,omitempty"`
+	PromptTokens     int           `json:"prompt_tokens"`
+	CompletionTokens int           `json:"completion_tokens"`
+	Cost             float64       `json:"cost"`
+	Latency          time.Duration `json:"latency"`
+	StatusCode       int           `json:"status_code"`
+	Error            string        `json:"error,omitempty"`
+	Quality          *QualityScore `json:"quality,omitempty"`
+}
+
+// AuditStore persists audit records for usage reporting
+type AuditStore interface {
+	Add(record AuditRecord)
+	// List returns records with from <= Timestamp < to, oldest first
+	List(from, to time.Time) []AuditRecord
+	// Update applies fn to the record with the given ID, reporting whether it exists
+	Update(id string, fn func(*AuditRecord)) bool
+	// Get returns the record with the given ID
+	Get(id string) (AuditRecord, bool)
+}
+
+// memoryAuditStore keeps the most recent records in memory
+type memoryAuditStore struct {
+	mu      sync.RWMutex
+	records []AuditRecord
+	max     int
+}
+
+func newMemoryAuditStore(max int) *memoryAuditStore {
+	return &memoryAuditStore{max: max}
+}
+
+func (s *memoryAuditStore) Add(record AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	if s.max > 0 && len(s.records) > s.max {
+		s.records = append([]AuditRecord(nil), s.records[len(s.records)-s.max:]...)
+	}
+}
+
+func (s *memoryAuditStore) List(from, to time.Time) []AuditRecord {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var out []AuditRecord
+	for _, r := range s.records {
+		if !r.Timestamp.Before(from) && r.Timestamp.Before(to) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (s *memoryAuditStore) Update(id string, fn func(*AuditRecord)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if s.records[i].ID == id {
+			fn(&s.records[i])
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryAuditStore) Get(id string) (AuditRecord, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.records) - 1; i >= 0; i-- {
+		if s.records[i].ID == id {
+			return s.records[i], true
+		}
+	}
+	return AuditRecord{}, false
+}
+
+var (
+	auditStore AuditStore
+
+	// Per 1K token prices used to estimate request cost
+	promptTokenPrice     float64
+	completionTokenPrice float64
+)
+
+func configureAudit() {
+	if storage != nil {
+		auditStore = storage.audit
+	} else {
+		auditStore = newMemoryAuditStore(envInt("AUDIT_MAX_RECORDS", 100000))
+	}
+	promptTokenPrice = envFloat("COST_PER_1K_PROMPT_TOKENS", 0)
+	completionTokenPrice = envFloat("COST_PER_1K_COMPLETION_TOKENS", 0)
+}
+
+func estimateCost(promptTokens, completionTokens int) float64 {
+	return float64(promptTokens)/1000*promptTokenPrice + float64(completionTokens)/1000*completionTokenPrice
+}
+
+// newID returns a random 16 byte hex identifier
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
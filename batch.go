@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchChatRequest submits prompts to be answered in the background
+type BatchChatRequest struct {
+	Messages   []string `json:"messages" binding:"required,min=1"`
+	OffPeak    bool     `json:"off_peak"`
+	WebhookURL string   `json:"webhook_url"`
+}
+
+// BatchChatResult is the answer to one prompt of a batch
+type BatchChatResult struct {
+	Message string `json:"message"`
+	Content string `json:"content,omitempty"`
+	Policy  string `json:"policy,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// timeWindow is a daily window in minutes since midnight; end may be before
+// start for windows crossing midnight
+type timeWindow struct {
+	start, end int
+}
+
+var (
+	offPeakWindows  []timeWindow
+	offPeakLocation *time.Location
+	batchMaxPrompts int
+)
+
+func configureBatch() {
+	batchMaxPrompts = envInt("BATCH_MAX_PROMPTS", 1000)
+
+	offPeakLocation = time.UTC
+	if tz := envString("BATCH_TIMEZONE", ""); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			configWarn("invalid BATCH_TIMEZONE %q: %v", tz, err)
+		} else {
+			offPeakLocation = loc
+		}
+	}
+
+	offPeakWindows = nil
+	for _, spec := range envList("BATCH_OFFPEAK_WINDOWS") {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			configWarn("ignoring off-peak window %q: %v", spec, err)
+			continue
+		}
+		offPeakWindows = append(offPeakWindows, w)
+	}
+}
+
+// parseTimeWindow parses "HH:MM-HH:MM"
+func parseTimeWindow(spec string) (timeWindow, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return timeWindow{}, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	var w timeWindow
+	for i, p := range parts {
+		hm := strings.Split(strings.TrimSpace(p), ":")
+		if len(hm) != 2 {
+			return timeWindow{}, fmt.Errorf("expected HH:MM-HH:MM")
+		}
+		h, err1 := strconv.Atoi(hm[0])
+		m, err2 := strconv.Atoi(hm[1])
+		if err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 {
+			return timeWindow{}, fmt.Errorf("invalid time %q", p)
+		}
+		if i == 0 {
+			w.start = h*60 + m
+		} else {
+			w.end = h*60 + m
+		}
+	}
+	return w, nil
+}
+
+// offPeakOpen reports whether t falls in an off-peak window; with no windows
+// configured off-peak jobs run immediately
+func offPeakOpen(t time.Time) bool {
+	if len(offPeakWindows) == 0 {
+		return true
+	}
+	t = t.In(offPeakLocation)
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range offPeakWindows {
+		if w.start <= w.end && minute >= w.start && minute < w.end {
+			return true
+		}
+		if w.start > w.end && (minute >= w.start || minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleSubmitBatchChat(c *gin.Context) {
+	var req BatchChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if batchMaxPrompts > 0 && len(req.Messages) > batchMaxPrompts {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A batch may contain at most %d messages", batchMaxPrompts)})
+		return
+	}
+	if err := validateWebhookURL(req.WebhookURL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// The batch counts as one request towards abuse detection
+	if rejectAbusive(c, strings.Join(req.Messages, "\n")) || rejectOverQuota(c) {
+		return
+	}
+
+	user := requestUser(c)
+	job := jobs.submit(Job{
+		Type:       "batch_chat",
+		User:       user,
+		OffPeak:    req.OffPeak,
+		Total:      len(req.Messages),
+		WebhookURL: req.WebhookURL,
+	}, batchChatRunner(user, req.Messages))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// batchChatRunner answers the prompts one at a time at batch priority,
+// pausing between prompts when an off-peak job's window closes
+func batchChatRunner(user string, messages []string) jobFunc {
+	results := make([]BatchChatResult, len(messages))
+	next := 0
+
+	return func(id string) (interface{}, error) {
+		job, _ := jobs.get(id)
+		for ; next < len(messages); next++ {
+			if job.OffPeak && !offPeakOpen(time.Now()) {
+				return nil, errJobPaused
+			}
+			results[next] = answerBatchPrompt(id, user, messages[next])
+
+			done := append([]BatchChatResult(nil), results[:next+1]...)
+			jobs.update(id, func(j *Job) { j.Progress, j.Result = len(done), done })
+		}
+		return results, nil
+	}
+}
+
+func answerBatchPrompt(jobID, user, message string) BatchChatResult {
+	result := BatchChatResult{Message: message}
+	// The quota may run out while the job runs
+	if entitlementsConfig.Load() != nil {
+		if status := quotaStatus(user, entitlementsFor(user).Tier, time.Now()); status.exhausted() {
+			result.Error = fmt.Sprintf("Daily quota of the %s tier used up", status.Tier)
+			return result
+		}
+	}
+	if v := checkGuardrails("input", message); v != nil {
+		result.Content, result.Policy = v.Message, v.Rule
+		return result
+	}
+
+	start := time.Now()
+	record := AuditRecord{ID: jobID + "-" + newID()[:8], Timestamp: start, User: user, Model: llmEndpoint(), Prompt: message}
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	content, llmResp, err := completeChat(PriorityBatch, llmEndpoint(), buildChatMessages(message))
+	if err != nil {
+		record.StatusCode, record.Error = http.StatusBadGateway, err.Error()
+		result.Error = "Error from LLM endpoint"
+		return result
+	}
+	record.StatusCode = http.StatusOK
+	record.Response = content
+	record.PromptTokens = llmResp.Usage.PromptTokens
+	record.CompletionTokens = llmResp.Usage.CompletionTokens
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+
+	if v := checkGuardrails("output", content); v != nil {
+		result.Content, result.Policy = v.Message, v.Rule
+		return result
+	}
+	result.Content, _ = truncateResponse(postProcessAnswer(message, content))
+	return result
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of access security events are recorded for. Only service tokens are
+// credentials the lockout tracker protects; admin and agent access follows
+// from the forwarded identity.
+const (
+	authServiceToken = "service_token"
+	authAdmin        = "admin"
+	authAgent        = "agent"
+)
+
+// SecurityEvent is a failed authentication, a lockout or a denied access to
+// admin or agent routes. Every event is
+// logged and stored with the audit data, in the database when there is one.
+type SecurityEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"` // auth_failure, lockout or access_denied
+	Kind      string    `json:"kind"`
+	ClientIP  string    `json:"client_ip"`
+	Subject   string    `json:"subject,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// authAttempts counts recent failures per client IP and per subject,
+// locking either out once it fails AUTH_FAILURE_LIMIT times within
+// AUTH_FAILURE_WINDOW. Every further lockout lasts twice as long, until a
+// key stays clear for a window after its last lockout.
+type authAttempts struct {
+	limit      int
+	window     time.Duration
+	lockout    time.Duration
+	maxLockout time.Duration
+
+	mu          sync.Mutex
+	failures    map[string][]time.Time
+	lockouts    map[string]lockoutHistory
+	lockedUntil map[string]time.Time
+}
+
+// lockoutHistory is how often a key was locked out, and until when the last
+// time
+type lockoutHistory struct {
+	count int
+	until time.Time
+}
+
+// lockoutDuration doubles AUTH_LOCKOUT for every lockout after the first,
+// capped at AUTH_LOCKOUT_MAX and without overflowing
+func (a *authAttempts) lockoutDuration(count int) time.Duration {
+	d := a.lockout
+	for i := 1; i < count && d < math.MaxInt64/2 && (a.maxLockout <= 0 || d < a.maxLockout); i++ {
+		d *= 2
+	}
+	if a.maxLockout > 0 && d > a.maxLockout {
+		d = a.maxLockout
+	}
+	return d
+}
+
+// SecurityEventStore keeps security events
+type SecurityEventStore interface {
+	Add(event SecurityEvent)
+	// Recent returns up to limit events, newest first
+	Recent(limit int) []SecurityEvent
+}
+
+// memorySecurityEventStore keeps the last max events
+type memorySecurityEventStore struct {
+	mu     sync.Mutex
+	events []SecurityEvent
+	max    int
+}
+
+func (s *memorySecurityEventStore) Add(event SecurityEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	if s.max > 0 && len(s.events) > s.max {
+		s.events = append([]SecurityEvent(nil), s.events[len(s.events)-s.max:]...)
+	}
+}
+
+func (s *memorySecurityEventStore) Recent(limit int) []SecurityEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]SecurityEvent, 0, len(s.events))
+	for i := len(s.events) - 1; i >= 0 && (limit <= 0 || len(events) < limit); i-- {
+		events = append(events, s.events[i])
+	}
+	return events
+}
+
+var (
+	authGuard *authAttempts
+
+	securityEvents     SecurityEventStore
+	securityEventsSize int
+
+	authFailures *counterVec
+	authLockouts *counterVec
+)
+
+func configureBruteForce() {
+	authGuard = &authAttempts{
+		limit:       envInt("AUTH_FAILURE_LIMIT", 5),
+		window:      envDuration("AUTH_FAILURE_WINDOW", 15*time.Minute),
+		lockout:     envDuration("AUTH_LOCKOUT", time.Minute),
+		maxLockout:  envDuration("AUTH_LOCKOUT_MAX", 24*time.Hour),
+		failures:    map[string][]time.Time{},
+		lockouts:    map[string]lockoutHistory{},
+		lockedUntil: map[string]time.Time{},
+	}
+	securityEventsSize = envInt("SECURITY_EVENTS_RETAINED", 1000)
+	if storage != nil {
+		securityEvents = storage.securityEvents
+	} else {
+		securityEvents = &memorySecurityEventStore{max: securityEventsSize}
+	}
+	authFailures = newCounterVec("chatbot_auth_failures_total", "Failed authentication attempts by kind", "kind")
+	authLockouts = newCounterVec("chatbot_auth_lockouts_total", "Clients and credentials locked out by kind", "kind")
+}
+
+// credentialKey identifies a credential in the tracker and logs without
+// revealing it
+func credentialKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// locked returns how long any of the keys is still locked out
+func (a *authAttempts) locked(kind string, keys []string, now time.Time) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if until, ok := a.lockedUntil[kind+":"+key]; ok {
+			if now.After(until) {
+				delete(a.lockedUntil, kind+":"+key)
+			} else {
+				wait = max(wait, until.Sub(now))
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed attempt for every key and returns the keys that were
+// locked out by it, with the lockout duration
+func (a *authAttempts) fail(kind string, keys []string, now time.Time) ([]string, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limit <= 0 {
+		return nil, 0
+	}
+	var locked []string
+	var duration time.Duration
+	cutoff := now.Add(-a.window)
+	for _, key := range keys {
+		k := kind + ":" + key
+		recent := a.failures[k][:0]
+		for _, at := range a.failures[k] {
+			if at.After(cutoff) {
+				recent = append(recent, at)
+			}
+		}
+		recent = append(recent, now)
+		if len(recent) < a.limit {
+			a.failures[k] = recent
+			continue
+		}
+		delete(a.failures, k)
+		history := a.lockouts[k]
+		history.count++
+		d := a.lockoutDuration(history.count)
+		history.until = now.Add(d)
+		a.lockouts[k] = history
+		a.lockedUntil[k] = history.until
+		locked, duration = append(locked, key), max(duration, d)
+	}
+	return locked, duration
+}
+
+// succeed forgives the failures and past lockouts of the keys
+func (a *authAttempts) succeed(kind string, keys []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, key := range keys {
+		delete(a.failures, kind+":"+key)
+		delete(a.lockouts, kind+":"+key)
+	}
+}
+
+// sweep forgets failures outside the window, expired lockouts, and the
+// lockout history of keys clear for a window since their last lockout
+func (a *authAttempts) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cutoff := now.Add(-a.window)
+	for k, times := range a.failures {
+		if len(times) == 0 || times[len(times)-1].Before(cutoff) {
+			delete(a.failures, k)
+		}
+	}
+	for k, until := range a.lockedUntil {
+		if now.After(until) {
+			delete(a.lockedUntil, k)
+		}
+	}
+	for k, history := range a.lockouts {
+		if history.until.Before(cutoff) {
+			delete(a.lockouts, k)
+		}
+	}
+}
+
+// authKeys are the tracker keys of a client IP and a subject, a credential
+// fingerprint
+func authKeys(ip, subject string) []string {
+	keys := []string{"ip:" + ip}
+	if subject != "" {
+		keys = append(keys, "subject:"+subject)
+	}
+	return keys
+}
+
+// authClientIP is the address failed attempts are counted against. Unless
+// TRUSTED_PROXIES is set it is the connecting address, whatever the request's
+// headers claim, so a client cannot give every attempt a fresh address.
+func authClientIP(c *gin.Context) string {
+	if len(trustedProxies) > 0 {
+		return c.ClientIP()
+	}
+	if ip, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+		return ip
+	}
+	return c.Request.RemoteAddr
+}
+
+// rejectLockedOut aborts with 429 when the client or subject is locked out
+// of kind, and reports whether it did
+func rejectLockedOut(c *gin.Context, kind, subject string) bool {
+	wait := authGuard.locked(kind, authKeys(authClientIP(c), subject), time.Now())
+	if wait <= 0 {
+		return false
+	}
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed authentication attempts", "retry_after": seconds})
+	return true
+}
+
+// authFailed records a failed attempt from the client with the given
+// subject, locking them out and raising an alert once they reach the limit
+func authFailed(c *gin.Context, kind, subject, detail string) {
+	now := time.Now()
+	ip := authClientIP(c)
+	authFailures.inc(kind)
+	authGuard.sweep(now)
+	recordSecurityEvent(SecurityEvent{Timestamp: now, Event: "auth_failure", Kind: kind, ClientIP: ip, Subject: subject, Detail: detail})
+
+	locked, duration := authGuard.fail(kind, authKeys(ip, subject), now)
+	if len(locked) == 0 {
+		return
+	}
+	authLockouts.inc(kind)
+	until := now.Add(duration)
+	recordSecurityEvent(SecurityEvent{Timestamp: now, Event: "lockout", Kind: kind, ClientIP: ip, Subject: subject, Detail: fmt.Sprintf("locked out until %s", until.Format(time.RFC3339))})
+	notify(Alert{
+		Type:     "security",
+		Severity: "warning",
+		Message:  fmt.Sprintf("Locked out %s from %s authentication until %s after repeated failures", strings.Join(locked, " and "), kind, until.Format(time.RFC3339)),
+		Details:  map[string]interface{}{"kind": kind, "client_ip": ip, "subject": subject, "locked": locked},
+	})
+}
+
+// accessDenied records a user reaching a route their identity does not allow.
+// That is no failed credential, so it does not count towards a lockout:
+// clients probing whether the user may see admin pages would lock them out.
+func accessDenied(c *gin.Context, kind, user, detail string) {
+	recordSecurityEvent(SecurityEvent{Timestamp: time.Now(), Event: "access_denied", Kind: kind, ClientIP: authClientIP(c), Subject: user, Detail: detail})
+}
+
+func authSucceeded(c *gin.Context, kind, subject string) {
+	authGuard.succeed(kind, authKeys(authClientIP(c), subject))
+}
+
+func recordSecurityEvent(event SecurityEvent) {
+	log.Printf("Security event: %s %s from %s %s %s", event.Kind, event.Event, event.ClientIP, event.Subject, event.Detail)
+	securityEvents.Add(event)
+}
+
+// handleListSecurityEvents returns the last SECURITY_EVENTS_RETAINED security
+// events, newest first
+func handleListSecurityEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"events": securityEvents.Recent(securityEventsSize)})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name       string
+		lockout    time.Duration
+		maxLockout time.Duration
+		count      int
+		want       time.Duration
+	}{
+		{name: "first lockout", lockout: time.Minute, maxLockout: time.Hour, count: 1, want: time.Minute},
+		{name: "doubles", lockout: time.Minute, maxLockout: time.Hour, count: 3, want: 4 * time.Minute},
+		{name: "capped", lockout: time.Minute, maxLockout: time.Hour, count: 7, want: time.Hour},
+		{name: "capped far past the cap", lockout: time.Minute, maxLockout: time.Hour, count: 10000, want: time.Hour},
+		{name: "uncapped", lockout: time.Minute, count: 11, want: 1024 * time.Minute},
+		{name: "uncapped without overflowing", lockout: time.Minute, count: 10000, want: time.Minute << 27},
+		{name: "longest lockout stays positive", lockout: math.MaxInt64 / 3, count: 5, want: math.MaxInt64 / 3 * 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &authAttempts{lockout: tt.lockout, maxLockout: tt.maxLockout}
+			if got := a.lockoutDuration(tt.count); got != tt.want {
+				t.Fatalf("lockoutDuration(%d) = %s, want %s", tt.count, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthAttempts(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	keys := []string{"ip:10.0.0.1"}
+
+	tests := []struct {
+		name string
+		// rounds of limit failures each, the next round starting pause
+		// after the previous lockout ended
+		rounds int
+		pause  time.Duration
+		want   time.Duration
+	}{
+		{name: "one lockout", rounds: 1, want: time.Minute},
+		{name: "back-to-back lockouts double", rounds: 3, pause: time.Second, want: 4 * time.Minute},
+		{name: "doubling starts over after a clear window", rounds: 3, pause: 20 * time.Minute, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &authAttempts{limit: 3, window: 15 * time.Minute, lockout: time.Minute, maxLockout: time.Hour,
+				failures: map[string][]time.Time{}, lockouts: map[string]lockoutHistory{}, lockedUntil: map[string]time.Time{}}
+			now := start
+			var duration time.Duration
+			for round := 0; round < tt.rounds; round++ {
+				a.sweep(now)
+				if wait := a.locked("api", keys, now); wait > 0 {
+					t.Fatalf("round %d: still locked out for %s", round, wait)
+				}
+				var locked []string
+				for i := 0; i < a.limit; i++ {
+					locked, duration = a.fail("api", keys, now)
+				}
+				if len(locked) != 1 {
+					t.Fatalf("round %d: locked %v", round, locked)
+				}
+				if wait := a.locked("api", keys, now); wait != duration {
+					t.Fatalf("round %d: locked out for %s, fail reported %s", round, wait, duration)
+				}
+				now = now.Add(duration + tt.pause)
+			}
+			if duration != tt.want {
+				t.Fatalf("last lockout %s, want %s", duration, tt.want)
+			}
+			a.succeed("api", keys)
+			if len(a.lockouts) != 0 || len(a.failures) != 0 {
+				t.Fatalf("success left %v lockouts and %v failures", a.lockouts, a.failures)
+			}
+		})
+	}
+}
+
+func TestServiceAuthLockout(t *testing.T) {
+	verifier, tokens, guard, proxies := jwtVerifier, serviceTokens, authGuard, trustedProxies
+	t.Cleanup(func() { jwtVerifier, serviceTokens, authGuard, trustedProxies = verifier, tokens, guard, proxies })
+	jwtVerifier = oidc.NewVerifier("", &oidc.StaticKeySet{}, &oidc.Config{ClientID: "test", SkipIssuerCheck: true})
+	serviceTokens = &counterVec{labelNames: []string{"result"}, values: map[string]float64{}}
+
+	// Each attempt sends its own token, so only the address can lock it out
+	attempt := func(r *gin.Engine, i int, remote, forwarded string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/chat", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer not-a-token-%d", i))
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	tests := []struct {
+		name    string
+		trusted []string
+		remote  string
+		// forwarded is the X-Forwarded-For of attempt i
+		forwarded func(i int) string
+		// last is the attempt after the limit
+		lastRemote    string
+		lastForwarded string
+		want          int
+	}{
+		{name: "client locked out", remote: "198.51.100.1:1234", forwarded: func(int) string { return "" },
+			lastRemote: "198.51.100.1:1234", want: http.StatusTooManyRequests},
+		{name: "spoofed addresses without trusted proxies", remote: "198.51.100.1:1234", forwarded: func(i int) string { return fmt.Sprintf("10.0.0.%d", i) },
+			lastRemote: "198.51.100.1:1234", lastForwarded: "10.0.1.1", want: http.StatusTooManyRequests},
+		{name: "other clients behind a trusted proxy", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.10:1234", forwarded: func(int) string { return "10.0.0.1" },
+			lastRemote: "192.0.2.10:1234", lastForwarded: "10.0.0.2", want: http.StatusUnauthorized},
+		{name: "client behind a trusted proxy locked out", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.10:1234", forwarded: func(int) string { return "10.0.0.1" },
+			lastRemote: "192.0.2.11:1234", lastForwarded: "10.0.0.1", want: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = tt.trusted
+			authGuard = &authAttempts{limit: 3, window: 15 * time.Minute, lockout: time.Minute, maxLockout: time.Hour,
+				failures: map[string][]time.Time{}, lockouts: map[string]lockoutHistory{}, lockedUntil: map[string]time.Time{}}
+			r := gin.New()
+			setTrustedProxies(r)
+			r.Use(serviceAuth())
+			r.GET("/api/chat", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			for i := 0; i < authGuard.limit; i++ {
+				if w := attempt(r, i, tt.remote, tt.forwarded(i)); w.Code != http.StatusUnauthorized {
+					t.Fatalf("attempt %d: status %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+				}
+			}
+			w := attempt(r, authGuard.limit, tt.lastRemote, tt.lastForwarded)
+			if w.Code != tt.want {
+				t.Fatalf("attempt after the limit: status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Fatal("lockout without Retry-After")
+			}
+		})
+	}
+}
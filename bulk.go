@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+// Bulk admin operations run on the job queue and answer 202 with the job,
+// which is polled at /api/jobs/:id like any other
+
+// caches lists what POST /api/admin/bulk/cache/invalidate can clear; each
+// drops the entries whose key starts with the prefix and reports how many
+var caches = map[string]func(prefix string) int{
+	"groups": invalidateGroupCache,
+}
+
+// PurgeConversationsRequest selects the conversations to delete by owner
+// and creation time; at least one filter is required
+type PurgeConversationsRequest struct {
+	User   string     `json:"user"`
+	After  *time.Time `json:"after"`
+	Before *time.Time `json:"before"`
+}
+
+type InvalidateCacheRequest struct {
+	// Cache names the cache to clear; empty clears all of them
+	Cache  string `json:"cache"`
+	Prefix string `json:"prefix"`
+}
+
+func submitBulkJob(c *gin.Context, kind string, run jobFunc) {
+	job := jobs.submit(Job{Type: kind, User: requestUser(c)}, run)
+	log.Printf("Bulk %s job %s submitted by %s", kind, job.ID, requestUser(c))
+	c.JSON(http.StatusAccepted, job)
+}
+
+func handleBulkPurgeConversations(c *gin.Context) {
+	var req PurgeConversationsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.User == "" && req.After == nil && req.Before == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give a user, after or before to select conversations"})
+		return
+	}
+	submitBulkJob(c, "purge_conversations", func(id string) (interface{}, error) {
+		return purgeConversations(id, req), nil
+	})
+}
+
+// purgeConversations deletes the matching conversations from the store;
+// copies already archived to cold storage are left alone
+func purgeConversations(jobID string, req PurgeConversationsRequest) gin.H {
+	candidates := conversationStore.All()
+	if req.User != "" {
+		candidates = conversationStore.List(req.User)
+	}
+	var matched []string
+	for _, conv := range candidates {
+		if (req.After != nil && conv.CreatedAt.Before(*req.After)) || (req.Before != nil && !conv.CreatedAt.Before(*req.Before)) {
+			continue
+		}
+		matched = append(matched, conv.ID)
+	}
+	jobs.update(jobID, func(j *Job) { j.Total = len(matched) })
+
+	deleted := 0
+	for i, id := range matched {
+		if conversationStore.Delete(id) {
+			deleted++
+		}
+		jobs.update(jobID, func(j *Job) { j.Progress = i + 1 })
+	}
+	return gin.H{"matched": len(matched), "deleted": deleted}
+}
+
+func handleBulkRetryWebhooks(c *gin.Context) {
+	submitBulkJob(c, "retry_webhooks", retryFailedDeliveries)
+}
+
+// retryFailedDeliveries sends every failed callback again; those that fail
+// once more go back on the list with their attempts counted
+func retryFailedDeliveries(jobID string) (interface{}, error) {
+	pending := takeFailedDeliveries()
+	jobs.update(jobID, func(j *Job) { j.Total = len(pending) })
+
+	delivered, failed := 0, 0
+	for i, d := range pending {
+		if err := deliverJSON(d.URL, d.Payload); err != nil {
+			d.Error, d.Attempts, d.FailedAt = err.Error(), d.Attempts+1, time.Now()
+			recordFailedDelivery(d)
+			failed++
+		} else {
+			delivered++
+		}
+		jobs.update(jobID, func(j *Job) { j.Progress = i + 1 })
+	}
+	return gin.H{"delivered": delivered, "failed": failed}, nil
+}
+
+func handleBulkInvalidateCache(c *gin.Context) {
+	var req InvalidateCacheRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	names := []string{req.Cache}
+	if req.Cache == "" {
+		names = names[:0]
+		for name := range caches {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	} else if caches[req.Cache] == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown cache: " + req.Cache})
+		return
+	}
+	submitBulkJob(c, "invalidate_cache", func(id string) (interface{}, error) {
+		dropped := map[string]int{}
+		for _, name := range names {
+			dropped[name] = caches[name](req.Prefix)
+		}
+		return gin.H{"dropped": dropped}, nil
+	})
+}
+
+func handleBulkRotateKeys(c *gin.Context) {
+	submitBulkJob(c, "rotate_keys", func(id string) (interface{}, error) {
+		return rotateKeys()
+	})
+}
+
+// rotateKeys re-reads the .env file, letting its values replace the ones
+// read at start, and switches to any new keys. A new DATABRICKS_TOKEN is
+// only used once the workspace accepts it. Without ARTIFACT_SIGNING_KEY the
+// current artifact key is kept, so issued artifact URLs keep working.
+func rotateKeys() (interface{}, error) {
+	if err := godotenv.Overload(); err != nil {
+		log.Printf("No .env file re-read for key rotation: %v", err)
+	}
+	rotated := []string{}
+
+	if token := lookupEnv("DATABRICKS_TOKEN", ""); token != "" && token != databricksToken() {
+		status := checkCredentials(token)
+		if !status.Valid {
+			return nil, fmt.Errorf("new DATABRICKS_TOKEN rejected, keeping the current one: %s", status.Error)
+		}
+		setDatabricksToken(token)
+		recordCredentialStatus(status)
+		rotated = append(rotated, "DATABRICKS_TOKEN")
+	}
+	if secret := envString("WEBHOOK_SIGNING_SECRET", ""); secret != webhookSigningSecret() {
+		setWebhookSigningSecret(secret)
+		rotated = append(rotated, "WEBHOOK_SIGNING_SECRET")
+	}
+	if key := []byte(lookupEnv("ARTIFACT_SIGNING_KEY", "")); len(key) > 0 && !bytes.Equal(key, artifactKey()) {
+		setArtifactKey(key)
+		rotated = append(rotated, "ARTIFACT_SIGNING_KEY")
+	}
+	log.Printf("Rotated keys: %v", rotated)
+	return gin.H{"rotated": rotated}, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const headerCache = "X-Cache"
+
+// cachedAnswer is a stored answer to the first prompt of a conversation,
+// with the call that produced it so it can be refreshed
+type cachedAnswer struct {
+	key       string
+	scope     string
+	prompt    string
+	content   string
+	embedding []float32
+	cost      float64
+	storedAt  time.Time
+
+	endpoint   string
+	question   string
+	messages   []ChatMessage
+	refreshing bool // guarded by responseCache.mu
+}
+
+// responseCache keeps recent answers, least recently used first out. Keys
+// are scoped by endpoint and system prompt, so a persona or prompt change
+// never serves an answer written for another.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	max     int
+	ttl     time.Duration
+
+	// Answers older than staleAfter are served while a new one is fetched
+	staleAfter time.Duration
+}
+
+var (
+	responses         *responseCache
+	semanticThreshold float64
+
+	cacheLookups   *counterVec
+	cacheSavedCost *counterVec
+	cacheRefreshes *counterVec
+)
+
+func configureResponseCache() {
+	responses = nil
+	size := envInt("RESPONSE_CACHE_SIZE", 0)
+	semanticThreshold = envFloat("SEMANTIC_CACHE_THRESHOLD", 0)
+	if semanticThreshold > 0 && retrievalConfig.EmbeddingModel == "" {
+		configWarn("SEMANTIC_CACHE_THRESHOLD needs EMBEDDING_ENDPOINT_NAME; only exact matches are cached")
+	}
+	cacheLookups = newCounterVec("chatbot_response_cache_lookups_total", "Response cache lookups by result", "result")
+	cacheSavedCost = newCounterVec("chatbot_response_cache_saved_cost_total", "Estimated cost of the calls cached answers replaced")
+	cacheRefreshes = newCounterVec("chatbot_response_cache_refreshes_total", "Background refreshes of stale cached answers by result", "result")
+	registerGaugeFunc("chatbot_response_cache_entries", "Answers in the response cache", func() float64 {
+		if responses == nil {
+			return 0
+		}
+		responses.mu.Lock()
+		defer responses.mu.Unlock()
+		return float64(responses.order.Len())
+	})
+	if size <= 0 {
+		delete(caches, "responses")
+		return
+	}
+	responses = &responseCache{
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+		max:        size,
+		ttl:        envDuration("RESPONSE_CACHE_TTL", time.Hour),
+		staleAfter: envDuration("RESPONSE_CACHE_STALE_AFTER", 0),
+	}
+	if responses.staleAfter >= responses.ttl {
+		configWarn("RESPONSE_CACHE_STALE_AFTER is not shorter than RESPONSE_CACHE_TTL; answers are never refreshed")
+	}
+	caches["responses"] = responses.invalidate
+}
+
+// normalizePrompt makes prompts differing only in case and spacing share a key
+func normalizePrompt(prompt string) string {
+	return strings.ToLower(strings.Join(strings.Fields(prompt), " "))
+}
+
+// find returns the exact match for key, or else the closest answer in scope
+// at least semanticThreshold similar to embedding
+func (rc *responseCache) find(key, scope string, embedding []float32) (*cachedAnswer, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[key]; ok {
+		entry := el.Value.(*cachedAnswer)
+		if time.Since(entry.storedAt) < rc.ttl {
+			rc.order.MoveToFront(el)
+			return entry, false
+		}
+		rc.order.Remove(el)
+		delete(rc.entries, key)
+	}
+	if embedding == nil {
+		return nil, false
+	}
+	var best *list.Element
+	bestScore := semanticThreshold
+	for el := rc.order.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*cachedAnswer)
+		if entry.scope != scope || time.Since(entry.storedAt) >= rc.ttl {
+			continue
+		}
+		if score := cosineSimilarity(embedding, entry.embedding); score >= bestScore {
+			best, bestScore = el, score
+		}
+	}
+	if best == nil {
+		return nil, false
+	}
+	rc.order.MoveToFront(best)
+	return best.Value.(*cachedAnswer), true
+}
+
+func (rc *responseCache) put(entry *cachedAnswer) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[entry.key]; ok {
+		rc.order.Remove(el)
+	}
+	rc.entries[entry.key] = rc.order.PushFront(entry)
+	for rc.order.Len() > rc.max {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cachedAnswer).key)
+	}
+}
+
+func (rc *responseCache) stale(entry *cachedAnswer) bool {
+	return rc.staleAfter > 0 && time.Since(entry.storedAt) >= rc.staleAfter
+}
+
+// claimRefresh reports whether nobody is refreshing entry yet, in which case
+// the caller must refresh it
+func (rc *responseCache) claimRefresh(entry *cachedAnswer) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+// refresh asks the model the cached question again and replaces the answer.
+// A failed call keeps the old answer until it expires; an answer that is
+// blocked or truncated is dropped so the next request asks the model.
+func (rc *responseCache) refresh(entry *cachedAnswer) {
+	content, llmResp, err := completeChat(PriorityBatch, entry.endpoint, entry.messages)
+	if err != nil {
+		log.Printf("Failed to refresh cached answer: %v", err)
+		rc.mu.Lock()
+		entry.refreshing = false
+		rc.mu.Unlock()
+		cacheRefreshes.inc("failed")
+		return
+	}
+	content, truncated := truncateResponse(postProcessAnswer(entry.question, content))
+	if checkGuardrails("output", content) != nil || truncated || llmResp.Choices[0].FinishReason == "length" {
+		rc.mu.Lock()
+		if el, ok := rc.entries[entry.key]; ok && el.Value == entry {
+			rc.order.Remove(el)
+			delete(rc.entries, entry.key)
+		}
+		rc.mu.Unlock()
+		cacheRefreshes.inc("dropped")
+		return
+	}
+	fresh := *entry
+	fresh.content, fresh.storedAt, fresh.refreshing = content, time.Now(), false
+	fresh.cost = estimateCost(llmResp.Usage.PromptTokens, llmResp.Usage.CompletionTokens)
+	rc.put(&fresh)
+	cacheRefreshes.inc("refreshed")
+}
+
+// invalidate drops the answers to prompts starting with prefix
+func (rc *responseCache) invalidate(prefix string) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	prefix = normalizePrompt(prefix)
+	dropped := 0
+	for key, el := range rc.entries {
+		if strings.HasPrefix(el.Value.(*cachedAnswer).prompt, prefix) {
+			rc.order.Remove(el)
+			delete(rc.entries, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// cacheProbe is one request's use of the cache: the answer found, or what
+// is needed to store the answer once the model gave it
+type cacheProbe struct {
+	key, scope, prompt string
+	embedding          []float32
+	endpoint, question string
+	messages           []ChatMessage
+	hit                *cachedAnswer
+}
+
+// probeResponseCache looks the request up when its answer can be cached:
+// the cache feature is on and the prompt opens a conversation without tools,
+// whose answers may depend on live data. It returns nil otherwise.
+func probeResponseCache(c *gin.Context, endpoint, system, prompt string, conv Conversation, payload *ChatPayload) *cacheProbe {
+	if responses == nil || !featureEnabled("cache") || len(conv.Messages) > 0 || len(payload.Tools) > 0 {
+		return nil
+	}
+	scope := endpoint + "\x00" + system
+	p := &cacheProbe{scope: scope, prompt: normalizePrompt(prompt), endpoint: endpoint, question: prompt, messages: payload.Messages}
+	p.key = scope + "\x00" + p.prompt
+	if semanticThreshold > 0 && retrievalConfig.EmbeddingModel != "" && featureEnabled("semantic_cache") {
+		if embeddings, err := embedTexts([]string{prompt}); err != nil {
+			log.Printf("Failed to embed prompt for the response cache: %v", err)
+		} else {
+			p.embedding = embeddings[0]
+		}
+	}
+
+	hit, semantic := responses.find(p.key, scope, p.embedding)
+	result := "miss"
+	switch {
+	case hit != nil && responses.stale(hit):
+		result = "stale"
+		if responses.claimRefresh(hit) {
+			go responses.refresh(hit)
+		}
+	case hit != nil && semantic:
+		result = "semantic"
+	case hit != nil:
+		result = "hit"
+	}
+	if hit != nil {
+		p.hit = hit
+		cacheSavedCost.add(hit.cost)
+	}
+	cacheLookups.inc(result)
+	c.Header(headerCache, result)
+	return p
+}
+
+// store keeps a complete answer for later requests; p may be nil
+func (p *cacheProbe) store(content string, cost float64) {
+	if p == nil || p.hit != nil {
+		return
+	}
+	responses.put(&cachedAnswer{
+		key: p.key, scope: p.scope, prompt: p.prompt, content: content, embedding: p.embedding, cost: cost, storedAt: time.Now(),
+		endpoint: p.endpoint, question: p.question, messages: p.messages,
+	})
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelCapabilities is what the model behind a serving endpoint can do, so
+// requests leave out what it would reject instead of failing upstream
+type ModelCapabilities struct {
+	Streaming bool `json:"streaming"`
+	Tools     bool `json:"tools"`
+	Vision    bool `json:"vision"`
+	// MaxContext is the context window in tokens, 0 when unknown
+	MaxContext int `json:"max_context,omitempty"`
+	// MaxOutputTokens caps max_tokens, 0 when unknown
+	MaxOutputTokens int `json:"max_output_tokens,omitempty"`
+	// Model is the model the endpoint serves, when discovered
+	Model string `json:"model,omitempty"`
+	// Source is "configured", "discovered" or "default"
+	Source string `json:"source"`
+}
+
+// capabilityOverride is an entry of MODEL_CAPABILITIES_FILE; fields left
+// out keep the discovered value
+type capabilityOverride struct {
+	Streaming       *bool `json:"streaming"`
+	Tools           *bool `json:"tools"`
+	Vision          *bool `json:"vision"`
+	MaxContext      *int  `json:"max_context"`
+	MaxOutputTokens *int  `json:"max_output_tokens"`
+}
+
+func (o capabilityOverride) apply(caps *ModelCapabilities) {
+	set := func(dst *bool, src *bool) {
+		if src != nil {
+			*dst, caps.Source = *src, "configured"
+		}
+	}
+	set(&caps.Streaming, o.Streaming)
+	set(&caps.Tools, o.Tools)
+	set(&caps.Vision, o.Vision)
+	if o.MaxContext != nil {
+		caps.MaxContext, caps.Source = *o.MaxContext, "configured"
+	}
+	if o.MaxOutputTokens != nil {
+		caps.MaxOutputTokens, caps.Source = *o.MaxOutputTokens, "configured"
+	}
+}
+
+// knownModels maps model names, matched by substring in order, to what the
+// model family supports. Endpoints serving anything else are assumed to
+// stream and call tools, as the OpenAI chat format allows.
+var knownModels = []struct {
+	pattern string
+	caps    ModelCapabilities
+}{
+	{"claude", ModelCapabilities{Streaming: true, Tools: true, Vision: true, MaxContext: 200000}},
+	{"gpt-4o", ModelCapabilities{Streaming: true, Tools: true, Vision: true, MaxContext: 128000}},
+	{"gpt-oss", ModelCapabilities{Streaming: true, Tools: true, MaxContext: 131072}},
+	{"gemini", ModelCapabilities{Streaming: true, Tools: true, Vision: true, MaxContext: 1000000}},
+	{"llama-4", ModelCapabilities{Streaming: true, Tools: true, MaxContext: 128000}},
+	{"llama-3", ModelCapabilities{Streaming: true, Tools: true, MaxContext: 128000}},
+	{"llama-2", ModelCapabilities{Streaming: true, MaxContext: 4096}},
+	{"gemma", ModelCapabilities{Streaming: true, MaxContext: 128000}},
+	{"dbrx", ModelCapabilities{Streaming: true, MaxContext: 32768}},
+	{"mixtral", ModelCapabilities{Streaming: true, MaxContext: 32768}},
+}
+
+var (
+	capabilityDiscovery bool
+	capabilityRefresh   time.Duration
+	// capabilityOverrides holds MODEL_CAPABILITIES_FILE, with "*" applying
+	// to every endpoint before the endpoint's own entry
+	capabilityOverrides map[string]capabilityOverride
+
+	capabilitiesMu sync.RWMutex
+	discovered     = map[string]ModelCapabilities{}
+	// discoveryTried keeps endpoints whose discovery started, so a failing
+	// one is retried at the next refresh rather than on every request
+	discoveryTried = map[string]time.Time{}
+
+	capabilityAdjustments *counterVec
+)
+
+// configureCapabilities reads MODEL_CAPABILITIES_FILE, a JSON object of
+// endpoint name to capabilities, for endpoints discovery gets wrong or
+// cannot see, such as custom models
+func configureCapabilities() {
+	capabilityDiscovery = envBool("MODEL_CAPABILITY_DISCOVERY", true)
+	capabilityRefresh = envDuration("MODEL_CAPABILITY_REFRESH", time.Hour)
+	capabilityOverrides = map[string]capabilityOverride{}
+	if path := envString("MODEL_CAPABILITIES_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &capabilityOverrides)
+		}
+		if err != nil {
+			configWarn("failed to load model capabilities from %s: %v", path, err)
+		}
+	}
+	capabilityAdjustments = newCounterVec("chatbot_capability_adjustments_total",
+		"Upstream requests changed to suit what the endpoint supports", "endpoint", "capability")
+}
+
+// startCapabilityDiscovery looks up the configured endpoints, then again
+// every MODEL_CAPABILITY_REFRESH in case they are pointed at other models
+func startCapabilityDiscovery() {
+	if !capabilityDiscovery || databricksToken() == "" || databricksHost() == "" {
+		return
+	}
+	go func() {
+		refreshCapabilities()
+		if capabilityRefresh <= 0 {
+			return
+		}
+		for range time.Tick(capabilityRefresh) {
+			refreshCapabilities()
+		}
+	}()
+}
+
+// refreshCapabilities rediscovers the configured endpoints and every other
+// endpoint requests have used
+func refreshCapabilities() {
+	if databricksToken() == "" || databricksHost() == "" {
+		return
+	}
+	names := map[string]bool{}
+	for _, check := range configuredEndpoints() {
+		if check.Purpose != "embedding" && check.Purpose != "rerank" {
+			names[check.Name] = true
+		}
+	}
+	capabilitiesMu.Lock()
+	for name := range discoveryTried {
+		names[name] = true
+	}
+	for name := range names {
+		discoveryTried[name] = time.Now()
+	}
+	capabilitiesMu.Unlock()
+	for name := range names {
+		discoverCapabilities(name)
+	}
+}
+
+// capabilitiesOf returns what the endpoint supports. An endpoint not seen
+// before is assumed to support everything while it is looked up in the
+// background.
+func capabilitiesOf(endpoint string) ModelCapabilities {
+	capabilitiesMu.RLock()
+	caps, ok := discovered[endpoint]
+	tried := discoveryTried[endpoint]
+	capabilitiesMu.RUnlock()
+	if !ok {
+		caps = ModelCapabilities{Streaming: true, Tools: true, Source: "default"}
+		if capabilityDiscovery && databricksToken() != "" && discoveryDue(tried) {
+			capabilitiesMu.Lock()
+			if discoveryDue(discoveryTried[endpoint]) {
+				discoveryTried[endpoint] = time.Now()
+				go discoverCapabilities(endpoint)
+			}
+			capabilitiesMu.Unlock()
+		}
+	}
+	if o, ok := capabilityOverrides["*"]; ok {
+		o.apply(&caps)
+	}
+	if o, ok := capabilityOverrides[endpoint]; ok {
+		o.apply(&caps)
+	}
+	return caps
+}
+
+// discoveryDue reports whether an endpoint last looked up at tried should be
+// looked up again
+func discoveryDue(tried time.Time) bool {
+	return tried.IsZero() || capabilityRefresh > 0 && time.Since(tried) > capabilityRefresh
+}
+
+// discoverCapabilities asks the workspace which model the endpoint serves
+// and looks its family up in knownModels
+func discoverCapabilities(endpoint string) {
+	model, err := servedModel(endpoint)
+	if err != nil {
+		log.Printf("Failed to discover capabilities of endpoint %s: %v", endpoint, err)
+		return
+	}
+	caps := ModelCapabilities{Streaming: true, Tools: true}
+	for _, known := range knownModels {
+		if strings.Contains(strings.ToLower(model), known.pattern) {
+			caps = known.caps
+			break
+		}
+	}
+	caps.Model, caps.Source = model, "discovered"
+	capabilitiesMu.Lock()
+	previous, seen := discovered[endpoint]
+	discovered[endpoint] = caps
+	capabilitiesMu.Unlock()
+	if !seen || previous != caps {
+		log.Printf("Endpoint %s serves %s: streaming=%t tools=%t vision=%t max_context=%d",
+			endpoint, model, caps.Streaming, caps.Tools, caps.Vision, caps.MaxContext)
+	}
+}
+
+// servedModel returns the name of the model the endpoint serves: the
+// external or foundation model, else the registered model
+func servedModel(endpoint string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("https://%s/api/2.0/serving-endpoints/%s", databricksHost(), endpoint), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+databricksToken())
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("workspace returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+	}
+	var info struct {
+		Config struct {
+			ServedEntities []struct {
+				EntityName    string `json:"entity_name"`
+				ExternalModel *struct {
+					Name string `json:"name"`
+				} `json:"external_model"`
+				FoundationModel *struct {
+					Name string `json:"name"`
+				} `json:"foundation_model"`
+			} `json:"served_entities"`
+		} `json:"config"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(&info); err != nil {
+		return "", err
+	}
+	for _, e := range info.Config.ServedEntities {
+		switch {
+		case e.ExternalModel != nil && e.ExternalModel.Name != "":
+			return e.ExternalModel.Name, nil
+		case e.FoundationModel != nil && e.FoundationModel.Name != "":
+			return e.FoundationModel.Name, nil
+		case e.EntityName != "":
+			return e.EntityName, nil
+		}
+	}
+	return endpoint, nil
+}
+
+// adaptPayload returns the payload as the endpoint can take it, leaving out
+// tools it cannot call, capping max_tokens and trimming the messages to its
+// context window, and what was changed. The caller's payload is not changed,
+// since it may go to other endpoints too.
+func adaptPayload(endpoint string, payload *ChatPayload) (*ChatPayload, []string) {
+	caps := capabilitiesOf(endpoint)
+	adapted := *payload
+	var changed []string
+	if len(adapted.Tools) > 0 && !caps.Tools {
+		adapted.Tools, changed = nil, append(changed, "tools")
+	}
+	if caps.MaxOutputTokens > 0 && adapted.MaxTokens > caps.MaxOutputTokens {
+		adapted.MaxTokens, changed = caps.MaxOutputTokens, append(changed, "max_tokens")
+	}
+	if messages, trim := fitContextWindow(endpoint, caps.MaxContext, &adapted); trim.History > 0 || trim.Sources > 0 {
+		adapted.Messages, changed = messages, append(changed, "context")
+	}
+	if len(changed) == 0 {
+		return payload, nil
+	}
+	return &adapted, changed
+}
+
+// applyCapabilities adapts the payload to the endpoint, counting the changes
+func applyCapabilities(endpoint string, payload *ChatPayload) *ChatPayload {
+	adapted, changed := adaptPayload(endpoint, payload)
+	for _, capability := range changed {
+		capabilityAdjustments.inc(endpoint, capability)
+	}
+	return adapted
+}
+
+// completeAsStream answers a streaming request to an endpoint that cannot
+// stream with one completion, returned as a stream of a single chunk
+func completeAsStream(ctx context.Context, endpoint string, payload *ChatPayload) (io.ReadCloser, int, error) {
+	capabilityAdjustments.inc(endpoint, "streaming")
+	complete := *payload
+	complete.Stream = false
+	httpReq, err := newUpstreamRequest(ctx, endpoint, &complete)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := httpReq.do(upstreamClient)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("endpoint %s returned %d: %s", endpoint, resp.StatusCode, readErrorBody(resp.Body))
+	}
+	var llmResp LLMResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(&llmResp); err != nil {
+		return nil, resp.StatusCode, err
+	}
+	var choices []gin.H
+	for _, choice := range llmResp.Choices {
+		delta := gin.H{"content": choice.Message.Content}
+		var calls []toolCallDelta
+		for i, call := range choice.Message.ToolCalls {
+			calls = append(calls, toolCallDelta{Index: i, ToolCall: call})
+		}
+		if len(calls) > 0 {
+			delta["tool_calls"] = calls
+		}
+		choices = append(choices, gin.H{"delta": delta, "finish_reason": choice.FinishReason})
+	}
+	chunk, err := json.Marshal(gin.H{"choices": choices, "usage": gin.H{
+		"prompt_tokens": llmResp.Usage.PromptTokens, "completion_tokens": llmResp.Usage.CompletionTokens}})
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	// The stream ends with the body, whatever done markers are configured
+	return io.NopCloser(bytes.NewReader([]byte("data: " + string(chunk) + "\n\n"))), resp.StatusCode, nil
+}
+
+// handleModelCapabilities lists what the chat endpoint and the endpoints
+// the caller may choose support, for clients to hide what a model lacks
+func handleModelCapabilities(c *gin.Context) {
+	names := map[string]bool{llmEndpoint(): true}
+	for _, e := range entitlementsFor(requestUser(c)).Endpoints {
+		names[e] = true
+	}
+	for _, e := range compareEndpoints {
+		names[e] = true
+	}
+	models := map[string]ModelCapabilities{}
+	for name := range names {
+		if name != "" {
+			models[name] = capabilitiesOf(name)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+// handleRefreshCapabilities rediscovers every known endpoint at once, e.g.
+// after one was pointed at another model
+func handleRefreshCapabilities(c *gin.Context) {
+	refreshCapabilities()
+	capabilitiesMu.RLock()
+	names := make([]string, 0, len(discoveryTried))
+	for name := range discoveryTried {
+		names = append(names, name)
+	}
+	capabilitiesMu.RUnlock()
+	models := map[string]ModelCapabilities{}
+	for _, name := range names {
+		models[name] = capabilitiesOf(name)
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
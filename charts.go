@@ -0,0 +1,214 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ChartSpec is a Vega-Lite specification the frontend can render as is
+type ChartSpec map[string]interface{}
+
+const vegaLiteSchema = "https://vega.github.io/schema/vega-lite/v5.json"
+
+var (
+	chartMaxCharts int
+	chartMaxRows   int
+
+	chartsGenerated *counterVec
+
+	tableSeparatorPattern = regexp.MustCompile(`^\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?$`)
+)
+
+// configureCharts reads CHART_MAX_CHARTS, how many charts an answer gets at
+// most, and CHART_MAX_ROWS, how many rows of a table are charted
+func configureCharts() {
+	chartMaxCharts = envInt("CHART_MAX_CHARTS", 3)
+	chartMaxRows = envInt("CHART_MAX_ROWS", 200)
+	chartsGenerated = newCounterVec("chatbot_chart_specs_total", "Chart specs generated from answers, by mark", "mark")
+}
+
+// chartSpecs charts the Markdown tables of an answer that have a numeric
+// column, so the frontend can draw them without asking the model again
+func chartSpecs(content string) []ChartSpec {
+	if !featureEnabled("charts") || chartMaxCharts <= 0 {
+		return nil
+	}
+	var charts []ChartSpec
+	for _, t := range markdownTables(content) {
+		if spec, mark := chartTable(t); spec != nil {
+			charts = append(charts, spec)
+			chartsGenerated.inc(mark)
+			if len(charts) == chartMaxCharts {
+				break
+			}
+		}
+	}
+	return charts
+}
+
+// markdownTables finds the pipe tables outside code fences
+func markdownTables(content string) []table {
+	lines := strings.Split(content, "\n")
+	var tables []table
+	fenced := false
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, "```") {
+			fenced = !fenced
+			continue
+		}
+		if fenced || !strings.Contains(line, "|") || i+1 >= len(lines) || !tableSeparatorPattern.MatchString(strings.TrimSpace(lines[i+1])) {
+			continue
+		}
+		t := table{columns: markdownCells(line)}
+		i += 2
+		for ; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+			row := markdownCells(strings.TrimSpace(lines[i]))
+			row = append(row, make([]string, len(t.columns))...)[:len(t.columns)]
+			t.rows = append(t.rows, row)
+		}
+		// The line after the table is looked at again
+		i--
+		tables = append(tables, t)
+	}
+	return tables
+}
+
+func markdownCells(line string) []string {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+	// An escaped pipe is part of the cell
+	cells := strings.Split(strings.ReplaceAll(line, `\|`, "\x00"), "|")
+	for i, cell := range cells {
+		cells[i] = strings.TrimSpace(strings.ReplaceAll(cell, "\x00", "|"))
+	}
+	return cells
+}
+
+// chartNumber reads a cell as a number, allowing emphasis, thousands
+// separators, currency symbols and a percent sign
+func chartNumber(cell string) (float64, bool) {
+	v := strings.Trim(cell, "*_` ")
+	for _, symbol := range []string{"$", "€", "£", "¥"} {
+		v = strings.TrimPrefix(v, symbol)
+	}
+	v = strings.TrimSuffix(strings.ReplaceAll(v, ",", ""), "%")
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	return f, err == nil
+}
+
+// chartTable picks a chart for the table: a line over a date column, bars
+// over a text column, or a scatter plot of two numeric columns. Every other
+// numeric column becomes a series. Tables without two rows and a numeric
+// column are not charted.
+func chartTable(t table) (ChartSpec, string) {
+	rows := t.rows
+	if chartMaxRows > 0 && len(rows) > chartMaxRows {
+		rows = rows[:chartMaxRows]
+	}
+	if len(rows) < 2 {
+		return nil, ""
+	}
+	numeric := make([]bool, len(t.columns))
+	dated := make([]bool, len(t.columns))
+	for col := range t.columns {
+		numeric[col], dated[col] = true, true
+		filled := 0
+		for _, row := range rows {
+			cell := strings.Trim(row[col], "*_` ")
+			if cell == "" || cell == "-" {
+				continue
+			}
+			filled++
+			if _, ok := chartNumber(cell); !ok {
+				numeric[col] = false
+			}
+			if _, ok := parseTableDate(cell); !ok {
+				dated[col] = false
+			}
+		}
+		if filled == 0 {
+			numeric[col], dated[col] = false, false
+		}
+	}
+
+	x := -1
+	for col := range t.columns {
+		if !numeric[col] {
+			x = col
+			break
+		}
+	}
+	var series []int
+	for col := range t.columns {
+		if numeric[col] && col != x {
+			series = append(series, col)
+		}
+	}
+	mark, xType := "bar", "nominal"
+	switch {
+	case x >= 0 && dated[x]:
+		mark, xType = "line", "temporal"
+	case x < 0 && len(series) >= 2:
+		// All numeric: the first column is plotted against the others
+		x, series = series[0], series[1:]
+		mark, xType = "point", "quantitative"
+	}
+	if x < 0 || len(series) == 0 {
+		return nil, ""
+	}
+
+	values := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		v := map[string]interface{}{t.columns[x]: strings.Trim(row[x], "*_` ")}
+		if xType == "quantitative" {
+			v[t.columns[x]] = chartValue(row[x])
+		}
+		for _, col := range series {
+			v[t.columns[col]] = chartValue(row[col])
+		}
+		values = append(values, v)
+	}
+
+	xEnc := map[string]interface{}{"field": vegaField(t.columns[x]), "type": xType, "title": t.columns[x]}
+	if xType == "nominal" {
+		// Keep the rows in the order of the table
+		xEnc["sort"] = nil
+	}
+	encoding := map[string]interface{}{"x": xEnc}
+	spec := ChartSpec{
+		"$schema": vegaLiteSchema,
+		"data":    map[string]interface{}{"values": values},
+		"mark":    map[string]interface{}{"type": mark, "tooltip": true},
+	}
+	if len(series) == 1 {
+		name := t.columns[series[0]]
+		encoding["y"] = map[string]interface{}{"field": vegaField(name), "type": "quantitative", "title": name}
+	} else {
+		fields := make([]string, len(series))
+		for i, col := range series {
+			fields[i] = vegaField(t.columns[col])
+		}
+		spec["transform"] = []interface{}{map[string]interface{}{"fold": fields, "as": []string{"series", "value"}}}
+		encoding["y"] = map[string]interface{}{"field": "value", "type": "quantitative", "title": nil}
+		encoding["color"] = map[string]interface{}{"field": "series", "type": "nominal", "title": nil}
+		if mark == "bar" {
+			encoding["xOffset"] = map[string]interface{}{"field": "series"}
+		}
+	}
+	spec["encoding"] = encoding
+	return spec, mark
+}
+
+// chartValue is the number in a cell, or null for a gap
+func chartValue(cell string) interface{} {
+	if f, ok := chartNumber(cell); ok {
+		return f
+	}
+	return nil
+}
+
+// vegaField escapes the characters Vega-Lite reads as nested field access
+func vegaField(name string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`, "[", `\[`, "]", `\]`).Replace(name)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ChunkConfig controls how documents of a corpus are split for retrieval
+type ChunkConfig struct {
+	Size     int    `json:"size"`
+	Overlap  int    `json:"overlap"`
+	Splitter string `json:"splitter"`
+}
+
+func (cfg ChunkConfig) validate() error {
+	if cfg.Size <= 0 {
+		return fmt.Errorf("chunk size must be positive")
+	}
+	if cfg.Overlap < 0 || cfg.Overlap >= cfg.Size {
+		return fmt.Errorf("chunk overlap must be between 0 and the chunk size")
+	}
+	if _, ok := splitters[cfg.Splitter]; !ok {
+		return fmt.Errorf("unknown splitter %q", cfg.Splitter)
+	}
+	return nil
+}
+
+func defaultChunkConfig() ChunkConfig {
+	return ChunkConfig{
+		Size:     envInt("RAG_CHUNK_SIZE", 1000),
+		Overlap:  envInt("RAG_CHUNK_OVERLAP", 200),
+		Splitter: envString("RAG_SPLITTER", "fixed"),
+	}
+}
+
+// A splitter breaks text into segments that are then packed into chunks
+var splitters = map[string]func(string) []string{
+	"fixed":    func(text string) []string { return []string{text} },
+	"sentence": splitSentences,
+	"markdown": splitMarkdown,
+	"code":     splitCode,
+}
+
+var (
+	sentenceEnd     = regexp.MustCompile(`[.!?]+["')\]]*\s+|\n\s*\n`)
+	markdownHeading = regexp.MustCompile(`(?m)^#{1,6}\s`)
+	codeBoundary    = regexp.MustCompile(`(?m)^(func |def |class |type |public |private |fn |impl |CREATE |SELECT |WITH |@)`)
+)
+
+// chunkText splits text with the configured splitter and packs the segments
+// into chunks of at most cfg.Size runes with cfg.Overlap runes carried over
+func chunkText(doc, text string, cfg ChunkConfig) []Chunk {
+	split := splitters[cfg.Splitter]
+	if split == nil {
+		split = splitters["fixed"]
+	}
+
+	var pieces []string
+	for _, segment := range split(text) {
+		pieces = append(pieces, packSegment(segment, cfg)...)
+	}
+	pieces = mergePieces(pieces, cfg)
+
+	var chunks []Chunk
+	for _, piece := range pieces {
+		if piece = strings.TrimSpace(piece); piece != "" {
+			chunks = append(chunks, Chunk{ID: fmt.Sprintf("%s#%d", doc, len(chunks)), Document: doc, Index: len(chunks), Text: piece})
+		}
+	}
+	return chunks
+}
+
+// packSegment cuts a single oversized segment into fixed windows
+func packSegment(segment string, cfg ChunkConfig) []string {
+	runes := []rune(segment)
+	if len(runes) <= cfg.Size {
+		return []string{segment}
+	}
+
+	step := cfg.Size - cfg.Overlap
+	if step <= 0 {
+		step = cfg.Size
+	}
+	var out []string
+	for start := 0; start < len(runes); start += step {
+		end := start + cfg.Size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		out = append(out, string(runes[start:end]))
+		if end == len(runes) {
+			break
+		}
+	}
+	return out
+}
+
+// mergePieces greedily joins consecutive small pieces up to the chunk size,
+// starting each new chunk with the tail of the previous one
+func mergePieces(pieces []string, cfg ChunkConfig) []string {
+	var out []string
+	var current []rune
+
+	for _, piece := range pieces {
+		p := []rune(piece)
+		if len(current) > 0 && len(current)+len(p) > cfg.Size {
+			out = append(out, string(current))
+			tail := cfg.Overlap
+			if tail > len(current) {
+				tail = len(current)
+			}
+			current = append([]rune(nil), current[len(current)-tail:]...)
+			if len(current)+len(p) > cfg.Size {
+				current = nil
+			}
+		}
+		current = append(current, p...)
+	}
+	if len(current) > 0 {
+		out = append(out, string(current))
+	}
+	return out
+}
+
+func splitSentences(text string) []string {
+	return splitAfterMatches(text, sentenceEnd)
+}
+
+// splitMarkdown keeps each heading together with its section body
+func splitMarkdown(text string) []string {
+	return splitBeforeMatches(text, markdownHeading)
+}
+
+// splitCode starts a new segment at top-level declarations
+func splitCode(text string) []string {
+	return splitBeforeMatches(text, codeBoundary)
+}
+
+func splitAfterMatches(text string, re *regexp.Regexp) []string {
+	var out []string
+	last := 0
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		out = append(out, text[last:m[1]])
+		last = m[1]
+	}
+	if last < len(text) {
+		out = append(out, text[last:])
+	}
+	return out
+}
+
+func splitBeforeMatches(text string, re *regexp.Regexp) []string {
+	var out []string
+	last := 0
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		if m[0] > last {
+			out = append(out, text[last:m[0]])
+		}
+		last = m[0]
+	}
+	if last < len(text) {
+		out = append(out, text[last:])
+	}
+	return out
+}
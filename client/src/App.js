@@ -1,8 +1,38 @@
+import React from "react";
 import "./App.css";
 import "./index.css";
 import PremiumChatBotUI from "./PremiumChatBot";
+import { reportRenderError } from "./lib/telemetry";
+
+// ErrorBoundary reports render errors to the server's telemetry endpoint
+class ErrorBoundary extends React.Component {
+  constructor(props) {
+    super(props);
+    this.state = { failed: false };
+  }
+
+  static getDerivedStateFromError() {
+    return { failed: true };
+  }
+
+  componentDidCatch(error, info) {
+    reportRenderError(`${error?.stack || error}\n${info.componentStack}`, "App");
+  }
+
+  render() {
+    if (this.state.failed) {
+      return <div className="p-6 text-gray-100">Something went wrong. Please reload the page.</div>;
+    }
+    return this.props.children;
+  }
+}
+
 function App() {
-  return <PremiumChatBotUI />;
+  return (
+    <ErrorBoundary>
+      <PremiumChatBotUI />
+    </ErrorBoundary>
+  );
 }
 
 export default App;
@@ -9,7 +9,11 @@ import {
   ThumbsUpIcon,
   ThumbsDownIcon,
   CopyIcon,
+  AlertTriangleIcon,
+  BellIcon,
+  XIcon,
 } from "lucide-react";
+import { reportTimeToFirstToken } from "./lib/telemetry";
 
 const PremiumChatBotUI = () => {
   const [conversations, setConversations] = useState([
@@ -24,6 +28,8 @@ const PremiumChatBotUI = () => {
   const [isLoading, setIsLoading] = useState(false);
   const [feedback, setFeedback] = useState({});
   const initialized = useRef(false);
+  const [setupProblems, setSetupProblems] = useState([]);
+  const [notifications, setNotifications] = useState([]);
 
   const scrollToBottom = () => {
     messagesEndRef.current?.scrollIntoView({ behavior: "smooth" });
@@ -38,6 +44,7 @@ const PremiumChatBotUI = () => {
       setIsLoading(true);
 
       try {
+        const sentAt = performance.now();
         const response = await fetch('/api/chat', {
           method: 'POST',
           headers: {
@@ -51,7 +58,9 @@ const PremiumChatBotUI = () => {
         }
 
         const data = await response.json();
-        setMessages(prevMessages => [...prevMessages, { text: data.content, sender: "bot" }]);
+        // The answer arrives whole, so its first token is the full response
+        reportTimeToFirstToken(performance.now() - sentAt, response);
+        setMessages(prevMessages => [...prevMessages, { text: data.content, sender: "bot", actions: data.pending_actions }]);
         setIsLoading(false);
       } catch (error) {
         console.error('Error:', error);
@@ -67,6 +76,31 @@ const PremiumChatBotUI = () => {
     }
   };
 
+  // Answers a tool call the model made, such as filing a ticket or sending an
+  // email, that waits for the user's confirmation
+  const handleAction = async (messageIndex, action, confirm) => {
+    const setStatus = (status) => setMessages(prev => prev.map((m, i) => i !== messageIndex ? m : {
+      ...m,
+      actions: m.actions.map(a => a.id === action.id ? { ...a, status } : a),
+    }));
+    setStatus(confirm ? "running" : "rejected");
+    try {
+      const response = await fetch(`/api/actions/${action.id}/${confirm ? "confirm" : "reject"}`, { method: 'POST' });
+      const data = await response.json();
+      if (!response.ok && !data.status) {
+        throw new Error(data.error || `HTTP error! status: ${response.status}`);
+      }
+      setStatus(data.status);
+      if (confirm) {
+        const text = data.status === "completed" ? data.result : `Could not ${data.summary}: ${data.result}`;
+        setMessages(prev => [...prev, { text, sender: "bot" }]);
+      }
+    } catch (error) {
+      setStatus("pending");
+      setMessages(prev => [...prev, { text: `Error: ${error.message}`, sender: "bot" }]);
+    }
+  };
+
   const handleFeedback = (messageIndex, isPositive) => {
     setFeedback(prev => ({
       ...prev,
@@ -105,6 +139,23 @@ const PremiumChatBotUI = () => {
           )}
           <div className="markdown-content">
             <ReactMarkdown>{message.text}</ReactMarkdown>
+            {message.actions?.map(action => (
+              <div key={action.id} className="mt-3 p-3 rounded-xl bg-gray-900 bg-opacity-60 border border-purple-500">
+                <div className="text-sm">Confirm: {action.summary}</div>
+                {action.status === "pending" ? (
+                  <div className="mt-2 flex space-x-2">
+                    <button onClick={() => handleAction(index, action, true)} className="px-3 py-1 rounded-full bg-purple-500 hover:bg-purple-400 text-sm">
+                      Confirm
+                    </button>
+                    <button onClick={() => handleAction(index, action, false)} className="px-3 py-1 rounded-full bg-gray-700 hover:bg-gray-600 text-sm">
+                      Cancel
+                    </button>
+                  </div>
+                ) : (
+                  <div className="mt-2 text-xs text-gray-400">{action.status}</div>
+                )}
+              </div>
+            ))}
             
             {message.sender === "bot" && (
               <div className="mt-2 flex justify-end space-x-2">
@@ -166,6 +217,44 @@ const PremiumChatBotUI = () => {
     }
   };
 
+  // Poll readiness so a server started without credentials shows why chat is
+  // unavailable, and the banner clears once it recovers
+  useEffect(() => {
+    let timer;
+    const checkReadiness = async () => {
+      try {
+        const response = await fetch('/readyz');
+        const data = await response.json();
+        setSetupProblems(data.status === 'degraded' ? data.problems || [] : []);
+        if (data.status === 'degraded') {
+          timer = setTimeout(checkReadiness, 10000);
+        }
+      } catch (error) {
+        console.error('Readiness check failed:', error);
+      }
+    };
+    checkReadiness();
+    return () => clearTimeout(timer);
+  }, []);
+
+  // Reminders, quota warnings, maintenance notices and finished jobs arrive
+  // on the notification stream. The last one seen is remembered, so those
+  // sent while the page was closed are shown when it opens again.
+  useEffect(() => {
+    const after = localStorage.getItem('notificationSeq') || '';
+    const source = new EventSource(`/api/notifications/stream?after=${after}`);
+    source.addEventListener('notification', (event) => {
+      const notification = JSON.parse(event.data);
+      localStorage.setItem('notificationSeq', String(notification.seq));
+      setNotifications(prev => [...prev, notification].slice(-5));
+    });
+    return () => source.close();
+  }, []);
+
+  const dismissNotification = (seq) => {
+    setNotifications(prev => prev.filter(n => n.seq !== seq));
+  };
+
   // Call the initialization function when component mounts
   useEffect(() => {
     if (!initialized.current) {
@@ -200,6 +289,29 @@ const PremiumChatBotUI = () => {
 
       {/* Main Chat Area */}
       <div className="flex-1 flex flex-col bg-black bg-opacity-50 backdrop-filter backdrop-blur-md">
+        {setupProblems.length > 0 && (
+          <div className="flex items-start bg-yellow-500 bg-opacity-20 border-b border-yellow-600 text-yellow-100 px-8 py-3 text-sm">
+            <AlertTriangleIcon className="w-5 h-5 mr-3 mt-0.5 text-yellow-400" />
+            <div>
+              <div className="font-semibold">Chat is unavailable until the server is configured</div>
+              {setupProblems.map((problem) => (
+                <div key={problem}>{problem}</div>
+              ))}
+            </div>
+          </div>
+        )}
+        {notifications.map((notification) => (
+          <div key={notification.seq} className="flex items-start bg-purple-500 bg-opacity-20 border-b border-purple-600 text-purple-100 px-8 py-3 text-sm">
+            <BellIcon className="w-5 h-5 mr-3 mt-0.5 text-purple-300" />
+            <div className="flex-grow">
+              <div className="font-semibold">{notification.title}</div>
+              {notification.message && <div>{notification.message}</div>}
+            </div>
+            <button onClick={() => dismissNotification(notification.seq)} className="p-1 rounded-full hover:bg-white hover:bg-opacity-10" title="Dismiss">
+              <XIcon className="w-4 h-4" />
+            </button>
+          </div>
+        ))}
         {/* Messages */}
         <div className="flex-grow overflow-y-auto p-8 space-y-6 custom-scrollbar">
           {messages.map((message, index) => renderMessage(message, index))}
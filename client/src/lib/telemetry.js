@@ -0,0 +1,107 @@
+// Reports Web Vitals, render errors and time to first token to
+// POST /api/telemetry, batched and flushed periodically and when the page is
+// hidden, so the browser's view of latency can be compared with the server's
+const FLUSH_INTERVAL_MS = 10000;
+const MAX_BATCH = 100;
+
+let queue = [];
+
+function enqueue(event) {
+  queue.push(event);
+  if (queue.length >= MAX_BATCH) {
+    flush();
+  }
+}
+
+export function flush() {
+  if (queue.length === 0) {
+    return;
+  }
+  const body = JSON.stringify({ events: queue.splice(0, MAX_BATCH) });
+  const blob = new Blob([body], { type: "application/json" });
+  if (navigator.sendBeacon && navigator.sendBeacon("/api/telemetry", blob)) {
+    return;
+  }
+  fetch("/api/telemetry", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body,
+    keepalive: true,
+  }).catch(() => {});
+}
+
+// reportTimeToFirstToken records how long the user waited for the first
+// token of an answer, with the upstream latency the server reported
+export function reportTimeToFirstToken(ms, response, streaming = false) {
+  const upstream = Number(response?.headers.get("X-Upstream-Latency-Ms"));
+  enqueue({
+    type: "ttft",
+    value: ms,
+    streaming,
+    upstream_ms: Number.isFinite(upstream) && upstream > 0 ? upstream : undefined,
+    request_id: response?.headers.get("X-Request-Id") || undefined,
+  });
+}
+
+export function reportRenderError(error, component) {
+  enqueue({
+    type: "render_error",
+    message: String(error?.stack || error?.message || error),
+    component,
+  });
+}
+
+function observe(type, callback) {
+  try {
+    new PerformanceObserver((list) => list.getEntries().forEach(callback)).observe({ type, buffered: true });
+  } catch (e) {
+    // The browser does not support this entry type
+  }
+}
+
+// startTelemetry observes the Web Vitals and uncaught errors; the final LCP,
+// CLS and INP are reported when the page is first hidden
+export function startTelemetry() {
+  let lcp = 0;
+  let cls = 0;
+  let inp = 0;
+  let reported = false;
+
+  const nav = performance.getEntriesByType?.("navigation")?.[0];
+  if (nav) {
+    enqueue({ type: "web_vital", name: "TTFB", value: nav.responseStart });
+  }
+  observe("paint", (entry) => {
+    if (entry.name === "first-contentful-paint") {
+      enqueue({ type: "web_vital", name: "FCP", value: entry.startTime });
+    }
+  });
+  observe("largest-contentful-paint", (entry) => {
+    lcp = entry.startTime;
+  });
+  observe("layout-shift", (entry) => {
+    if (!entry.hadRecentInput) {
+      cls += entry.value;
+    }
+  });
+  observe("event", (entry) => {
+    inp = Math.max(inp, entry.duration);
+  });
+
+  window.addEventListener("error", (e) => reportRenderError(e.error || e.message, "window"));
+  window.addEventListener("unhandledrejection", (e) => reportRenderError(e.reason, "promise"));
+
+  document.addEventListener("visibilitychange", () => {
+    if (document.visibilityState !== "hidden") {
+      return;
+    }
+    if (!reported) {
+      reported = true;
+      if (lcp > 0) enqueue({ type: "web_vital", name: "LCP", value: lcp });
+      enqueue({ type: "web_vital", name: "CLS", value: cls });
+      if (inp > 0) enqueue({ type: "web_vital", name: "INP", value: inp });
+    }
+    flush();
+  });
+  setInterval(flush, FLUSH_INTERVAL_MS);
+}
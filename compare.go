@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CompareRequest sends one prompt to several endpoints
+type CompareRequest struct {
+	Message   string   `json:"message" binding:"required"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// CompareResult is one endpoint's answer; MessageID names it for
+// /api/messages/diff
+type CompareResult struct {
+	Endpoint         string `json:"endpoint"`
+	MessageID        string `json:"message_id"`
+	Content          string `json:"content,omitempty"`
+	Policy           string `json:"policy,omitempty"`
+	LatencyMs        int64  `json:"latency_ms"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	Error            string `json:"error,omitempty"`
+}
+
+const (
+	minCompareEndpoints = 2
+	maxCompareEndpoints = 4
+)
+
+// compareEndpoints are the endpoints users may compare; the chat endpoint is
+// always allowed
+var compareEndpoints []string
+
+func configureCompare() {
+	compareEndpoints = envList("COMPARE_ENDPOINTS")
+}
+
+func compareAllowed(endpoint string) bool {
+	if endpoint == llmEndpoint() {
+		return true
+	}
+	for _, e := range compareEndpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+func handleChatCompare(c *gin.Context) {
+	var req CompareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	endpoints := uniqueStrings(req.Endpoints)
+	if len(endpoints) == 0 {
+		endpoints = uniqueStrings(append([]string{llmEndpoint()}, compareEndpoints...))
+		if len(endpoints) > maxCompareEndpoints {
+			endpoints = endpoints[:maxCompareEndpoints]
+		}
+	}
+	if len(endpoints) < minCompareEndpoints || len(endpoints) > maxCompareEndpoints {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Compare needs between %d and %d endpoints", minCompareEndpoints, maxCompareEndpoints)})
+		return
+	}
+	for _, e := range endpoints {
+		if !endpointAllowed(requestUser(c), e) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Endpoint not available for comparison: " + e})
+			return
+		}
+	}
+
+	if !admitChatRequest(c, req.Message) {
+		return
+	}
+
+	user, id, clientID := requestUser(c), requestID(c), clientRequestID(c)
+	messages := buildChatMessages(req.Message)
+	results := make([]CompareResult, len(endpoints))
+	var wg sync.WaitGroup
+	for i, endpoint := range endpoints {
+		wg.Add(1)
+		go func(i int, endpoint string) {
+			defer wg.Done()
+			results[i] = compareEndpoint(endpoint, messages)
+			results[i].MessageID = fmt.Sprintf("%s-%d", id, i)
+
+			r := results[i]
+			recordAudit(AuditRecord{
+				ID:               r.MessageID,
+				ClientRequestID:  clientID,
+				Timestamp:        time.Now().Add(-time.Duration(r.LatencyMs) * time.Millisecond),
+				User:             user,
+				Model:            endpoint,
+				Prompt:           req.Message,
+				Response:         r.Content,
+				PromptTokens:     r.PromptTokens,
+				CompletionTokens: r.CompletionTokens,
+				Cost:             estimateCost(r.PromptTokens, r.CompletionTokens),
+				Latency:          time.Duration(r.LatencyMs) * time.Millisecond,
+				StatusCode:       compareStatus(r),
+				Error:            r.Error,
+			})
+		}(i, endpoint)
+	}
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"prompt": req.Message, "results": results})
+}
+
+func compareEndpoint(endpoint string, messages []ChatMessage) CompareResult {
+	result := CompareResult{Endpoint: endpoint}
+	start := time.Now()
+	content, llmResp, err := completeChat(PriorityBatch, endpoint, messages)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.PromptTokens = llmResp.Usage.PromptTokens
+	result.CompletionTokens = llmResp.Usage.CompletionTokens
+	result.TotalTokens = llmResp.Usage.TotalTokens
+	if v := checkGuardrails("output", content); v != nil {
+		result.Content, result.Policy = v.Message, v.Rule
+		return result
+	}
+	result.Content, _ = truncateResponse(content)
+	return result
+}
+
+func compareStatus(r CompareResult) int {
+	if r.Error != "" {
+		return http.StatusBadGateway
+	}
+	return http.StatusOK
+}
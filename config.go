@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Helper functions for reading optional settings from the environment.
+// Every key can also be set with the CHATBOT_ prefix, which takes precedence.
+// Invalid values are logged and replaced by the default.
+
+const envPrefix = "CHATBOT_"
+
+// Short CHATBOT_ names for the variables Databricks Apps provides
+var envAliases = map[string]string{
+	"DATABRICKS_TOKEN":      "CHATBOT_TOKEN",
+	"DATABRICKS_HOST":       "CHATBOT_HOST",
+	"SERVING_ENDPOINT_NAME": "CHATBOT_ENDPOINT",
+	"DATABRICKS_APP_PORT":   "CHATBOT_PORT",
+}
+
+// envNames lists the variables that may hold key, in order of precedence
+func envNames(key string) []string {
+	if alias, ok := envAliases[key]; ok {
+		return []string{alias, envPrefix + key, key}
+	}
+	return []string{envPrefix + key, key}
+}
+
+func envString(key, def string) string {
+	if v := lookupEnv(key, def); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	v := lookupEnv(key, strconv.Itoa(def))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		configWarn("invalid integer for %s: %q", key, v)
+		return def
+	}
+	return n
+}
+
+func envFloat(key string, def float64) float64 {
+	v := lookupEnv(key, strconv.FormatFloat(def, 'g', -1, 64))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		configWarn("invalid number for %s: %q", key, v)
+		return def
+	}
+	return f
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := lookupEnv(key, def.String())
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		configWarn("invalid duration for %s: %q", key, v)
+		return def
+	}
+	return d
+}
+
+func envBool(key string, def bool) bool {
+	v := lookupEnv(key, strconv.FormatBool(def))
+	if v == "" {
+		return def
+	}
+	switch strings.ToLower(v) {
+	case "yes", "on":
+		return true
+	case "no", "off":
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		configWarn("invalid boolean for %s: %q", key, v)
+		return def
+	}
+	return b
+}
+
+var sizePattern = regexp.MustCompile(`(?i)^\s*(\d+(?:\.\d+)?)\s*([kmg]?i?b?)\s*$`)
+
+// envSize reads a byte size such as 512, 64KB or 5MiB; K, M and G without a
+// B are binary units
+func envSize(key string, def int64) int64 {
+	v := lookupEnv(key, strconv.FormatInt(def, 10))
+	if v == "" {
+		return def
+	}
+	n, err := parseSize(v)
+	if err != nil {
+		configWarn("invalid size for %s: %q", key, v)
+		return def
+	}
+	return n
+}
+
+func parseSize(v string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(v)
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	f, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := strings.ToLower(m[2])
+	multipliers := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1 << 10, "ki": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+		"m": 1 << 20, "mi": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+		"g": 1 << 30, "gi": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+	}
+	mult, ok := multipliers[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown size unit %q", m[2])
+	}
+	// Converting a float past the int64 range gives an arbitrary value
+	size := f * mult
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", v)
+	}
+	return int64(size), nil
+}
+
+// envList splits a comma separated value, dropping empty entries
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(lookupEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envSet reads a comma separated value as a set of lower-cased names; it is
+// nil when the value is empty
+func envSet(key string) map[string]bool {
+	var set map[string]bool
+	for _, name := range envList(key) {
+		if set == nil {
+			set = map[string]bool{}
+		}
+		set[strings.ToLower(name)] = true
+	}
+	return set
+}
+
+// ConfigSetting is one resolved setting, as shown by --validate-config
+type ConfigSetting struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Source  string `json:"source,omitempty"`
+	Default bool   `json:"default"`
+}
+
+var (
+	configMu       sync.Mutex
+	configSettings = map[string]ConfigSetting{}
+	configProblems []string
+	// configRev counts changes to configSettings
+	configRev int
+
+	secretKeyPattern = regexp.MustCompile(`(?i)(_TOKEN$|SECRET|PASSWORD|_KEY$|WEBHOOK_URL$|DATABASE_URL$|CONNECTION_STRING$)`)
+)
+
+// lookupEnv reads key from the first of its names that is set and records
+// the effective value for reporting
+func lookupEnv(key, def string) string {
+	var v, source string
+	for _, name := range envNames(key) {
+		if v = os.Getenv(name); v != "" {
+			source = name
+			break
+		}
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	if v != "" {
+		if configSettings[key].Value != v {
+			configRev++
+		}
+		configSettings[key] = ConfigSetting{Key: key, Value: v, Source: source}
+	} else if _, seen := configSettings[key]; !seen {
+		configSettings[key] = ConfigSetting{Key: key, Value: def, Default: true}
+	}
+	return v
+}
+
+// configWarn logs a configuration problem and keeps it for validation
+func configWarn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Warning: %s", msg)
+
+	configMu.Lock()
+	defer configMu.Unlock()
+	configProblems = append(configProblems, msg)
+}
+
+// effectiveConfig returns every setting read so far, sorted by key, with
+// secrets redacted
+func effectiveConfig() []ConfigSetting {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	out := make([]ConfigSetting, 0, len(configSettings))
+	for _, s := range configSettings {
+		if s.Value != "" && secretKeyPattern.MatchString(s.Key) {
+			s.Value = redact(s.Value)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+func configRevision() int {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return configRev
+}
+
+// secretSettingValues returns the values of settings holding secrets. Short
+// values are left out, as redacting them would redact ordinary words.
+func secretSettingValues() []string {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	var values []string
+	for _, s := range configSettings {
+		if len(s.Value) >= 8 && secretKeyPattern.MatchString(s.Key) {
+			values = append(values, s.Value)
+		}
+	}
+	return values
+}
+
+func handleEffectiveConfig(c *gin.Context) {
+	configMu.Lock()
+	problems := append([]string{}, configProblems...)
+	configMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"settings": effectiveConfig(), "problems": problems})
+}
+
+func redact(v string) string {
+	if len(v) <= 8 {
+		return "****"
+	}
+	return v[:4] + "****"
+}
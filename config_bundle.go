@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// A config bundle is a directory of YAML files kept in git, one per section.
+// A missing file leaves its section to the admin API; a present one is the
+// whole truth for that section.
+//
+//	prompts.yaml       system prompt and personas
+//	routes.yaml        request scripts, e.g. model routing rules
+//	entitlements.yaml  admin groups, group and user endpoints and quota tiers
+//	features.yaml      feature flags; features not listed stay on
+//
+// bundleSection starts the named section in cfg and returns where to decode it
+func bundleSection(cfg *RuntimeConfig, section string) (interface{}, bool) {
+	switch section {
+	case "prompts":
+		cfg.Prompts = &PromptConfig{}
+		return cfg.Prompts, true
+	case "routes":
+		cfg.Scripts = []RequestScript{}
+		return &cfg.Scripts, true
+	case "entitlements":
+		cfg.Entitlements = &EntitlementsConfig{}
+		return cfg.Entitlements, true
+	case "features":
+		cfg.Features = map[string]bool{}
+		return &cfg.Features, true
+	}
+	return nil, false
+}
+
+var configBundleDir string
+
+// configureConfigBundle applies the bundle at startup, before the first
+// configuration version is recorded
+func configureConfigBundle() {
+	configBundleDir = envString("CONFIG_BUNDLE_DIR", "")
+	if configBundleDir == "" {
+		return
+	}
+	changes, err := applyConfigBundle(false)
+	if err != nil {
+		configWarn("config bundle %s not applied: %v", configBundleDir, err)
+		return
+	}
+	log.Printf("Config bundle %s applied: %d changes", configBundleDir, len(changes))
+}
+
+// loadConfigBundle reads the bundle into the sections it manages; the others
+// stay nil. YAML is converted to JSON so the API's field names and types
+// apply, and unknown fields are rejected.
+func loadConfigBundle(dir string) (RuntimeConfig, error) {
+	var cfg RuntimeConfig
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return cfg, err
+	}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		section := strings.TrimSuffix(entry.Name(), ext)
+		if seen[section] {
+			return cfg, fmt.Errorf("%s: section %s is defined twice", entry.Name(), section)
+		}
+		seen[section] = true
+		target, ok := bundleSection(&cfg, section)
+		if !ok {
+			return cfg, fmt.Errorf("%s: unknown section %s", entry.Name(), section)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return cfg, err
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return cfg, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		if doc == nil {
+			continue
+		}
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(encoded))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(target); err != nil {
+			return cfg, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+	}
+	if cfg.Features != nil {
+		if err := validateFeatures(cfg.Features); err != nil {
+			return cfg, fmt.Errorf("features.yaml: %v", err)
+		}
+		for _, f := range knownFeatures {
+			if _, ok := cfg.Features[f]; !ok {
+				cfg.Features[f] = true
+			}
+		}
+	}
+	if cfg.Prompts != nil && cfg.Prompts.Personas == nil {
+		cfg.Prompts.Personas = []Persona{}
+	}
+	if cfg.Entitlements != nil && cfg.Entitlements.DefaultTier.Name == "" && !cfg.Entitlements.empty() {
+		cfg.Entitlements.DefaultTier.Name = "default"
+	}
+	return cfg, nil
+}
+
+// ConfigChange is one difference between the running configuration and the
+// bundle
+type ConfigChange struct {
+	Section string          `json:"section"`
+	Name    string          `json:"name"`
+	Action  string          `json:"action"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+}
+
+// configItems breaks the sections managed by cfg into named items, so a diff
+// points at the persona or rule that changed rather than a whole section
+func configItems(cfg RuntimeConfig, managed RuntimeConfig) map[string]map[string]interface{} {
+	items := map[string]map[string]interface{}{}
+	if managed.Prompts != nil {
+		p := cfg.Prompts
+		items["prompts"] = map[string]interface{}{"system": p.System}
+		personas := map[string]interface{}{}
+		for _, persona := range p.Personas {
+			personas[persona.Name] = persona
+		}
+		items["personas"] = personas
+	}
+	if managed.Scripts != nil {
+		routes := map[string]interface{}{}
+		for _, s := range cfg.Scripts {
+			routes[s.Name] = s
+		}
+		items["routes"] = routes
+	}
+	if managed.Entitlements != nil {
+		e := cfg.Entitlements
+		ent := map[string]interface{}{}
+		if len(e.AdminGroups) > 0 {
+			ent["admin_groups"] = e.AdminGroups
+		}
+		for group, endpoints := range e.Endpoints {
+			ent["endpoints/"+group] = endpoints
+		}
+		for user, endpoints := range e.Users {
+			ent["users/"+user] = endpoints
+		}
+		if e.FallbackModel {
+			ent["fallback_model"] = true
+		}
+		// Tiers are matched in order, so they are compared as one list
+		if len(e.Tiers) > 0 {
+			ent["tiers"] = e.Tiers
+		}
+		if !e.empty() {
+			ent["default_tier"] = e.DefaultTier
+		}
+		items["entitlements"] = ent
+	}
+	if managed.Features != nil {
+		flags := map[string]interface{}{}
+		for name, enabled := range cfg.Features {
+			flags[name] = enabled
+		}
+		items["features"] = flags
+	}
+	return items
+}
+
+// diffConfig lists what applying proposed would change, sorted by section
+// and name
+func diffConfig(current, proposed RuntimeConfig) []ConfigChange {
+	before, after := configItems(current, proposed), configItems(proposed, proposed)
+	changes := []ConfigChange{}
+	for section, items := range after {
+		names := map[string]bool{}
+		for name := range items {
+			names[name] = true
+		}
+		for name := range before[section] {
+			names[name] = true
+		}
+		for name := range names {
+			old, hadOld := before[section][name]
+			updated, hasNew := items[name]
+			oldJSON, _ := json.Marshal(old)
+			newJSON, _ := json.Marshal(updated)
+			change := ConfigChange{Section: section, Name: name}
+			switch {
+			case !hadOld:
+				change.Action, change.After = "added", newJSON
+			case !hasNew:
+				change.Action, change.Before = "removed", oldJSON
+			case !bytes.Equal(oldJSON, newJSON):
+				change.Action, change.Before, change.After = "changed", oldJSON, newJSON
+			default:
+				continue
+			}
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Section != changes[j].Section {
+			return changes[i].Section < changes[j].Section
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// applyConfigBundle loads the bundle and, unless dryRun, installs the sections
+// that differ from the running configuration. The bundle is validated as a
+// whole first, so either every section is applied or none is.
+func applyConfigBundle(dryRun bool) ([]ConfigChange, error) {
+	bundle, err := loadConfigBundle(configBundleDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.validate(); err != nil {
+		return nil, err
+	}
+	for _, s := range bundle.Scripts {
+		if err := compileScript(&s); err != nil {
+			return nil, err
+		}
+	}
+	current := currentRuntimeConfig()
+	changes := diffConfig(current, bundle)
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	// Leave unchanged sections alone, e.g. so script stats are kept
+	changed := map[string]bool{}
+	for _, ch := range changes {
+		changed[ch.Section] = true
+	}
+	if !changed["routes"] {
+		bundle.Scripts = nil
+	}
+	if !changed["prompts"] && !changed["personas"] {
+		bundle.Prompts = nil
+	}
+	if !changed["entitlements"] {
+		bundle.Entitlements = nil
+	}
+	if !changed["features"] {
+		bundle.Features = nil
+	}
+	if _, _, err := bundle.apply(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// handleApplyConfigBundle re-reads CONFIG_BUNDLE_DIR, e.g. after a git pull,
+// and applies it; dry_run=true only reports the diff
+func handleApplyConfigBundle(c *gin.Context) {
+	if configBundleDir == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No config bundle configured"})
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+	changes, err := applyConfigBundle(dryRun)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := gin.H{"changes": changes, "applied": !dryRun && len(changes) > 0}
+	if !dryRun && len(changes) > 0 {
+		resp["config_version"] = recordConfigChange(c, fmt.Sprintf("apply config bundle (%d changes)", len(changes)))
+		log.Printf("Config bundle applied by %s: %d changes", requestUser(c), len(changes))
+	}
+	c.JSON(http.StatusOK, resp)
+}
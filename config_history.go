@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ConfigSnapshot is the runtime configuration as it stood after one change
+type ConfigSnapshot struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	User      string        `json:"user,omitempty"`
+	Change    string        `json:"change"`
+	Config    RuntimeConfig `json:"config"`
+}
+
+// configHistory keeps the most recent snapshots, oldest first
+type configHistory struct {
+	mu        sync.Mutex
+	snapshots []ConfigSnapshot
+	next      int
+	max       int
+}
+
+var runtimeConfigHistory *configHistory
+
+// configureConfigHistory records the configuration loaded at startup as the
+// first version, so it runs after every subsystem with runtime settings
+func configureConfigHistory() {
+	runtimeConfigHistory = &configHistory{next: 1, max: envInt("CONFIG_HISTORY_SIZE", 50)}
+	runtimeConfigHistory.record("", "startup")
+}
+
+// record snapshots the current configuration and returns its version
+func (h *configHistory) record(user, change string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := ConfigSnapshot{Version: h.next, CreatedAt: time.Now(), User: user, Change: change, Config: currentRuntimeConfig()}
+	h.next++
+	h.snapshots = append(h.snapshots, snap)
+	if h.max > 0 && len(h.snapshots) > h.max {
+		h.snapshots = append([]ConfigSnapshot(nil), h.snapshots[len(h.snapshots)-h.max:]...)
+	}
+	return snap.Version
+}
+
+func (h *configHistory) list() []ConfigSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]ConfigSnapshot{}, h.snapshots...)
+}
+
+func (h *configHistory) get(version int) (ConfigSnapshot, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, snap := range h.snapshots {
+		if snap.Version == version {
+			return snap, true
+		}
+	}
+	return ConfigSnapshot{}, false
+}
+
+// recordConfigChange adds a version after an admin changed the configuration
+func recordConfigChange(c *gin.Context, change string) int {
+	return runtimeConfigHistory.record(requestUser(c), change)
+}
+
+func handleConfigHistory(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"versions": runtimeConfigHistory.list()})
+}
+
+// handleConfigRollback reinstates the configuration of an earlier version.
+// The rollback is itself recorded as a new version, so it can be undone.
+func handleConfigRollback(c *gin.Context) {
+	var req struct {
+		Version int `json:"version" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	snap, ok := runtimeConfigHistory.get(req.Version)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found in history"})
+		return
+	}
+
+	cfg := snap.Config
+	cfg.Scripts = append([]RequestScript{}, snap.Config.Scripts...)
+	_, skipped, err := cfg.apply()
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Cannot restore version %d: %v", req.Version, err)})
+		return
+	}
+	version := recordConfigChange(c, fmt.Sprintf("rollback to version %d", req.Version))
+	log.Printf("Runtime configuration rolled back to version %d by %s", req.Version, requestUser(c))
+	resp := gin.H{"version": version, "restored": req.Version}
+	if len(skipped) > 0 {
+		resp["skipped"] = skipped
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "0", want: 0},
+		{in: "512", want: 512},
+		{in: "512b", want: 512},
+		{in: "64KB", want: 64000},
+		{in: "64k", want: 64 << 10},
+		{in: "64KiB", want: 64 << 10},
+		{in: " 1.5 MiB ", want: 3 << 19},
+		{in: "1mb", want: 1e6},
+		{in: "2G", want: 2 << 30},
+		{in: "1gb", want: 1e9},
+		{in: "8589934591G", want: 8589934591 << 30},
+		{in: "8589934592G", wantErr: true},
+		{in: "99999999999999999999", wantErr: true},
+		{in: "1e3", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "10tb", wantErr: true},
+		{in: "1ib", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("parseSize(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretSettings(t *testing.T) {
+	tests := []struct {
+		key    string
+		secret bool
+	}{
+		{key: "DATABRICKS_TOKEN", secret: true},
+		{key: "WEBHOOK_SIGNING_SECRET", secret: true},
+		{key: "SMTP_PASSWORD", secret: true},
+		{key: "ARTIFACT_SIGNING_KEY", secret: true},
+		{key: "SLACK_WEBHOOK_URL", secret: true},
+		{key: "DATABASE_URL", secret: true},
+		{key: "AZURE_STORAGE_CONNECTION_STRING", secret: true},
+		{key: "SERVING_ENDPOINT_NAME"},
+		{key: "DATABRICKS_HOST"},
+		{key: "MAX_TOKENS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			value := "DefaultEndpointsProtocol=https;AccountName=test;AccountKey=c2VjcmV0"
+			t.Setenv(tt.key, value)
+			configMu.Lock()
+			previous, seen := configSettings[tt.key]
+			configMu.Unlock()
+			t.Cleanup(func() {
+				configMu.Lock()
+				defer configMu.Unlock()
+				if seen {
+					configSettings[tt.key] = previous
+				} else {
+					delete(configSettings, tt.key)
+				}
+			})
+			lookupEnv(tt.key, "")
+
+			i := slices.IndexFunc(effectiveConfig(), func(s ConfigSetting) bool { return s.Key == tt.key })
+			if redacted := effectiveConfig()[i].Value != value; redacted != tt.secret {
+				t.Fatalf("effective config redacted = %v, want %v", redacted, tt.secret)
+			}
+			if kept := slices.Contains(secretSettingValues(), value); kept != tt.secret {
+				t.Fatalf("secret setting values include it = %v, want %v", kept, tt.secret)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"math"
+	"strings"
+	"sync"
+)
+
+var (
+	contextTrimming bool
+	// contextOutputReserve is kept free for the answer when a request sets
+	// no max_tokens
+	contextOutputReserve int
+	contextSafetyMargin  float64
+
+	// tokenRatios is, per endpoint, how many tokens the endpoint reports for
+	// each estimated one, learned from the prompt tokens of past requests
+	tokenRatiosMu sync.Mutex
+	tokenRatios   = map[string]float64{}
+)
+
+func configureContextWindow() {
+	contextTrimming = envBool("CONTEXT_TRIMMING", true)
+	contextOutputReserve = envInt("CONTEXT_OUTPUT_RESERVE", 1024)
+	contextSafetyMargin = envFloat("CONTEXT_SAFETY_MARGIN", 0.05)
+	if contextSafetyMargin < 0 || contextSafetyMargin >= 1 {
+		configWarn("CONTEXT_SAFETY_MARGIN must be at least 0 and below 1, not %g", contextSafetyMargin)
+		contextSafetyMargin = 0.05
+	}
+}
+
+// learnTokenRatio moves the endpoint's ratio towards what it reported for a
+// prompt estimated at estimated tokens, so estimates follow its tokenizer
+func learnTokenRatio(endpoint string, estimated, reported int) {
+	if estimated <= 0 || reported <= 0 {
+		return
+	}
+	ratio := math.Max(0.5, math.Min(3, float64(reported)/float64(estimated)))
+	tokenRatiosMu.Lock()
+	defer tokenRatiosMu.Unlock()
+	if previous, ok := tokenRatios[endpoint]; ok {
+		ratio = 0.8*previous + 0.2*ratio
+	}
+	tokenRatios[endpoint] = ratio
+}
+
+func tokenRatio(endpoint string) float64 {
+	tokenRatiosMu.Lock()
+	defer tokenRatiosMu.Unlock()
+	if ratio, ok := tokenRatios[endpoint]; ok {
+		return ratio
+	}
+	return 1
+}
+
+const sourceOpening = "\n[source: "
+
+// contextTrim is what fitContextWindow left out
+type contextTrim struct {
+	History int
+	Sources int
+}
+
+// fitContextWindow trims the messages to fit a context window of maxContext
+// tokens, with room for the answer and the tool definitions. The oldest
+// history goes first, then the lowest ranked retrieved sources. The system
+// prompt, the new prompt and the current turn's tool rounds are kept; if
+// they alone do not fit the endpoint has the last word. The messages passed
+// in are not changed.
+func fitContextWindow(endpoint string, maxContext int, payload *ChatPayload) ([]ChatMessage, contextTrim) {
+	var trim contextTrim
+	messages := payload.Messages
+	if !contextTrimming || maxContext <= 0 {
+		return messages, trim
+	}
+	ratio := tokenRatio(endpoint)
+	cost := func(m ChatMessage) int {
+		return int(math.Ceil(float64(estimateTokens(m.Content)+messageOverheadTokens) * ratio))
+	}
+	reserve := payload.MaxTokens
+	if reserve <= 0 {
+		reserve = contextOutputReserve
+	}
+	limit := int(float64(maxContext)*(1-contextSafetyMargin)) - reserve
+	if len(payload.Tools) > 0 {
+		limit -= int(math.Ceil(float64(promptBudget(&ChatPayload{Tools: payload.Tools}).Tools) * ratio))
+	}
+	total := 0
+	for _, m := range messages {
+		total += cost(m)
+	}
+	if total <= limit {
+		return messages, trim
+	}
+
+	// History sits between the leading system messages and the new prompt,
+	// the last user message
+	first := 0
+	for first < len(messages) && messages[first].Role == "system" {
+		first++
+	}
+	prompt := len(messages)
+	for i := len(messages) - 1; i >= first; i-- {
+		if messages[i].Role == "user" {
+			prompt = i
+			break
+		}
+	}
+	drop := first
+	for drop < prompt && total > limit {
+		total -= cost(messages[drop])
+		drop++
+	}
+	// Answers and tool results whose question is gone go with it
+	for drop < prompt && messages[drop].Role != "user" {
+		total -= cost(messages[drop])
+		drop++
+	}
+	trim.History = drop - first
+	trimmed := append(append([]ChatMessage(nil), messages[:first]...), messages[drop:]...)
+
+	if total > limit {
+		for i, m := range trimmed[:first] {
+			if !strings.HasPrefix(m.Content, groundingPreamble) {
+				continue
+			}
+			// Sources follow the preamble in rank order, each opened by its
+			// path as retrievalContext writes it
+			sources := strings.Split(strings.TrimPrefix(m.Content, groundingPreamble), sourceOpening)[1:]
+			grounding := func() string {
+				return groundingPreamble + sourceOpening + strings.Join(sources, sourceOpening)
+			}
+			total -= cost(m)
+			for len(sources) > 0 && total+cost(ChatMessage{Content: grounding()}) > limit {
+				sources = sources[:len(sources)-1]
+				trim.Sources++
+			}
+			if len(sources) == 0 {
+				trimmed = append(trimmed[:i], trimmed[i+1:]...)
+				break
+			}
+			trimmed[i].Content = grounding()
+			total += cost(trimmed[i])
+			break
+		}
+	}
+	if trim.History > 0 || trim.Sources > 0 {
+		log.Printf("Trimmed %d history messages and %d retrieved sources to fit the %d token context of %s",
+			trim.History, trim.Sources, maxContext, endpoint)
+	}
+	return trimmed, trim
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFitContextWindow(t *testing.T) {
+	trimming, reserve, margin := contextTrimming, contextOutputReserve, contextSafetyMargin
+	t.Cleanup(func() { contextTrimming, contextOutputReserve, contextSafetyMargin = trimming, reserve, margin })
+	contextTrimming, contextOutputReserve, contextSafetyMargin = true, 10, 0
+
+	// msg is a message costing tokens, named by its first word
+	msg := func(role, name string, tokens int) ChatMessage {
+		content := name + " "
+		return ChatMessage{Role: role, Content: content + strings.Repeat("x", (tokens-messageOverheadTokens)*4-len(content))}
+	}
+	cost := func(messages ...ChatMessage) int {
+		total := 0
+		for _, m := range messages {
+			total += estimateTokens(m.Content) + messageOverheadTokens
+		}
+		return total
+	}
+	grounding := func(sources ...string) ChatMessage {
+		var b strings.Builder
+		b.WriteString(groundingPreamble)
+		for _, s := range sources {
+			fmt.Fprintf(&b, "\n[source: %s]\n%s\n", s, strings.Repeat("y", 80))
+		}
+		return ChatMessage{Role: "system", Content: b.String()}
+	}
+	system := msg("system", "system", 10)
+	u1, a1, u2, a2 := msg("user", "u1", 10), msg("assistant", "a1", 10), msg("user", "u2", 10), msg("assistant", "a2", 10)
+	prompt := msg("user", "prompt", 10)
+	call := ChatMessage{Role: "assistant", ToolCalls: []ToolCall{{ID: "1"}}}
+	result := msg("tool", "result", 10)
+	history := []ChatMessage{system, u1, a1, u2, a2, prompt}
+
+	tests := []struct {
+		name       string
+		trimming   bool
+		maxContext int
+		messages   []ChatMessage
+		want       []ChatMessage
+		trim       contextTrim
+	}{
+		{name: "fits", trimming: true, maxContext: 70, messages: history, want: history},
+		{name: "trimming off", trimming: false, maxContext: 20, messages: history, want: history},
+		{name: "unknown context window", trimming: true, maxContext: 0, messages: history, want: history},
+		{name: "oldest turn dropped", trimming: true, maxContext: 50, messages: history,
+			want: []ChatMessage{system, u2, a2, prompt}, trim: contextTrim{History: 2}},
+		{name: "answer goes with its question", trimming: true, maxContext: 60, messages: history,
+			want: []ChatMessage{system, u2, a2, prompt}, trim: contextTrim{History: 2}},
+		{name: "current tool round kept", trimming: true, maxContext: 10 + cost(system, prompt, call, result),
+			messages: []ChatMessage{system, u1, a1, prompt, call, result}, want: []ChatMessage{system, prompt, call, result}, trim: contextTrim{History: 2}},
+		{name: "prompt kept when nothing else fits", trimming: true, maxContext: 15, messages: history,
+			want: []ChatMessage{system, prompt}, trim: contextTrim{History: 4}},
+		{name: "lowest ranked source dropped", trimming: true, maxContext: 10 + cost(grounding("a", "b"), prompt),
+			messages: []ChatMessage{grounding("a", "b", "c"), prompt}, want: []ChatMessage{grounding("a", "b"), prompt}, trim: contextTrim{Sources: 1}},
+		{name: "grounding dropped without sources", trimming: true, maxContext: 10 + cost(prompt),
+			messages: []ChatMessage{grounding("a", "b"), u1, a1, prompt}, want: []ChatMessage{prompt}, trim: contextTrim{History: 2, Sources: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contextTrimming = tt.trimming
+			messages := append([]ChatMessage(nil), tt.messages...)
+			got, trim := fitContextWindow("test", tt.maxContext, &ChatPayload{Messages: messages})
+			if trim != tt.trim {
+				t.Fatalf("trim = %+v, want %+v", trim, tt.trim)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("messages = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Fatal("the messages passed in were changed")
+			}
+		})
+	}
+}
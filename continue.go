@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ContinueRequest identifies a truncated or stopped answer to resume
+type ContinueRequest struct {
+	ConversationID string `json:"conversation_id" binding:"required"`
+	MessageID      string `json:"message_id" binding:"required"`
+}
+
+const continuePrompt = "Continue exactly where you left off. Do not repeat anything you already wrote."
+
+// continuationMessages replays the context with the partial answer so the
+// model picks up where it stopped
+func continuationMessages(messages []ChatMessage, partial string) []ChatMessage {
+	out := append(make([]ChatMessage, 0, len(messages)+2), messages...)
+	return append(out,
+		ChatMessage{Role: "assistant", Content: partial},
+		ChatMessage{Role: "user", Content: continuePrompt},
+	)
+}
+
+// handleChatContinue generates the rest of a stored answer and stitches it
+// onto the message, returning only the new text
+func handleChatContinue(c *gin.Context) {
+	var req ContinueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conv, ok := conversationForRequest(c, req.ConversationID)
+	if !ok {
+		return
+	}
+	idx := -1
+	for i, m := range conv.Messages {
+		if m.ID == req.MessageID && m.Role == "assistant" && i > 0 {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	partial := conv.Messages[idx]
+	if !partial.Truncated && !partial.Stopped {
+		c.JSON(http.StatusConflict, gin.H{"error": "Message is already complete"})
+		return
+	}
+
+	// The answer is continued with the conversation's own settings
+	endpoint := llmEndpoint()
+	if s := conv.Settings; s.Model != "" && endpointAllowed(conv.User, s.Model) {
+		endpoint = s.Model
+	}
+	system := chatSystemPrompt(conv.Settings.Persona, conv.Settings.Language)
+
+	start := time.Now()
+	prompt := conv.Messages[idx-1].Content
+	record := AuditRecord{
+		ID:              requestID(c),
+		ClientRequestID: clientRequestID(c),
+		Timestamp:       start,
+		User:            conv.User,
+		Model:           endpoint,
+		Prompt:          prompt,
+	}
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	messages := attachTables(buildConversationMessages(system, conv.Messages[:idx-1], prompt), conv.Messages[idx-1].Tables)
+	messages = continuationMessages(messages, partial.Content)
+	content, llmResp, err := completeChat(PriorityInteractive, endpoint, messages)
+	if err != nil {
+		log.Printf("Continuation failed: %v", err)
+		record.StatusCode, record.Error = http.StatusBadGateway, "Error from LLM endpoint"
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Error from LLM endpoint"})
+		return
+	}
+	record.StatusCode = http.StatusOK
+	record.Response = content
+	record.PromptTokens = llmResp.Usage.PromptTokens
+	record.CompletionTokens = llmResp.Usage.CompletionTokens
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+	setUpstreamHeaders(c, endpoint, llmResp.latency)
+	setTokenHeaders(c, record.PromptTokens, record.CompletionTokens)
+
+	if v := checkGuardrails("output", content); v != nil {
+		log.Printf("Guardrail %s blocked continuation", v.Rule)
+		record.Error = "output blocked by guardrail " + v.Rule
+		c.JSON(http.StatusOK, ChatResponse{Content: v.Message, Policy: v.Rule, ConversationID: conv.ID, MessageID: partial.ID})
+		return
+	}
+
+	content, truncated := truncateResponse(content)
+	truncated = truncated || llmResp.Choices[0].FinishReason == "length"
+	conversationStore.Update(conv.ID, func(stored *Conversation) {
+		for i := range stored.Messages {
+			if m := &stored.Messages[i]; m.ID == partial.ID {
+				m.Content += content
+				m.Truncated, m.Stopped = truncated, false
+				// The user has not seen the continuation yet
+				m.Status, m.ReadAt = messageCompleted, nil
+			}
+		}
+	})
+	c.JSON(http.StatusOK, ChatResponse{Content: content, Truncated: truncated, ConversationID: conv.ID, MessageID: partial.ID})
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Conversation event types. The conversation ones carry the whole
+// conversation, the message ones the message after the change.
+const (
+	eventConversationCreated  = "conversation.created"
+	eventConversationForked   = "conversation.forked"
+	eventConversationRestored = "conversation.restored"
+	eventConversationDeleted  = "conversation.deleted"
+	eventSettingsChanged      = "conversation.settings_changed"
+	eventMessageAdded         = "message.added"
+	eventMessageUpdated       = "message.updated"
+	eventMessageEdited        = "message.edited"
+	eventMessageDeleted       = "message.deleted"
+)
+
+// ConversationEvent is one change to a conversation. Events are only ever
+// appended; replaying a conversation's events in order rebuilds it.
+type ConversationEvent struct {
+	// Seq orders all events, assigned by the store when appended
+	Seq            int64     `json:"seq"`
+	ID             string    `json:"id"`
+	ConversationID string    `json:"conversation_id"`
+	User           string    `json:"user"`
+	Type           string    `json:"type"`
+	At             time.Time `json:"at"`
+	MessageID      string    `json:"message_id,omitempty"`
+	Message        *Message  `json:"message,omitempty"`
+	// Settings are the conversation's settings after the change
+	Settings     *ChatSettings `json:"settings,omitempty"`
+	Conversation *Conversation `json:"conversation,omitempty"`
+	// ForkedFrom is the conversation a forked one was copied from
+	ForkedFrom string `json:"forked_from,omitempty"`
+}
+
+// ConversationEventStore keeps the conversation event log
+type ConversationEventStore interface {
+	Append(events ...ConversationEvent)
+	// Conversation returns the conversation's events in order
+	Conversation(id string) []ConversationEvent
+	// Drop removes the conversation's events, before a deletion is recorded
+	// so the deleted messages are not kept in the log
+	Drop(id string)
+	// Since returns up to limit of the user's events after seq, in order,
+	// stopping at the first one appended at or after before
+	Since(user string, seq int64, before time.Time, limit int) []ConversationEvent
+	// Latest is the seq of the last event appended before before
+	Latest(before time.Time) int64
+	// Forgotten is the seq of the last event no longer kept for lack of
+	// space, 0 when all are kept
+	Forgotten() int64
+}
+
+// memoryConversationEventStore keeps up to max events in memory, forgetting
+// the oldest first
+type memoryConversationEventStore struct {
+	mu        sync.RWMutex
+	events    []ConversationEvent
+	seq       int64
+	max       int
+	forgotten int64
+}
+
+func (s *memoryConversationEventStore) Append(events ...ConversationEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.seq++
+		e.Seq = s.seq
+		s.events = append(s.events, e)
+	}
+	if s.max > 0 && len(s.events) > s.max {
+		s.forgotten = s.events[len(s.events)-s.max-1].Seq
+		s.events = append([]ConversationEvent(nil), s.events[len(s.events)-s.max:]...)
+	}
+}
+
+func (s *memoryConversationEventStore) Conversation(id string) []ConversationEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []ConversationEvent{}
+	for _, e := range s.events {
+		if e.ConversationID == id {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func (s *memoryConversationEventStore) Drop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.events[:0]
+	for _, e := range s.events {
+		if e.ConversationID != id {
+			kept = append(kept, e)
+		}
+	}
+	s.events = kept
+}
+
+func (s *memoryConversationEventStore) Since(user string, seq int64, before time.Time, limit int) []ConversationEvent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []ConversationEvent{}
+	for _, e := range s.events {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		if e.Seq <= seq || e.User != user {
+			continue
+		}
+		if !e.At.Before(before) {
+			break
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func (s *memoryConversationEventStore) Latest(before time.Time) int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if s.events[i].At.Before(before) {
+			return s.events[i].Seq
+		}
+	}
+	return s.forgotten
+}
+
+func (s *memoryConversationEventStore) Forgotten() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.forgotten
+}
+
+// eventLogConversationStore records every change to a conversation in the
+// event log and applies it to the store beneath, which is the projection
+// the read APIs use
+type eventLogConversationStore struct {
+	ConversationStore
+	events ConversationEventStore
+	// locks keep one conversation's events in the order its changes were
+	// applied
+	locks [64]sync.Mutex
+}
+
+var (
+	conversationEvents ConversationEventStore
+	conversationLog    *eventLogConversationStore
+)
+
+func (s *eventLogConversationStore) lock(id string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	mu := &s.locks[h.Sum32()%uint32(len(s.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (s *eventLogConversationStore) Create(user string) Conversation {
+	conv := s.ConversationStore.Create(user)
+	s.events.Append(conversationEvent(eventConversationCreated, conv))
+	return conv
+}
+
+func (s *eventLogConversationStore) Update(id string, fn func(*Conversation)) bool {
+	return s.update(id, eventMessageUpdated, fn)
+}
+
+// update applies fn and records what it changed. Messages fn changed are
+// recorded as changeType.
+func (s *eventLogConversationStore) update(id, changeType string, fn func(*Conversation)) bool {
+	defer s.lock(id)()
+	var before, after Conversation
+	ok := s.ConversationStore.Update(id, func(conv *Conversation) {
+		before = copyConversation(conv)
+		fn(conv)
+		after = copyConversation(conv)
+	})
+	if ok {
+		if events := conversationChanges(before, after, changeType); len(events) > 0 {
+			s.events.Append(events...)
+		}
+	}
+	return ok
+}
+
+// Put records the conversation as restored, e.g. from a backup or archive
+func (s *eventLogConversationStore) Put(conv Conversation) {
+	defer s.lock(conv.ID)()
+	s.ConversationStore.Put(conv)
+	s.events.Append(conversationEvent(eventConversationRestored, conv))
+}
+
+func (s *eventLogConversationStore) Delete(id string) bool {
+	defer s.lock(id)()
+	conv, _ := s.ConversationStore.Get(id)
+	return s.deleteLocked(conv, id)
+}
+
+// deleteUnchanged deletes the conversation only if it was last updated at
+// updatedAt, reporting whether it did. The check and the delete hold the
+// conversation's lock, so an update cannot slip in between.
+func (s *eventLogConversationStore) deleteUnchanged(id string, updatedAt time.Time) bool {
+	defer s.lock(id)()
+	conv, ok := s.ConversationStore.Get(id)
+	if !ok || !conv.UpdatedAt.Equal(updatedAt) {
+		return false
+	}
+	return s.deleteLocked(conv, id)
+}
+
+func (s *eventLogConversationStore) deleteLocked(conv Conversation, id string) bool {
+	if !s.ConversationStore.Delete(id) {
+		return false
+	}
+	s.events.Drop(id)
+	s.events.Append(ConversationEvent{ID: newID(), ConversationID: id, User: conv.User, Type: eventConversationDeleted, At: time.Now()})
+	return true
+}
+
+// fork copies the conversation up to and including its message at upTo into
+// a new conversation of the same user
+func (s *eventLogConversationStore) fork(src Conversation, upTo int) Conversation {
+	now := time.Now()
+	conv := Conversation{ID: newID(), User: src.User, CreatedAt: now, UpdatedAt: now, Settings: src.Settings,
+		Messages: append([]Message(nil), src.Messages[:upTo+1]...)}
+	defer s.lock(conv.ID)()
+	s.ConversationStore.Put(conv)
+	e := conversationEvent(eventConversationForked, conv)
+	e.ForkedFrom = src.ID
+	s.events.Append(e)
+	return conv
+}
+
+func conversationEvent(eventType string, conv Conversation) ConversationEvent {
+	snapshot := copyConversation(&conv)
+	return ConversationEvent{ID: newID(), ConversationID: conv.ID, User: conv.User, Type: eventType, At: conv.UpdatedAt, Conversation: &snapshot}
+}
+
+// conversationChanges lists the events that turn before into after
+func conversationChanges(before, after Conversation, changeType string) []ConversationEvent {
+	var events []ConversationEvent
+	event := func(eventType string) ConversationEvent {
+		return ConversationEvent{ID: newID(), ConversationID: after.ID, User: after.User, Type: eventType, At: after.UpdatedAt}
+	}
+	if !reflect.DeepEqual(before.Settings, after.Settings) {
+		e := event(eventSettingsChanged)
+		settings := after.Settings
+		e.Settings = &settings
+		events = append(events, e)
+	}
+	previous := map[string]Message{}
+	for _, m := range before.Messages {
+		previous[m.ID] = m
+	}
+	kept := map[string]bool{}
+	for _, m := range after.Messages {
+		kept[m.ID] = true
+		old, existed := previous[m.ID]
+		if existed && reflect.DeepEqual(old, m) {
+			continue
+		}
+		e := event(eventMessageAdded)
+		if existed {
+			e.Type = changeType
+		}
+		m := m
+		e.MessageID, e.Message = m.ID, &m
+		events = append(events, e)
+	}
+	for _, m := range before.Messages {
+		if !kept[m.ID] {
+			e := event(eventMessageDeleted)
+			e.MessageID = m.ID
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// replayConversation rebuilds a conversation from its events. It reports
+// false when the log does not start with the conversation's creation, fork
+// or restore, or ends with its deletion.
+func replayConversation(events []ConversationEvent) (Conversation, bool) {
+	var conv Conversation
+	started := false
+	for _, e := range events {
+		switch e.Type {
+		case eventConversationCreated, eventConversationForked, eventConversationRestored:
+			conv, started = copyConversation(e.Conversation), true
+		case eventConversationDeleted:
+			return Conversation{}, false
+		case eventSettingsChanged:
+			conv.Settings = *e.Settings
+		case eventMessageAdded:
+			conv.Messages = append(conv.Messages, *e.Message)
+		case eventMessageUpdated, eventMessageEdited:
+			for i := range conv.Messages {
+				if conv.Messages[i].ID == e.MessageID {
+					conv.Messages[i] = *e.Message
+				}
+			}
+		case eventMessageDeleted:
+			kept := conv.Messages[:0]
+			for _, m := range conv.Messages {
+				if m.ID != e.MessageID {
+					kept = append(kept, m)
+				}
+			}
+			conv.Messages = kept
+		}
+		conv.UpdatedAt = e.At
+	}
+	return conv, started
+}
+
+// ownMessage finds the caller's conversation and the index of its message,
+// writing the 404 when either is missing
+func ownMessage(c *gin.Context) (Conversation, int, bool) {
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return Conversation{}, 0, false
+	}
+	for i, m := range conv.Messages {
+		if m.ID == c.Param("message_id") {
+			return conv, i, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	return Conversation{}, 0, false
+}
+
+// handleEditMessage replaces the text of one of the user's own messages.
+// Answers are left as they are; the user can fork from the edited message
+// to have it answered again. With base_seq the edit is refused when the
+// message changed after it.
+func handleEditMessage(c *gin.Context) {
+	var req struct {
+		Content string `json:"content" binding:"required"`
+		BaseSeq int64  `json:"base_seq"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	conv, i, ok := ownMessage(c)
+	if !ok {
+		return
+	}
+	if conv.Messages[i].Role != "user" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only the user's own messages can be edited"})
+		return
+	}
+	now := time.Now()
+	var edited Message
+	var conflict *ConversationEvent
+	conversationLog.update(conv.ID, eventMessageEdited, func(current *Conversation) {
+		// Checked under the conversation's lock, so no change slips in between
+		if e, changed := messageChangedSince(current.ID, c.Param("message_id"), req.BaseSeq); changed {
+			conv, conflict = copyConversation(current), &e
+			return
+		}
+		for i := range current.Messages {
+			if current.Messages[i].ID == c.Param("message_id") {
+				current.Messages[i].Content, current.Messages[i].EditedAt = req.Content, &now
+				edited = current.Messages[i]
+			}
+		}
+	})
+	if conflict != nil {
+		syncConflict(c, conv, *conflict)
+		return
+	}
+	c.JSON(http.StatusOK, edited)
+}
+
+// handleDeleteMessage removes a message. Like an edit, it is refused when
+// the message changed after the base_seq query parameter.
+func handleDeleteMessage(c *gin.Context) {
+	var baseSeq int64
+	if raw := c.Query("base_seq"); raw != "" {
+		var err error
+		if baseSeq, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "base_seq must be a seq returned by a sync"})
+			return
+		}
+	}
+	conv, _, ok := ownMessage(c)
+	if !ok {
+		return
+	}
+	var conflict *ConversationEvent
+	conversationStore.Update(conv.ID, func(current *Conversation) {
+		if e, changed := messageChangedSince(current.ID, c.Param("message_id"), baseSeq); changed {
+			conv, conflict = copyConversation(current), &e
+			return
+		}
+		kept := current.Messages[:0]
+		for _, m := range current.Messages {
+			if m.ID != c.Param("message_id") {
+				kept = append(kept, m)
+			}
+		}
+		current.Messages = kept
+	})
+	if conflict != nil {
+		syncConflict(c, conv, *conflict)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conversation_id": conv.ID, "message_id": c.Param("message_id"), "deleted": true})
+}
+
+// handleForkConversation starts a new conversation from this one's history
+// up to message_id, or all of it, with the same settings
+func handleForkConversation(c *gin.Context) {
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	upTo := len(conv.Messages) - 1
+	if req.MessageID != "" {
+		upTo = -1
+		for i, m := range conv.Messages {
+			if m.ID == req.MessageID {
+				upTo = i
+			}
+		}
+		if upTo < 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+	}
+	c.JSON(http.StatusCreated, conversationLog.fork(conv, upTo))
+}
+
+// handleConversationEvents returns the conversation's change history
+func handleConversationEvents(c *gin.Context) {
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": conversationEvents.Conversation(conv.ID)})
+}
+
+// handleRebuildConversation replays the conversation's events into the
+// projection, repairing a conversation whose stored state went astray
+func handleRebuildConversation(c *gin.Context) {
+	id := c.Param("id")
+	conv, ok := replayConversation(conversationEvents.Conversation(id))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No complete event log for conversation"})
+		return
+	}
+	defer conversationLog.lock(id)()
+	conversationLog.ConversationStore.Put(conv)
+	log.Printf("Rebuilt conversation %s from its event log", id)
+	c.JSON(http.StatusOK, conv)
+}
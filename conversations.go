@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Message is one stored turn of a conversation
+type Message struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	Policy    string    `json:"policy,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Stopped   bool      `json:"stopped,omitempty"`
+	// Agent is the human agent who wrote the message, in an escalated
+	// conversation
+	Agent  string     `json:"agent,omitempty"`
+	Status string     `json:"status,omitempty"`
+	ReadAt *time.Time `json:"read_at,omitempty"`
+	// Tables are the tables attached to a user's message, as the model sees
+	// them on every later turn
+	Tables string `json:"tables,omitempty"`
+	// Charts are generated from the tables in an answer
+	Charts []ChartSpec `json:"charts,omitempty"`
+	// EditedAt is set once the user has changed the message
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+}
+
+// Message statuses. The user's messages are sent, then read once the model
+// starts answering or an agent has seen them; answers are generating until
+// they are completed or failed, and read once the user has seen them.
+const (
+	messageSent       = "sent"
+	messageGenerating = "generating"
+	messageCompleted  = "completed"
+	messageFailed     = "failed"
+	messageRead       = "read"
+)
+
+// Conversation is a user's chat history
+type Conversation struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Messages  []Message `json:"messages"`
+	// Settings are inherited by every turn that does not override them
+	Settings ChatSettings `json:"settings"`
+}
+
+// ConversationStore persists conversations; returned values are copies
+type ConversationStore interface {
+	Create(user string) Conversation
+	Get(id string) (Conversation, bool)
+	// Update applies fn to the conversation with the given ID, reporting whether it exists
+	Update(id string, fn func(*Conversation)) bool
+	// List returns the user's conversations, most recently updated first
+	List(user string) []Conversation
+	// All returns every user's conversations, for backups
+	All() []Conversation
+	// Put stores conv as is, replacing any conversation with the same ID
+	Put(conv Conversation)
+	// Inactive returns up to limit conversations last updated before the
+	// cutoff, least recently updated first
+	Inactive(before time.Time, limit int) []Conversation
+	// Delete removes a conversation, reporting whether it existed
+	Delete(id string) bool
+}
+
+// memoryConversationStore keeps conversations in memory, evicting the least
+// recently updated beyond max
+type memoryConversationStore struct {
+	mu            sync.RWMutex
+	conversations map[string]*Conversation
+	max           int
+}
+
+func newMemoryConversationStore(max int) *memoryConversationStore {
+	return &memoryConversationStore{conversations: map[string]*Conversation{}, max: max}
+}
+
+func (s *memoryConversationStore) Create(user string) Conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 && len(s.conversations) >= s.max {
+		var oldest *Conversation
+		for _, conv := range s.conversations {
+			if oldest == nil || conv.UpdatedAt.Before(oldest.UpdatedAt) {
+				oldest = conv
+			}
+		}
+		delete(s.conversations, oldest.ID)
+	}
+
+	now := time.Now()
+	conv := &Conversation{ID: newID(), User: user, CreatedAt: now, UpdatedAt: now}
+	s.conversations[conv.ID] = conv
+	return copyConversation(conv)
+}
+
+func (s *memoryConversationStore) Get(id string) (Conversation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	conv, ok := s.conversations[id]
+	if !ok {
+		return Conversation{}, false
+	}
+	return copyConversation(conv), true
+}
+
+func (s *memoryConversationStore) Update(id string, fn func(*Conversation)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conv, ok := s.conversations[id]
+	if !ok {
+		return false
+	}
+	fn(conv)
+	conv.UpdatedAt = time.Now()
+	return true
+}
+
+func (s *memoryConversationStore) List(user string) []Conversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := []Conversation{}
+	for _, conv := range s.conversations {
+		if conv.User == user {
+			out = append(out, copyConversation(conv))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.After(out[j].UpdatedAt) })
+	return out
+}
+
+func (s *memoryConversationStore) All() []Conversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := []Conversation{}
+	for _, conv := range s.conversations {
+		out = append(out, copyConversation(conv))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (s *memoryConversationStore) Put(conv Conversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := copyConversation(&conv)
+	s.conversations[conv.ID] = &stored
+	for s.max > 0 && len(s.conversations) > s.max {
+		var oldest *Conversation
+		for _, c := range s.conversations {
+			if oldest == nil || c.UpdatedAt.Before(oldest.UpdatedAt) {
+				oldest = c
+			}
+		}
+		delete(s.conversations, oldest.ID)
+	}
+}
+
+func (s *memoryConversationStore) Inactive(before time.Time, limit int) []Conversation {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := []Conversation{}
+	for _, conv := range s.conversations {
+		if conv.UpdatedAt.Before(before) {
+			out = append(out, copyConversation(conv))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].UpdatedAt.Before(out[j].UpdatedAt) })
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+func (s *memoryConversationStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.conversations[id]
+	delete(s.conversations, id)
+	return ok
+}
+
+func copyConversation(conv *Conversation) Conversation {
+	out := *conv
+	out.Messages = append([]Message(nil), conv.Messages...)
+	return out
+}
+
+var conversationStore ConversationStore
+
+// configureConversations keeps every change to a conversation in the event
+// log, with the conversation store as the projection that is read
+func configureConversations() {
+	var projection ConversationStore
+	if storage != nil {
+		projection, conversationEvents = storage.conversations, storage.conversationEvents
+	} else {
+		projection = newMemoryConversationStore(envInt("CONVERSATION_MAX_COUNT", 10000))
+		conversationEvents = &memoryConversationEventStore{max: envInt("CONVERSATION_EVENTS_MAX", 100000)}
+	}
+	conversationLog = &eventLogConversationStore{ConversationStore: projection, events: conversationEvents}
+	conversationStore = conversationLog
+}
+
+// conversationForRequest loads the caller's conversation, or starts a new one
+// when id is empty. It writes a 404 and returns false for unknown or foreign IDs.
+func conversationForRequest(c *gin.Context, id string) (Conversation, bool) {
+	user := requestUser(c)
+	if id == "" {
+		return conversationStore.Create(user), true
+	}
+	conv, ok := conversationStore.Get(id)
+	if !ok || conv.User != user {
+		conversationNotFound(c, id)
+		return Conversation{}, false
+	}
+	return conv, true
+}
+
+// recordTurn appends the request's prompt and its answer from endpoint to a
+// conversation, and publishes the turn to the transcript webhook
+func recordTurn(conv Conversation, req ChatRequest, endpoint string, answer Message) {
+	now := time.Now()
+	answer.Role, answer.CreatedAt, answer.Status = "assistant", now, messageCompleted
+	prompt := Message{ID: newID(), Role: "user", Content: req.Message, CreatedAt: now, Status: messageRead, Tables: req.tables}
+	conversationStore.Update(conv.ID, func(conv *Conversation) {
+		conv.Messages = append(conv.Messages, prompt, answer)
+	})
+	publishTranscript(conv, req, endpoint, prompt, answer)
+}
+
+// beginTurn stores the request's prompt and an empty answer while it is
+// generated, for turns whose progress is streamed
+func beginTurn(conv Conversation, req ChatRequest) (prompt, answer Message) {
+	now := time.Now()
+	prompt = Message{ID: newID(), Role: "user", Content: req.Message, CreatedAt: now, Status: messageSent, Tables: req.tables}
+	answer = Message{ID: newID(), Role: "assistant", CreatedAt: now, Status: messageGenerating}
+	conversationStore.Update(conv.ID, func(conv *Conversation) {
+		conv.Messages = append(conv.Messages, prompt, answer)
+	})
+	return prompt, answer
+}
+
+// finishTurn replaces the answer stored by beginTurn, completed unless it
+// failed, and publishes the turn to the transcript webhook
+func finishTurn(conv Conversation, req ChatRequest, endpoint string, prompt, answer Message) Message {
+	answer.CreatedAt = time.Now()
+	if answer.Status == messageGenerating {
+		answer.Status = messageCompleted
+	}
+	prompt.Status = messageRead
+	conversationStore.Update(conv.ID, func(conv *Conversation) {
+		for i, m := range conv.Messages {
+			switch m.ID {
+			case prompt.ID:
+				conv.Messages[i].Status = messageRead
+			case answer.ID:
+				conv.Messages[i] = answer
+			}
+		}
+	})
+	publishTranscript(conv, req, endpoint, prompt, answer)
+	return answer
+}
+
+// setMessageStatus changes the status of one stored message
+func setMessageStatus(conversationID, messageID, status string) {
+	conversationStore.Update(conversationID, func(conv *Conversation) {
+		for i := range conv.Messages {
+			if conv.Messages[i].ID == messageID {
+				conv.Messages[i].Status = status
+			}
+		}
+	})
+}
+
+// markRead marks the messages with the given role read, up to and including
+// upTo or all of them when it is empty, and returns how many changed
+func markRead(conversationID, role, upTo string) int {
+	now := time.Now()
+	marked := 0
+	conversationStore.Update(conversationID, func(conv *Conversation) {
+		last := len(conv.Messages) - 1
+		if upTo != "" {
+			last = -1
+			for i, m := range conv.Messages {
+				if m.ID == upTo {
+					last = i
+				}
+			}
+		}
+		for i := 0; i <= last; i++ {
+			m := &conv.Messages[i]
+			// Answers still being written are read once they are done
+			if m.Role != role || m.Status == messageRead || m.Status == messageGenerating {
+				continue
+			}
+			m.Status, m.ReadAt = messageRead, &now
+			marked++
+		}
+	})
+	return marked
+}
+
+func handleListConversations(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"conversations": conversationStore.List(requestUser(c))})
+}
+
+func handleGetConversation(c *gin.Context) {
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		Conversation
+		Escalation *Escalation `json:"escalation,omitempty"`
+	}{conv, escalationOf(conv.ID)})
+}
+
+// handleMarkConversationRead records that the user has seen the answers,
+// those up to message_id when the body has one
+func handleMarkConversationRead(c *gin.Context) {
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"read": markRead(conv.ID, "assistant", req.MessageID)})
+}
+
+// conversationNotFound answers 404, pointing at the rehydrate endpoint when
+// the conversation was archived
+func conversationNotFound(c *gin.Context, id string) {
+	if archiveAfter > 0 && isArchived(c, id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation is archived; rehydrate it first", "archived": true})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+}
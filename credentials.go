@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CredentialStatus is the outcome of the latest check of the workspace token
+type CredentialStatus struct {
+	Valid        bool       `json:"valid"`
+	CheckedAt    time.Time  `json:"checked_at"`
+	User         string     `json:"user,omitempty"`
+	StatusCode   int        `json:"status_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ExpiresIn    string     `json:"expires_in,omitempty"`
+	ExpirySource string     `json:"expiry_source,omitempty"`
+}
+
+var (
+	credentialCheckInterval time.Duration
+	credentialExpiryWarning time.Duration
+	tokenExpiresAt          time.Time
+
+	credentialMu          sync.Mutex
+	credentialStatus      *CredentialStatus
+	credentialWarnedAt    time.Time
+	credentialAlertedFail bool
+)
+
+func configureCredentials() {
+	credentialCheckInterval = envDuration("CREDENTIAL_CHECK_INTERVAL", 15*time.Minute)
+	credentialExpiryWarning = envDuration("CREDENTIAL_EXPIRY_WARNING", 72*time.Hour)
+
+	tokenExpiresAt = time.Time{}
+	if v := envString("DATABRICKS_TOKEN_EXPIRES_AT", ""); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			configWarn("invalid time for DATABRICKS_TOKEN_EXPIRES_AT: %q", v)
+		} else {
+			tokenExpiresAt = t
+		}
+	}
+}
+
+// tokenExpiry finds when the token expires: OAuth tokens are JWTs carrying an
+// exp claim, while personal access tokens are opaque and need
+// DATABRICKS_TOKEN_EXPIRES_AT
+func tokenExpiry(token string) (time.Time, string) {
+	if !tokenExpiresAt.IsZero() {
+		return tokenExpiresAt, "DATABRICKS_TOKEN_EXPIRES_AT"
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, ""
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, ""
+	}
+	return time.Unix(claims.Exp, 0), "jwt"
+}
+
+// checkCredentials asks the workspace who the token belongs to, which fails
+// with 401 or 403 once the token is revoked or expired
+func checkCredentials(token string) CredentialStatus {
+	status := CredentialStatus{CheckedAt: time.Now()}
+	if expires, source := tokenExpiry(token); !expires.IsZero() {
+		status.ExpiresAt, status.ExpirySource = &expires, source
+		status.ExpiresIn = time.Until(expires).Round(time.Minute).String()
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/2.0/preview/scim/v2/Me", databricksHost()), nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		status.Error = fmt.Sprintf("workspace unreachable: %v", err)
+		return status
+	}
+	defer resp.Body.Close()
+
+	status.StatusCode = resp.StatusCode
+	if resp.StatusCode != http.StatusOK {
+		status.Error = fmt.Sprintf("workspace returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+		return status
+	}
+	var me struct {
+		UserName    string `json:"userName"`
+		DisplayName string `json:"displayName"`
+	}
+	json.NewDecoder(resp.Body).Decode(&me)
+	status.User = me.UserName
+	if status.User == "" {
+		status.User = me.DisplayName
+	}
+	status.Valid = true
+	return status
+}
+
+// recordCredentialStatus keeps the latest check and raises alerts when the
+// token stops working or is about to expire. Failures alert once until the
+// token works again; expiry warnings repeat at most daily.
+func recordCredentialStatus(status CredentialStatus) {
+	credentialMu.Lock()
+	defer credentialMu.Unlock()
+	credentialStatus = &status
+
+	rejected := status.StatusCode == http.StatusUnauthorized || status.StatusCode == http.StatusForbidden
+	switch {
+	case rejected && !credentialAlertedFail:
+		credentialAlertedFail = true
+		notify(Alert{Type: "credentials_invalid", Severity: "critical",
+			Message: "The workspace rejected DATABRICKS_TOKEN; chat requests will fail: " + status.Error,
+			Details: map[string]interface{}{"status_code": status.StatusCode}})
+	case status.Valid:
+		credentialAlertedFail = false
+	}
+
+	if status.ExpiresAt == nil || time.Until(*status.ExpiresAt) > credentialExpiryWarning {
+		return
+	}
+	if time.Since(credentialWarnedAt) < 24*time.Hour {
+		return
+	}
+	credentialWarnedAt = time.Now()
+	severity, message := "warning", fmt.Sprintf("DATABRICKS_TOKEN expires in %s, at %s", status.ExpiresIn, status.ExpiresAt.Format(time.RFC3339))
+	if time.Now().After(*status.ExpiresAt) {
+		severity, message = "critical", "DATABRICKS_TOKEN expired at "+status.ExpiresAt.Format(time.RFC3339)
+	}
+	notify(Alert{Type: "credentials_expiring", Severity: severity, Message: message,
+		Details: map[string]interface{}{"expires_at": status.ExpiresAt, "source": status.ExpirySource}})
+}
+
+// startCredentialChecks validates the token now and every
+// CREDENTIAL_CHECK_INTERVAL; checks wait until the server leaves degraded mode
+func startCredentialChecks() {
+	if credentialCheckInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if degraded.Load() {
+				time.Sleep(credentialsRetry)
+				continue
+			}
+			runCredentialCheck()
+			time.Sleep(credentialCheckInterval)
+		}
+	}()
+}
+
+func runCredentialCheck() {
+	status := checkCredentials(databricksToken())
+	if !status.Valid {
+		log.Printf("Credential check failed: %s", status.Error)
+	}
+	recordCredentialStatus(status)
+}
+
+// handleDiagnostics reports the latest credential check; pass check=true to
+// run a fresh one first
+func handleDiagnostics(c *gin.Context) {
+	if c.Query("check") == "true" && !degraded.Load() {
+		runCredentialCheck()
+	}
+
+	credentialMu.Lock()
+	var creds interface{}
+	if credentialStatus != nil {
+		creds = *credentialStatus
+	}
+	credentialMu.Unlock()
+
+	readiness := gin.H{"status": "ready"}
+	if degraded.Load() {
+		readiness = gin.H{"status": "degraded", "problems": readinessProblems()}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"credentials":    creds,
+		"check_interval": credentialCheckInterval.String(),
+		"readiness":      readiness,
+	})
+}
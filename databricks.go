@@ -0,0 +1,697 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	dbsql "github.com/databricks/databricks-sql-go"
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+//go:embed migrations/databricks/*.sql
+var databricksMigrations embed.FS
+
+// newDatabricksStorage connects to a SQL warehouse in the workspace and keeps
+// data in Delta tables of DATABRICKS_SQL_CATALOG.DATABRICKS_SQL_SCHEMA, which
+// must already exist
+func newDatabricksStorage() (*storageBackend, error) {
+	httpPath := envString("DATABRICKS_SQL_HTTP_PATH", "")
+	if id := envString("DATABRICKS_SQL_WAREHOUSE_ID", ""); id != "" && httpPath == "" {
+		httpPath = "/sql/1.0/warehouses/" + id
+	}
+	if httpPath == "" {
+		return nil, errors.New("DATABRICKS_SQL_WAREHOUSE_ID or DATABRICKS_SQL_HTTP_PATH is required")
+	}
+
+	connector, err := dbsql.NewConnector(
+		dbsql.WithServerHostname(databricksHost()),
+		dbsql.WithPort(443),
+		dbsql.WithHTTPPath(httpPath),
+		dbsql.WithAccessToken(databricksToken()),
+		dbsql.WithInitialNamespace(envString("DATABRICKS_SQL_CATALOG", "main"), envString("DATABRICKS_SQL_SCHEMA", "chatbot")),
+		dbsql.WithUserAgentEntry("chatbot-app-go"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(envInt("DATABASE_MAX_CONNS", 10))
+
+	// A stopped warehouse can take minutes to start
+	startupTimeout := envDuration("DATABRICKS_SQL_STARTUP_TIMEOUT", 5*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), startupTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrations, err := fs.Sub(databricksMigrations, "migrations/databricks")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &storageBackend{
+		name:               "databricks",
+		db:                 db,
+		audit:              &databricksAuditStore{db: db},
+		conversations:      &databricksConversationStore{db: db},
+		killSwitches:       &databricksKillSwitchStore{db: db},
+		conversationEvents: &databricksConversationEventStore{db: db},
+		requestCaptures:    &databricksRequestCaptureStore{db: db},
+		securityEvents:     &databricksSecurityEventStore{db: db},
+		migrations:         migrations,
+		migrationDriver: func() (database.Driver, error) {
+			return &databricksMigrator{db: db, timeout: startupTimeout, holder: newID()}, nil
+		},
+	}, nil
+}
+
+// bigintParam and doubleParam bind named 64 bit values; the driver would
+// otherwise send int64 as INT and float64 as FLOAT
+func bigintParam(name string, n int64) dbsql.Parameter {
+	return dbsql.Parameter{Name: name, Type: dbsql.SqlBigInt, Value: strconv.FormatInt(n, 10)}
+}
+
+func doubleParam(name string, f float64) dbsql.Parameter {
+	return dbsql.Parameter{Name: name, Type: dbsql.SqlDouble, Value: strconv.FormatFloat(f, 'g', -1, 64)}
+}
+
+// auditParams binds the columns of a record by name
+func auditParams(r AuditRecord, quality interface{}) []interface{} {
+	return []interface{}{
+		sql.Named("id", r.ID), sql.Named("ts", r.Timestamp), sql.Named("user_id", r.User),
+		sql.Named("model", r.Model), sql.Named("prompt", r.Prompt), sql.Named("response", r.Response),
+		sql.Named("prompt_tokens", r.PromptTokens), sql.Named("completion_tokens", r.CompletionTokens),
+		doubleParam("cost", r.Cost), bigintParam("latency_ns", int64(r.Latency)),
+		sql.Named("status_code", r.StatusCode), sql.Named("error", r.Error), sql.Named("quality", quality),
+		sql.Named("client_request_id", r.ClientRequestID),
+	}
+}
+
+// databricksAuditStore keeps audit records in the audit_records Delta table
+type databricksAuditStore struct {
+	db *sql.DB
+}
+
+func (s *databricksAuditStore) Add(record AuditRecord) {
+	quality, err := marshalQuality(record.Quality)
+	if err != nil {
+		log.Printf("Failed to store audit record %s: %v", record.ID, err)
+		return
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, `INSERT INTO audit_records (`+auditColumns+`)
+		VALUES (:id, :ts, :user_id, :model, :prompt, :response, :prompt_tokens, :completion_tokens,
+		:cost, :latency_ns, :status_code, :error, :quality, :client_request_id)`, auditParams(record, quality)...)
+	if err != nil {
+		log.Printf("Failed to store audit record %s: %v", record.ID, err)
+	}
+}
+
+func (s *databricksAuditStore) List(from, to time.Time) []AuditRecord {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE ts >= :from AND ts < :to ORDER BY ts`, sql.Named("from", from), sql.Named("to", to))
+	if err != nil {
+		log.Printf("Failed to list audit records: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var out []AuditRecord
+	for rows.Next() {
+		r, err := scanAuditRecord(rows)
+		if err != nil {
+			log.Printf("Failed to read audit record: %v", err)
+			return out
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list audit records: %v", err)
+	}
+	return out
+}
+
+// Update reads and rewrites the row without a lock, since Delta tables have no
+// row locking; concurrent updates of one record keep the last write
+func (s *databricksAuditStore) Get(id string) (AuditRecord, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	r, err := scanAuditRecord(s.db.QueryRowContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE id = :id`, sql.Named("id", id)))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get audit record %s: %v", id, err)
+		}
+		return AuditRecord{}, false
+	}
+	return r, true
+}
+
+func (s *databricksAuditStore) Update(id string, fn func(*AuditRecord)) bool {
+	ctx, cancel := storageContext()
+	defer cancel()
+	r, err := scanAuditRecord(s.db.QueryRowContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE id = :id`, sql.Named("id", id)))
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to update audit record %s: %v", id, err)
+		return false
+	}
+	fn(&r)
+
+	quality, err := marshalQuality(r.Quality)
+	if err == nil {
+		r.ID = id
+		_, err = s.db.ExecContext(ctx, `UPDATE audit_records SET ts = :ts, user_id = :user_id, model = :model,
+			prompt = :prompt, response = :response, prompt_tokens = :prompt_tokens,
+			completion_tokens = :completion_tokens, cost = :cost, latency_ns = :latency_ns,
+			status_code = :status_code, error = :error, quality = :quality,
+			client_request_id = :client_request_id
+			WHERE id = :id`, auditParams(r, quality)...)
+	}
+	if err != nil {
+		log.Printf("Failed to update audit record %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+// databricksConversationStore keeps conversations in the conversations Delta
+// table, with the messages and settings of each as JSON strings
+type databricksConversationStore struct {
+	db *sql.DB
+}
+
+func (s *databricksConversationStore) Create(user string) Conversation {
+	now := time.Now()
+	conv := Conversation{ID: newID(), User: user, CreatedAt: now, UpdatedAt: now}
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO conversations (id, user_id, created_at, updated_at, messages)
+		VALUES (:id, :user_id, :created_at, :updated_at, '[]')`, sql.Named("id", conv.ID), sql.Named("user_id", conv.User),
+		sql.Named("created_at", conv.CreatedAt), sql.Named("updated_at", conv.UpdatedAt))
+	if err != nil {
+		log.Printf("Failed to store conversation %s: %v", conv.ID, err)
+	}
+	return conv
+}
+
+func (s *databricksConversationStore) Get(id string) (Conversation, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	conv, err := scanConversation(s.db.QueryRowContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE id = :id`, sql.Named("id", id)))
+	if err == sql.ErrNoRows {
+		return Conversation{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to load conversation %s: %v", id, err)
+		return Conversation{}, false
+	}
+	return conv, true
+}
+
+// Update keeps the last write when one conversation is updated concurrently,
+// like databricksAuditStore.Update
+func (s *databricksConversationStore) Update(id string, fn func(*Conversation)) bool {
+	conv, ok := s.Get(id)
+	if !ok {
+		return false
+	}
+	fn(&conv)
+	conv.UpdatedAt = time.Now()
+
+	messages, settings, err := marshalConversation(conv)
+	if err == nil {
+		ctx, cancel := storageContext()
+		defer cancel()
+		_, err = s.db.ExecContext(ctx, `UPDATE conversations SET updated_at = :updated_at, messages = :messages,
+			settings = :settings WHERE id = :id`, sql.Named("updated_at", conv.UpdatedAt), sql.Named("messages", messages),
+			sql.Named("settings", settings), sql.Named("id", id))
+	}
+	if err != nil {
+		log.Printf("Failed to update conversation %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+func (s *databricksConversationStore) List(user string) []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE user_id = :user_id ORDER BY updated_at DESC`, sql.Named("user_id", user))
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *databricksConversationStore) All() []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations ORDER BY created_at`)
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *databricksConversationStore) Put(conv Conversation) {
+	messages, settings, err := marshalConversation(conv)
+	if err == nil {
+		ctx, cancel := storageContext()
+		defer cancel()
+		_, err = s.db.ExecContext(ctx, `MERGE INTO conversations AS t
+			USING (SELECT :id AS id, :user_id AS user_id, :created_at AS created_at,
+				:updated_at AS updated_at, :messages AS messages, :settings AS settings) AS s
+			ON t.id = s.id
+			WHEN MATCHED THEN UPDATE SET *
+			WHEN NOT MATCHED THEN INSERT *`,
+			sql.Named("id", conv.ID), sql.Named("user_id", conv.User), sql.Named("created_at", conv.CreatedAt),
+			sql.Named("updated_at", conv.UpdatedAt), sql.Named("messages", messages), sql.Named("settings", settings))
+	}
+	if err != nil {
+		log.Printf("Failed to store conversation %s: %v", conv.ID, err)
+	}
+}
+
+func (s *databricksConversationStore) Inactive(before time.Time, limit int) []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE updated_at < :before ORDER BY updated_at LIMIT :limit`,
+		sql.Named("before", before), sql.Named("limit", limit))
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *databricksConversationStore) Delete(id string) bool {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE id = :id`, sql.Named("id", id))
+	if err != nil {
+		log.Printf("Failed to delete conversation %s: %v", id, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// databricksKillSwitchStore keeps engaged kill switches in the kill_switches
+// Delta table, one row per feature
+type databricksKillSwitchStore struct {
+	db *sql.DB
+}
+
+func (s *databricksKillSwitchStore) List() ([]KillSwitch, error) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT feature, reason, engaged_by, engaged_at FROM kill_switches`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanKillSwitches(rows)
+}
+
+func (s *databricksKillSwitchStore) Engage(sw KillSwitch) error {
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `MERGE INTO kill_switches AS t
+		USING (SELECT :feature AS feature, :reason AS reason, :engaged_by AS engaged_by, :engaged_at AS engaged_at) AS s
+		ON t.feature = s.feature
+		WHEN MATCHED THEN UPDATE SET *
+		WHEN NOT MATCHED THEN INSERT *`,
+		sql.Named("feature", sw.Feature), sql.Named("reason", sw.Reason), sql.Named("engaged_by", sw.EngagedBy),
+		sql.Named("engaged_at", sw.EngagedAt))
+	return err
+}
+
+func (s *databricksKillSwitchStore) Release(feature string) (bool, error) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM kill_switches WHERE feature = :feature`, sql.Named("feature", feature))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// databricksConversationEventStore keeps the conversation event log in the
+// conversation_events Delta table, with each event as a JSON string
+type databricksConversationEventStore struct {
+	db *sql.DB
+}
+
+// Append inserts the events in one statement, so they are committed together
+func (s *databricksConversationEventStore) Append(events ...ConversationEvent) {
+	var values []string
+	var args []interface{}
+	for i, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Failed to store conversation event %s: %v", e.ID, err)
+			return
+		}
+		n := strconv.Itoa(i)
+		values = append(values, fmt.Sprintf("(:id%[1]s, :conversation_id%[1]s, :user_id%[1]s, :type%[1]s, :ts%[1]s, :data%[1]s)", n))
+		args = append(args, sql.Named("id"+n, e.ID), sql.Named("conversation_id"+n, e.ConversationID), sql.Named("user_id"+n, e.User),
+			sql.Named("type"+n, e.Type), sql.Named("ts"+n, e.At), sql.Named("data"+n, string(data)))
+	}
+	if len(values) == 0 {
+		return
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO conversation_events (id, conversation_id, user_id, type, ts, data)
+		VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		log.Printf("Failed to store conversation events: %v", err)
+	}
+}
+
+func (s *databricksConversationEventStore) Conversation(id string) []ConversationEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, data FROM conversation_events WHERE conversation_id = :id ORDER BY seq`,
+		sql.Named("id", id))
+	if err != nil {
+		log.Printf("Failed to load events of conversation %s: %v", id, err)
+		return []ConversationEvent{}
+	}
+	defer rows.Close()
+	return scanConversationEvents(rows)
+}
+
+func (s *databricksConversationEventStore) Drop(id string) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM conversation_events WHERE conversation_id = :id`, sql.Named("id", id)); err != nil {
+		log.Printf("Failed to drop events of conversation %s: %v", id, err)
+	}
+}
+
+func (s *databricksConversationEventStore) Since(user string, seq int64, before time.Time, limit int) []ConversationEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, data FROM conversation_events
+		WHERE user_id = :user_id AND seq > :seq AND seq < COALESCE(
+			(SELECT MIN(seq) FROM conversation_events WHERE user_id = :user_id AND seq > :seq AND ts >= :before), 9223372036854775807)
+		ORDER BY seq LIMIT :limit`,
+		sql.Named("user_id", user), sql.Named("seq", seq), sql.Named("before", before), sql.Named("limit", limit))
+	if err != nil {
+		log.Printf("Failed to load conversation events of %s: %v", user, err)
+		return []ConversationEvent{}
+	}
+	defer rows.Close()
+	return scanConversationEvents(rows)
+}
+
+func (s *databricksConversationEventStore) Latest(before time.Time) int64 {
+	ctx, cancel := storageContext()
+	defer cancel()
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM conversation_events WHERE ts < :before`,
+		sql.Named("before", before)).Scan(&seq)
+	if err != nil {
+		log.Printf("Failed to read the latest conversation event: %v", err)
+	}
+	return seq
+}
+
+// Forgotten is 0, the table keeps every event
+func (s *databricksConversationEventStore) Forgotten() int64 { return 0 }
+
+// databricksMigrator is a golang-migrate database driver for a SQL warehouse.
+// The version is kept in the schema_migrations table. Warehouses have no
+// advisory locks, so replicas take turns through a row in the
+// schema_migrations_lock table instead.
+type databricksMigrator struct {
+	db      *sql.DB
+	timeout time.Duration
+	// holder identifies this migrator's row in schema_migrations_lock
+	holder string
+}
+
+// databricksLockStale is when a migration lock is taken to be left behind by
+// a replica that died holding it
+const databricksLockStale = time.Hour
+
+func (m *databricksMigrator) Open(url string) (database.Driver, error) {
+	return nil, errors.New("databricks migrations need an open connection")
+}
+
+func (m *databricksMigrator) Close() error {
+	return nil
+}
+
+// Lock waits up to MIGRATION_LOCK_TIMEOUT for the lock row to be free
+func (m *databricksMigrator) Lock() error {
+	if _, err := m.exec(`CREATE TABLE IF NOT EXISTS schema_migrations_lock
+		(id INT NOT NULL, holder STRING NOT NULL, acquired_at TIMESTAMP NOT NULL) USING DELTA`); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(migrationLockTimeout)
+	for {
+		acquired, err := m.tryLock()
+		if err != nil || acquired {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return database.ErrLocked
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// tryLock adds the lock row unless another replica holds it. Of concurrent
+// writes to the table Delta commits one and fails the others, so only one
+// replica can win; the losers try again.
+func (m *databricksMigrator) tryLock() (bool, error) {
+	_, err := m.exec(`DELETE FROM schema_migrations_lock WHERE acquired_at < :stale`,
+		sql.Named("stale", time.Now().Add(-databricksLockStale)))
+	if err == nil {
+		_, err = m.exec(`MERGE INTO schema_migrations_lock t USING (SELECT 1 AS id) s ON t.id = s.id
+			WHEN NOT MATCHED THEN INSERT (id, holder, acquired_at) VALUES (1, :holder, :now)`,
+			sql.Named("holder", m.holder), sql.Named("now", time.Now()))
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "Concurrent") {
+			return false, nil
+		}
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	var holder string
+	err = m.db.QueryRowContext(ctx, `SELECT holder FROM schema_migrations_lock WHERE id = 1`).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return holder == m.holder, err
+}
+
+func (m *databricksMigrator) Unlock() error {
+	result, err := m.exec(`DELETE FROM schema_migrations_lock WHERE id = 1 AND holder = :holder`, sql.Named("holder", m.holder))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return database.ErrNotLocked
+	}
+	return nil
+}
+
+// Run executes each statement of a migration in turn, since the warehouse
+// accepts one statement per request
+func (m *databricksMigrator) Run(migration io.Reader) error {
+	body, err := io.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range strings.Split(string(body), ";") {
+		if stmt = strings.TrimSpace(stmt); stmt == "" {
+			continue
+		}
+		if _, err := m.exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *databricksMigrator) SetVersion(version int, dirty bool) error {
+	if err := m.ensureVersionTable(); err != nil {
+		return err
+	}
+	if _, err := m.exec(`DELETE FROM schema_migrations`); err != nil {
+		return err
+	}
+	if version < 0 && !dirty {
+		return nil
+	}
+	_, err := m.exec(`INSERT INTO schema_migrations (version, dirty) VALUES (:version, :dirty)`,
+		bigintParam("version", int64(version)), sql.Named("dirty", dirty))
+	return err
+}
+
+func (m *databricksMigrator) Version() (int, bool, error) {
+	if err := m.ensureVersionTable(); err != nil {
+		return 0, false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	var version int64
+	var dirty bool
+	err := m.db.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return database.NilVersion, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return int(version), dirty, nil
+}
+
+// Drop removes every table in the schema
+func (m *databricksMigrator) Drop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	rows, err := m.db.QueryContext(ctx, `SHOW TABLES`)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	for rows.Next() {
+		var schema, table string
+		var temporary bool
+		if err := rows.Scan(&schema, &table, &temporary); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		// Held while dropping
+		if table == "schema_migrations_lock" {
+			continue
+		}
+		if _, err := m.exec("DROP TABLE IF EXISTS `" + strings.ReplaceAll(table, "`", "``") + "`"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *databricksMigrator) ensureVersionTable() error {
+	_, err := m.exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL, dirty BOOLEAN NOT NULL) USING DELTA`)
+	return err
+}
+
+func (m *databricksMigrator) exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	return m.db.ExecContext(ctx, query, args...)
+}
+
+// databricksRequestCaptureStore keeps captured requests in the
+// request_captures Delta table, with each capture as JSON
+type databricksRequestCaptureStore struct {
+	db *sql.DB
+}
+
+func (s *databricksRequestCaptureStore) Add(capture RequestCapture) {
+	data, err := json.Marshal(capture)
+	if err != nil {
+		log.Printf("Failed to store captured request %s: %v", capture.ID, err)
+		return
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO request_captures (id, user_id, ts, data) VALUES (:id, :user_id, :ts, :data)`,
+		sql.Named("id", capture.ID), sql.Named("user_id", capture.User), sql.Named("ts", capture.At),
+		sql.Named("data", string(data))); err != nil {
+		log.Printf("Failed to store captured request %s: %v", capture.ID, err)
+	}
+}
+
+func (s *databricksRequestCaptureStore) Get(id string) (RequestCapture, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	return scanRequestCapture(id, s.db.QueryRowContext(ctx, `SELECT data FROM request_captures WHERE id = :id LIMIT 1`,
+		sql.Named("id", id)))
+}
+
+func (s *databricksRequestCaptureStore) Prune(before time.Time) int {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM request_captures WHERE ts < :before`, sql.Named("before", before))
+	if err != nil {
+		log.Printf("Failed to prune captured requests: %v", err)
+		return 0
+	}
+	n, _ := result.RowsAffected()
+	return int(n)
+}
+
+// databricksSecurityEventStore keeps security events in the security_events
+// Delta table
+type databricksSecurityEventStore struct {
+	db *sql.DB
+}
+
+func (s *databricksSecurityEventStore) Add(e SecurityEvent) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO security_events (ts, event, kind, client_ip, subject, detail)
+		VALUES (:ts, :event, :kind, :client_ip, :subject, :detail)`,
+		sql.Named("ts", e.Timestamp), sql.Named("event", e.Event), sql.Named("kind", e.Kind),
+		sql.Named("client_ip", e.ClientIP), sql.Named("subject", e.Subject), sql.Named("detail", e.Detail)); err != nil {
+		log.Printf("Failed to store security event: %v", err)
+	}
+}
+
+func (s *databricksSecurityEventStore) Recent(limit int) []SecurityEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, event, kind, client_ip, subject, detail FROM security_events
+		ORDER BY ts DESC LIMIT :limit`, bigintParam("limit", int64(limit)))
+	if err != nil {
+		log.Printf("Failed to list security events: %v", err)
+		return []SecurityEvent{}
+	}
+	defer rows.Close()
+	return scanSecurityEvents(rows)
+}
@@ -0,0 +1,59 @@
+package main
+
+// DeterminismInfo reports which reproducibility controls were sent upstream
+type DeterminismInfo struct {
+	Seed              *int64   `json:"seed,omitempty"`
+	Temperature       float64  `json:"temperature"`
+	TopP              float64  `json:"top_p"`
+	Honored           []string `json:"honored"`
+	Ignored           []string `json:"ignored,omitempty"`
+	SystemFingerprint string   `json:"system_fingerprint,omitempty"`
+}
+
+var (
+	defaultSeed           int64
+	seedUnsupportedModels []string
+	deterministicTemp     float64
+	deterministicTopP     float64
+)
+
+func configureDeterminism() {
+	defaultSeed = int64(envInt("DETERMINISTIC_SEED", 42))
+	deterministicTemp = envFloat("DETERMINISTIC_TEMPERATURE", 0)
+	deterministicTopP = envFloat("DETERMINISTIC_TOP_P", 1)
+	seedUnsupportedModels = envList("SEED_UNSUPPORTED_ENDPOINTS")
+}
+
+// applyDeterminism pins sampling parameters on the payload when the request
+// asks for reproducible output, returning nil when it does not
+func applyDeterminism(payload *ChatPayload, endpoint string, req ChatRequest) *DeterminismInfo {
+	if !req.Deterministic && req.Seed == nil {
+		return nil
+	}
+
+	info := &DeterminismInfo{Temperature: deterministicTemp, TopP: deterministicTopP}
+	payload.Temperature, payload.TopP = &info.Temperature, &info.TopP
+	info.Honored = []string{"temperature", "top_p"}
+
+	seed := defaultSeed
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	if seedSupported(endpoint) {
+		payload.Seed = &seed
+		info.Seed = &seed
+		info.Honored = append(info.Honored, "seed")
+	} else {
+		info.Ignored = append(info.Ignored, "seed")
+	}
+	return info
+}
+
+func seedSupported(endpoint string) bool {
+	for _, e := range seedUnsupportedModels {
+		if e == endpoint {
+			return false
+		}
+	}
+	return true
+}
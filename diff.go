@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Longest answer, in words, handleMessageDiff compares; the table is quadratic
+const maxDiffWords = 2000
+
+var diffTokenPattern = regexp.MustCompile(`\s*\S+\s*`)
+
+// DiffSide is one of the two answers being compared
+type DiffSide struct {
+	ID             string `json:"id"`
+	Source         string `json:"source"` // conversation or audit
+	ConversationID string `json:"conversation_id,omitempty"`
+	Model          string `json:"model,omitempty"`
+	Content        string `json:"content"`
+}
+
+// DiffOp is a run of words both answers share (equal), or only b (insert) or
+// only a (delete) has
+type DiffOp struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+type DiffStats struct {
+	Equal    int `json:"equal"`
+	Inserted int `json:"inserted"`
+	Deleted  int `json:"deleted"`
+}
+
+// MessageDiff compares two answers word by word. Similarity is twice the
+// shared words over the words of both, from 0 to 1.
+type MessageDiff struct {
+	A          DiffSide  `json:"a"`
+	B          DiffSide  `json:"b"`
+	Similarity float64   `json:"similarity"`
+	Stats      DiffStats `json:"stats"`
+	Diff       []DiffOp  `json:"diff"`
+}
+
+// findAnswer looks the ID up among the caller's assistant messages, then
+// among audit records, which is where compare mode answers are kept. Admins
+// may read anyone's audit records.
+func findAnswer(c *gin.Context, id string) (DiffSide, bool) {
+	user := requestUser(c)
+	for _, conv := range conversationStore.List(user) {
+		for _, m := range conv.Messages {
+			if m.ID == id && m.Role == "assistant" {
+				return DiffSide{ID: id, Source: "conversation", ConversationID: conv.ID, Content: m.Content}, true
+			}
+		}
+	}
+	if r, ok := auditStore.Get(id); ok && (r.User == user || isAdmin(c)) {
+		return DiffSide{ID: id, Source: "audit", Model: r.Model, Content: r.Response}, true
+	}
+	return DiffSide{}, false
+}
+
+// handleMessageDiff compares the answers ?a= and ?b=, e.g. two results of
+// one compare request
+func handleMessageDiff(c *gin.Context) {
+	var sides [2]DiffSide
+	for i, param := range []string{"a", "b"} {
+		id := c.Query(param)
+		if id == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Give the message IDs to compare as a and b"})
+			return
+		}
+		side, ok := findAnswer(c, id)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found: " + id})
+			return
+		}
+		sides[i] = side
+	}
+	diff, ok := compareAnswers(sides[0], sides[1])
+	if !ok {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Answers longer than %d words cannot be compared", maxDiffWords)})
+		return
+	}
+	c.JSON(http.StatusOK, diff)
+}
+
+// compareAnswers diffs the content of two answers word by word. It is false
+// when either is longer than maxDiffWords.
+func compareAnswers(sideA, sideB DiffSide) (MessageDiff, bool) {
+	a, b := diffTokenPattern.FindAllString(sideA.Content, -1), diffTokenPattern.FindAllString(sideB.Content, -1)
+	if len(a) > maxDiffWords || len(b) > maxDiffWords {
+		return MessageDiff{}, false
+	}
+	diff := MessageDiff{A: sideA, B: sideB, Diff: diffWords(a, b)}
+	for _, op := range diff.Diff {
+		n := len(diffTokenPattern.FindAllString(op.Text, -1))
+		switch op.Op {
+		case "equal":
+			diff.Stats.Equal += n
+		case "insert":
+			diff.Stats.Inserted += n
+		case "delete":
+			diff.Stats.Deleted += n
+		}
+	}
+	diff.Similarity = 1
+	if total := len(a) + len(b); total > 0 {
+		diff.Similarity = float64(2*diff.Stats.Equal) / float64(total)
+	}
+	return diff, true
+}
+
+// diffWords aligns the words on their longest common subsequence, ignoring
+// differences in surrounding whitespace, and merges neighbouring words with
+// the same op
+func diffWords(a, b []string) []DiffOp {
+	ka, kb := make([]string, len(a)), make([]string, len(b))
+	for i := range a {
+		ka[i] = strings.TrimSpace(a[i])
+	}
+	for j := range b {
+		kb[j] = strings.TrimSpace(b[j])
+	}
+
+	// lcs[i][j] is the common subsequence length of a[i:] and b[j:]
+	lcs := make([][]uint16, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]uint16, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if ka[i] == kb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	ops := []DiffOp{}
+	emit := func(op, text string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == op {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Op: op, Text: text})
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && ka[i] == kb[j]:
+			emit("equal", b[j])
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			emit("delete", a[i])
+			i++
+		default:
+			emit("insert", b[j])
+			j++
+		}
+	}
+	return ops
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// draftToolSource is the source of the built-in email and invite tools
+const draftToolSource = "builtin:drafts"
+
+var (
+	smtpAddr     string
+	smtpHost     string
+	smtpUsername string
+	smtpPassword string
+	smtpFrom     *mail.Address
+
+	draftAllowedDomains map[string]bool
+	draftMaxRecipients  int
+
+	// sendMail is smtp.SendMail, which upgrades to TLS when the server offers it
+	sendMail = smtp.SendMail
+)
+
+// emailDraft is the arguments of draft_email
+type emailDraft struct {
+	To      []string `json:"to"`
+	Cc      []string `json:"cc"`
+	Subject string   `json:"subject"`
+	Body    string   `json:"body"`
+}
+
+// inviteDraft is the arguments of draft_meeting_invite
+type inviteDraft struct {
+	Attendees       []string `json:"attendees"`
+	Title           string   `json:"title"`
+	Start           string   `json:"start"`
+	DurationMinutes int      `json:"duration_minutes"`
+	Location        string   `json:"location"`
+	Description     string   `json:"description"`
+}
+
+// configureDrafts reads the SMTP settings. With SMTP_HOST and SMTP_FROM set,
+// the model can draft emails and meeting invites, which are only sent once
+// the user confirms them.
+func configureDrafts() {
+	smtpHost = envString("SMTP_HOST", "")
+	smtpAddr = net.JoinHostPort(smtpHost, strconv.Itoa(envInt("SMTP_PORT", 587)))
+	smtpUsername = envString("SMTP_USERNAME", "")
+	smtpPassword = envString("SMTP_PASSWORD", "")
+	draftAllowedDomains = envSet("DRAFT_ALLOWED_DOMAINS")
+	draftMaxRecipients = envInt("DRAFT_MAX_RECIPIENTS", 20)
+	smtpFrom = nil
+	if from := envString("SMTP_FROM", ""); from != "" {
+		addr, err := mail.ParseAddress(from)
+		if err != nil {
+			configWarn("invalid SMTP_FROM %q: %v", from, err)
+		} else {
+			smtpFrom = addr
+		}
+	}
+
+	unregisterTools(draftToolSource)
+	if smtpHost == "" {
+		return
+	}
+	if smtpFrom == nil {
+		configWarn("SMTP_HOST is set but SMTP_FROM is missing; the email and invite tools are disabled")
+		return
+	}
+	registerDraftTools()
+}
+
+func registerDraftTools() {
+	addresses := map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}}
+	schema := func(properties map[string]interface{}, required ...string) json.RawMessage {
+		raw, _ := json.Marshal(map[string]interface{}{"type": "object", "properties": properties, "required": required})
+		return raw
+	}
+
+	registerTool(Tool{
+		Name: "draft_email",
+		Description: "Draft an email for the user. The draft is shown to the user, who may edit it, and it is only sent once they confirm. " +
+			"Write the whole message; never claim it was sent.",
+		Parameters: schema(map[string]interface{}{
+			"to":      withDescription(addresses, "Recipient email addresses"),
+			"cc":      withDescription(addresses, "Copied email addresses"),
+			"subject": map[string]interface{}{"type": "string"},
+			"body":    map[string]interface{}{"type": "string", "description": "Plain text body"},
+		}, "to", "subject", "body"),
+		Source:   draftToolSource,
+		Confirm:  true,
+		call:     func(arguments json.RawMessage) (string, error) { return sendEmailDraft("", arguments) },
+		callAs:   sendEmailDraft,
+		describe: describeEmailDraft,
+	})
+	registerTool(Tool{
+		Name: "draft_meeting_invite",
+		Description: "Draft a meeting invite for the user. The user is invited too. The draft is shown to the user, who may edit it, " +
+			"and it is only sent once they confirm; never claim it was sent.",
+		Parameters: schema(map[string]interface{}{
+			"attendees":        withDescription(addresses, "Attendee email addresses"),
+			"title":            map[string]interface{}{"type": "string"},
+			"start":            map[string]interface{}{"type": "string", "description": "Start time in RFC 3339, with the time zone offset"},
+			"duration_minutes": map[string]interface{}{"type": "integer", "description": "Length of the meeting; 30 when left out"},
+			"location":         map[string]interface{}{"type": "string", "description": "Room or video call link"},
+			"description":      map[string]interface{}{"type": "string", "description": "Agenda"},
+		}, "attendees", "title", "start"),
+		Source:   draftToolSource,
+		Confirm:  true,
+		call:     func(arguments json.RawMessage) (string, error) { return sendInviteDraft("", arguments) },
+		callAs:   sendInviteDraft,
+		describe: describeInviteDraft,
+	})
+}
+
+func withDescription(schema map[string]interface{}, description string) map[string]interface{} {
+	out := map[string]interface{}{"description": description}
+	for k, v := range schema {
+		out[k] = v
+	}
+	return out
+}
+
+// parseRecipients checks addresses against the allowed domains, returning
+// them in canonical form
+func parseRecipients(field string, list []string) ([]string, error) {
+	var out []string
+	for _, raw := range list {
+		addr, err := mail.ParseAddress(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an email address", field, raw)
+		}
+		domain := strings.ToLower(addr.Address[strings.LastIndex(addr.Address, "@")+1:])
+		if draftAllowedDomains != nil && !draftAllowedDomains[domain] {
+			return nil, fmt.Errorf("%s: %s is outside the domains mail may be sent to", field, addr.Address)
+		}
+		out = append(out, addr.Address)
+	}
+	return out, nil
+}
+
+func parseEmailDraft(arguments json.RawMessage) (emailDraft, error) {
+	var d emailDraft
+	if err := json.Unmarshal(arguments, &d); err != nil {
+		return d, fmt.Errorf("invalid arguments: %v", err)
+	}
+	var err error
+	if d.To, err = parseRecipients("to", d.To); err != nil {
+		return d, err
+	}
+	if d.Cc, err = parseRecipients("cc", d.Cc); err != nil {
+		return d, err
+	}
+	d.Subject = strings.Join(strings.Fields(d.Subject), " ")
+	switch {
+	case len(d.To) == 0:
+		return d, errors.New("to needs at least one recipient")
+	case draftMaxRecipients > 0 && len(d.To)+len(d.Cc) > draftMaxRecipients:
+		return d, fmt.Errorf("at most %d recipients are allowed", draftMaxRecipients)
+	case d.Subject == "":
+		return d, errors.New("subject is required")
+	}
+	return d, nil
+}
+
+func parseInviteDraft(arguments json.RawMessage) (inviteDraft, time.Time, error) {
+	var d inviteDraft
+	if err := json.Unmarshal(arguments, &d); err != nil {
+		return d, time.Time{}, fmt.Errorf("invalid arguments: %v", err)
+	}
+	var err error
+	if d.Attendees, err = parseRecipients("attendees", d.Attendees); err != nil {
+		return d, time.Time{}, err
+	}
+	d.Title = strings.Join(strings.Fields(d.Title), " ")
+	if d.DurationMinutes == 0 {
+		d.DurationMinutes = 30
+	}
+	start, err := time.Parse(time.RFC3339, d.Start)
+	switch {
+	case len(d.Attendees) == 0:
+		return d, start, errors.New("attendees needs at least one address")
+	case draftMaxRecipients > 0 && len(d.Attendees) > draftMaxRecipients:
+		return d, start, fmt.Errorf("at most %d attendees are allowed", draftMaxRecipients)
+	case d.Title == "":
+		return d, start, errors.New("title is required")
+	case err != nil:
+		return d, start, errors.New("start must be an RFC 3339 time such as 2026-03-02T15:00:00+01:00")
+	case start.Before(time.Now()):
+		return d, start, errors.New("start is in the past")
+	case d.DurationMinutes < 0 || d.DurationMinutes > 24*60:
+		return d, start, errors.New("duration_minutes must be between 1 and 1440")
+	}
+	return d, start, nil
+}
+
+func describeEmailDraft(arguments json.RawMessage) (string, error) {
+	d, err := parseEmailDraft(arguments)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("send an email %q to %s", d.Subject, strings.Join(append(d.To, d.Cc...), ", ")), nil
+}
+
+func describeInviteDraft(arguments json.RawMessage) (string, error) {
+	d, start, err := parseInviteDraft(arguments)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("send an invite to %q on %s for %d minutes to %s",
+		d.Title, start.Format("Mon 2 Jan 2006 15:04 MST"), d.DurationMinutes, strings.Join(d.Attendees, ", ")), nil
+}
+
+// userAddress returns the user's email address, when their identity is one
+func userAddress(user string) string {
+	if addr, err := mail.ParseAddress(user); err == nil {
+		return addr.Address
+	}
+	return ""
+}
+
+// signature notes who had the message sent, since it goes out from SMTP_FROM
+func signature(user string) string {
+	if user == "" {
+		return ""
+	}
+	return "\n\n--\nSent on behalf of " + user + " through the chatbot."
+}
+
+func sendEmailDraft(user string, arguments json.RawMessage) (string, error) {
+	d, err := parseEmailDraft(arguments)
+	if err != nil {
+		return "", err
+	}
+	msg, err := composeMail(user, d.To, d.Cc, d.Subject, d.Body+signature(user), "")
+	if err != nil {
+		return "", err
+	}
+	if err := deliverMail(append(d.To, d.Cc...), msg); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Sent the email %q to %s.", d.Subject, strings.Join(append(d.To, d.Cc...), ", ")), nil
+}
+
+func sendInviteDraft(user string, arguments json.RawMessage) (string, error) {
+	d, start, err := parseInviteDraft(arguments)
+	if err != nil {
+		return "", err
+	}
+	attendees := d.Attendees
+	if own := userAddress(user); own != "" && !containsFold(attendees, own) {
+		attendees = append(attendees, own)
+	}
+	end := start.Add(time.Duration(d.DurationMinutes) * time.Minute)
+	description := strings.TrimSpace(d.Description + signature(user))
+	ics := calendarInvite(newID(), d.Title, d.Location, description, start, end, attendees)
+	text := strings.Join([]string{d.Title, start.Format(time.RFC1123Z) + " - " + end.Format(time.RFC1123Z), d.Location, "", description}, "\n")
+	msg, err := composeMail(user, attendees, nil, "Invitation: "+d.Title, text, ics)
+	if err != nil {
+		return "", err
+	}
+	if err := deliverMail(attendees, msg); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Sent the invite %q for %s to %s.", d.Title, start.Format(time.RFC1123Z), strings.Join(attendees, ", ")), nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func deliverMail(recipients []string, msg []byte) error {
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, smtpHost)
+	}
+	if err := sendMail(smtpAddr, auth, smtpFrom.Address, recipients, msg); err != nil {
+		return fmt.Errorf("mail server refused the message: %v", err)
+	}
+	return nil
+}
+
+// composeMail builds a message from SMTP_FROM with replies going to the user.
+// A calendar invite is attached as the text/calendar alternative, which mail
+// clients show as an invitation.
+func composeMail(user string, to, cc []string, subject, text, calendar string) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&buf, "%s: %s\r\n", name, value) }
+	header("From", smtpFrom.String())
+	header("To", strings.Join(to, ", "))
+	if len(cc) > 0 {
+		header("Cc", strings.Join(cc, ", "))
+	}
+	if own := userAddress(user); own != "" {
+		header("Reply-To", own)
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", "<"+newID()+"@"+smtpFrom.Address[strings.LastIndex(smtpFrom.Address, "@")+1:]+">")
+	header("MIME-Version", "1.0")
+
+	if calendar == "" {
+		header("Content-Type", "text/plain; charset=utf-8")
+		header("Content-Transfer-Encoding", "quoted-printable")
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	buf.WriteString("\r\n")
+	for _, p := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/calendar; method=REQUEST; charset=utf-8", calendar},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// calendarInvite renders a single-event iCalendar REQUEST organized by
+// SMTP_FROM
+func calendarInvite(uid, title, location, description string, start, end time.Time, attendees []string) string {
+	const stamp = "20060102T150405Z"
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Chatbot Studio//Drafts//EN",
+		"METHOD:REQUEST",
+		"BEGIN:VEVENT",
+		"UID:" + uid + "@chatbot",
+		"DTSTAMP:" + time.Now().UTC().Format(stamp),
+		"DTSTART:" + start.UTC().Format(stamp),
+		"DTEND:" + end.UTC().Format(stamp),
+		"SUMMARY:" + icsEscape(title),
+		"ORGANIZER;CN=" + icsEscape(smtpFrom.Name) + ":mailto:" + smtpFrom.Address,
+	}
+	if location != "" {
+		lines = append(lines, "LOCATION:"+icsEscape(location))
+	}
+	if description != "" {
+		lines = append(lines, "DESCRIPTION:"+icsEscape(description))
+	}
+	for _, a := range attendees {
+		lines = append(lines, "ATTENDEE;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:"+a)
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(icsFold(line))
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+func icsEscape(s string) string { return icsEscaper.Replace(s) }
+
+// icsFold splits a content line into 75-octet pieces, continued with a
+// leading space, without breaking a UTF-8 sequence
+func icsFold(line string) string {
+	var b strings.Builder
+	for limit := 75; len(line) > limit; limit = 74 {
+		cut := utf8Boundary(line, limit)
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line)
+	return b.String()
+}
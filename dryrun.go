@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DryRunResponse is the request a chat would have sent upstream
+type DryRunResponse struct {
+	DryRun         bool         `json:"dry_run"`
+	Endpoint       string       `json:"endpoint"`
+	ConversationID string       `json:"conversation_id,omitempty"`
+	Payload        *ChatPayload `json:"payload"`
+	TokenBudget    TokenBudget  `json:"token_budget"`
+}
+
+// conversationForChat is conversationForRequest, except that a dry run does
+// not start a conversation it would never add a turn to. A conversation it
+// starts keeps the settings of its first turn.
+func conversationForChat(c *gin.Context, req ChatRequest) (Conversation, bool) {
+	if req.ConversationID != "" {
+		return conversationForRequest(c, req.ConversationID)
+	}
+	if req.DryRun {
+		return Conversation{}, true
+	}
+	conv, _ := conversationForRequest(c, "")
+	keepFirstTurnSettings(&conv, req)
+	return conv, true
+}
+
+// respondDryRun returns the payload as assembled: history, retrieved context,
+// system prompt, script changes and tool definitions included. Nothing is
+// sent upstream, audited or added to the conversation.
+func respondDryRun(c *gin.Context, endpoint string, conv Conversation, payload *ChatPayload) {
+	// What the endpoint would receive, e.g. without tools it cannot call
+	payload, _ = adaptPayload(endpoint, payload)
+	c.JSON(http.StatusOK, DryRunResponse{DryRun: true, Endpoint: endpoint, ConversationID: conv.ID, Payload: payload, TokenBudget: promptBudget(payload)})
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EntitlementsConfig maps workspace groups to what their members may do, so
+// access follows group membership instead of lists kept in the app
+type EntitlementsConfig struct {
+	// AdminGroups grant admin access, like listing the user in ADMIN_USERS
+	AdminGroups []string `json:"admin_groups"`
+	// Endpoints maps a group to the extra serving endpoints its members may
+	// use, on top of the chat endpoint and COMPARE_ENDPOINTS
+	Endpoints map[string][]string `json:"endpoints"`
+	// Users maps a user to extra serving endpoints, for those who need a
+	// model without a group to grant it
+	Users map[string][]string `json:"users,omitempty"`
+	// FallbackModel answers chat turns that ask for a model the user may not
+	// use with the chat endpoint, instead of refusing them
+	FallbackModel bool `json:"fallback_model,omitempty"`
+	// Tiers are tried in order and the first one matching any of the user's
+	// groups applies; everyone else gets DefaultTier
+	Tiers       []QuotaTier `json:"tiers"`
+	DefaultTier QuotaTier   `json:"default_tier"`
+}
+
+// QuotaTier is a daily allowance; zero means unlimited
+type QuotaTier struct {
+	Name           string   `json:"name"`
+	Groups         []string `json:"groups,omitempty"`
+	RequestsPerDay int      `json:"requests_per_day"`
+	TokensPerDay   int      `json:"tokens_per_day"`
+	// MaxStreams overrides STREAMS_PER_USER for the tier's members
+	MaxStreams int `json:"max_streams,omitempty"`
+}
+
+// Entitlements is what one identity is allowed, resolved from its groups
+type Entitlements struct {
+	Identity  string    `json:"identity"`
+	Groups    []string  `json:"groups"`
+	Admin     bool      `json:"admin"`
+	Endpoints []string  `json:"endpoints"`
+	Tier      QuotaTier `json:"tier"`
+}
+
+var (
+	// entitlementsConfig is nil when entitlements are not configured
+	entitlementsConfig atomic.Pointer[EntitlementsConfig]
+	groupCacheTTL      time.Duration
+	// groupLookupBackoff is how long a failed lookup is not retried
+	groupLookupBackoff time.Duration
+
+	groupCacheMu sync.Mutex
+	groupCache   = map[string]cachedGroups{}
+
+	quotas = &quotaTracker{usage: map[string]*quotaUsage{}}
+
+	modelFallbacks *counterVec
+)
+
+type cachedGroups struct {
+	groups []string
+	// expires is when the groups are looked up again
+	expires time.Time
+}
+
+func configureEntitlements() {
+	groupCacheTTL = envDuration("GROUP_CACHE_TTL", 10*time.Minute)
+	groupLookupBackoff = envDuration("GROUP_LOOKUP_BACKOFF", 30*time.Second)
+	modelFallbacks = newCounterVec("chatbot_model_fallbacks_total", "Chat turns answered by the chat endpoint instead of a model the user may not use", "model")
+
+	entitlementsConfig.Store(nil)
+	path := envString("ENTITLEMENTS_FILE", "")
+	if path == "" {
+		return
+	}
+	var cfg EntitlementsConfig
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		configWarn("failed to load entitlements from %s: %v", path, err)
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		configWarn("entitlements in %s: %v", path, err)
+	}
+	setEntitlements(cfg)
+	log.Printf("Entitlements: %d admin groups, %d endpoint groups, %d users with endpoints, %d quota tiers", len(cfg.AdminGroups), len(cfg.Endpoints), len(cfg.Users), len(cfg.Tiers))
+}
+
+func (cfg EntitlementsConfig) validate() error {
+	for i, tier := range cfg.Tiers {
+		if tier.Name == "" || len(tier.Groups) == 0 {
+			return fmt.Errorf("quota tier %d needs a name and at least one group", i)
+		}
+	}
+	return nil
+}
+
+func (cfg EntitlementsConfig) empty() bool {
+	return len(cfg.AdminGroups) == 0 && len(cfg.Endpoints) == 0 && len(cfg.Users) == 0 && len(cfg.Tiers) == 0 &&
+		cfg.DefaultTier.RequestsPerDay == 0 && cfg.DefaultTier.TokensPerDay == 0 && cfg.DefaultTier.MaxStreams == 0
+}
+
+// setEntitlements installs cfg; an empty configuration turns entitlements
+// off, so no groups are looked up
+func setEntitlements(cfg EntitlementsConfig) {
+	if cfg.empty() {
+		entitlementsConfig.Store(nil)
+		return
+	}
+	if cfg.DefaultTier.Name == "" {
+		cfg.DefaultTier.Name = "default"
+	}
+	entitlementsConfig.Store(&cfg)
+}
+
+// currentEntitlements returns the configuration in effect, empty when
+// entitlements are off
+func currentEntitlements() EntitlementsConfig {
+	if cfg := entitlementsConfig.Load(); cfg != nil {
+		return *cfg
+	}
+	return EntitlementsConfig{}
+}
+
+// userGroups returns the workspace groups of the user, from the cache while
+// it is fresh. A failed lookup falls back to the last known groups, which
+// are kept for GROUP_LOOKUP_BACKOFF so an unavailable workspace API is not
+// asked again on every request.
+func userGroups(identity string) []string {
+	now := time.Now()
+	groupCacheMu.Lock()
+	cached, ok := groupCache[identity]
+	groupCacheMu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.groups
+	}
+
+	groups, err := fetchUserGroups(identity)
+	expires := now.Add(groupCacheTTL)
+	if err != nil {
+		log.Printf("Failed to look up groups of %s: %v", identity, err)
+		groups, expires = cached.groups, now.Add(groupLookupBackoff)
+	}
+	groupCacheMu.Lock()
+	sweepGroupCache(now)
+	groupCache[identity] = cachedGroups{groups: groups, expires: expires}
+	groupCacheMu.Unlock()
+	return groups
+}
+
+// sweepGroupCache forgets groups that expired over a GROUP_CACHE_TTL ago.
+// Recently expired ones are kept to fall back on if their lookup fails.
+// Callers hold groupCacheMu.
+func sweepGroupCache(now time.Time) {
+	for identity, cached := range groupCache {
+		if now.Sub(cached.expires) > groupCacheTTL {
+			delete(groupCache, identity)
+		}
+	}
+}
+
+// invalidateGroupCache forgets the cached groups of identities starting with
+// prefix, so they are looked up again on the next request
+func invalidateGroupCache(prefix string) int {
+	groupCacheMu.Lock()
+	defer groupCacheMu.Unlock()
+	dropped := 0
+	for identity := range groupCache {
+		if strings.HasPrefix(identity, prefix) {
+			delete(groupCache, identity)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// fetchUserGroups asks the workspace SCIM API for the groups of the user
+// with this user name; unknown users have none
+func fetchUserGroups(identity string) ([]string, error) {
+	query := url.Values{
+		"filter":     {fmt.Sprintf("userName eq %q", identity)},
+		"attributes": {"groups"},
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/2.0/preview/scim/v2/Users?%s", databricksHost(), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+databricksToken())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("workspace returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+	}
+	var result struct {
+		Resources []struct {
+			Groups []struct {
+				Display string `json:"display"`
+			} `json:"groups"`
+		} `json:"Resources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, user := range result.Resources {
+		for _, g := range user.Groups {
+			groups = append(groups, g.Display)
+		}
+	}
+	return groups, nil
+}
+
+// entitlementsFor resolves what identity may do. Without ENTITLEMENTS_FILE
+// no groups are looked up and the default tier applies to everyone.
+func entitlementsFor(identity string) Entitlements {
+	ent := Entitlements{Identity: identity, Groups: []string{}, Endpoints: allowedEndpoints(nil)}
+	cfg := entitlementsConfig.Load()
+	if cfg == nil {
+		return ent
+	}
+	ent.Groups = userGroups(identity)
+	member := func(groups []string) bool {
+		for _, g := range groups {
+			for _, ug := range ent.Groups {
+				if strings.EqualFold(g, ug) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	ent.Admin = member(cfg.AdminGroups)
+	var extra []string
+	for group, endpoints := range cfg.Endpoints {
+		if member([]string{group}) {
+			extra = append(extra, endpoints...)
+		}
+	}
+	for user, endpoints := range cfg.Users {
+		if strings.EqualFold(user, identity) {
+			extra = append(extra, endpoints...)
+		}
+	}
+	ent.Endpoints = allowedEndpoints(extra)
+	ent.Tier = cfg.DefaultTier
+	for _, tier := range cfg.Tiers {
+		if member(tier.Groups) {
+			ent.Tier = tier
+			break
+		}
+	}
+	return ent
+}
+
+// allowedEndpoints lists the chat endpoint, COMPARE_ENDPOINTS and extra
+// without duplicates
+func allowedEndpoints(extra []string) []string {
+	seen := map[string]bool{}
+	var endpoints []string
+	for _, e := range append(append([]string{llmEndpoint()}, compareEndpoints...), extra...) {
+		if !seen[e] {
+			seen[e] = true
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// endpointAllowed reports whether identity may send prompts to endpoint,
+// either because everyone may or through one of its groups
+func endpointAllowed(identity, endpoint string) bool {
+	if compareAllowed(endpoint) {
+		return true
+	}
+	for _, e := range entitlementsFor(identity).Endpoints {
+		if e == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// modelFallback reports whether turns asking for a model the user may not
+// use are answered by the chat endpoint
+func modelFallback() bool {
+	cfg := entitlementsConfig.Load()
+	return cfg != nil && cfg.FallbackModel
+}
+
+// inAdminGroup reports whether the forwarded user belongs to an admin group.
+// Requests with a service token are not looked up, as their forwarded
+// headers are not set by the proxy.
+func inAdminGroup(c *gin.Context) bool {
+	if c.GetString(serviceIdentityKey) != "" {
+		return false
+	}
+	email := c.GetHeader("X-Forwarded-Email")
+	if cfg := entitlementsConfig.Load(); cfg == nil || len(cfg.AdminGroups) == 0 || email == "" {
+		return false
+	}
+	return entitlementsFor(email).Admin
+}
+
+type quotaUsage struct {
+	day      string
+	requests int
+	tokens   int
+}
+
+// quotaTracker counts each identity's requests and tokens per UTC day
+type quotaTracker struct {
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+	// day is the last day charged; the usage of earlier days is dropped
+	// when it changes
+	day string
+}
+
+func (q *quotaTracker) current(identity string, now time.Time) quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.usage[identity]
+	if u == nil || u.day != now.UTC().Format("2006-01-02") {
+		return quotaUsage{}
+	}
+	return *u
+}
+
+// charge records one completed request and the tokens it used
+func (q *quotaTracker) charge(identity string, tokens int, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	day := now.UTC().Format("2006-01-02")
+	if day != q.day {
+		for id, u := range q.usage {
+			if u.day != day {
+				delete(q.usage, id)
+			}
+		}
+		q.day = day
+	}
+	u := q.usage[identity]
+	if u == nil || u.day != day {
+		u = &quotaUsage{day: day}
+		q.usage[identity] = u
+	}
+	u.requests++
+	u.tokens += tokens
+}
+
+// QuotaStatus is an identity's use of its tier today
+type QuotaStatus struct {
+	Tier              string    `json:"tier"`
+	RequestsUsed      int       `json:"requests_used"`
+	RequestsRemaining *int      `json:"requests_remaining,omitempty"`
+	TokensUsed        int       `json:"tokens_used"`
+	TokensRemaining   *int      `json:"tokens_remaining,omitempty"`
+	ResetsAt          time.Time `json:"resets_at"`
+}
+
+func quotaStatus(identity string, tier QuotaTier, now time.Time) QuotaStatus {
+	used := quotas.current(identity, now)
+	status := QuotaStatus{
+		Tier:         tier.Name,
+		RequestsUsed: used.requests,
+		TokensUsed:   used.tokens,
+		ResetsAt:     now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour),
+	}
+	remaining := func(limit, used int) *int {
+		if limit <= 0 {
+			return nil
+		}
+		n := limit - used
+		if n < 0 {
+			n = 0
+		}
+		return &n
+	}
+	status.RequestsRemaining = remaining(tier.RequestsPerDay, used.requests)
+	status.TokensRemaining = remaining(tier.TokensPerDay, used.tokens)
+	return status
+}
+
+func (s QuotaStatus) exhausted() bool {
+	return (s.RequestsRemaining != nil && *s.RequestsRemaining == 0) ||
+		(s.TokensRemaining != nil && *s.TokensRemaining == 0)
+}
+
+// rejectOverQuota aborts the request when the caller has used up today's
+// allowance of their tier, and reports whether it did
+func rejectOverQuota(c *gin.Context) bool {
+	if entitlementsConfig.Load() == nil {
+		return false
+	}
+	user := requestUser(c)
+	now := time.Now()
+	tier := entitlementsFor(user).Tier
+	status := quotaStatus(user, tier, now)
+	setQuotaHeaders(c, tier, status, now)
+	if !status.exhausted() {
+		return false
+	}
+	seconds := int(math.Ceil(status.ResetsAt.Sub(now).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Daily quota of the %s tier used up", status.Tier), "retry_after": seconds})
+	return true
+}
+
+// recordAudit stores the record and charges successful calls to the user's
+// quota, warning users who are close to using it up
+func recordAudit(record AuditRecord) {
+	auditStore.Add(record)
+	if entitlementsConfig.Load() != nil && record.StatusCode == http.StatusOK {
+		quotas.charge(record.User, record.PromptTokens+record.CompletionTokens, record.Timestamp)
+		warnQuota(record.User, record.Timestamp)
+	}
+}
+
+// handleGetEntitlements shows callers their groups, endpoints and quota
+func handleGetEntitlements(c *gin.Context) {
+	ent := entitlementsFor(requestUser(c))
+	ent.Admin = ent.Admin || isAdmin(c)
+	c.JSON(http.StatusOK, gin.H{"entitlements": ent, "quota": quotaStatus(ent.Identity, ent.Tier, time.Now())})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Why a conversation was handed to a human
+const (
+	escalationRequested = "requested" // the user's message asked for a person
+	escalationUncertain = "uncertain" // the model's answer showed it could not help
+	escalationManual    = "manual"    // the user pressed the escalate button
+)
+
+// Escalation is a conversation handed over to a human agent. While it is
+// open the model stays out of the conversation, and the user's messages go to
+// the agents instead.
+type Escalation struct {
+	ConversationID string     `json:"conversation_id"`
+	User           string     `json:"user"`
+	Status         string     `json:"status"` // open, resolved
+	Reason         string     `json:"reason"`
+	Trigger        string     `json:"trigger,omitempty"` // the text that matched a trigger pattern
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy     string     `json:"resolved_by,omitempty"`
+	Agent          string     `json:"agent,omitempty"` // the agent who claimed it
+	ClaimedAt      *time.Time `json:"claimed_at,omitempty"`
+	Unread         int        `json:"unread"` // user messages the agents have not read yet
+}
+
+// EscalationEvent is posted to ESCALATION_WEBHOOK_URL as an escalation
+// progresses
+type EscalationEvent struct {
+	Type       string     `json:"type"` // conversation.escalated, .claimed, .message, .reply, .resolved
+	Escalation Escalation `json:"escalation"`
+	Message    *Message   `json:"message,omitempty"`
+}
+
+var (
+	escalationEnabled          bool
+	escalationRequestPattern   *regexp.Regexp
+	escalationUncertainPattern *regexp.Regexp
+	escalationMessage          string
+	escalationWebhookURL       string
+	escalationSlackURL         string
+
+	escalationsMu sync.Mutex
+	escalations   = map[string]*Escalation{}
+
+	escalationsTotal *counterVec
+)
+
+const (
+	defaultEscalationRequestPattern   = `(?i)\b(talk|speak|chat)\s+(to|with)\s+(a\s+|an\s+)?(human|person|agent|someone|representative)\b|\b(real|live)\s+(person|human|agent)\b`
+	defaultEscalationUncertainPattern = `(?i)\b(I'?m not sure|I am not sure|I don'?t know|I do not know|I can'?t help with|I cannot help with|I'?m unable to help)\b`
+)
+
+// configureEscalation reads the handoff settings. With ESCALATION_ENABLED,
+// a message matching ESCALATION_REQUEST_PATTERN or an answer matching
+// ESCALATION_UNCERTAIN_PATTERN hands the conversation to an agent; either
+// pattern can be set to off to turn that trigger off.
+func configureEscalation() {
+	escalationEnabled = envBool("ESCALATION_ENABLED", false)
+	escalationRequestPattern = escalationPattern("ESCALATION_REQUEST_PATTERN", defaultEscalationRequestPattern)
+	escalationUncertainPattern = escalationPattern("ESCALATION_UNCERTAIN_PATTERN", defaultEscalationUncertainPattern)
+	escalationMessage = envString("ESCALATION_MESSAGE", "I've asked a member of our support team to join this conversation. They will reply here.")
+	escalationWebhookURL = envString("ESCALATION_WEBHOOK_URL", "")
+	escalationSlackURL = envString("ESCALATION_SLACK_WEBHOOK_URL", "")
+	escalationsTotal = newCounterVec("chatbot_escalations_total", "Conversations handed to a human agent", "reason")
+	registerGaugeFunc("chatbot_escalations_open", "Conversations waiting for or with a human agent", func() float64 {
+		escalationsMu.Lock()
+		defer escalationsMu.Unlock()
+		open := 0
+		for _, e := range escalations {
+			if e.Status == "open" {
+				open++
+			}
+		}
+		return float64(open)
+	})
+}
+
+func escalationPattern(key, def string) *regexp.Regexp {
+	raw := envString(key, def)
+	if raw == "off" {
+		return nil
+	}
+	re, err := regexp.Compile(raw)
+	if err != nil {
+		configWarn("invalid %s: %v; using the default", key, err)
+		return regexp.MustCompile(def)
+	}
+	return re
+}
+
+// openEscalation returns the conversation's escalation while it is open
+func openEscalation(id string) (Escalation, bool) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	e, ok := escalations[id]
+	if !ok || e.Status != "open" {
+		return Escalation{}, false
+	}
+	return *e, true
+}
+
+// escalationOf returns the conversation's latest escalation, if it had one
+func escalationOf(id string) *Escalation {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	if e, ok := escalations[id]; ok {
+		copied := *e
+		return &copied
+	}
+	return nil
+}
+
+// escalate hands a conversation to the agents, or returns the escalation
+// already open for it
+func escalate(conv Conversation, reason, trigger string) Escalation {
+	now := time.Now()
+	escalationsMu.Lock()
+	if e, ok := escalations[conv.ID]; ok && e.Status == "open" {
+		escalationsMu.Unlock()
+		return *e
+	}
+	e := &Escalation{ConversationID: conv.ID, User: conv.User, Status: "open", Reason: reason, Trigger: trigger, CreatedAt: now, UpdatedAt: now}
+	if reason != escalationManual {
+		// The message that triggered it is waiting for an agent
+		e.Unread = 1
+	}
+	escalations[conv.ID] = e
+	escalated := *e
+	escalationsMu.Unlock()
+
+	escalationsTotal.inc(reason)
+	log.Printf("Conversation %s escalated to an agent (%s)", conv.ID, reason)
+	publishEscalation(EscalationEvent{Type: "conversation.escalated", Escalation: escalated})
+	if escalationSlackURL != "" {
+		text := fmt.Sprintf(":raising_hand: Conversation `%s` with %s needs an agent (%s)", conv.ID, conv.User, reason)
+		if last := lastUserMessage(conv); last != "" {
+			text += "\n> " + strings.ReplaceAll(last, "\n", "\n> ")
+		}
+		go postJSON(escalationSlackURL, map[string]string{"text": text})
+	}
+	return escalated
+}
+
+func lastUserMessage(conv Conversation) string {
+	for i := len(conv.Messages) - 1; i >= 0; i-- {
+		if conv.Messages[i].Role == "user" {
+			return conv.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+func publishEscalation(event EscalationEvent) {
+	if escalationWebhookURL != "" {
+		go postJSON(escalationWebhookURL, event)
+	}
+}
+
+// touchEscalation marks the escalation updated, counting unread user
+// messages, and returns it
+func touchEscalation(id string, unread int) (Escalation, bool) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	e, ok := escalations[id]
+	if !ok {
+		return Escalation{}, false
+	}
+	e.UpdatedAt = time.Now()
+	e.Unread += unread
+	return *e, true
+}
+
+// escalateChat answers a chat turn without the model when the conversation is
+// with an agent, or hands it to one when the user asks for a person. It
+// reports whether it wrote the response.
+func escalateChat(c *gin.Context, conv Conversation, req ChatRequest, stream bool) bool {
+	if !escalationEnabled || conv.ID == "" {
+		return false
+	}
+	var answer, waiting *Message
+	e, open := openEscalation(conv.ID)
+	if open {
+		// The agents get the message; nobody answers until one replies
+		prompt := Message{ID: newID(), Role: "user", Content: req.Message, CreatedAt: time.Now(), Status: messageSent, Tables: req.tables}
+		conversationStore.Update(conv.ID, func(conv *Conversation) {
+			conv.Messages = append(conv.Messages, prompt)
+		})
+		e, _ = touchEscalation(conv.ID, 1)
+		publishEscalation(EscalationEvent{Type: "conversation.message", Escalation: e, Message: &prompt})
+		waiting = &prompt
+	} else {
+		if escalationRequestPattern == nil {
+			return false
+		}
+		trigger := escalationRequestPattern.FindString(req.Message)
+		if trigger == "" {
+			return false
+		}
+		answer = &Message{ID: newID(), Content: escalationMessage}
+		recordTurn(conv, req, "", *answer)
+		conv.Messages = append(conv.Messages, Message{Role: "user", Content: req.Message})
+		e = escalate(conv, escalationRequested, trigger)
+	}
+
+	if !stream {
+		resp := ChatResponse{ConversationID: conv.ID, Escalation: &e}
+		if answer != nil {
+			resp.Content, resp.MessageID = answer.Content, answer.ID
+		}
+		c.JSON(http.StatusOK, resp)
+		return true
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+	out := newStreamBuffer(c)
+	defer out.close()
+	start := gin.H{"conversation_id": conv.ID}
+	if answer != nil {
+		start["message_id"] = answer.ID
+	}
+	if waiting != nil {
+		start["prompt_id"] = waiting.ID
+	}
+	out.send("start", start)
+	if waiting != nil {
+		out.send("status", gin.H{"message_id": waiting.ID, "status": waiting.Status})
+	}
+	if answer != nil {
+		out.send("delta", gin.H{"content": answer.Content})
+	}
+	out.send("escalated", e)
+	out.send("done", gin.H{"prompt_tokens": 0, "completion_tokens": 0})
+	return true
+}
+
+// escalateUncertain hands the conversation to an agent when the model's
+// answer shows it could not help, returning the escalation
+func escalateUncertain(conv Conversation, answer string) *Escalation {
+	if !escalationEnabled || escalationUncertainPattern == nil || conv.ID == "" {
+		return nil
+	}
+	trigger := escalationUncertainPattern.FindString(answer)
+	if trigger == "" {
+		return nil
+	}
+	if latest, ok := conversationStore.Get(conv.ID); ok {
+		conv = latest
+	}
+	e := escalate(conv, escalationUncertain, trigger)
+	return &e
+}
+
+// handleEscalateConversation lets the user ask for a person directly
+func handleEscalateConversation(c *gin.Context) {
+	if !escalationEnabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Escalation is not enabled"})
+		return
+	}
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, escalate(conv, escalationManual, ""))
+}
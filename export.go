@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NotebookExportRequest represents a conversation to be exported as a notebook
+type NotebookExportRequest struct {
+	Title      string        `json:"title"`
+	Language   string        `json:"language"`
+	Messages   []ChatMessage `json:"messages" binding:"required,min=1"`
+	ImportPath string        `json:"import_path"`
+}
+
+// Notebook is the subset of the nbformat v4 document we generate
+type Notebook struct {
+	Cells         []NotebookCell         `json:"cells"`
+	Metadata      map[string]interface{} `json:"metadata"`
+	NBFormat      int                    `json:"nbformat"`
+	NBFormatMinor int                    `json:"nbformat_minor"`
+}
+
+// NotebookCell represents a single markdown or code cell
+type NotebookCell struct {
+	CellType       string                 `json:"cell_type"`
+	Metadata       map[string]interface{} `json:"metadata"`
+	Source         []string               `json:"source"`
+	ExecutionCount *int                   `json:"execution_count,omitempty"`
+	Outputs        []interface{}          `json:"outputs,omitempty"`
+}
+
+var codeFencePattern = regexp.MustCompile("(?s)```([A-Za-z0-9_+-]*)[^\\n]*\\n(.*?)```")
+
+// Languages Databricks can run in a cell of another language via a magic command
+var notebookMagics = map[string]string{
+	"python": "%python",
+	"py":     "%python",
+	"sql":    "%sql",
+	"scala":  "%scala",
+	"r":      "%r",
+	"sh":     "%sh",
+	"bash":   "%sh",
+	"shell":  "%sh",
+}
+
+func handleNotebookExport(c *gin.Context) {
+	var req NotebookExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Title == "" {
+		req.Title = "Chat Conversation"
+	}
+	if req.Language == "" {
+		req.Language = "python"
+	}
+	req.Language = strings.ToLower(req.Language)
+
+	notebook := buildNotebook(req.Title, req.Language, req.Messages)
+	content, err := json.MarshalIndent(notebook, "", " ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build notebook"})
+		return
+	}
+
+	if req.ImportPath == "" && len(content) > artifactInlineMax {
+		url, expires, err := storeArtifact(content, ".ipynb")
+		if err != nil {
+			log.Printf("Failed to store notebook artifact: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store notebook"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"url": url, "expires_at": expires, "size": len(content)})
+		return
+	}
+
+	if req.ImportPath == "" {
+		filename := notebookFilename(req.Title)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		c.Data(http.StatusOK, "application/x-ipynb+json", content)
+		return
+	}
+
+	if err := importWorkspaceNotebook(req.ImportPath, content); err != nil {
+		log.Printf("Failed to import notebook to %s: %v", req.ImportPath, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to import notebook into workspace"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path": req.ImportPath,
+		"url":  fmt.Sprintf("https://%s/#workspace%s", databricksHost(), req.ImportPath),
+	})
+}
+
+// buildNotebook turns user questions into markdown cells and splits assistant
+// answers into markdown and runnable code cells
+func buildNotebook(title, language string, messages []ChatMessage) Notebook {
+	cells := []NotebookCell{markdownCell("# " + title)}
+
+	for _, msg := range messages {
+		switch msg.Role {
+		case "user":
+			cells = append(cells, markdownCell("### Question\n\n"+msg.Content))
+		case "assistant":
+			cells = append(cells, answerCells(language, msg.Content)...)
+		default:
+			cells = append(cells, markdownCell(fmt.Sprintf("_%s:_ %s", msg.Role, msg.Content)))
+		}
+	}
+
+	return Notebook{
+		Cells: cells,
+		Metadata: map[string]interface{}{
+			"language_info": map[string]string{"name": language},
+			"application/vnd.databricks.v1+notebook": map[string]string{
+				"notebookName": title,
+				"language":     language,
+			},
+		},
+		NBFormat:      4,
+		NBFormatMinor: 5,
+	}
+}
+
+func answerCells(language, content string) []NotebookCell {
+	var cells []NotebookCell
+	last := 0
+
+	for _, match := range codeFencePattern.FindAllStringSubmatchIndex(content, -1) {
+		if text := strings.TrimSpace(content[last:match[0]]); text != "" {
+			cells = append(cells, markdownCell(text))
+		}
+
+		lang := strings.ToLower(content[match[2]:match[3]])
+		code := strings.TrimRight(content[match[4]:match[5]], "\n")
+		if magic, ok := notebookMagics[lang]; ok && notebookMagics[language] != magic {
+			code = magic + "\n" + code
+		} else if !ok && lang != "" {
+			// Code in a language the notebook can't run stays readable as markdown
+			cells = append(cells, markdownCell(content[match[0]:match[1]]))
+			last = match[1]
+			continue
+		}
+		cells = append(cells, codeCell(code))
+		last = match[1]
+	}
+
+	if text := strings.TrimSpace(content[last:]); text != "" {
+		cells = append(cells, markdownCell(text))
+	}
+	return cells
+}
+
+func markdownCell(text string) NotebookCell {
+	return NotebookCell{CellType: "markdown", Metadata: map[string]interface{}{}, Source: splitSource(text)}
+}
+
+func codeCell(code string) NotebookCell {
+	return NotebookCell{
+		CellType: "code",
+		Metadata: map[string]interface{}{},
+		Source:   splitSource(code),
+		Outputs:  []interface{}{},
+	}
+}
+
+// splitSource keeps line endings, as nbformat expects for multi-line sources
+func splitSource(text string) []string {
+	return strings.SplitAfter(text, "\n")
+}
+
+func notebookFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, title)
+	return name + ".ipynb"
+}
+
+func importWorkspaceNotebook(path string, content []byte) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"path":      path,
+		"format":    "JUPYTER",
+		"content":   base64.StdEncoding.EncodeToString(content),
+		"overwrite": true,
+	})
+	if err != nil {
+		return err
+	}
+
+	requestURL := fmt.Sprintf("https://%s/api/2.0/workspace/import", databricksHost())
+	httpReq, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", databricksToken()))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("workspace import returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// knownFeatures can be switched off without a redeploy; all are on by default
+var knownFeatures = []string{"streaming", "tools", "rag", "compare", "batch", "load_test", "cache", "semantic_cache", "charts"}
+
+var (
+	featuresMu sync.RWMutex
+	features   = map[string]bool{}
+)
+
+func validateFeatures(flags map[string]bool) error {
+	for name := range flags {
+		known := false
+		for _, f := range knownFeatures {
+			known = known || f == name
+		}
+		if !known {
+			return fmt.Errorf("unknown feature %s (known: %v)", name, knownFeatures)
+		}
+	}
+	return nil
+}
+
+// currentFeatures lists every known feature with its state
+func currentFeatures() map[string]bool {
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+	flags := map[string]bool{}
+	for _, f := range knownFeatures {
+		enabled, ok := features[f]
+		flags[f] = enabled || !ok
+	}
+	return flags
+}
+
+func setFeatures(flags map[string]bool) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	features = flags
+}
+
+// featureEnabled reports whether the feature's flag is on and no kill switch
+// has turned it off
+func featureEnabled(name string) bool {
+	if featureKilled(name) {
+		return false
+	}
+	featuresMu.RLock()
+	defer featuresMu.RUnlock()
+	enabled, ok := features[name]
+	return enabled || !ok
+}
+
+// requireFeature rejects requests to a route whose feature is switched off
+func requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !featureEnabled(name) {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": fmt.Sprintf("The %s feature is disabled", name)})
+			return
+		}
+		c.Next()
+	}
+}
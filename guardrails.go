@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+)
+
+// GuardrailRule blocks prompts or answers matching a pattern
+type GuardrailRule struct {
+	Name      string `json:"name"`
+	Pattern   string `json:"pattern"`
+	AppliesTo string `json:"applies_to"` // input, output or both
+	Message   string `json:"message,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// GuardrailViolation describes the rule a piece of text tripped
+type GuardrailViolation struct {
+	Rule    string `json:"rule"`
+	Stage   string `json:"stage"`
+	Message string `json:"message"`
+}
+
+const defaultPolicyMessage = "This content was blocked by the usage policy."
+
+// Rules used when GUARDRAILS_FILE is not set
+var defaultGuardrailRules = []GuardrailRule{
+	{Name: "prompt_injection", Pattern: jailbreakPattern.String(), AppliesTo: "input", Message: "Requests to override the assistant's instructions are not allowed."},
+	{Name: "credential_leak", Pattern: `(?i)\b(dapi[0-9a-f]{32}|AKIA[0-9A-Z]{16}|ghp_[0-9A-Za-z]{36}|xox[bp]-[0-9A-Za-z-]{10,}|-----BEGIN [A-Z ]*PRIVATE KEY-----)`, AppliesTo: "both", Message: "Content containing credentials was blocked."},
+}
+
+var guardrailRules []GuardrailRule
+
+func configureGuardrails() {
+	rules := defaultGuardrailRules
+	if path := envString("GUARDRAILS_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &rules)
+		}
+		if err != nil {
+			configWarn("failed to load guardrails from %s, using defaults: %v", path, err)
+			rules = defaultGuardrailRules
+		}
+	}
+
+	guardrailRules = nil
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			configWarn("skipping guardrail %s with invalid pattern: %v", rule.Name, err)
+			continue
+		}
+		if rule.AppliesTo == "" {
+			rule.AppliesTo = "both"
+		}
+		if rule.Message == "" {
+			rule.Message = defaultPolicyMessage
+		}
+		rule.re = re
+		guardrailRules = append(guardrailRules, rule)
+	}
+}
+
+// checkGuardrails returns the first rule for the stage ("input" or "output")
+// that matches text, or nil if the text is allowed
+func checkGuardrails(stage, text string) *GuardrailViolation {
+	for _, rule := range guardrailRules {
+		if rule.AppliesTo != stage && rule.AppliesTo != "both" {
+			continue
+		}
+		if rule.re.MatchString(text) {
+			return &GuardrailViolation{Rule: rule.Name, Stage: stage, Message: rule.Message}
+		}
+	}
+	return checkPluginGuardrails(stage, text)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	hedgeEndpoint string
+	hedgeDelay    time.Duration
+
+	hedgedRequests *counterVec
+)
+
+func configureHedging() {
+	hedgeEndpoint = envString("HEDGE_ENDPOINT", "")
+	hedgeDelay = envDuration("HEDGE_DELAY", time.Second)
+	hedgedRequests = newCounterVec("chatbot_hedged_requests_total", "Hedged chat requests by which attempt answered", "winner")
+}
+
+// upstreamAttempt is the outcome of one call
+type upstreamAttempt struct {
+	endpoint string
+	resp     *http.Response
+	err      error
+}
+
+func (a upstreamAttempt) answered() bool {
+	return a.err == nil && a.resp.StatusCode == http.StatusOK
+}
+
+// sendChat posts payload to endpoint and returns the response and the
+// endpoint that gave it. With HEDGE_ENDPOINT set and hedge true, a call that
+// has not answered within HEDGE_DELAY, or has already failed, is raced
+// against the same payload on HEDGE_ENDPOINT; the first complete answer wins
+// and the other call is cancelled.
+func sendChat(endpoint string, payload *ChatPayload, hedge bool) (*http.Response, string, error) {
+	if !hedge || hedgeEndpoint == "" || hedgeEndpoint == endpoint {
+		a := callUpstream(context.Background(), endpoint, payload, false)
+		return a.resp, endpoint, a.err
+	}
+
+	results := make(chan upstreamAttempt, 2)
+	primaryCtx, cancelPrimary := context.WithCancel(context.Background())
+	defer cancelPrimary()
+	hedgeCtx, cancelHedge := context.WithCancel(context.Background())
+	defer cancelHedge()
+	go func() { results <- callUpstream(primaryCtx, endpoint, payload, true) }()
+
+	timer := time.NewTimer(hedgeDelay)
+	defer timer.Stop()
+	startHedge := func() {
+		timer.Stop()
+		go func() { results <- callUpstream(hedgeCtx, hedgeEndpoint, payload, true) }()
+	}
+
+	var primary *upstreamAttempt
+	pending, hedged := 1, false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			log.Printf("No answer from %s after %s, hedging with %s", endpoint, hedgeDelay, hedgeEndpoint)
+			startHedge()
+			pending, hedged = pending+1, true
+		case a := <-results:
+			pending--
+			if a.answered() {
+				winner := "primary"
+				switch {
+				case !hedged:
+					winner = "unhedged"
+				case a.endpoint == hedgeEndpoint:
+					winner = "hedge"
+				}
+				hedgedRequests.inc(winner)
+				return a.resp, a.endpoint, nil
+			}
+			if a.endpoint == endpoint {
+				primary = &a
+				if !hedged {
+					log.Printf("Call to %s failed, falling back to %s", endpoint, hedgeEndpoint)
+					startHedge()
+					pending, hedged = pending+1, true
+				}
+			}
+		}
+	}
+	hedgedRequests.inc("failed")
+	return primary.resp, endpoint, primary.err
+}
+
+// callUpstream makes one chat call. When racing, the body is read before
+// returning, so an answer still arriving does not count as complete,
+// cancelling the race cannot cut it short, and a late loser is not left
+// holding its connection.
+func callUpstream(ctx context.Context, endpoint string, payload *ChatPayload, racing bool) upstreamAttempt {
+	a := upstreamAttempt{endpoint: endpoint}
+	httpReq, err := newUpstreamRequest(ctx, endpoint, payload)
+	if err != nil {
+		a.err = err
+		return a
+	}
+	log.Printf("Payload: %d messages, %d bytes to %s", len(payload.Messages), httpReq.ContentLength, endpoint)
+
+	start := time.Now()
+	a.resp, a.err = httpReq.do(upstreamClient)
+	if a.err != nil {
+		return a
+	}
+	pool.observe(a.resp.StatusCode, time.Since(start))
+	if racing {
+		body, err := io.ReadAll(io.LimitReader(a.resp.Body, maxResponseBody))
+		closeBody(a.resp.Body)
+		a.resp.Body, a.err = io.NopCloser(bytes.NewReader(body)), err
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendChatHedging(t *testing.T) {
+	endpoint, delay, client, previousHost := hedgeEndpoint, hedgeDelay, upstreamClient, databricksHost()
+	t.Cleanup(func() {
+		hedgeEndpoint, hedgeDelay, upstreamClient = endpoint, delay, client
+		setDatabricksHost(previousHost)
+	})
+	hedgeEndpoint, hedgeDelay = "fallback", 200*time.Millisecond
+
+	// reply is how an endpoint answers: after a delay, with a status
+	type reply struct {
+		after  time.Duration
+		status int
+	}
+	tests := []struct {
+		name     string
+		hedge    bool
+		primary  reply
+		fallback reply
+		// want is the endpoint whose answer is returned, and status its code
+		want       string
+		status     int
+		wantHedged bool
+	}{
+		{name: "fast primary", hedge: true, primary: reply{0, 200}, fallback: reply{0, 200}, want: "primary", status: 200},
+		{name: "slow primary is hedged", hedge: true, primary: reply{2 * time.Second, 200}, fallback: reply{0, 200}, want: "fallback", status: 200, wantHedged: true},
+		{name: "slow primary still wins against a slower hedge", hedge: true, primary: reply{400 * time.Millisecond, 200}, fallback: reply{2 * time.Second, 200}, want: "primary", status: 200, wantHedged: true},
+		{name: "failed primary falls back at once", hedge: true, primary: reply{0, 500}, fallback: reply{0, 200}, want: "fallback", status: 200, wantHedged: true},
+		{name: "both failing returns the primary's answer", hedge: true, primary: reply{0, 503}, fallback: reply{0, 500}, want: "primary", status: 503, wantHedged: true},
+		{name: "hedging off", hedge: false, primary: reply{150 * time.Millisecond, 200}, fallback: reply{0, 200}, want: "primary", status: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			called := map[string]bool{}
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Reading the body lets the server notice a cancelled call
+				io.Copy(io.Discard, r.Body)
+				name := strings.Split(r.URL.Path, "/")[2]
+				mu.Lock()
+				called[name] = true
+				mu.Unlock()
+				rep := tt.primary
+				if name == "fallback" {
+					rep = tt.fallback
+				}
+				select {
+				case <-time.After(rep.after):
+				case <-r.Context().Done():
+					return
+				}
+				w.WriteHeader(rep.status)
+				io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"`+name+`"}}]}`)
+			}))
+			defer server.Close()
+			upstreamClient = server.Client()
+			setDatabricksHost(strings.TrimPrefix(server.URL, "https://"))
+
+			payload := &ChatPayload{Messages: []ChatMessage{{Role: "user", Content: "hello"}}}
+			resp, answeredBy, err := sendChat("primary", payload, tt.hedge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if answeredBy != tt.want || resp.StatusCode != tt.status || !strings.Contains(string(body), `"content":"`+tt.want+`"`) {
+				t.Fatalf("answered by %s with %d %s, want %s with %d", answeredBy, resp.StatusCode, body, tt.want, tt.status)
+			}
+			mu.Lock()
+			hedged := called["fallback"]
+			mu.Unlock()
+			if hedged != tt.wantHedged {
+				t.Fatalf("hedged = %v, want %v", hedged, tt.wantHedged)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpMetricLabels are the labels of the per-route request metrics
+var httpMetricLabels = []string{"method", "route", "status"}
+
+// httpLatencyBuckets in seconds, reaching past the upstream timeout for chat
+var httpLatencyBuckets = []float64{0.005, 0.025, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	httpRequests      *counterVec
+	httpLatency       *histogramVec
+	httpMetricsLabels []string
+)
+
+// configureHTTPMetrics sets up request metrics labelled by route template,
+// never the raw path, so IDs in URLs do not create new series.
+// METRICS_DROP_LABELS removes labels entirely when even that is too many.
+func configureHTTPMetrics() {
+	drop := map[string]bool{}
+	for _, name := range envList("METRICS_DROP_LABELS") {
+		known := false
+		for _, l := range httpMetricLabels {
+			known = known || l == name
+		}
+		if !known {
+			configWarn("METRICS_DROP_LABELS: unknown label %q", name)
+		}
+		drop[name] = true
+	}
+	httpMetricsLabels = nil
+	for _, l := range httpMetricLabels {
+		if !drop[l] {
+			httpMetricsLabels = append(httpMetricsLabels, l)
+		}
+	}
+	httpRequests = newCounterVec("chatbot_http_requests_total", "HTTP requests by route template", httpMetricsLabels...)
+	httpLatency = newHistogramVec("chatbot_http_request_duration_seconds", "HTTP request latency by route template", httpLatencyBuckets, httpMetricsLabels...)
+}
+
+// routeTemplate is the pattern the request matched, such as
+// /api/conversations/:id; unmatched paths share one label value
+func routeTemplate(c *gin.Context) string {
+	if route := c.FullPath(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+func httpMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		values := make([]string, 0, len(httpMetricsLabels))
+		for _, l := range httpMetricsLabels {
+			switch l {
+			case "method":
+				values = append(values, c.Request.Method)
+			case "route":
+				values = append(values, routeTemplate(c))
+			case "status":
+				values = append(values, strconv.Itoa(c.Writer.Status()))
+			}
+		}
+		httpRequests.inc(values...)
+		httpLatency.observe(time.Since(start).Seconds(), values...)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AgentPresence is whether a support agent is around to take conversations
+type AgentPresence struct {
+	Agent    string    `json:"agent"`
+	Status   string    `json:"status"` // online, away, offline
+	LastSeen time.Time `json:"last_seen"`
+	Claimed  int       `json:"claimed"` // open escalations the agent has claimed
+}
+
+var (
+	agentUsers            []string
+	agentPresenceTimeout  time.Duration
+	agentPresenceStatuses = map[string]bool{"online": true, "away": true, "offline": true}
+
+	presenceMu    sync.Mutex
+	agentPresence = map[string]*AgentPresence{}
+)
+
+// configureInbox reads AGENT_USERS, who besides the admins may work the
+// escalation inbox, and AGENT_PRESENCE_TIMEOUT, after which an agent that
+// made no request is shown offline
+func configureInbox() {
+	agentUsers = envList("AGENT_USERS")
+	agentPresenceTimeout = envDuration("AGENT_PRESENCE_TIMEOUT", 2*time.Minute)
+	registerGaugeFunc("chatbot_agents_online", "Support agents currently online", func() float64 {
+		online := 0
+		for _, p := range agentPresenceList() {
+			if p.Status == "online" {
+				online++
+			}
+		}
+		return float64(online)
+	})
+}
+
+// requireAgent rejects requests from anyone who is neither in AGENT_USERS
+// nor an admin, and records the agent as seen
+func requireAgent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := requestUser(c)
+		if !isAgent(c) {
+			accessDenied(c, authAgent, user, "not an agent")
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Agent access required"})
+			return
+		}
+		seeAgent(user)
+		c.Next()
+	}
+}
+
+func isAgent(c *gin.Context) bool {
+	email := c.GetHeader("X-Forwarded-Email")
+	username := c.GetHeader("X-Forwarded-Preferred-Username")
+	for _, user := range agentUsers {
+		if (email != "" && strings.EqualFold(user, email)) || (username != "" && strings.EqualFold(user, username)) {
+			return true
+		}
+	}
+	return isAdmin(c)
+}
+
+// seeAgent marks the agent active, online unless they said otherwise
+func seeAgent(agent string) {
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	p, ok := agentPresence[agent]
+	if !ok {
+		p = &AgentPresence{Agent: agent, Status: "online"}
+		agentPresence[agent] = p
+	}
+	p.LastSeen = time.Now()
+}
+
+// agentPresenceList returns every agent seen since the start, shown offline
+// once they have been quiet for longer than the timeout
+func agentPresenceList() []AgentPresence {
+	claimed := map[string]int{}
+	escalationsMu.Lock()
+	for _, e := range escalations {
+		if e.Status == "open" && e.Agent != "" {
+			claimed[e.Agent]++
+		}
+	}
+	escalationsMu.Unlock()
+
+	now := time.Now()
+	presenceMu.Lock()
+	out := make([]AgentPresence, 0, len(agentPresence))
+	for _, p := range agentPresence {
+		shown := *p
+		if now.Sub(p.LastSeen) > agentPresenceTimeout {
+			shown.Status = "offline"
+		}
+		shown.Claimed = claimed[p.Agent]
+		out = append(out, shown)
+	}
+	presenceMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Agent < out[j].Agent })
+	return out
+}
+
+func handleListAgentPresence(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"agents": agentPresenceList()})
+}
+
+// handleSetAgentPresence sets the caller's status. An agent who goes away or
+// offline keeps their claims.
+func handleSetAgentPresence(c *gin.Context) {
+	var req struct {
+		Status string `json:"status" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !agentPresenceStatuses[req.Status] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be online, away or offline"})
+		return
+	}
+	agent := requestUser(c)
+	presenceMu.Lock()
+	agentPresence[agent].Status = req.Status
+	presenceMu.Unlock()
+	for _, p := range agentPresenceList() {
+		if p.Agent == agent {
+			c.JSON(http.StatusOK, p)
+			return
+		}
+	}
+}
+
+// handleAgentInbox lists escalations, oldest first: the open ones by default,
+// or those with the given status or all of them. With mine=true only the
+// caller's claims are listed, with unclaimed=true only those nobody took.
+func handleAgentInbox(c *gin.Context) {
+	agent := requestUser(c)
+	status := c.DefaultQuery("status", "open")
+	mine := c.Query("mine") == "true"
+	unclaimed := c.Query("unclaimed") == "true"
+	escalationsMu.Lock()
+	out := []Escalation{}
+	unread := 0
+	for _, e := range escalations {
+		if status != "all" && e.Status != status {
+			continue
+		}
+		if (mine && e.Agent != agent) || (unclaimed && e.Agent != "") {
+			continue
+		}
+		out = append(out, *e)
+		unread += e.Unread
+	}
+	escalationsMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{"escalations": out, "unread": unread})
+}
+
+// agentEscalation returns the open escalation with the id in the path when
+// the caller may work it, either because they claimed it or nobody has, or
+// writes the error and returns nil; escalationsMu must be held
+func agentEscalation(c *gin.Context) *Escalation {
+	e, ok := escalations[c.Param("id")]
+	if !ok || e.Status != "open" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation is not escalated"})
+		return nil
+	}
+	if e.Agent != "" && e.Agent != requestUser(c) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Conversation was claimed by " + e.Agent})
+		return nil
+	}
+	return e
+}
+
+// claimLocked assigns the escalation to the agent, reporting whether it was
+// newly claimed; escalationsMu must be held
+func claimLocked(e *Escalation, agent string) bool {
+	if e.Agent == agent {
+		return false
+	}
+	now := time.Now()
+	e.Agent, e.ClaimedAt, e.UpdatedAt = agent, &now, now
+	return true
+}
+
+// handleGetAgentConversation returns an escalated conversation with its
+// escalation. It counts as read when the caller is the one who claimed it,
+// or nobody has yet.
+func handleGetAgentConversation(c *gin.Context) {
+	id := c.Param("id")
+	conv, ok := conversationStore.Get(id)
+	if !ok {
+		conversationNotFound(c, id)
+		return
+	}
+	agent := requestUser(c)
+	escalationsMu.Lock()
+	e, ok := escalations[id]
+	if !ok {
+		escalationsMu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation was not escalated"})
+		return
+	}
+	read := e.Agent == "" || e.Agent == agent
+	if read {
+		e.Unread = 0
+	}
+	shown := *e
+	escalationsMu.Unlock()
+	if read && markRead(id, "user", "") > 0 {
+		conv, _ = conversationStore.Get(id)
+	}
+	c.JSON(http.StatusOK, struct {
+		Conversation
+		Escalation Escalation `json:"escalation"`
+	}{conv, shown})
+}
+
+func handleMarkEscalationRead(c *gin.Context) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	e := agentEscalation(c)
+	if e == nil {
+		return
+	}
+	e.Unread = 0
+	markRead(e.ConversationID, "user", "")
+	c.JSON(http.StatusOK, *e)
+}
+
+// handleClaimEscalation assigns an open escalation to the caller. A claim
+// held by another agent has to be released first.
+func handleClaimEscalation(c *gin.Context) {
+	escalationsMu.Lock()
+	e := agentEscalation(c)
+	if e == nil {
+		escalationsMu.Unlock()
+		return
+	}
+	claimed := claimLocked(e, requestUser(c))
+	shown := *e
+	escalationsMu.Unlock()
+
+	if claimed {
+		publishEscalation(EscalationEvent{Type: "conversation.claimed", Escalation: shown})
+	}
+	c.JSON(http.StatusOK, shown)
+}
+
+// handleReleaseEscalation gives the caller's claim back to the inbox
+func handleReleaseEscalation(c *gin.Context) {
+	escalationsMu.Lock()
+	defer escalationsMu.Unlock()
+	e := agentEscalation(c)
+	if e == nil {
+		return
+	}
+	e.Agent, e.ClaimedAt, e.UpdatedAt = "", nil, time.Now()
+	c.JSON(http.StatusOK, *e)
+}
+
+// handleAgentReply relays an agent's reply to the user, claiming the
+// conversation when nobody has. The reply is stored as an assistant message
+// naming the agent, so the model sees it once the conversation is handed
+// back, and marks the conversation read.
+func handleAgentReply(c *gin.Context) {
+	var req struct {
+		Message string `json:"message" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, agent := c.Param("id"), requestUser(c)
+	escalationsMu.Lock()
+	e := agentEscalation(c)
+	if e == nil {
+		escalationsMu.Unlock()
+		return
+	}
+	claimed := claimLocked(e, agent)
+	e.Unread = 0
+	shown := *e
+	escalationsMu.Unlock()
+	if claimed {
+		publishEscalation(EscalationEvent{Type: "conversation.claimed", Escalation: shown})
+	}
+
+	markRead(id, "user", "")
+	reply := Message{ID: newID(), Role: "assistant", Content: req.Message, CreatedAt: time.Now(), Agent: agent, Status: messageCompleted}
+	if !conversationStore.Update(id, func(conv *Conversation) {
+		conv.Messages = append(conv.Messages, reply)
+	}) {
+		conversationNotFound(c, id)
+		return
+	}
+	shown, _ = touchEscalation(id, 0)
+	publishEscalation(EscalationEvent{Type: "conversation.reply", Escalation: shown, Message: &reply})
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleResolveEscalation hands the conversation back to the model. The body
+// may carry a closing message for the user.
+func handleResolveEscalation(c *gin.Context) {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, agent := c.Param("id"), requestUser(c)
+	escalationsMu.Lock()
+	e := agentEscalation(c)
+	if e == nil {
+		escalationsMu.Unlock()
+		return
+	}
+	now := time.Now()
+	claimLocked(e, agent)
+	e.Status, e.UpdatedAt, e.ResolvedAt, e.ResolvedBy, e.Unread = "resolved", now, &now, agent, 0
+	resolved := *e
+	escalationsMu.Unlock()
+
+	event := EscalationEvent{Type: "conversation.resolved", Escalation: resolved}
+	if req.Message != "" {
+		closing := Message{ID: newID(), Role: "assistant", Content: req.Message, CreatedAt: now, Agent: agent, Status: messageCompleted}
+		conversationStore.Update(id, func(conv *Conversation) {
+			conv.Messages = append(conv.Messages, closing)
+		})
+		event.Message = &closing
+	}
+	publishEscalation(event)
+	c.JSON(http.StatusOK, resolved)
+}
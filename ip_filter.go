@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipList is a set of addresses and CIDR ranges
+type ipList []netip.Prefix
+
+func (l ipList) contains(addr netip.Addr) bool {
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter admits a client when it is on the allow list, or there is none,
+// and not on the deny list
+type ipFilter struct {
+	name  string
+	allow ipList
+	deny  ipList
+}
+
+func (f ipFilter) empty() bool {
+	return len(f.allow) == 0 && len(f.deny) == 0
+}
+
+func (f ipFilter) admits(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return (len(f.allow) == 0 || f.allow.contains(addr)) && !f.deny.contains(addr)
+}
+
+var (
+	apiIPFilter    ipFilter
+	adminIPFilter  ipFilter
+	trustedProxies []string
+
+	ipRejections *counterVec
+)
+
+func configureIPFilters() {
+	apiIPFilter = ipFilter{name: "api", allow: envIPList("IP_ALLOW_LIST"), deny: envIPList("IP_DENY_LIST")}
+	adminIPFilter = ipFilter{name: "admin", allow: envIPList("ADMIN_IP_ALLOW_LIST"), deny: envIPList("ADMIN_IP_DENY_LIST")}
+	trustedProxies = envList("TRUSTED_PROXIES")
+	if len(trustedProxies) == 0 && (!apiIPFilter.empty() || !adminIPFilter.empty()) {
+		configWarn("IP lists are set without TRUSTED_PROXIES, so X-Forwarded-For is ignored and they are checked against the connecting address")
+	}
+	ipRejections = newCounterVec("chatbot_ip_rejections_total", "Requests rejected by the IP allow and deny lists", "list")
+}
+
+// envIPList reads a comma-separated list of addresses and CIDR ranges
+func envIPList(name string) ipList {
+	var list ipList
+	for _, entry := range envList(name) {
+		var p netip.Prefix
+		var err error
+		if strings.Contains(entry, "/") {
+			p, err = netip.ParsePrefix(entry)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(entry)
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			configWarn("invalid %s entry %q: %v", name, entry, err)
+			continue
+		}
+		list = append(list, p.Masked())
+	}
+	return list
+}
+
+// setTrustedProxies makes ClientIP honor X-Forwarded-For only from
+// TRUSTED_PROXIES. Without them it is never honored, as Gin would otherwise
+// trust it from every client.
+func setTrustedProxies(r *gin.Engine) {
+	if len(trustedProxies) == 0 {
+		r.SetTrustedProxies(nil)
+		return
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Printf("Warning: invalid TRUSTED_PROXIES: %v", err)
+	}
+}
+
+// requireAllowedIP rejects clients the filter does not admit. Health probes
+// are always let through, as they come from the platform.
+func requireAllowedIP(f ipFilter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if f.empty() || c.Request.URL.Path == "/healthz" || c.Request.URL.Path == "/readyz" {
+			c.Next()
+			return
+		}
+		if !f.admits(c.ClientIP()) {
+			log.Printf("Rejected request to %s from %s by the %s IP lists", c.Request.URL.Path, c.ClientIP(), f.name)
+			ipRejections.inc(f.name)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access from this address is not allowed"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testIPList(entries ...string) ipList {
+	var list ipList
+	for _, e := range entries {
+		list = append(list, netip.MustParsePrefix(e).Masked())
+	}
+	return list
+}
+
+func TestIPFilterAdmits(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter ipFilter
+		ip     string
+		want   bool
+	}{
+		{name: "no lists", filter: ipFilter{}, ip: "203.0.113.7", want: true},
+		{name: "v4 on the allow list", filter: ipFilter{allow: testIPList("203.0.113.7/32")}, ip: "203.0.113.7", want: true},
+		{name: "v4 off the allow list", filter: ipFilter{allow: testIPList("203.0.113.7/32")}, ip: "203.0.113.8", want: false},
+		{name: "v4 in an allowed CIDR", filter: ipFilter{allow: testIPList("10.0.0.0/8")}, ip: "10.1.2.3", want: true},
+		{name: "v4-mapped v6 in an allowed CIDR", filter: ipFilter{allow: testIPList("10.0.0.0/8")}, ip: "::ffff:10.1.2.3", want: true},
+		{name: "v6 in an allowed CIDR", filter: ipFilter{allow: testIPList("2001:db8::/32")}, ip: "2001:db8::1", want: true},
+		{name: "v6 off the allow list", filter: ipFilter{allow: testIPList("2001:db8::/32")}, ip: "2001:db9::1", want: false},
+		{name: "v6 on the deny list", filter: ipFilter{deny: testIPList("2001:db8::1/128")}, ip: "2001:db8::1", want: false},
+		{name: "deny wins over allow", filter: ipFilter{allow: testIPList("10.0.0.0/8"), deny: testIPList("10.0.0.0/24")}, ip: "10.0.0.5", want: false},
+		{name: "allowed outside the denied range", filter: ipFilter{allow: testIPList("10.0.0.0/8"), deny: testIPList("10.0.0.0/24")}, ip: "10.0.1.5", want: true},
+		{name: "unparsable address", filter: ipFilter{deny: testIPList("10.0.0.0/8")}, ip: "not-an-ip", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.admits(tt.ip); got != tt.want {
+				t.Fatalf("admits(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequireAllowedIP(t *testing.T) {
+	previous := trustedProxies
+	t.Cleanup(func() { trustedProxies = previous })
+	filter := ipFilter{name: "api", allow: testIPList("10.0.0.0/8")}
+
+	tests := []struct {
+		name    string
+		trusted []string
+		// remote is the connecting address and forwarded its X-Forwarded-For
+		remote    string
+		forwarded string
+		path      string
+		want      int
+	}{
+		{name: "allowed peer", remote: "10.0.0.1:1234", path: "/api/chat", want: http.StatusOK},
+		{name: "refused peer", remote: "198.51.100.1:1234", path: "/api/chat", want: http.StatusForbidden},
+		{name: "spoofed header without trusted proxies", remote: "198.51.100.1:1234", forwarded: "10.0.0.1", path: "/api/chat", want: http.StatusForbidden},
+		{name: "spoofed header from an untrusted peer", trusted: []string{"192.0.2.0/24"}, remote: "198.51.100.1:1234", forwarded: "10.0.0.1", path: "/api/chat", want: http.StatusForbidden},
+		{name: "header from a trusted proxy", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.10:1234", forwarded: "10.0.0.1", path: "/api/chat", want: http.StatusOK},
+		{name: "refused client behind a trusted proxy", trusted: []string{"192.0.2.0/24"}, remote: "192.0.2.10:1234", forwarded: "198.51.100.1", path: "/api/chat", want: http.StatusForbidden},
+		{name: "health probe", remote: "198.51.100.1:1234", path: "/healthz", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = tt.trusted
+			r := gin.New()
+			setTrustedProxies(r)
+			r.Use(requireAllowedIP(filter))
+			r.GET(tt.path, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
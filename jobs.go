@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job is a unit of background work tracked by the job queue
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	User       string      `json:"user"`
+	Status     string      `json:"status"` // queued, running, completed, failed
+	OffPeak    bool        `json:"off_peak"`
+	Progress   int         `json:"progress"`
+	Total      int         `json:"total"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	WebhookURL string      `json:"webhook_url,omitempty"`
+}
+
+// jobFunc does the work of a job. It may record progress through
+// jobs.update and returns errJobPaused to be requeued for later.
+type jobFunc func(id string) (interface{}, error)
+
+var errJobPaused = errors.New("job paused")
+
+// jobQueue runs submitted jobs on a fixed number of workers in submission
+// order; off-peak jobs only start while an off-peak window is open
+type jobQueue struct {
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	runners  map[string]jobFunc
+	order    []string
+	running  int
+	workers  int
+	retained int
+	wake     chan struct{}
+}
+
+var (
+	jobs            *jobQueue
+	jobWebhookHosts []string
+)
+
+func configureJobs() {
+	jobs = &jobQueue{
+		jobs:     map[string]*Job{},
+		runners:  map[string]jobFunc{},
+		workers:  envInt("JOB_WORKERS", 2),
+		retained: envInt("JOB_MAX_RETAINED", 1000),
+		wake:     make(chan struct{}, 1),
+	}
+	jobWebhookHosts = envList("JOB_WEBHOOK_HOSTS")
+}
+
+// startJobQueue dispatches queued jobs whenever a worker frees up, a job is
+// submitted, or periodically so off-peak windows are noticed
+func startJobQueue() {
+	go func() {
+		for {
+			jobs.dispatch()
+			select {
+			case <-jobs.wake:
+			case <-time.After(30 * time.Second):
+			}
+		}
+	}()
+}
+
+func (q *jobQueue) submit(job Job, run jobFunc) Job {
+	q.mu.Lock()
+	job.ID = newID()
+	job.Status = "queued"
+	job.CreatedAt = time.Now()
+	q.jobs[job.ID] = &job
+	q.runners[job.ID] = run
+	q.order = append(q.order, job.ID)
+	q.trim()
+	q.mu.Unlock()
+
+	q.signal()
+	return job
+}
+
+// trim forgets the oldest finished jobs beyond the retention limit
+func (q *jobQueue) trim() {
+	excess := len(q.order) - q.retained
+	if q.retained <= 0 || excess <= 0 {
+		return
+	}
+	kept := q.order[:0]
+	for _, id := range q.order {
+		if excess > 0 && finished(q.jobs[id].Status) {
+			delete(q.jobs, id)
+			delete(q.runners, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	q.order = kept
+}
+
+func finished(status string) bool {
+	return status == "completed" || status == "failed"
+}
+
+func (q *jobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *jobQueue) dispatch() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for _, id := range q.order {
+		if q.running >= q.workers {
+			return
+		}
+		job := q.jobs[id]
+		if job.Status != "queued" || (job.OffPeak && !offPeakOpen(now)) {
+			continue
+		}
+		job.Status = "running"
+		if job.StartedAt == nil {
+			job.StartedAt = &now
+		}
+		q.running++
+		go q.execute(id, q.runners[id])
+	}
+}
+
+func (q *jobQueue) execute(id string, run jobFunc) {
+	result, err := run(id)
+
+	q.mu.Lock()
+	q.running--
+	job := q.jobs[id]
+	var snapshot Job
+	if err == errJobPaused {
+		job.Status = "queued"
+	} else {
+		now := time.Now()
+		job.FinishedAt = &now
+		if err != nil {
+			job.Status, job.Error = "failed", err.Error()
+		} else {
+			job.Status, job.Result = "completed", result
+		}
+		snapshot = *job
+		delete(q.runners, id)
+	}
+	q.mu.Unlock()
+
+	if snapshot.ID != "" {
+		log.Printf("Job %s (%s) %s", id, snapshot.Type, snapshot.Status)
+		if snapshot.WebhookURL != "" {
+			go postJSON(snapshot.WebhookURL, snapshot)
+		}
+		notifyUser(snapshot.User, Notification{
+			Type:    "job." + snapshot.Status,
+			Title:   fmt.Sprintf("Your %s job %s", snapshot.Type, snapshot.Status),
+			Message: snapshot.Error,
+			Data:    gin.H{"job_id": snapshot.ID, "type": snapshot.Type, "status": snapshot.Status},
+		})
+	}
+	q.signal()
+}
+
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+func (q *jobQueue) update(id string, fn func(*Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// list returns the user's jobs, or every job for an empty user, newest first
+func (q *jobQueue) list(user string) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := []Job{}
+	for _, job := range q.jobs {
+		if user == "" || job.User == user {
+			snapshot := *job
+			snapshot.Result = nil
+			out = append(out, snapshot)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// validateWebhookURL only allows completion webhooks to hosts listed in
+// JOB_WEBHOOK_HOSTS so jobs cannot be used to reach internal services
+func validateWebhookURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid webhook_url")
+	}
+	for _, host := range jobWebhookHosts {
+		if strings.EqualFold(host, u.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("webhook host %s is not allowed", u.Hostname())
+}
+
+func handleListJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jobs": jobs.list(requestUser(c))})
+}
+
+func handleGetJob(c *gin.Context) {
+	job, ok := jobs.get(c.Param("id"))
+	if !ok || (job.User != requestUser(c) && !isAdmin(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,83 @@
+package main
+
+import "sync"
+
+// Keys a bulk rotation job may replace while requests are using them, and
+// the credentials degraded mode fills in once they appear. They are only read
+// and replaced through the functions below.
+var (
+	keysMu sync.RWMutex
+	// servingEndpoint is the default chat endpoint, and workspaceHost the
+	// host API calls go to
+	servingEndpoint string
+	workspaceHost   string
+	apiKey          string
+	// webhookSecret signs every outbound callback; see pkg/webhook
+	webhookSecret      string
+	artifactSigningKey []byte
+)
+
+// llmEndpoint is the SERVING_ENDPOINT_NAME in use
+func llmEndpoint() string {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return servingEndpoint
+}
+
+func setLLMEndpoint(name string) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	servingEndpoint = name
+}
+
+// databricksHost is the DATABRICKS_HOST in use
+func databricksHost() string {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return workspaceHost
+}
+
+func setDatabricksHost(host string) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	workspaceHost = host
+}
+
+// databricksToken is the DATABRICKS_TOKEN in use
+func databricksToken() string {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return apiKey
+}
+
+func setDatabricksToken(token string) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	apiKey = token
+}
+
+// webhookSigningSecret is the WEBHOOK_SIGNING_SECRET in use
+func webhookSigningSecret() string {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return webhookSecret
+}
+
+func setWebhookSigningSecret(secret string) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	webhookSecret = secret
+}
+
+// artifactKey is the key artifact URLs are signed with
+func artifactKey() []byte {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return artifactSigningKey
+}
+
+func setArtifactKey(key []byte) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	artifactSigningKey = key
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KillSwitch turns a feature off during an incident, whatever the feature
+// flags say, until an admin releases it
+type KillSwitch struct {
+	Feature   string    `json:"feature"`
+	Reason    string    `json:"reason,omitempty"`
+	EngagedBy string    `json:"engaged_by"`
+	EngagedAt time.Time `json:"engaged_at"`
+}
+
+// KillSwitchStore keeps the engaged switches where every replica reads them.
+// Unlike the other stores it reports failures, since a switch that was not
+// stored would only hold on the replica that engaged it.
+type KillSwitchStore interface {
+	List() ([]KillSwitch, error)
+	// Engage stores sw, replacing any switch for the same feature
+	Engage(sw KillSwitch) error
+	// Release removes the feature's switch, reporting whether it was engaged
+	Release(feature string) (bool, error)
+}
+
+// memoryKillSwitchStore keeps switches for a single replica
+type memoryKillSwitchStore struct {
+	mu       sync.Mutex
+	switches map[string]KillSwitch
+}
+
+func (s *memoryKillSwitchStore) List() ([]KillSwitch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]KillSwitch, 0, len(s.switches))
+	for _, sw := range s.switches {
+		out = append(out, sw)
+	}
+	return out, nil
+}
+
+func (s *memoryKillSwitchStore) Engage(sw KillSwitch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.switches[sw.Feature] = sw
+	return nil
+}
+
+func (s *memoryKillSwitchStore) Release(feature string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.switches[feature]
+	delete(s.switches, feature)
+	return ok, nil
+}
+
+var (
+	killSwitchStore        KillSwitchStore
+	killSwitchSyncInterval time.Duration
+
+	// killed caches the engaged switches by feature, as last read from the
+	// store, so checking a feature never waits on the database
+	killedMu   sync.RWMutex
+	killed     = map[string]KillSwitch{}
+	killedSync time.Time
+)
+
+// configureKillSwitches keeps switches in the storage backend, so engaging
+// one on any replica reaches the others within KILL_SWITCH_SYNC_INTERVAL
+func configureKillSwitches() {
+	if storage != nil {
+		killSwitchStore = storage.killSwitches
+	} else {
+		killSwitchStore = &memoryKillSwitchStore{switches: map[string]KillSwitch{}}
+	}
+	killSwitchSyncInterval = envDuration("KILL_SWITCH_SYNC_INTERVAL", 5*time.Second)
+}
+
+// startKillSwitchSync reads the switches engaged before this replica started,
+// then rereads the ones other replicas may change
+func startKillSwitchSync() {
+	syncKillSwitches()
+	if storage == nil || killSwitchSyncInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(killSwitchSyncInterval) {
+			syncKillSwitches()
+		}
+	}()
+}
+
+// syncKillSwitches replaces the cache with the store's switches. When the
+// store cannot be read the last known switches stay engaged.
+func syncKillSwitches() {
+	switches, err := killSwitchStore.List()
+	if err != nil {
+		log.Printf("Failed to read kill switches, keeping the last known ones: %v", err)
+		return
+	}
+	current := map[string]KillSwitch{}
+	for _, sw := range switches {
+		current[sw.Feature] = sw
+	}
+	killedMu.Lock()
+	engaged := map[string]bool{}
+	for feature := range current {
+		if _, ok := killed[feature]; !ok {
+			log.Printf("Kill switch engaged for %s", feature)
+			engaged[feature] = true
+		}
+	}
+	for feature := range killed {
+		if _, ok := current[feature]; !ok {
+			log.Printf("Kill switch released for %s", feature)
+		}
+	}
+	killed, killedSync = current, time.Now()
+	killedMu.Unlock()
+
+	// Load tests already running would otherwise go on until their duration
+	// is up
+	if engaged["load_test"] {
+		stopLoadTests("kill switch engaged")
+	}
+}
+
+func featureKilled(name string) bool {
+	killedMu.RLock()
+	defer killedMu.RUnlock()
+	_, ok := killed[name]
+	return ok
+}
+
+// engagedKillSwitches lists the cached switches by feature
+func engagedKillSwitches() ([]KillSwitch, time.Time) {
+	killedMu.RLock()
+	defer killedMu.RUnlock()
+	out := make([]KillSwitch, 0, len(killed))
+	for _, sw := range killed {
+		out = append(out, sw)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Feature < out[j].Feature })
+	return out, killedSync
+}
+
+func handleListKillSwitches(c *gin.Context) {
+	switches, synced := engagedKillSwitches()
+	c.JSON(http.StatusOK, gin.H{"kill_switches": switches, "synced_at": synced})
+}
+
+// handleEngageKillSwitch turns a feature off on every replica. It takes
+// effect here at once and on the others at their next sync.
+func handleEngageKillSwitch(c *gin.Context) {
+	feature := c.Param("feature")
+	if err := validateFeatures(map[string]bool{feature: false}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	sw := KillSwitch{Feature: feature, Reason: req.Reason, EngagedBy: requestUser(c), EngagedAt: time.Now()}
+	if err := killSwitchStore.Engage(sw); err != nil {
+		log.Printf("Failed to store kill switch for %s: %v", feature, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The kill switch could not be stored for the other replicas"})
+		return
+	}
+	syncKillSwitches()
+	if feature == "load_test" {
+		// syncKillSwitches only stops them when the switch is new here
+		stopLoadTests("kill switch engaged")
+	}
+	notify(Alert{Type: "kill_switch", Severity: "critical", Message: fmt.Sprintf("%s engaged the kill switch for %s", sw.EngagedBy, feature),
+		Details: map[string]interface{}{"feature": feature, "reason": sw.Reason}})
+	c.JSON(http.StatusOK, sw)
+}
+
+func handleReleaseKillSwitch(c *gin.Context) {
+	feature := c.Param("feature")
+	released, err := killSwitchStore.Release(feature)
+	if err != nil {
+		log.Printf("Failed to release kill switch for %s: %v", feature, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The kill switch could not be released for the other replicas"})
+		return
+	}
+	if !released {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No kill switch engaged for feature"})
+		return
+	}
+	syncKillSwitches()
+	notify(Alert{Type: "kill_switch", Severity: "info", Message: fmt.Sprintf("%s released the kill switch for %s", requestUser(c), feature),
+		Details: map[string]interface{}{"feature": feature}})
+	c.JSON(http.StatusOK, gin.H{"feature": feature, "released": true})
+}
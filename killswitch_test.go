@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestKillSwitchStopsLoadTests(t *testing.T) {
+	store := killSwitchStore
+	killedMu.RLock()
+	previous := killed
+	killedMu.RUnlock()
+	t.Cleanup(func() {
+		killSwitchStore = store
+		killedMu.Lock()
+		killed = previous
+		killedMu.Unlock()
+	})
+
+	tests := []struct {
+		name string
+		// engage switches the feature off, as an admin on this replica or
+		// another one would
+		engage  func(feature string)
+		feature string
+		stopped bool
+	}{
+		{name: "engaged here", feature: "load_test", stopped: true, engage: func(feature string) {
+			r := gin.New()
+			r.PUT("/api/admin/kill-switches/:feature", handleEngageKillSwitch)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/api/admin/kill-switches/"+feature, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("engage status = %d %s", w.Code, w.Body)
+			}
+		}},
+		{name: "engaged on another replica", feature: "load_test", stopped: true, engage: func(feature string) {
+			killSwitchStore.Engage(KillSwitch{Feature: feature, EngagedAt: time.Now()})
+			syncKillSwitches()
+		}},
+		{name: "other feature", feature: "streaming", engage: func(feature string) {
+			killSwitchStore.Engage(KillSwitch{Feature: feature, EngagedAt: time.Now()})
+			syncKillSwitches()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			killSwitchStore = &memoryKillSwitchStore{switches: map[string]KillSwitch{}}
+			syncKillSwitches()
+			run := &loadTestRun{ID: newID(), stopped: make(chan struct{})}
+			loadTestsMu.Lock()
+			runningLoadTests[run.ID] = run
+			loadTestsMu.Unlock()
+			defer finishLoadTestRun(run)
+
+			tt.engage(tt.feature)
+			select {
+			case <-run.stopped:
+				if !tt.stopped {
+					t.Fatal("load test stopped")
+				}
+			default:
+				if tt.stopped {
+					t.Fatal("load test still running")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The LangServe runnable protocol, so LangChain's RemoteRunnable can use the
+// chat endpoint as a chat model:
+//
+//	RemoteRunnable("https://<app>/api/langserve").invoke("Hello")
+
+// LangServeRequest is the body of /invoke and /stream
+type LangServeRequest struct {
+	Input  json.RawMessage        `json:"input" binding:"required"`
+	Config map[string]interface{} `json:"config"`
+	Kwargs map[string]interface{} `json:"kwargs"`
+}
+
+// LangServeBatchRequest is the body of /batch
+type LangServeBatchRequest struct {
+	Inputs []json.RawMessage      `json:"inputs" binding:"required,min=1"`
+	Config interface{}            `json:"config"`
+	Kwargs map[string]interface{} `json:"kwargs"`
+}
+
+// langChainMessage is a serialized LangChain message
+type langChainMessage struct {
+	Content          string                 `json:"content"`
+	Type             string                 `json:"type"`
+	ID               string                 `json:"id,omitempty"`
+	AdditionalKwargs map[string]interface{} `json:"additional_kwargs"`
+	ResponseMetadata map[string]interface{} `json:"response_metadata"`
+}
+
+// langServeRoles maps LangChain message types to chat roles. System messages
+// are refused: the server sets the system prompt, as it does for /api/chat.
+var langServeRoles = map[string]string{
+	"human": "user", "user": "user",
+	"ai": "assistant", "assistant": "assistant", "AIMessageChunk": "assistant",
+}
+
+// langServeInput accepts the input shapes LangChain chat models take: a
+// string, a message, a list of messages or [role, content] pairs, or an
+// object with messages or input. It returns the history and the final prompt.
+func langServeInput(raw json.RawMessage) ([]Message, string, error) {
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		if text == "" {
+			return nil, "", fmt.Errorf("input must not be empty")
+		}
+		return nil, text, nil
+	}
+
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		var obj struct {
+			Messages json.RawMessage `json:"messages"`
+			Input    json.RawMessage `json:"input"`
+			Content  *string         `json:"content"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, "", fmt.Errorf("unsupported input")
+		}
+		switch {
+		case obj.Content != nil:
+			list = []json.RawMessage{raw}
+		case len(obj.Messages) > 0:
+			return langServeInput(obj.Messages)
+		case len(obj.Input) > 0:
+			return langServeInput(obj.Input)
+		default:
+			return nil, "", fmt.Errorf("input needs messages, input or content")
+		}
+	}
+
+	var history []Message
+	for _, item := range list {
+		var m struct {
+			Type    string `json:"type"`
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}
+		var pair []string
+		if json.Unmarshal(item, &pair) == nil && len(pair) == 2 {
+			m.Type, m.Content = pair[0], pair[1]
+		} else if err := json.Unmarshal(item, &m); err != nil {
+			return nil, "", fmt.Errorf("unsupported message")
+		}
+		kind := m.Type
+		if kind == "" {
+			kind = m.Role
+		}
+		if kind == "system" {
+			return nil, "", fmt.Errorf("system messages are not accepted")
+		}
+		role, ok := langServeRoles[kind]
+		if !ok {
+			return nil, "", fmt.Errorf("unsupported message type %q", kind)
+		}
+		history = append(history, Message{Role: role, Content: m.Content})
+	}
+	if len(history) == 0 || history[len(history)-1].Role != "user" {
+		return nil, "", fmt.Errorf("the last message must be from the user")
+	}
+	last := history[len(history)-1]
+	return history[:len(history)-1], last.Content, nil
+}
+
+// langServeGuardrails checks the input guardrails against every user turn,
+// since LangChain clients send the whole history with each request and any
+// of it reaches the model
+func langServeGuardrails(history []Message, prompt string) *GuardrailViolation {
+	for _, m := range history {
+		if m.Role != "user" {
+			continue
+		}
+		if v := checkGuardrails("input", m.Content); v != nil {
+			return v
+		}
+	}
+	return checkGuardrails("input", prompt)
+}
+
+// admitLangServeRequest is admitChatRequest for the whole history
+func admitLangServeRequest(c *gin.Context, history []Message, prompt string) bool {
+	if !admitChatRequest(c, prompt) {
+		return false
+	}
+	if v := langServeGuardrails(history, prompt); v != nil {
+		log.Printf("Guardrail %s blocked input", v.Rule)
+		c.JSON(http.StatusBadRequest, gin.H{"error": v.Message, "policy": v.Rule})
+		return false
+	}
+	return true
+}
+
+func langServeError(c *gin.Context, err error) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"detail": err.Error()})
+}
+
+// langServeFailure reports an error from langServeAnswer without exposing
+// upstream details
+func langServeFailure(c *gin.Context, status int, err error) {
+	if status == http.StatusUnprocessableEntity {
+		langServeError(c, err)
+		return
+	}
+	c.JSON(status, gin.H{"detail": "Error from LLM endpoint"})
+}
+
+// langServeAnswer runs one input through guardrails and the chat endpoint
+func langServeAnswer(c *gin.Context, runID string, raw json.RawMessage) (langChainMessage, int, error) {
+	history, prompt, err := langServeInput(raw)
+	if err != nil {
+		return langChainMessage{}, http.StatusUnprocessableEntity, err
+	}
+	out := langChainMessage{Type: "ai", ID: runID, AdditionalKwargs: map[string]interface{}{}, ResponseMetadata: map[string]interface{}{}}
+	if v := langServeGuardrails(history, prompt); v != nil {
+		out.Content, out.ResponseMetadata["policy"] = v.Message, v.Rule
+		return out, http.StatusOK, nil
+	}
+
+	start := time.Now()
+	record := AuditRecord{ID: runID, ClientRequestID: clientRequestID(c), Timestamp: start, User: requestUser(c), Model: llmEndpoint(), Prompt: prompt}
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	content, llmResp, err := completeChat(PriorityInteractive, llmEndpoint(), buildConversationMessages(defaultSystemPrompt(), history, prompt))
+	if err != nil {
+		log.Printf("LangServe invoke failed: %v", err)
+		record.StatusCode, record.Error = upstreamStatus(err), err.Error()
+		return langChainMessage{}, http.StatusBadGateway, err
+	}
+	record.StatusCode = http.StatusOK
+	record.Response = content
+	record.PromptTokens = llmResp.Usage.PromptTokens
+	record.CompletionTokens = llmResp.Usage.CompletionTokens
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+
+	if v := checkGuardrails("output", content); v != nil {
+		record.Error = "output blocked by guardrail " + v.Rule
+		out.Content, out.ResponseMetadata["policy"] = v.Message, v.Rule
+		return out, http.StatusOK, nil
+	}
+	out.Content, _ = truncateResponse(postProcessAnswer(prompt, content))
+	out.ResponseMetadata["finish_reason"] = llmResp.Choices[0].FinishReason
+	out.ResponseMetadata["token_usage"] = llmResp.Usage
+	return out, http.StatusOK, nil
+}
+
+func handleLangServeInvoke(c *gin.Context) {
+	var req LangServeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		langServeError(c, err)
+		return
+	}
+	history, prompt, err := langServeInput(req.Input)
+	if err != nil {
+		langServeError(c, err)
+		return
+	}
+	if !admitLangServeRequest(c, history, prompt) {
+		return
+	}
+
+	runID := requestID(c)
+	out, status, err := langServeAnswer(c, runID, req.Input)
+	if err != nil {
+		langServeFailure(c, status, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"output": out, "metadata": gin.H{"run_id": runID, "feedback_tokens": []string{}}})
+}
+
+func handleLangServeBatch(c *gin.Context) {
+	var req LangServeBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		langServeError(c, err)
+		return
+	}
+	if batchMaxPrompts > 0 && len(req.Inputs) > batchMaxPrompts {
+		langServeError(c, fmt.Errorf("a batch may contain at most %d inputs", batchMaxPrompts))
+		return
+	}
+	for _, input := range req.Inputs {
+		_, prompt, err := langServeInput(input)
+		if err != nil {
+			langServeError(c, err)
+			return
+		}
+		if rejectAbusive(c, prompt) {
+			return
+		}
+	}
+	if rejectOverQuota(c) {
+		return
+	}
+
+	outputs := make([]langChainMessage, len(req.Inputs))
+	runIDs := make([]string, len(req.Inputs))
+	for i, input := range req.Inputs {
+		runIDs[i] = newID()
+		out, status, err := langServeAnswer(c, runIDs[i], input)
+		if err != nil {
+			langServeFailure(c, status, err)
+			return
+		}
+		outputs[i] = out
+	}
+	c.JSON(http.StatusOK, gin.H{"output": outputs, "metadata": gin.H{"run_ids": runIDs}})
+}
+
+// handleLangServeStream streams AIMessageChunk data events, checking the
+// output guardrails as the text arrives like /api/chat/stream does
+func handleLangServeStream(c *gin.Context) {
+	var req LangServeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		langServeError(c, err)
+		return
+	}
+	history, prompt, err := langServeInput(req.Input)
+	if err != nil {
+		langServeError(c, err)
+		return
+	}
+	if !admitLangServeRequest(c, history, prompt) {
+		return
+	}
+	endStream := acquireUserStream(c)
+	if endStream == nil {
+		return
+	}
+	defer endStream()
+	release := acquireChatSlot(c, PriorityInteractive)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	runID := requestID(c)
+	start := time.Now()
+	record := AuditRecord{ID: runID, ClientRequestID: clientRequestID(c), Timestamp: start, User: requestUser(c), Model: llmEndpoint(), Prompt: prompt}
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	upstreamStart := time.Now()
+	body, status, err := openUpstreamStream(ctx, llmEndpoint(), chatPayload(buildConversationMessages(defaultSystemPrompt(), history, prompt)))
+	pool.observe(status, time.Since(upstreamStart))
+	if err != nil {
+		log.Printf("Failed to open upstream stream: %v", err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		record.StatusCode, record.Error = status, "Error from LLM endpoint"
+		c.JSON(status, gin.H{"detail": "Error from LLM endpoint"})
+		return
+	}
+	defer body.Close()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	record.StatusCode = http.StatusOK
+	out := newStreamBuffer(c)
+	defer out.close()
+	send := func(event string, data interface{}) { out.send(event, data) }
+	chunk := func(content string, metadata map[string]interface{}) langChainMessage {
+		if metadata == nil {
+			metadata = map[string]interface{}{}
+		}
+		return langChainMessage{Content: content, Type: "AIMessageChunk", ID: runID, AdditionalKwargs: map[string]interface{}{}, ResponseMetadata: metadata}
+	}
+	text := newStreamGuard(func(text string) {
+		out.sendText("data", text, func(text string) interface{} { return chunk(text, nil) })
+	})
+	send("metadata", gin.H{"run_id": runID})
+
+	stopped := false
+	err = readStreamChunks(body, func(sc StreamChunk) bool {
+		if sc.Usage != nil {
+			record.PromptTokens = sc.Usage.PromptTokens
+			record.CompletionTokens = sc.Usage.CompletionTokens
+		}
+		if len(sc.Choices) == 0 || sc.Choices[0].Delta.Content == "" {
+			return true
+		}
+		if text.write(sc.Choices[0].Delta.Content) {
+			return true
+		}
+		if v := text.violation; v != nil {
+			record.Error = "generation stopped by guardrail " + v.Rule
+			send("data", chunk("", map[string]interface{}{"policy": v.Rule, "message": v.Message}))
+			stopped = true
+		}
+		cancel()
+		return false
+	})
+
+	record.Response = text.String()
+	rateLimiter.chargeTokens(record.PromptTokens + record.CompletionTokens)
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+	if err != nil && !stopped {
+		log.Printf("Upstream stream failed: %v", err)
+		record.Error = "stream interrupted"
+		send("error", gin.H{"status_code": http.StatusBadGateway, "message": "Stream from LLM endpoint was interrupted"})
+		return
+	}
+	if !stopped {
+		record.Response = text.finish()
+	}
+	send("end", "")
+}
+
+func handleLangServeInputSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"title": "ChatInput",
+		"anyOf": []gin.H{
+			{"type": "string"},
+			{"type": "array", "items": gin.H{"type": "object", "properties": gin.H{"type": gin.H{"type": "string"}, "content": gin.H{"type": "string"}}}},
+		},
+	})
+}
+
+func handleLangServeOutputSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"title":      "AIMessage",
+		"type":       "object",
+		"properties": gin.H{"content": gin.H{"type": "string"}, "type": gin.H{"type": "string", "enum": []string{"ai"}}},
+		"required":   []string{"content"},
+	})
+}
+
+func handleLangServeConfigSchema(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"title": "RunnableConfig", "type": "object", "properties": gin.H{}})
+}
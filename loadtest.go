@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+const defaultLoadTestMessage = "Hello"
+
+// LatencyStats summarizes one side of the latency split
+type LatencyStats struct {
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+}
+
+// LatencySplit attributes chat latency to the serving endpoint and to the app
+// itself (middleware, abuse checks, queueing for an upstream slot and
+// post-processing), so it is clear which layer to optimize
+type LatencySplit struct {
+	// Samples counts successful responses that reported upstream latency
+	Samples  int          `json:"samples"`
+	Upstream LatencyStats `json:"upstream"`
+	App      LatencyStats `json:"app"`
+	// UpstreamShare is the fraction of total time spent upstream
+	UpstreamShare float64 `json:"upstream_share"`
+}
+
+// loadTestTarget builds the request the attacker repeats
+func loadTestTarget(req LoadTestRequest) vegeta.Target {
+	header := http.Header{"Content-Type": []string{"application/json"}, headerLoadTest: []string{"1"}}
+	if req.Target != "chat" {
+		return vegeta.Target{Method: "GET", URL: fmt.Sprintf("http://localhost:%s/api", appPort), Header: header}
+	}
+	message := req.Message
+	if message == "" {
+		message = defaultLoadTestMessage
+	}
+	body, _ := json.Marshal(ChatRequest{Message: message})
+	if req.User != "" {
+		header.Set("X-Forwarded-Email", req.User)
+	}
+	return vegeta.Target{Method: "POST", URL: fmt.Sprintf("http://localhost:%s/api/chat", appPort), Body: body, Header: header}
+}
+
+// latencySplitter collects per-request timings from the X-Upstream-Latency-Ms
+// header the chat handler sets
+type latencySplitter struct {
+	upstream, app []float64
+}
+
+func (s *latencySplitter) add(res *vegeta.Result) {
+	if res.Code != http.StatusOK || res.Headers == nil {
+		return
+	}
+	ms, err := strconv.ParseFloat(res.Headers.Get(headerUpstreamLatency), 64)
+	if err != nil {
+		return
+	}
+	total := float64(res.Latency) / float64(time.Millisecond)
+	// Header values are whole milliseconds, so clamp rounding below zero
+	app := total - ms
+	if app < 0 {
+		app = 0
+	}
+	s.upstream = append(s.upstream, ms)
+	s.app = append(s.app, app)
+}
+
+func (s *latencySplitter) summary() *LatencySplit {
+	split := &LatencySplit{
+		Samples:  len(s.upstream),
+		Upstream: latencyStats(s.upstream),
+		App:      latencyStats(s.app),
+	}
+	if total := split.Upstream.Mean + split.App.Mean; total > 0 {
+		split.UpstreamShare = float64(split.Upstream.Mean) / float64(total)
+	}
+	return split
+}
+
+func latencyStats(ms []float64) LatencyStats {
+	d := func(v float64) time.Duration { return time.Duration(v * float64(time.Millisecond)) }
+	return LatencyStats{
+		Mean: d(mean(ms)),
+		P50:  d(percentile(ms, 50)),
+		P95:  d(percentile(ms, 95)),
+		P99:  d(percentile(ms, 99)),
+	}
+}
+
+// newLoadTestAttacker bounds the attack to users concurrent workers and
+// connections. vegeta otherwise spawns workers without limit when responses
+// slow down, and keeps its idle connections open after the run.
+func newLoadTestAttacker(users int) (*vegeta.Attacker, *loadTestConns) {
+	conns := &loadTestConns{}
+	conns.transport = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         conns.dial,
+		MaxIdleConnsPerHost: users,
+		MaxConnsPerHost:     users,
+	}
+	workers := uint64(users)
+	if workers > vegeta.DefaultWorkers {
+		workers = vegeta.DefaultWorkers
+	}
+	attacker := vegeta.NewAttacker(
+		vegeta.Client(&http.Client{Timeout: vegeta.DefaultTimeout, Transport: conns.transport}),
+		vegeta.Workers(workers),
+		vegeta.MaxWorkers(uint64(users)),
+	)
+	return attacker, conns
+}
+
+// leakSettle is how long connections returning to the idle pool get to be
+// closed after the last response
+const leakSettle = time.Second
+
+// loadTestConns is a load test's own transport, counting the connections it
+// opens and those still open, so the leak check sees nothing but the test
+type loadTestConns struct {
+	transport *http.Transport
+	dialer    net.Dialer
+	opened    atomic.Int64
+	open      atomic.Int64
+}
+
+func (l *loadTestConns) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := l.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l.opened.Add(1)
+	l.open.Add(1)
+	return &countedConn{Conn: conn, open: &l.open}, nil
+}
+
+// countedConn takes itself off the open count when first closed
+type countedConn struct {
+	net.Conn
+	open *atomic.Int64
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// LeakCheck counts the connections of a load test left open after it
+type LeakCheck struct {
+	Opened int64 `json:"connections_opened"`
+	// Open are still open once the idle connections are closed
+	Open   int64 `json:"connections_open"`
+	Leaked bool  `json:"leaked"`
+	// Skipped is set when requests still in flight were abandoned, as those
+	// keep their connections until they time out
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// check closes the idle connections and waits up to leakSettle for the rest
+// to close, logging a warning if they do not
+func (l *loadTestConns) check() LeakCheck {
+	deadline := time.Now().Add(leakSettle)
+	for {
+		l.transport.CloseIdleConnections()
+		if l.open.Load() == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check := LeakCheck{Opened: l.opened.Load(), Open: l.open.Load()}
+	if check.Leaked = check.Open > 0; check.Leaked {
+		log.Printf("Load test leak check failed: %d of %d connections still open", check.Open, check.Opened)
+	}
+	return check
+}
+
+var (
+	errLoadTestNameTaken = errors.New("a load test with that name is already running")
+	errLoadTestCapacity  = errors.New("not enough load test capacity left")
+)
+
+var (
+	loadTestStopTimeout time.Duration
+	// Totals over all running load tests; 0 is unlimited
+	loadTestMaxUsers int
+	loadTestMaxRate  int
+
+	loadTestsMu      sync.Mutex
+	runningLoadTests = map[string]*loadTestRun{}
+)
+
+func configureLoadTests() {
+	loadTestStopTimeout = envDuration("LOAD_TEST_STOP_TIMEOUT", 10*time.Second)
+	loadTestMaxUsers = envInt("LOAD_TEST_MAX_USERS", 1000)
+	loadTestMaxRate = envInt("LOAD_TEST_MAX_RATE", 0)
+	configureLoadTestPresets()
+	configureLoadTestGuard()
+}
+
+// loadTestRun is a load test in progress, which can be stopped early
+type loadTestRun struct {
+	ID        string          `json:"id"`
+	Name      string          `json:"name,omitempty"`
+	Request   LoadTestRequest `json:"request"`
+	User      string          `json:"user,omitempty"`
+	StartedAt time.Time       `json:"started_at"`
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	reason   string
+	progress LoadTestProgress
+	// pacer sets the attack rate, which the error budget guard may lower
+	pacer     *throttledPacer
+	throttles []LoadTestThrottle
+}
+
+// LoadTestProgress is what a running test has done so far
+type LoadTestProgress struct {
+	Requests    int64         `json:"requests"`
+	Failures    int64         `json:"failures"`
+	MeanLatency time.Duration `json:"mean_latency"`
+	latencySum  time.Duration
+}
+
+func (p *LoadTestProgress) add(other LoadTestProgress) {
+	p.Requests += other.Requests
+	p.Failures += other.Failures
+	p.latencySum += other.latencySum
+	if p.Requests > 0 {
+		p.MeanLatency = p.latencySum / time.Duration(p.Requests)
+	}
+}
+
+// startLoadTestRun reserves the test's users and rate, failing when a test
+// of the same name is running or the totals would exceed LOAD_TEST_MAX_USERS
+// or LOAD_TEST_MAX_RATE
+func startLoadTestRun(req LoadTestRequest) (*loadTestRun, error) {
+	loadTestsMu.Lock()
+	defer loadTestsMu.Unlock()
+	users, rate := req.Users, req.SpawnRate
+	for _, other := range runningLoadTests {
+		if req.Name != "" && other.Name == req.Name {
+			return nil, fmt.Errorf("%w: %s", errLoadTestNameTaken, req.Name)
+		}
+		users, rate = users+other.Request.Users, rate+other.Request.SpawnRate
+	}
+	if loadTestMaxUsers > 0 && users > loadTestMaxUsers {
+		return nil, fmt.Errorf("%w: %d of %d users are in use", errLoadTestCapacity, users-req.Users, loadTestMaxUsers)
+	}
+	if loadTestMaxRate > 0 && rate > loadTestMaxRate {
+		return nil, fmt.Errorf("%w: %d of %d requests per second are in use", errLoadTestCapacity, rate-req.SpawnRate, loadTestMaxRate)
+	}
+
+	run := &loadTestRun{ID: newID(), Name: req.Name, Request: req, User: req.User, StartedAt: time.Now(), stopped: make(chan struct{}),
+		pacer: &throttledPacer{freq: float64(req.SpawnRate)}}
+	runningLoadTests[run.ID] = run
+	log.Printf("Load test %s started: %d users, %d/s for %ds against %s", run.ID, req.Users, req.SpawnRate, req.TestTime, loadTestTarget(req).URL)
+	return run, nil
+}
+
+func finishLoadTestRun(run *loadTestRun) {
+	loadTestsMu.Lock()
+	delete(runningLoadTests, run.ID)
+	loadTestsMu.Unlock()
+}
+
+func (r *loadTestRun) record(res *vegeta.Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	one := LoadTestProgress{Requests: 1, latencySum: res.Latency}
+	if res.Code < 200 || res.Code >= 400 {
+		one.Failures = 1
+	}
+	r.progress.add(one)
+}
+
+// stop ends the attack early; only the first reason is kept
+func (r *loadTestRun) stop(reason string) {
+	r.stopOnce.Do(func() {
+		r.mu.Lock()
+		r.reason = reason
+		r.mu.Unlock()
+		log.Printf("Stopping load test %s: %s", r.ID, reason)
+		close(r.stopped)
+	})
+}
+
+// throttled returns the slowdowns by the error budget guard so far
+func (r *loadTestRun) throttled() []LoadTestThrottle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LoadTestThrottle(nil), r.throttles...)
+}
+
+func (r *loadTestRun) stopReason() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reason
+}
+
+// stopLoadTests stops every running load test, e.g. on shutdown
+func stopLoadTests(reason string) {
+	loadTestsMu.Lock()
+	defer loadTestsMu.Unlock()
+	for _, run := range runningLoadTests {
+		run.stop(reason)
+	}
+}
+
+func loadTestResultKey(id string) string {
+	return "load-test-" + id + ".json"
+}
+
+// saveLoadTestResult keeps the results in artifact storage, so those of a
+// test stopped by a shutdown outlive the request that started it
+func saveLoadTestResult(result LoadTestResponse) {
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = blobStore.Put(loadTestResultKey(result.ID), data)
+	}
+	if err != nil {
+		log.Printf("Failed to save results of load test %s: %v", result.ID, err)
+	}
+}
+
+// RunningLoadTest is a running test in the admin view
+type RunningLoadTest struct {
+	*loadTestRun
+	Progress LoadTestProgress `json:"progress"`
+	// Rate is the current attack rate, below the requested one once throttled
+	Rate      float64            `json:"rate"`
+	Throttles []LoadTestThrottle `json:"throttles,omitempty"`
+}
+
+// LoadTestTotals adds up the running tests, against the capacity limits
+type LoadTestTotals struct {
+	Tests    int              `json:"tests"`
+	Users    int              `json:"users"`
+	Rate     int              `json:"rate"`
+	MaxUsers int              `json:"max_users,omitempty"`
+	MaxRate  int              `json:"max_rate,omitempty"`
+	Progress LoadTestProgress `json:"progress"`
+}
+
+// handleListLoadTests shows every running test with its progress, and the
+// totals over all of them
+func handleListLoadTests(c *gin.Context) {
+	loadTestsMu.Lock()
+	runs := make([]RunningLoadTest, 0, len(runningLoadTests))
+	totals := LoadTestTotals{MaxUsers: loadTestMaxUsers, MaxRate: loadTestMaxRate}
+	for _, run := range runningLoadTests {
+		run.mu.Lock()
+		progress := run.progress
+		run.mu.Unlock()
+		runs = append(runs, RunningLoadTest{loadTestRun: run, Progress: progress, Rate: run.pacer.Rate(0), Throttles: run.throttled()})
+		totals.Tests++
+		totals.Users += run.Request.Users
+		totals.Rate += run.Request.SpawnRate
+		totals.Progress.add(progress)
+	}
+	loadTestsMu.Unlock()
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+	c.JSON(http.StatusOK, gin.H{"running": runs, "totals": totals})
+}
+
+// handleGetLoadTest returns the saved results of a finished load test
+func handleGetLoadTest(c *gin.Context) {
+	body, err := blobStore.Get(loadTestResultKey(c.Param("id")))
+	if err == errBlobNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Load test results not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read results of load test %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read load test results"})
+		return
+	}
+	defer body.Close()
+	c.DataFromReader(http.StatusOK, -1, "application/json", body, nil)
+}
+
+// handleStopLoadTest stops a running load test, given its ID or name; the
+// request that started it then returns the results so far
+func handleStopLoadTest(c *gin.Context) {
+	loadTestsMu.Lock()
+	run, ok := runningLoadTests[c.Param("id")]
+	for _, other := range runningLoadTests {
+		if !ok && other.Name != "" && other.Name == c.Param("id") {
+			run, ok = other, true
+		}
+	}
+	loadTestsMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No running load test with that ID"})
+		return
+	}
+	run.stop("stopped by " + requestUser(c))
+	c.JSON(http.StatusAccepted, gin.H{"id": run.ID, "stopping": true})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerLoadTest marks the requests a load test sends, so they are left out
+// of the live error rate
+const headerLoadTest = "X-Load-Test"
+
+// Actions the error budget guard takes when live traffic suffers
+const (
+	sloActionThrottle = "throttle"
+	sloActionAbort    = "abort"
+)
+
+// LoadTestThrottle is one slowdown of a load test by the error budget guard
+type LoadTestThrottle struct {
+	At        time.Time `json:"at"`
+	ErrorRate float64   `json:"error_rate"`
+	Rate      float64   `json:"rate"`
+}
+
+var (
+	loadTestSLOErrorRate   float64
+	loadTestSLOMinRequests int
+	loadTestSLOAction      string
+	loadTestSLOInterval    time.Duration
+
+	liveTraffic *trafficWindow
+
+	loadTestSLOActions *counterVec
+)
+
+// configureLoadTestGuard reads the error budget settings. While a load test
+// runs, the error rate of all other traffic over LOAD_TEST_SLO_WINDOW is
+// checked every LOAD_TEST_SLO_CHECK_INTERVAL; once it exceeds
+// LOAD_TEST_SLO_ERROR_RATE the test's rate is halved, or the test aborted.
+func configureLoadTestGuard() {
+	loadTestSLOErrorRate = envFloat("LOAD_TEST_SLO_ERROR_RATE", 0.01)
+	loadTestSLOMinRequests = envInt("LOAD_TEST_SLO_MIN_REQUESTS", 20)
+	loadTestSLOInterval = envDuration("LOAD_TEST_SLO_CHECK_INTERVAL", 5*time.Second)
+	switch loadTestSLOAction = envString("LOAD_TEST_SLO_ACTION", sloActionThrottle); loadTestSLOAction {
+	case sloActionThrottle, sloActionAbort:
+	default:
+		configWarn("LOAD_TEST_SLO_ACTION must be throttle or abort, got %q; using throttle", loadTestSLOAction)
+		loadTestSLOAction = sloActionThrottle
+	}
+	window := envDuration("LOAD_TEST_SLO_WINDOW", time.Minute)
+	if window < time.Second {
+		window = time.Second
+	}
+	liveTraffic = newTrafficWindow(window)
+	loadTestSLOActions = newCounterVec("chatbot_load_test_slo_actions_total", "Load tests throttled or aborted because live traffic exceeded the error budget", "action")
+}
+
+// trafficWindow counts requests and errors per second over a sliding window
+type trafficWindow struct {
+	mu      sync.Mutex
+	seconds []trafficSecond
+}
+
+type trafficSecond struct {
+	unix     int64
+	requests int
+	errors   int
+}
+
+func newTrafficWindow(window time.Duration) *trafficWindow {
+	return &trafficWindow{seconds: make([]trafficSecond, int(window/time.Second))}
+}
+
+func (w *trafficWindow) record(now time.Time, failed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	unix := now.Unix()
+	slot := &w.seconds[unix%int64(len(w.seconds))]
+	if slot.unix != unix {
+		*slot = trafficSecond{unix: unix}
+	}
+	slot.requests++
+	if failed {
+		slot.errors++
+	}
+}
+
+// errorRate returns the share of failed requests in the window and how many
+// requests it covers
+func (w *trafficWindow) errorRate(now time.Time) (float64, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cutoff := now.Unix() - int64(len(w.seconds))
+	requests, errors := 0, 0
+	for _, s := range w.seconds {
+		if s.unix > cutoff {
+			requests, errors = requests+s.requests, errors+s.errors
+		}
+	}
+	if requests == 0 {
+		return 0, 0
+	}
+	return float64(errors) / float64(requests), requests
+}
+
+// fromLoadTest reports whether a request was sent by a load test: marked, and
+// from this host, where the attacker runs
+func fromLoadTest(c *gin.Context) bool {
+	if c.GetHeader(headerLoadTest) == "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// trackLiveTraffic feeds the live error rate. Server errors and rate limiting
+// count as failures, since both mean a real user went without an answer.
+func trackLiveTraffic() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if fromLoadTest(c) {
+			return
+		}
+		status := c.Writer.Status()
+		liveTraffic.record(time.Now(), status >= 500 || status == http.StatusTooManyRequests)
+	}
+}
+
+// throttledPacer sends hits at a rate the guard can lower mid-attack
+type throttledPacer struct {
+	mu   sync.Mutex
+	freq float64
+	// the rate applies from base, when baseHits had been sent; a change is
+	// rebased on the next call to Pace
+	base     time.Duration
+	baseHits uint64
+	rebase   bool
+}
+
+func (p *throttledPacer) Pace(elapsed time.Duration, hits uint64) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rebase {
+		p.base, p.baseHits, p.rebase = elapsed, hits, false
+	}
+	if p.freq <= 0 {
+		return 0, true
+	}
+	interval := time.Duration(float64(time.Second) / p.freq)
+	due := p.base + time.Duration(hits-p.baseHits+1)*interval
+	return due - elapsed, false
+}
+
+func (p *throttledPacer) Rate(time.Duration) float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.freq
+}
+
+func (p *throttledPacer) setRate(freq float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.freq, p.rebase = freq, true
+}
+
+// guardErrorBudget watches live traffic until done is closed, halving the
+// test's rate while the error rate is above the threshold and stopping the
+// test when it cannot go lower or the action is abort. After a slowdown it
+// waits a whole window, so the errors that caused it have aged out.
+func (r *loadTestRun) guardErrorBudget(done <-chan struct{}) {
+	if loadTestSLOErrorRate <= 0 || loadTestSLOInterval <= 0 {
+		return
+	}
+	window := time.Duration(len(liveTraffic.seconds)) * time.Second
+	ticker := time.NewTicker(loadTestSLOInterval)
+	defer ticker.Stop()
+	var lastThrottle time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.stopped:
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastThrottle) < window {
+				continue
+			}
+			rate, requests := liveTraffic.errorRate(now)
+			if requests < loadTestSLOMinRequests || rate <= loadTestSLOErrorRate {
+				continue
+			}
+			current := r.pacer.Rate(0)
+			if loadTestSLOAction == sloActionAbort || current <= 1 {
+				r.abortForErrorBudget(rate, requests)
+				return
+			}
+			reduced := max(current/2, 1)
+			r.pacer.setRate(reduced)
+			lastThrottle = now
+			r.mu.Lock()
+			r.throttles = append(r.throttles, LoadTestThrottle{At: now, ErrorRate: rate, Rate: reduced})
+			r.mu.Unlock()
+			loadTestSLOActions.inc(sloActionThrottle)
+			log.Printf("Load test %s: live error rate %.1f%% over %d requests is above %.1f%%; reducing the rate from %.1f/s to %.1f/s",
+				r.ID, rate*100, requests, loadTestSLOErrorRate*100, current, reduced)
+		}
+	}
+}
+
+func (r *loadTestRun) abortForErrorBudget(rate float64, requests int) {
+	loadTestSLOActions.inc(sloActionAbort)
+	reason := fmt.Sprintf("live error rate %.1f%% exceeded the %.1f%% error budget threshold", rate*100, loadTestSLOErrorRate*100)
+	r.stop(reason)
+	notify(Alert{
+		Type:     "load_test",
+		Severity: "warning",
+		Message:  fmt.Sprintf("Load test %s aborted: %s", r.ID, reason),
+		Details:  map[string]interface{}{"load_test": r.ID, "name": r.Name, "user": r.User, "error_rate": rate, "requests": requests},
+	})
+}
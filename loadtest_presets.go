@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LoadTestPreset is a named load test admins save once and launch by name.
+// Version counts the saves of the preset; earlier versions are kept in the
+// configuration history.
+type LoadTestPreset struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Users       int       `json:"users"`
+	SpawnRate   int       `json:"spawn_rate"`
+	TestTime    int       `json:"test_time"`
+	Target      string    `json:"target,omitempty"`
+	Message     string    `json:"message,omitempty"`
+	Version     int       `json:"version"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UpdatedBy   string    `json:"updated_by,omitempty"`
+}
+
+// builtinLoadTestPresets are installed at startup and can be changed or
+// deleted like any other preset
+var builtinLoadTestPresets = []LoadTestPreset{
+	{Name: "smoke", Description: "A few users for a quick check that the app answers", Users: 5, SpawnRate: 1, TestTime: 30},
+	{Name: "baseline", Description: "Typical traffic, to compare releases against", Users: 50, SpawnRate: 10, TestTime: 60},
+	{Name: "stress", Description: "Well beyond typical traffic, to find the breaking point", Users: 500, SpawnRate: 100, TestTime: 120},
+	{Name: "soak", Description: "Typical traffic for half an hour, to surface leaks", Users: 50, SpawnRate: 10, TestTime: 1800},
+}
+
+var (
+	loadTestPresetsMu sync.RWMutex
+	loadTestPresets   = map[string]LoadTestPreset{}
+	// lastPresetVersion is the highest version each preset name reached, so
+	// saving after a rollback or delete never reuses a version number
+	lastPresetVersion = map[string]int{}
+)
+
+func configureLoadTestPresets() {
+	presets := map[string]LoadTestPreset{}
+	now := time.Now().UTC()
+	for _, p := range builtinLoadTestPresets {
+		p.Version, p.UpdatedAt = 1, now
+		presets[p.Name] = p
+	}
+	setLoadTestPresets(presets)
+}
+
+func (p LoadTestPreset) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("presets need a name")
+	}
+	if p.Users <= 0 || p.SpawnRate <= 0 || p.TestTime <= 0 {
+		return fmt.Errorf("preset %s: users, spawn_rate and test_time must be positive", p.Name)
+	}
+	if p.Target != "" && p.Target != "api" && p.Target != "chat" {
+		return fmt.Errorf("preset %s: target must be api or chat", p.Name)
+	}
+	return nil
+}
+
+func validateLoadTestPresets(presets map[string]LoadTestPreset) error {
+	for name, p := range presets {
+		if p.Name != name {
+			return fmt.Errorf("preset %s is stored under the name %s", p.Name, name)
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request is the load test the preset runs. Name is left for the caller, so
+// a preset can be launched more than once at a time.
+func (p LoadTestPreset) request() LoadTestRequest {
+	return LoadTestRequest{Users: p.Users, SpawnRate: p.SpawnRate, TestTime: p.TestTime, Target: p.Target, Message: p.Message}
+}
+
+func currentLoadTestPresets() map[string]LoadTestPreset {
+	loadTestPresetsMu.RLock()
+	defer loadTestPresetsMu.RUnlock()
+	presets := make(map[string]LoadTestPreset, len(loadTestPresets))
+	for name, p := range loadTestPresets {
+		presets[name] = p
+	}
+	return presets
+}
+
+func setLoadTestPresets(presets map[string]LoadTestPreset) {
+	loadTestPresetsMu.Lock()
+	defer loadTestPresetsMu.Unlock()
+	loadTestPresets = presets
+	for name, p := range presets {
+		lastPresetVersion[name] = max(lastPresetVersion[name], p.Version)
+	}
+}
+
+func loadTestPreset(name string) (LoadTestPreset, bool) {
+	loadTestPresetsMu.RLock()
+	defer loadTestPresetsMu.RUnlock()
+	p, ok := loadTestPresets[name]
+	return p, ok
+}
+
+// saveLoadTestPreset creates or replaces a preset, bumping its version
+func saveLoadTestPreset(p LoadTestPreset, user string) LoadTestPreset {
+	loadTestPresetsMu.Lock()
+	defer loadTestPresetsMu.Unlock()
+	p.Version = lastPresetVersion[p.Name] + 1
+	lastPresetVersion[p.Name] = p.Version
+	p.UpdatedAt, p.UpdatedBy = time.Now().UTC(), user
+	presets := make(map[string]LoadTestPreset, len(loadTestPresets)+1)
+	for name, existing := range loadTestPresets {
+		presets[name] = existing
+	}
+	presets[p.Name] = p
+	loadTestPresets = presets
+	return p
+}
+
+func deleteLoadTestPreset(name string) bool {
+	loadTestPresetsMu.Lock()
+	defer loadTestPresetsMu.Unlock()
+	if _, ok := loadTestPresets[name]; !ok {
+		return false
+	}
+	presets := make(map[string]LoadTestPreset, len(loadTestPresets))
+	for n, p := range loadTestPresets {
+		if n != name {
+			presets[n] = p
+		}
+	}
+	loadTestPresets = presets
+	return true
+}
+
+// handleListLoadTestPresets returns the presets sorted by name
+func handleListLoadTestPresets(c *gin.Context) {
+	presets := []LoadTestPreset{}
+	for _, p := range currentLoadTestPresets() {
+		presets = append(presets, p)
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	c.JSON(http.StatusOK, gin.H{"presets": presets})
+}
+
+func handleSaveLoadTestPreset(c *gin.Context) {
+	var p LoadTestPreset
+	if err := c.ShouldBindJSON(&p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p.Name = c.Param("name")
+	if err := p.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p = saveLoadTestPreset(p, requestUser(c))
+	version := recordConfigChange(c, fmt.Sprintf("save load test preset %s (version %d)", p.Name, p.Version))
+	log.Printf("Load test preset %s saved by %s (version %d)", p.Name, requestUser(c), p.Version)
+	c.JSON(http.StatusOK, gin.H{"preset": p, "config_version": version})
+}
+
+func handleDeleteLoadTestPreset(c *gin.Context) {
+	name := c.Param("name")
+	if !deleteLoadTestPreset(name) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Load test preset not found"})
+		return
+	}
+	version := recordConfigChange(c, "delete load test preset "+name)
+	log.Printf("Load test preset %s deleted by %s", name, requestUser(c))
+	c.JSON(http.StatusOK, gin.H{"deleted": name, "config_version": version})
+}
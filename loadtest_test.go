@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"go.uber.org/goleak"
+)
+
+// serveLoadTestTarget points load tests at a test server until the test ends
+func serveLoadTestTarget(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := appPort
+	appPort = u.Port()
+	t.Cleanup(func() { appPort = port })
+}
+
+func TestRunLoadTestLeavesNothingBehind(t *testing.T) {
+	tests := []struct {
+		name string
+		req  LoadTestRequest
+	}{
+		{name: "one user", req: LoadTestRequest{Users: 1, SpawnRate: 20, TestTime: 1}},
+		{name: "several users", req: LoadTestRequest{Users: 5, SpawnRate: 50, TestTime: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Goroutines started by init and earlier tests are not ours; the
+			// check runs last, after the test server is closed
+			ignore := goleak.IgnoreCurrent()
+			t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+			serveLoadTestTarget(t, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"ok":true}`)
+			})
+			response, err := runLoadTest(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.TotalRequests == 0 || response.FailedRequests != 0 {
+				t.Fatalf("%d requests, %d failed", response.TotalRequests, response.FailedRequests)
+			}
+			check := response.LeakCheck
+			if check.Leaked || check.Skipped || check.Open != 0 {
+				t.Fatalf("leak check = %+v", check)
+			}
+			if check.Opened == 0 || check.Opened > int64(tt.req.Users) {
+				t.Fatalf("%d connections opened for %d users", check.Opened, tt.req.Users)
+			}
+		})
+	}
+}
+
+func TestLoadTestConnsCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		// closeBody is false for a response whose body is never closed,
+		// which keeps its connection busy
+		closeBody bool
+		leaked    bool
+	}{
+		{name: "bodies closed", closeBody: true},
+		{name: "body left open", closeBody: false, leaked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "ok")
+			}))
+			defer server.Close()
+			_, conns := newLoadTestAttacker(1)
+			defer conns.transport.CloseIdleConnections()
+			client := &http.Client{Transport: conns.transport}
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.closeBody {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			check := conns.check()
+			if !tt.closeBody {
+				resp.Body.Close()
+			}
+			if check.Opened != 1 || check.Leaked != tt.leaked {
+				t.Fatalf("leak check = %+v, want leaked %v", check, tt.leaked)
+			}
+		})
+	}
+}
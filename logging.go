@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access log formats
+const (
+	accessLogText     = "text"
+	accessLogCombined = "combined"
+	accessLogJSON     = "json"
+)
+
+var (
+	ginMode         string
+	accessLog       bool
+	accessLogFormat string
+)
+
+func configureLogging() {
+	ginMode = envString("GIN_MODE", gin.ReleaseMode)
+	switch ginMode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+	default:
+		configWarn("GIN_MODE must be debug, release or test, got %q; using release", ginMode)
+		ginMode = gin.ReleaseMode
+	}
+	accessLog = envBool("ACCESS_LOG", true)
+	accessLogFormat = envString("ACCESS_LOG_FORMAT", accessLogText)
+	switch accessLogFormat {
+	case accessLogText, accessLogCombined, accessLogJSON:
+	default:
+		configWarn("ACCESS_LOG_FORMAT must be text, combined or json, got %q; using text", accessLogFormat)
+		accessLogFormat = accessLogText
+	}
+	if accessLog {
+		configureAccessLogSink()
+	}
+}
+
+// newRouter builds the engine with the configured mode, trusted proxies and
+// access log; debug mode also prints every registered route at startup
+func newRouter() *gin.Engine {
+	gin.SetMode(ginMode)
+	r := gin.New()
+	setTrustedProxies(r)
+	if accessLog {
+		r.Use(accessLogger())
+	}
+	r.Use(gin.Recovery())
+	return r
+}
+
+func accessLogger() gin.HandlerFunc {
+	config := gin.LoggerConfig{Output: accessLogOutput}
+	switch accessLogFormat {
+	case accessLogCombined:
+		config.Formatter = combinedLogLine
+	case accessLogJSON:
+		config.Formatter = jsonLogLine
+	}
+	return gin.LoggerWithConfig(config)
+}
+
+// accessLogUser is the service token's identity or the signed-in user from
+// the proxy headers, or "-"
+func accessLogUser(p gin.LogFormatterParams) string {
+	if identity, _ := p.Keys[serviceIdentityKey].(string); identity != "" {
+		return identity
+	}
+	if user := p.Request.Header.Get("X-Forwarded-Email"); user != "" {
+		return user
+	}
+	if user := p.Request.Header.Get("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return "-"
+}
+
+// combinedLogLine writes the Apache combined log format
+func combinedLogLine(p gin.LogFormatterParams) string {
+	referer, agent := p.Request.Referer(), p.Request.UserAgent()
+	if referer == "" {
+		referer = "-"
+	}
+	if agent == "" {
+		agent = "-"
+	}
+	size := "-"
+	if p.BodySize > 0 {
+		size = fmt.Sprint(p.BodySize)
+	}
+	return fmt.Sprintf("%s - %s [%s] %q %d %s %q %q\n",
+		p.ClientIP, accessLogUser(p), p.TimeStamp.Format("02/Jan/2006:15:04:05 -0700"),
+		p.Method+" "+p.Request.RequestURI+" "+p.Request.Proto, p.StatusCode, size, referer, agent)
+}
+
+// AccessLogEntry is one request in the JSON access log
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	Bytes     int       `json:"bytes"`
+	ClientIP  string    `json:"client_ip"`
+	User      string    `json:"user,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	// ClientRequestID is the X-Request-Id the caller or proxy sent
+	ClientRequestID string `json:"client_request_id,omitempty"`
+	UserAgent       string `json:"user_agent,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+func newAccessLogEntry(p gin.LogFormatterParams) AccessLogEntry {
+	entry := AccessLogEntry{
+		Time:            p.TimeStamp,
+		Method:          p.Method,
+		Path:            p.Path,
+		Status:          p.StatusCode,
+		LatencyMs:       float64(p.Latency.Microseconds()) / 1000,
+		Bytes:           p.BodySize,
+		ClientIP:        p.ClientIP,
+		ClientRequestID: p.Request.Header.Get(headerRequestID),
+		UserAgent:       p.Request.UserAgent(),
+		Error:           p.ErrorMessage,
+	}
+	if user := accessLogUser(p); user != "-" {
+		entry.User = user
+	}
+	// Generated by requestID for the requests that use one
+	entry.RequestID, _ = p.Keys[headerRequestID].(string)
+	return entry
+}
+
+func jsonLogLine(p gin.LogFormatterParams) string {
+	line, _ := json.Marshal(newAccessLogEntry(p))
+	return string(line) + "\n"
+}
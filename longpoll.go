@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Long polling lets clients behind proxies that break server-sent events
+// approximate streaming. POST /api/chat/poll runs the request through
+// /api/chat/stream in the background; GET /api/chat/poll/:id returns the text
+// produced since the client's cursor, waiting until there is some.
+
+var (
+	pollMaxWait     time.Duration
+	pollIdleTimeout time.Duration
+	pollRetention   time.Duration
+	pollMaxBody     int64
+
+	// pollRouter serves the stream requests of poll sessions and WebSocket
+	// streams
+	pollRouter http.Handler
+
+	pollMu       sync.Mutex
+	pollSessions = map[string]*pollSession{}
+)
+
+func configureLongPoll() {
+	pollMaxWait = envDuration("POLL_MAX_WAIT", 25*time.Second)
+	pollIdleTimeout = envDuration("POLL_IDLE_TIMEOUT", 2*time.Minute)
+	pollRetention = envDuration("POLL_RETENTION", 5*time.Minute)
+	pollMaxBody = envSize("POLL_MAX_BODY", 1<<20)
+}
+
+// PollResponse is what a poll returns: Content is the text after the
+// cursor, and Cursor is where the next poll continues from
+type PollResponse struct {
+	ID               string `json:"id"`
+	Cursor           int    `json:"cursor"`
+	Content          string `json:"content"`
+	Done             bool   `json:"done"`
+	ConversationID   string `json:"conversation_id,omitempty"`
+	MessageID        string `json:"message_id,omitempty"`
+	MessageStatus    string `json:"message_status,omitempty"`
+	Truncated        bool   `json:"truncated,omitempty"`
+	Policy           string `json:"policy,omitempty"`
+	PolicyMessage    string `json:"policy_message,omitempty"`
+	StatusCode       int    `json:"status_code,omitempty"`
+	Error            string `json:"error,omitempty"`
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+	// PendingActions are tool calls waiting for the user to confirm them
+	PendingActions []PendingAction `json:"pending_actions,omitempty"`
+}
+
+// pollSession collects the events of one background stream. It is the
+// stream's http.ResponseWriter.
+type pollSession struct {
+	user   string
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	pending  bytes.Buffer
+	text     strings.Builder
+	resp     PollResponse
+	changed  chan struct{}
+	lastPoll time.Time
+}
+
+func (s *pollSession) Header() http.Header { return s.header }
+
+func (s *pollSession) WriteHeader(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+// Write parses server-sent events as they arrive; other responses are
+// errors, kept whole until the handler returns
+func (s *pollSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	s.pending.Write(p)
+	if s.status != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		frame, rest, ok := bytes.Cut(s.pending.Bytes(), []byte("\n\n"))
+		if !ok {
+			break
+		}
+		s.event(string(frame))
+		s.pending = *bytes.NewBuffer(append([]byte(nil), rest...))
+	}
+	return len(p), nil
+}
+
+func (s *pollSession) Flush() {}
+
+// event applies one event of /api/chat/stream to the response
+func (s *pollSession) event(frame string) {
+	name, data := parseSSEFrame(frame)
+	var fields struct {
+		ConversationID   string `json:"conversation_id"`
+		MessageID        string `json:"message_id"`
+		Content          string `json:"content"`
+		Policy           string `json:"policy"`
+		Message          string `json:"message"`
+		Error            string `json:"error"`
+		Status           string `json:"status"`
+		PromptTokens     int    `json:"prompt_tokens"`
+		CompletionTokens int    `json:"completion_tokens"`
+	}
+	json.Unmarshal([]byte(data), &fields)
+	switch name {
+	case "start":
+		s.resp.ConversationID, s.resp.MessageID = fields.ConversationID, fields.MessageID
+	case "delta":
+		s.text.WriteString(fields.Content)
+	case "policy":
+		s.resp.Policy, s.resp.PolicyMessage = fields.Policy, fields.Message
+	case "truncated":
+		s.resp.Truncated = true
+	case "status":
+		if fields.MessageID == s.resp.MessageID {
+			s.resp.MessageStatus = fields.Status
+		}
+	case "action_required":
+		var action PendingAction
+		if json.Unmarshal([]byte(data), &action) == nil {
+			s.resp.PendingActions = append(s.resp.PendingActions, action)
+		}
+	case "error":
+		s.resp.Error = fields.Error
+	case "done":
+		s.resp.PromptTokens, s.resp.CompletionTokens = fields.PromptTokens, fields.CompletionTokens
+	}
+	s.notify()
+}
+
+// notify wakes the polls waiting for a change; s.mu must be held
+func (s *pollSession) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// finish marks the stream as ended, taking the error of a response that
+// never started streaming
+func (s *pollSession) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resp.Done, s.resp.StatusCode = true, s.status
+	if s.status != http.StatusOK {
+		var failed struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(s.pending.Bytes(), &failed)
+		s.resp.Error = failed.Error
+	}
+	s.notify()
+}
+
+// snapshot returns the response for a poll from cursor, and a channel closed
+// on the next change
+func (s *pollSession) snapshot(cursor int) (PollResponse, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPoll = time.Now()
+	resp := s.resp
+	text := s.text.String()
+	cursor = min(max(cursor, 0), len(text))
+	resp.Content, resp.Cursor = text[cursor:], len(text)
+	return resp, s.changed
+}
+
+// sweepPollSessions cancels streams nobody polls any more and forgets
+// finished sessions after POLL_RETENTION
+func sweepPollSessions() {
+	pollMu.Lock()
+	defer pollMu.Unlock()
+	for id, s := range pollSessions {
+		s.mu.Lock()
+		idle, done := time.Since(s.lastPoll), s.resp.Done
+		s.mu.Unlock()
+		switch {
+		case done && idle > pollRetention:
+			delete(pollSessions, id)
+		case !done && pollIdleTimeout > 0 && idle > pollIdleTimeout:
+			log.Printf("Poll session %s abandoned, stopping its stream", id)
+			s.cancel()
+		}
+	}
+}
+
+// handleStartPoll takes the same body as /api/chat/stream and answers 202
+// with the session to poll. Rejections such as an unknown persona show up in
+// the first poll.
+func handleStartPoll(c *gin.Context) {
+	sweepPollSessions()
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, pollMaxBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Request body is larger than %d bytes", pollMaxBody)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/chat/stream", bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start the stream"})
+		return
+	}
+	// The stream runs as the caller
+	req.Header = c.Request.Header.Clone()
+	req.RemoteAddr = c.Request.RemoteAddr
+
+	id := newID()
+	session := &pollSession{user: requestUser(c), cancel: cancel, header: http.Header{}, changed: make(chan struct{}), lastPoll: time.Now()}
+	session.resp.ID = id
+	pollMu.Lock()
+	pollSessions[id] = session
+	pollMu.Unlock()
+
+	go func() {
+		defer cancel()
+		pollRouter.ServeHTTP(session, req)
+		session.finish()
+	}()
+	c.JSON(http.StatusAccepted, gin.H{"id": id})
+}
+
+// handlePoll returns the output after ?cursor=, waiting up to ?wait= (at most
+// POLL_MAX_WAIT) when there is nothing new yet
+func handlePoll(c *gin.Context) {
+	pollMu.Lock()
+	session, ok := pollSessions[c.Param("id")]
+	pollMu.Unlock()
+	if !ok || session.user != requestUser(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Poll session not found"})
+		return
+	}
+	cursor, _ := strconv.Atoi(c.Query("cursor"))
+	wait := pollMaxWait
+	if v, err := time.ParseDuration(c.Query("wait")); err == nil && v < wait {
+		wait = v
+	}
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		resp, changed := session.snapshot(cursor)
+		if resp.Content != "" || resp.Done {
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			c.JSON(http.StatusOK, resp)
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
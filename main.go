@@ -1,51 +1,118 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	vegeta "github.com/tsenart/vegeta/v12/lib"
+
+	"chatbot_studio/server/pkg/server"
 )
 
 // ChatRequest represents the incoming chat request
 type ChatRequest struct {
-	Message string `json:"message"`
+	Message        string `json:"message"`
+	ConversationID string `json:"conversation_id"`
+	Deterministic  bool   `json:"deterministic"`
+	Seed           *int64 `json:"seed"`
+	Priority       string `json:"priority"`
+	Persona        string `json:"persona"`
+	// Language, Model and Temperature override the conversation's settings
+	// for this turn, as Persona does
+	Language    string   `json:"language"`
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature"`
+	// Tables are small datasets the user asks about in this turn
+	Tables []TableAttachment `json:"tables,omitempty"`
+	// tables is Tables as rendered for the model
+	tables string
+	// Tags label the turn for the transcript webhook's filter
+	Tags []string `json:"tags,omitempty"`
+	// DryRun returns the payload instead of sending it
+	DryRun bool `json:"dry_run"`
+	// Debug adds the prompt's token budget to the response
+	Debug bool `json:"debug"`
+}
+
+// ChatMessage represents a single turn in a conversation
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Set on the tool-calling turns sent back to the model
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
 }
 
 // ChatResponse represents the outgoing chat response
 type ChatResponse struct {
-	Content string `json:"content"`
+	Content        string           `json:"content"`
+	Policy         string           `json:"policy,omitempty"`
+	Truncated      bool             `json:"truncated,omitempty"`
+	ConversationID string           `json:"conversation_id,omitempty"`
+	MessageID      string           `json:"message_id,omitempty"`
+	Determinism    *DeterminismInfo `json:"determinism,omitempty"`
+	TokenBudget    *TokenBudget     `json:"token_budget,omitempty"`
+	// PendingActions are tool calls waiting for the user to confirm them
+	PendingActions []PendingAction `json:"pending_actions,omitempty"`
+	// Escalation is set once the conversation is handed to a human agent
+	Escalation *Escalation `json:"escalation,omitempty"`
+	// Charts are Vega-Lite specs of the tables in the answer
+	Charts []ChartSpec `json:"charts,omitempty"`
 }
 
 // LLMResponse represents the response from the LLM endpoint
 type LLMResponse struct {
 	Choices []struct {
 		Message struct {
-			Content string `json:"content"`
+			Content   string     `json:"content"`
+			ToolCalls []ToolCall `json:"tool_calls,omitempty"`
 		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	SystemFingerprint string `json:"system_fingerprint"`
+	// latency is the time the endpoint took to answer, set by completeChat
+	latency time.Duration
+	Usage   struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
 }
 
 // LoadTestRequest represents the incoming load test configuration
 type LoadTestRequest struct {
-	Users     int `form:"users" binding:"required,gt=0"`
-	SpawnRate int `form:"spawn_rate" binding:"required,gt=0"`
-	TestTime  int `form:"test_time" binding:"required,gt=0"`
+	Users     int `form:"users" json:"users" binding:"required,gt=0"`
+	SpawnRate int `form:"spawn_rate" json:"spawn_rate" binding:"required,gt=0"`
+	TestTime  int `form:"test_time" json:"test_time" binding:"required,gt=0"`
+	// Target is "api" (the default) or "chat", which posts Message to /api/chat
+	Target  string `form:"target" json:"target" binding:"omitempty,oneof=api chat"`
+	Message string `form:"message" json:"message"`
+	// Name tells concurrent load tests apart; it must be unique among them
+	Name string `form:"name" json:"name"`
+	// User is who chat requests are attributed to, for the usual abuse checks
+	User string `form:"-" json:"-"`
 }
 
 // LoadTestResponse represents the load test results
 type LoadTestResponse struct {
+	ID                 string  `json:"id"`
+	Name               string  `json:"name,omitempty"`
+	Preset             string  `json:"preset,omitempty"`
+	PresetVersion      int     `json:"preset_version,omitempty"`
 	TestDuration       int     `json:"test_duration"`
 	TotalRequests      int64   `json:"total_requests"`
 	SuccessfulRequests int64   `json:"successful_requests"`
@@ -60,6 +127,15 @@ type LoadTestResponse struct {
 		P99  time.Duration `json:"p99"`
 	} `json:"response_time"`
 	Errors []ErrorDetail `json:"errors"`
+	// Throttles are the slowdowns by the error budget guard
+	Throttles []LoadTestThrottle `json:"throttles,omitempty"`
+	// LatencySplit is only reported for the chat target
+	LatencySplit *LatencySplit `json:"latency_split,omitempty"`
+	LeakCheck    LeakCheck     `json:"leak_check"`
+	// Stopped is set when the test was stopped before TestDuration; the
+	// results cover the requests made until then
+	Stopped    bool   `json:"stopped,omitempty"`
+	StopReason string `json:"stop_reason,omitempty"`
 }
 
 type ErrorDetail struct {
@@ -68,44 +144,131 @@ type ErrorDetail struct {
 	ErrorType string `json:"error_type"`
 }
 
-var (
-	llmEndpoint string
-	apiKey      string
-)
+var appPort string
 
 func init() {
 	// Load .env file
 	if err := godotenv.Load(); err != nil {
 		log.Printf("Warning: .env file not found or error loading it: %v", err)
 	}
+	configureScrubbing()
 
 	// Load environment variables
-	llmEndpoint = os.Getenv("SERVING_ENDPOINT_NAME")
-	apiKey = os.Getenv("DATABRICKS_TOKEN")
-
-	if llmEndpoint == "" || apiKey == "" {
-		log.Fatal("Missing required environment variables")
+	setLLMEndpoint(lookupEnv("SERVING_ENDPOINT_NAME", ""))
+	setDatabricksToken(lookupEnv("DATABRICKS_TOKEN", ""))
+	setDatabricksHost(lookupEnv("DATABRICKS_HOST", ""))
+	appPort = lookupEnv("DATABRICKS_APP_PORT", "")
+
+	// --validate-config reports missing variables itself, and migrate only
+	// needs the database
+	if !validateMode() && !migrateMode() {
+		configureReadiness()
 	}
+
+	configureLogging()
+	configureIPFilters()
+	configureHTTPMetrics()
+	configureTelemetry()
+	configureStorage()
+	configureAudit()
+	configureAnomalyDetection()
+	configureReplay()
+	configureKillSwitches()
+	configureAdmin()
+	configureServiceAuth()
+	configureBruteForce()
+	configureEntitlements()
+	configurePrompts()
+	configureNotifier()
+	configureCredentials()
+	configureAbuse()
+	configureArtifacts()
+	configureRAG()
+	configureRetrieval()
+	configureRegression()
+	configureQuality()
+	configureGuardrails()
+	configureRedTeam()
+	configureStreaming()
+	configureLongPoll()
+	configureWebSocket()
+	configureTruncation()
+	configureTokenBudget()
+	configureContextWindow()
+	configureTables()
+	configureCharts()
+	configureConversations()
+	configureSync()
+	configureTranscripts()
+	configureEscalation()
+	configureInbox()
+	configureArchival()
+	configureCompare()
+	configureRouter()
+	configureResponseCache()
+	configureDeterminism()
+	configurePriority()
+	configureUpstreamRate()
+	configureUpstreamProxy()
+	configureUpstreamTLS()
+	configureCapabilities()
+	configureHedging()
+	configureJobs()
+	configureLoadTests()
+	configureBatch()
+	configureAsyncChat()
+	configurePlugins()
+	configureScripts()
+	configureMCP()
+	configureActions()
+	configureTickets()
+	configureDrafts()
+	configureReminders()
+	configureNotifications()
+	configureMCPServer()
+	configureConfigBundle()
+	configureConfigHistory()
+	configureStaticAssets()
+	configureMirroring()
 }
 
 func StartGoServer() {
-	r := gin.Default()
+	r := newRouter()
+	pollRouter = r
 
 	// Debug: Print current working directory and static file path
 	currentDir, _ := os.Getwd()
 	staticPath := filepath.Join(currentDir, "client/build")
 
+	startPlugins()
+	startMCPClients()
+	watchCredentials()
+	startCredentialChecks()
+	startConversationArchiver()
+
 	// CORS middleware configuration first
 	config := cors.Config{
 		AllowAllOrigins:  true,
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		ExposeHeaders:    exposedHeaders,
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}
+	r.Use(scrubErrorResponses())
 	r.Use(cors.New(config))
+	r.Use(httpMetrics())
+	r.Use(trackLiveTraffic())
+	r.Use(requireAllowedIP(apiIPFilter))
+	r.Use(serviceAuth())
+	r.Use(server.Middleware()...)
+	r.Use(apiSurrogateHeaders())
 
 	// API routes first
+	r.GET("/metrics", handleMetrics)
+	r.GET("/healthz", handleHealthz)
+	r.GET("/readyz", handleReadyz)
+	r.GET("/status", handleStatus)
 	r.GET("/api", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "Welcome to the LLM Chat API"})
 	})
@@ -114,27 +277,176 @@ func StartGoServer() {
 		c.Status(http.StatusOK)
 	})
 
-	r.POST("/api/chat", chatWithLLM)
+	r.POST("/api/chat", mirrorTraffic(), requireCredentials, chatWithLLM)
+	r.POST("/api/chat/stream", mirrorTraffic(), requireCredentials, requireFeature("streaming"), chatStream)
+	r.POST("/api/chat/poll", requireCredentials, requireFeature("streaming"), handleStartPoll)
+	r.GET("/api/chat/poll/:id", handlePoll)
+	r.GET("/api/chat/ws", requireFeature("streaming"), handleChatWebSocket)
+	r.POST("/api/chat/continue", requireCredentials, handleChatContinue)
+	r.POST("/api/chat/compare", requireCredentials, requireFeature("compare"), handleChatCompare)
+	r.POST("/api/chat/async", requireCredentials, requireFeature("streaming"), handleSubmitAsyncChat)
+	r.POST("/api/batch/chat", requireCredentials, requireFeature("batch"), handleSubmitBatchChat)
+	r.GET("/api/jobs", handleListJobs)
+	r.GET("/api/jobs/:id", handleGetJob)
+	r.GET("/api/entitlements", handleGetEntitlements)
+	r.GET("/api/models/capabilities", handleModelCapabilities)
+	r.GET("/api/conversations", handleListConversations)
+	r.GET("/api/sync", handleSync)
+	r.GET("/api/conversations/:id", handleGetConversation)
+	r.POST("/api/conversations/:id/rehydrate", handleRehydrateConversation)
+	r.POST("/api/conversations/:id/escalate", handleEscalateConversation)
+	r.POST("/api/conversations/:id/read", handleMarkConversationRead)
+	r.GET("/api/conversations/:id/settings", handleGetConversationSettings)
+	r.PUT("/api/conversations/:id/settings", handleSetConversationSettings)
+	r.GET("/api/conversations/:id/report", handleConversationReport)
+	r.GET("/api/conversations/:id/events", handleConversationEvents)
+	r.POST("/api/conversations/:id/fork", handleForkConversation)
+	r.PATCH("/api/conversations/:id/messages/:message_id", handleEditMessage)
+	r.DELETE("/api/conversations/:id/messages/:message_id", handleDeleteMessage)
+	r.GET("/api/messages/diff", handleMessageDiff)
+	if remindersEnabled {
+		r.GET("/api/reminders", handleListReminders)
+		r.POST("/api/reminders", handleCreateReminder)
+		r.DELETE("/api/reminders/:id", handleCancelReminder)
+	}
+	r.GET("/api/notifications", handleListNotifications)
+	r.GET("/api/notifications/stream", handleNotificationStream)
+	r.GET("/api/actions", handleListActions)
+	r.POST("/api/actions/:id/confirm", requireFeature("tools"), handleConfirmAction)
+	r.POST("/api/actions/:id/reject", handleRejectAction)
+
+	r.POST("/api/langserve/invoke", requireCredentials, handleLangServeInvoke)
+	r.POST("/api/langserve/batch", requireCredentials, handleLangServeBatch)
+	r.POST("/api/langserve/stream", requireCredentials, requireFeature("streaming"), handleLangServeStream)
+	r.GET("/api/langserve/input_schema", handleLangServeInputSchema)
+	r.GET("/api/langserve/output_schema", handleLangServeOutputSchema)
+	r.GET("/api/langserve/config_schema", handleLangServeConfigSchema)
+
+	if mcpServerEnabled {
+		r.POST("/mcp", requireCredentials, handleMCPStream)
+		r.GET("/mcp/sse", handleMCPSSE)
+		r.POST("/mcp/messages", requireCredentials, handleMCPSSEMessage)
+	}
 
 	// Add the load test endpoint
-	r.GET("/api/load-test", handleLoadTest)
+	r.GET("/api/load-test", requireCredentials, requireFeature("load_test"), handleLoadTest)
+	r.GET("/api/load-test/presets", requireCredentials, requireFeature("load_test"), handleListLoadTestPresets)
 
-	//Static file serving last
-	r.Static("/static", filepath.Join(staticPath, "static"))
-	r.NoRoute(func(c *gin.Context) {
-		indexPath := filepath.Join(staticPath, "index.html")
-		if fileExists(indexPath) {
-			c.File(indexPath)
+	r.POST("/api/telemetry", handleTelemetry)
+
+	r.POST("/api/export/notebook", requireCredentials, handleNotebookExport)
+	r.GET("/api/artifacts/:key", handleGetArtifact)
+	if assetManifestEnabled {
+		r.GET("/api/assets/manifest", handleAssetManifest(staticPath))
+	}
+
+	// Support agent routes
+	agent := r.Group("/api/agent", requireAgent())
+	agent.GET("/inbox", handleAgentInbox)
+	agent.GET("/presence", handleListAgentPresence)
+	agent.PUT("/presence", handleSetAgentPresence)
+	agent.GET("/conversations/:id", handleGetAgentConversation)
+	agent.POST("/conversations/:id/read", handleMarkEscalationRead)
+	agent.POST("/conversations/:id/claim", handleClaimEscalation)
+	agent.POST("/conversations/:id/release", handleReleaseEscalation)
+	agent.POST("/conversations/:id/reply", handleAgentReply)
+	agent.POST("/conversations/:id/resolve", handleResolveEscalation)
+
+	// Admin routes
+	admin := r.Group("/api", requireAllowedIP(adminIPFilter), requireAdmin())
+	admin.GET("/usage/timeseries", handleUsageTimeseries)
+	admin.GET("/admin/analytics/leaderboard", handleLeaderboard)
+	admin.GET("/admin/bans", handleListBans)
+	admin.GET("/admin/security/events", handleListSecurityEvents)
+	admin.DELETE("/admin/bans/:identity", handleLiftBan)
+	admin.GET("/admin/rag/files", handleListVolumeFiles)
+	admin.POST("/admin/rag/sync", handleRAGSync)
+	admin.GET("/admin/rag/status", handleRAGStatus)
+	admin.GET("/admin/rag/corpora", handleListCorpora)
+	admin.PUT("/admin/rag/chunking", handleUpdateChunking)
+	admin.POST("/admin/rag/reindex", handleRAGReindex)
+	admin.GET("/admin/rag/search", handleRAGSearch)
+	admin.POST("/admin/rag/eval", handleRAGEval)
+	admin.POST("/admin/regression/run", handleRunRegression)
+	admin.GET("/admin/quality/trends", handleQualityTrends)
+	admin.POST("/admin/redteam/run", handleRunRedTeam)
+	admin.GET("/admin/upstream/pool", handlePoolStats)
+	admin.GET("/admin/upstream/rate", handleUpstreamRateStats)
+	admin.GET("/admin/config/effective", handleEffectiveConfig)
+	admin.GET("/admin/diagnostics", handleDiagnostics)
+	admin.GET("/admin/config/history", handleConfigHistory)
+	admin.POST("/admin/config/rollback", handleConfigRollback)
+	admin.POST("/admin/config/bundle/apply", handleApplyConfigBundle)
+	admin.GET("/admin/kill-switches", handleListKillSwitches)
+	admin.PUT("/admin/kill-switches/:feature", handleEngageKillSwitch)
+	admin.DELETE("/admin/kill-switches/:feature", handleReleaseKillSwitch)
+	admin.POST("/admin/models/capabilities/refresh", handleRefreshCapabilities)
+	admin.POST("/admin/replay/:id", handleReplayRequest)
+	admin.GET("/admin/plugins", handleListPlugins)
+	admin.GET("/admin/scripts", handleListScripts)
+	admin.PUT("/admin/scripts", handleSetScripts)
+	admin.GET("/admin/mcp/servers", handleListMCPServers)
+	admin.POST("/admin/notifications/broadcast", handleBroadcastNotification)
+	admin.GET("/admin/state/export", handleExportState)
+	admin.POST("/admin/state/import", handleImportState)
+	admin.POST("/admin/conversations/:id/rebuild", handleRebuildConversation)
+	admin.POST("/admin/bulk/conversations/purge", handleBulkPurgeConversations)
+	admin.POST("/admin/bulk/webhooks/retry", handleBulkRetryWebhooks)
+	admin.POST("/admin/bulk/cache/invalidate", handleBulkInvalidateCache)
+	admin.POST("/admin/bulk/keys/rotate", handleBulkRotateKeys)
+	admin.GET("/admin/load-tests", handleListLoadTests)
+	admin.GET("/admin/load-tests/:id", handleGetLoadTest)
+	admin.POST("/admin/load-tests/:id/stop", handleStopLoadTest)
+	admin.PUT("/admin/load-tests/presets/:name", handleSaveLoadTestPreset)
+	admin.DELETE("/admin/load-tests/presets/:name", handleDeleteLoadTestPreset)
+
+	// Routes registered through pkg/server by embedding code
+	for _, route := range server.Routes() {
+		if route.Admin {
+			admin.Handle(route.Method, route.Path, route.Handlers...)
 		} else {
-			log.Printf("Index file not found at: %s", indexPath)
-			c.String(http.StatusNotFound, "File not found")
+			r.Handle(route.Method, route.Path, route.Handlers...)
 		}
-	})
+	}
+
+	//Static file serving last
+	r.Group("/static", staticCacheHeaders(filepath.Join(staticPath, "static"))).Static("/", filepath.Join(staticPath, "static"))
+	r.NoRoute(serveIndex(staticPath))
+
+	startAnomalyDetector()
+	startQualityEvaluator()
+	startJobQueue()
+	startReminderScheduler()
+	startMirroring()
+	startKillSwitchSync()
+	startCapabilityDiscovery()
+	startReplayPruning()
 
 	log.Println("Starting the Go server...")
-	if err := r.Run(fmt.Sprintf(":%s", os.Getenv("DATABRICKS_APP_PORT"))); err != nil {
+	serve(&http.Server{Addr: fmt.Sprintf(":%s", appPort), Handler: r.Handler()})
+}
+
+// serve runs srv until SIGINT or SIGTERM, then stops load tests so their
+// results are saved and lets requests finish for up to SHUTDOWN_TIMEOUT
+func serve(srv *http.Server) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		stopLoadTests("server shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown did not complete: %v", err)
+		}
+	}()
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-done
 }
 
 func chatWithLLM(c *gin.Context) {
@@ -146,67 +458,191 @@ func chatWithLLM(c *gin.Context) {
 
 	log.Printf("Received message: %s", req.Message)
 
-	payload := map[string]interface{}{
-		"messages": []map[string]string{
-			{"role": "user", "content": req.Message},
-		},
+	prio, ok := parsePriority(req.Priority)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "priority must be interactive or batch"})
+		return
+	}
+	if !resolveChatSettings(c, &req) {
+		return
+	}
+	system := chatSystemPrompt(req.Persona, req.Language)
+	endpoint, ok := applyRequestScripts(c, &req)
+	if !ok {
+		return
+	}
+	if !attachRequestTables(c, &req) {
+		return
+	}
+	if !admitChatRequest(c, req.Message) {
+		return
+	}
+	endpoint = routePrompt(endpoint, req.Message)
+	conv, found := conversationForChat(c, req)
+	if !found {
+		return
+	}
+	if !req.DryRun && escalateChat(c, conv, req, false) {
+		return
 	}
 
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payload"})
+	messages := attachTables(buildConversationMessages(system, conv.Messages, req.Message), req.tables)
+	payload := chatPayload(messages)
+	payload.Temperature = req.Temperature
+	determinism := applyDeterminism(payload, endpoint, req)
+	if defs := toolDefinitions(); len(defs) > 0 {
+		payload.Tools = defs
+	}
+	if req.DryRun {
+		respondDryRun(c, endpoint, conv, payload)
 		return
 	}
+	// Trimmed to the endpoint's context window before the budget is taken
+	payload = applyCapabilities(endpoint, payload)
+	budget := promptBudget(payload)
+
+	start := time.Now()
+	record := AuditRecord{
+		ID:              requestID(c),
+		ClientRequestID: clientRequestID(c),
+		Timestamp:       start,
+		User:            requestUser(c),
+		Model:           endpoint,
+		Prompt:          req.Message,
+	}
+	captureRequest(record, req, endpoint, payload)
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+		if record.StatusCode == http.StatusOK {
+			sampleForJudging(record, groundingOf(messages))
+		}
+	}()
 
-	log.Printf("Payload: %s", string(jsonPayload))
+	fail := func(status int, message string) {
+		record.StatusCode = status
+		record.Error = message
+		c.JSON(status, gin.H{"error": message})
+	}
 
-	client := &http.Client{}
-	requestURL := fmt.Sprintf("https://%s/serving-endpoints/%s/invocations", os.Getenv("DATABRICKS_HOST"), llmEndpoint)
-	httpReq, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+	// Requests pinning a seed or temperature, or attaching tables, are
+	// answered by the model
+	var cache *cacheProbe
+	if determinism == nil && req.Temperature == nil && req.tables == "" {
+		cache = probeResponseCache(c, endpoint, system, req.Message, conv, payload)
+	}
+	if cache != nil && cache.hit != nil {
+		record.StatusCode, record.Response = http.StatusOK, cache.hit.content
+		answer := Message{ID: newID(), Content: cache.hit.content, Charts: chartSpecs(cache.hit.content)}
+		recordTurn(conv, req, endpoint, answer)
+		c.JSON(http.StatusOK, ChatResponse{Content: answer.Content, ConversationID: conv.ID, MessageID: answer.ID, Charts: answer.Charts})
 		return
 	}
 
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+	release := acquireChatSlot(c, prio)
+	if release == nil {
+		record.StatusCode, record.Error = http.StatusServiceUnavailable, "upstream queue timeout"
+		return
+	}
+	defer release()
 
-	log.Printf("Sending request to LLM endpoint: %s", llmEndpoint)
-	resp, err := client.Do(httpReq)
+	log.Printf("Sending request to LLM endpoint: %s", endpoint)
+	upstreamStart := time.Now()
+	// Deterministic requests stay on the endpoint they were pinned for
+	resp, answeredBy, err := sendChat(endpoint, payload, determinism == nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send request to LLM"})
+		fail(http.StatusInternalServerError, "Failed to send request to LLM")
 		return
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp.Body)
+	endpoint, record.Model = answeredBy, answeredBy
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("HTTP error occurred. Status: %d, Body: %s", resp.StatusCode, string(body))
-		c.JSON(resp.StatusCode, gin.H{"error": "Error from LLM endpoint"})
+		log.Printf("HTTP error occurred. Status: %d, Body: %s", resp.StatusCode, readErrorBody(resp.Body))
+		fail(resp.StatusCode, "Error from LLM endpoint")
 		return
 	}
 
 	log.Println("Received response from LLM")
 
 	var llmResp LLMResponse
-	if err := json.NewDecoder(resp.Body).Decode(&llmResp); err != nil {
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(&llmResp); err != nil {
 		log.Printf("Failed to decode response: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid response from LLM endpoint"})
+		fail(http.StatusInternalServerError, "Invalid response from LLM endpoint")
 		return
 	}
+	// Before tool rounds add their own prompts
+	learnTokenRatio(endpoint, budget.Total, llmResp.Usage.PromptTokens)
+	budget.calibrate(llmResp.Usage.PromptTokens)
+
+	session := &toolSession{user: record.User, conversationID: conv.ID}
+	final, err := resolveToolCalls(endpoint, payload, &llmResp, session)
+	if err != nil {
+		log.Printf("Tool calling failed: %v", err)
+		fail(http.StatusBadGateway, "Error from LLM endpoint")
+		return
+	}
+	llmResp = *final
+	// Includes tool-call rounds, which go back to the model
+	setUpstreamHeaders(c, endpoint, time.Since(upstreamStart))
 
 	if len(llmResp.Choices) == 0 || llmResp.Choices[0].Message.Content == "" {
 		log.Println("Invalid response structure from LLM")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid response structure from LLM endpoint"})
+		fail(http.StatusInternalServerError, "Invalid response structure from LLM endpoint")
 		return
 	}
 
 	content := llmResp.Choices[0].Message.Content
-	c.JSON(http.StatusOK, ChatResponse{Content: content})
+	record.StatusCode = http.StatusOK
+	record.Response = content
+	record.PromptTokens = llmResp.Usage.PromptTokens
+	record.CompletionTokens = llmResp.Usage.CompletionTokens
+	rateLimiter.chargeTokens(llmResp.Usage.TotalTokens)
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+	setTokenHeaders(c, record.PromptTokens, record.CompletionTokens)
+	budget.observe()
+	var debugBudget *TokenBudget
+	if req.Debug {
+		debugBudget = &budget
+	}
+
+	if v := checkGuardrails("output", content); v != nil {
+		log.Printf("Guardrail %s blocked output", v.Rule)
+		record.Error = "output blocked by guardrail " + v.Rule
+		answer := Message{ID: newID(), Content: v.Message, Policy: v.Rule}
+		recordTurn(conv, req, endpoint, answer)
+		c.JSON(http.StatusOK, ChatResponse{Content: v.Message, Policy: v.Rule, ConversationID: conv.ID, MessageID: answer.ID, TokenBudget: debugBudget, PendingActions: session.pending})
+		return
+	}
+
+	answer := Message{ID: newID()}
+	answer.Content, answer.Truncated = truncateResponse(postProcessAnswer(req.Message, content))
+	answer.Truncated = answer.Truncated || llmResp.Choices[0].FinishReason == "length"
+	answer.Charts = chartSpecs(answer.Content)
+	recordTurn(conv, req, endpoint, answer)
+	// An answer asking to confirm an action is only right the first time
+	if !answer.Truncated && len(session.pending) == 0 {
+		cache.store(answer.Content, record.Cost)
+	}
+	if determinism != nil {
+		determinism.SystemFingerprint = llmResp.SystemFingerprint
+	}
+	c.JSON(http.StatusOK, ChatResponse{Content: answer.Content, Truncated: answer.Truncated, ConversationID: conv.ID, MessageID: answer.ID, Determinism: determinism, TokenBudget: debugBudget, PendingActions: session.pending,
+		Escalation: escalateUncertain(conv, answer.Content), Charts: answer.Charts})
 }
 
 func handleLoadTest(c *gin.Context) {
 	var req LoadTestRequest
+	// A preset fills in the parameters; any given in the query override it
+	var preset LoadTestPreset
+	if name := c.Query("preset"); name != "" {
+		var ok bool
+		if preset, ok = loadTestPreset(name); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Load test preset not found"})
+			return
+		}
+		req = preset.request()
+	}
 	if err := c.ShouldBindQuery(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -221,34 +657,82 @@ func handleLoadTest(c *gin.Context) {
 		"client_ip":  c.GetHeader("X-Real-Ip"),
 	}
 	log.Printf("Load test initiated by user: %v", userInfo)
+	req.User = requestUser(c)
 
-	// Create a new load test target
-	target := fmt.Sprintf("http://localhost:%s/api", os.Getenv("DATABRICKS_APP_PORT"))
-	rate := vegeta.Rate{Freq: req.SpawnRate, Per: time.Second}
+	response, err := runLoadTest(req)
+	if preset.Name != "" {
+		response.Preset, response.PresetVersion = preset.Name, preset.Version
+	}
+	switch {
+	case errors.Is(err, errLoadTestNameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errLoadTestCapacity):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// runLoadTest attacks the app's own API at the requested rate and summarizes
+// the results. It fails when the test would exceed the capacity left by the
+// load tests already running.
+func runLoadTest(req LoadTestRequest) (LoadTestResponse, error) {
 	duration := time.Duration(req.TestTime) * time.Second
 
-	// Create the attacker
-	attacker := vegeta.NewAttacker()
+	run, err := startLoadTestRun(req)
+	if err != nil {
+		return LoadTestResponse{}, err
+	}
+	defer finishLoadTestRun(run)
+
+	// Create the attacker, with one worker and connection per user at most
+	attacker, conns := newLoadTestAttacker(req.Users)
 
 	// Create a metrics collector
 	metrics := &vegeta.Metrics{}
 
-	// Create the target function with GET request instead of POST
-	targeter := vegeta.NewStaticTargeter(vegeta.Target{
-		Method: "GET",
-		URL:    target,
-		Header: http.Header{
-			"Content-Type": []string{"application/json"},
-		},
-	})
+	targeter := vegeta.NewStaticTargeter(loadTestTarget(req))
 
 	// Add a counter to track requests
-	for res := range attacker.Attack(targeter, rate, duration, "Load Test") {
-		metrics.Add(res)
+	var split latencySplitter
+	results := attacker.Attack(targeter, run.pacer, duration, "Load Test")
+	done := make(chan struct{})
+	go run.guardErrorBudget(done)
+	stop := run.stopped
+	var abandon <-chan time.Time
+	abandoned := false
+collect:
+	for {
+		select {
+		case res, ok := <-results:
+			if !ok {
+				break collect
+			}
+			metrics.Add(res)
+			split.add(res)
+			run.record(res)
+		case <-stop:
+			// Requests already sent get LOAD_TEST_STOP_TIMEOUT to answer
+			stop = nil
+			attacker.Stop()
+			abandon = time.After(loadTestStopTimeout)
+		case <-abandon:
+			log.Printf("Load test %s: abandoning requests still in flight after %s", run.ID, loadTestStopTimeout)
+			go func() {
+				for range results {
+				}
+			}()
+			abandoned = true
+			break collect
+		}
 	}
+	close(done)
 	metrics.Close()
 	// Prepare the response
 	response := LoadTestResponse{
+		ID:                 run.ID,
+		Name:               req.Name,
 		TestDuration:       req.TestTime,
 		TotalRequests:      int64(metrics.Requests),
 		SuccessfulRequests: int64(metrics.Requests) * int64(metrics.Success),
@@ -262,6 +746,18 @@ func handleLoadTest(c *gin.Context) {
 	response.ResponseTime.P95 = metrics.Latencies.P95
 	response.ResponseTime.P99 = metrics.Latencies.P99
 
+	if req.Target == "chat" {
+		response.LatencySplit = split.summary()
+	}
+	if abandoned {
+		conns.transport.CloseIdleConnections()
+		response.LeakCheck = LeakCheck{Opened: conns.opened.Load(), Open: conns.open.Load(), Skipped: true}
+	} else {
+		response.LeakCheck = conns.check()
+	}
+	response.Stopped, response.StopReason = run.stopReason() != "", run.stopReason()
+	response.Throttles = run.throttled()
+
 	for status, count := range metrics.StatusCodes {
 		statusCode, _ := strconv.Atoi(status)
 		if statusCode >= 400 {
@@ -308,7 +804,47 @@ Errors: %v
 		response.Errors,
 	)
 
-	c.JSON(http.StatusOK, response)
+	saveLoadTestResult(response)
+	return response, nil
+}
+
+// Helper function to identify the calling user from the forwarded headers
+func requestUser(c *gin.Context) string {
+	if identity := c.GetString(serviceIdentityKey); identity != "" {
+		return identity
+	}
+	if email := c.GetHeader("X-Forwarded-Email"); email != "" {
+		return email
+	}
+	if user := c.GetHeader("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return c.ClientIP()
+}
+
+// requestIDKey carries the request ID of a request the server makes to itself
+type requestIDKey struct{}
+
+// Helper function to get the request ID. It is always generated here, as it
+// keys the audit record and replay capture and callers can reuse their own;
+// the X-Request-Id a caller sent is kept apart by clientRequestID. The ID is
+// kept for the rest of the request and echoed in the response.
+func requestID(c *gin.Context) string {
+	if id := c.GetString(headerRequestID); id != "" {
+		return id
+	}
+	id, _ := c.Request.Context().Value(requestIDKey{}).(string)
+	if id == "" {
+		id = newID()
+	}
+	c.Set(headerRequestID, id)
+	c.Header(headerRequestID, id)
+	return id
+}
+
+// clientRequestID is the X-Request-Id sent by the caller or the proxy, if any
+func clientRequestID(c *gin.Context) string {
+	return c.GetHeader(headerRequestID)
 }
 
 // Helper function to check if file exists
@@ -318,5 +854,19 @@ func fileExists(path string) bool {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case validateConfigFlag:
+			os.Exit(runValidateConfig())
+		case "regress":
+			os.Exit(runRegressionCommand(os.Args[2:]))
+		case "redteam":
+			os.Exit(runRedTeamCommand(os.Args[2:]))
+		case mcpCommand:
+			os.Exit(runMCPCommand())
+		case migrateCommand:
+			os.Exit(runMigrateCommand(os.Args[2:]))
+		}
+	}
 	StartGoServer()
 }
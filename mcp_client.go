@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MCPServerConfig is one MCP server to connect to, either a local command
+// speaking stdio or a remote URL speaking streamable HTTP
+type MCPServerConfig struct {
+	Name    string            `json:"name"`
+	Command string            `json:"command,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// MCPServerStatus describes a configured MCP server for the admin API
+type MCPServerStatus struct {
+	Name        string    `json:"name"`
+	Transport   string    `json:"transport"`
+	Connected   bool      `json:"connected"`
+	ServerName  string    `json:"server_name,omitempty"`
+	Tools       []string  `json:"tools"`
+	Resources   int       `json:"resources"`
+	LastError   string    `json:"last_error,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+const mcpProtocolVersion = "2025-03-26"
+
+var (
+	mcpConfigs []MCPServerConfig
+	mcpTimeout time.Duration
+	mcpRetry   time.Duration
+
+	mcpClients []*mcpClient
+
+	mcpToolName = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+)
+
+func configureMCP() {
+	mcpTimeout = envDuration("MCP_TIMEOUT", 30*time.Second)
+	mcpRetry = envDuration("MCP_RECONNECT_INTERVAL", 30*time.Second)
+
+	mcpConfigs = nil
+	path := envString("MCP_SERVERS_FILE", "")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &mcpConfigs)
+	}
+	if err != nil {
+		configWarn("failed to load MCP servers from %s: %v", path, err)
+		mcpConfigs = nil
+		return
+	}
+	for _, cfg := range mcpConfigs {
+		if cfg.Name == "" || (cfg.Command == "") == (cfg.URL == "") {
+			configWarn("MCP server %q needs a name and exactly one of command or url", cfg.Name)
+		}
+	}
+}
+
+// JSON-RPC 2.0 as used by MCP
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string { return fmt.Sprintf("%s (%d)", e.Message, e.Code) }
+
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  interface{}     `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// errMCPClosed means the session ended and must be re-established
+var errMCPClosed = errors.New("MCP session closed")
+
+// mcpTransport carries JSON-RPC messages to one MCP server
+type mcpTransport interface {
+	call(method string, params interface{}) (json.RawMessage, error)
+	notify(method string, params interface{}) error
+	alive() bool
+	close()
+}
+
+// stdioTransport runs the server as a child process, exchanging one JSON
+// message per line
+type stdioTransport struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeMu sync.Mutex
+	nextID  int64
+
+	mu      sync.Mutex
+	pending map[string]chan rpcMessage
+	closed  bool
+
+	onNotify func(method string)
+}
+
+func startStdioTransport(cfg MCPServerConfig, onNotify func(string)) (*stdioTransport, error) {
+	cmd := exec.Command(cfg.Command, cfg.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range cfg.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	t := &stdioTransport{cmd: cmd, stdin: stdin, pending: map[string]chan rpcMessage{}, onNotify: onNotify}
+	go t.readLoop(stdout)
+	return t, nil
+}
+
+func (t *stdioTransport) readLoop(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		switch {
+		case msg.Method != "" && len(msg.ID) > 0:
+			// Requests from the server; only ping is supported
+			reply := rpcMessage{JSONRPC: "2.0", ID: msg.ID, Result: json.RawMessage(`{}`)}
+			if msg.Method != "ping" {
+				reply = rpcMessage{JSONRPC: "2.0", ID: msg.ID, Error: &rpcError{Code: -32601, Message: "method not found"}}
+			}
+			t.write(reply)
+		case msg.Method != "":
+			if t.onNotify != nil {
+				go t.onNotify(msg.Method)
+			}
+		default:
+			t.mu.Lock()
+			ch := t.pending[string(msg.ID)]
+			delete(t.pending, string(msg.ID))
+			t.mu.Unlock()
+			if ch != nil {
+				ch <- msg
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.closed = true
+	for id, ch := range t.pending {
+		close(ch)
+		delete(t.pending, id)
+	}
+	t.mu.Unlock()
+	t.cmd.Wait()
+}
+
+func (t *stdioTransport) write(msg rpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	_, err = t.stdin.Write(append(data, '\n'))
+	return err
+}
+
+func (t *stdioTransport) call(method string, params interface{}) (json.RawMessage, error) {
+	id := json.RawMessage(fmt.Sprint(atomic.AddInt64(&t.nextID, 1)))
+	ch := make(chan rpcMessage, 1)
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errMCPClosed
+	}
+	t.pending[string(id)] = ch
+	t.mu.Unlock()
+
+	if err := t.write(rpcMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params}); err != nil {
+		return nil, errMCPClosed
+	}
+
+	timer := time.NewTimer(mcpTimeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errMCPClosed
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-timer.C:
+		t.mu.Lock()
+		delete(t.pending, string(id))
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%s timed out after %v", method, mcpTimeout)
+	}
+}
+
+func (t *stdioTransport) notify(method string, params interface{}) error {
+	return t.write(rpcMessage{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (t *stdioTransport) alive() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.closed
+}
+
+func (t *stdioTransport) close() {
+	t.stdin.Close()
+	if t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+}
+
+// httpTransport speaks the streamable HTTP transport: every message is a POST
+// whose answer is either JSON or a short event stream
+type httpTransport struct {
+	cfg     MCPServerConfig
+	client  *http.Client
+	nextID  int64
+	session atomic.Value // string
+}
+
+func (t *httpTransport) post(msg rpcMessage) (*http.Response, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", t.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	if id, _ := t.session.Load().(string); id != "" {
+		req.Header.Set("Mcp-Session-Id", id)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.session.Store(id)
+	}
+	if resp.StatusCode == http.StatusNotFound && t.session.Load() != nil {
+		resp.Body.Close()
+		return nil, errMCPClosed
+	}
+	if resp.StatusCode >= 300 {
+		body := readErrorBody(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("MCP server returned %d: %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) call(method string, params interface{}) (json.RawMessage, error) {
+	id := json.RawMessage(fmt.Sprint(atomic.AddInt64(&t.nextID, 1)))
+	resp, err := t.post(rpcMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var msg rpcMessage
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		msg, err = readMCPEvent(resp.Body, string(id))
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg.Error != nil {
+		return nil, msg.Error
+	}
+	return msg.Result, nil
+}
+
+// readMCPEvent reads server-sent events until the response with id arrives
+func readMCPEvent(body io.Reader, id string) (rpcMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			continue
+		}
+		if line != "" || data.Len() == 0 {
+			continue
+		}
+		var msg rpcMessage
+		if json.Unmarshal([]byte(data.String()), &msg) == nil && string(msg.ID) == id && msg.Method == "" {
+			return msg, nil
+		}
+		data.Reset()
+	}
+	return rpcMessage{}, fmt.Errorf("MCP event stream ended without a response")
+}
+
+func (t *httpTransport) notify(method string, params interface{}) error {
+	resp, err := t.post(rpcMessage{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t *httpTransport) alive() bool { return true }
+
+// close ends the session; servers that do not support DELETE ignore it
+func (t *httpTransport) close() {
+	id, _ := t.session.Load().(string)
+	if id == "" {
+		return
+	}
+	req, err := http.NewRequest("DELETE", t.cfg.URL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Mcp-Session-Id", id)
+	if resp, err := t.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// mcpTool and mcpResource are the parts of tools/list and resources/list we use
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type mcpResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// mcpClient manages the session with one MCP server and the tools it
+// registered
+type mcpClient struct {
+	cfg MCPServerConfig
+
+	mu          sync.Mutex
+	transport   mcpTransport
+	serverName  string
+	capable     map[string]bool
+	tools       []string
+	resources   []mcpResource
+	lastErr     string
+	connectedAt time.Time
+}
+
+func (m *mcpClient) source() string { return "mcp:" + m.cfg.Name }
+
+// startMCPClients connects to every configured server in the background,
+// retrying servers that are down
+func startMCPClients() {
+	for _, cfg := range mcpConfigs {
+		if cfg.Name == "" || (cfg.Command == "") == (cfg.URL == "") {
+			continue
+		}
+		m := &mcpClient{cfg: cfg}
+		mcpClients = append(mcpClients, m)
+		go func() {
+			for {
+				if !m.connected() {
+					if err := m.connect(); err != nil {
+						m.fail(err)
+					}
+				}
+				time.Sleep(mcpRetry)
+			}
+		}()
+	}
+}
+
+// connected reports whether the session is up, dropping it if the server
+// process has exited
+func (m *mcpClient) connected() bool {
+	m.mu.Lock()
+	t := m.transport
+	m.mu.Unlock()
+	if t != nil && !t.alive() {
+		m.fail(errMCPClosed)
+		m.disconnect()
+		return false
+	}
+	return t != nil
+}
+
+func (m *mcpClient) fail(err error) {
+	log.Printf("MCP server %s: %v", m.cfg.Name, err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastErr = err.Error()
+}
+
+// connect runs the initialize handshake and registers the server's tools
+func (m *mcpClient) connect() error {
+	var transport mcpTransport
+	if m.cfg.Command != "" {
+		t, err := startStdioTransport(m.cfg, m.handleNotification)
+		if err != nil {
+			return err
+		}
+		transport = t
+	} else {
+		transport = &httpTransport{cfg: m.cfg, client: &http.Client{Timeout: mcpTimeout}}
+	}
+
+	params := map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "chatbot-app", "version": "1.0"},
+	}
+	result, err := transport.call("initialize", params)
+	if err != nil {
+		transport.close()
+		return fmt.Errorf("initialize: %v", err)
+	}
+	var info struct {
+		Capabilities map[string]json.RawMessage `json:"capabilities"`
+		ServerInfo   struct {
+			Name string `json:"name"`
+		} `json:"serverInfo"`
+	}
+	json.Unmarshal(result, &info)
+	if err := transport.notify("notifications/initialized", nil); err != nil {
+		transport.close()
+		return fmt.Errorf("initialized: %v", err)
+	}
+
+	m.mu.Lock()
+	m.transport = transport
+	m.serverName = info.ServerInfo.Name
+	m.capable = map[string]bool{}
+	for name := range info.Capabilities {
+		m.capable[name] = true
+	}
+	m.lastErr = ""
+	m.connectedAt = time.Now()
+	m.mu.Unlock()
+
+	if err := m.refresh(); err != nil {
+		m.disconnect()
+		return err
+	}
+	log.Printf("Connected to MCP server %s (%s)", m.cfg.Name, info.ServerInfo.Name)
+	return nil
+}
+
+// disconnect drops the session and its tools; the retry loop reconnects
+func (m *mcpClient) disconnect() {
+	m.mu.Lock()
+	t := m.transport
+	m.transport = nil
+	m.mu.Unlock()
+	if t != nil {
+		t.close()
+	}
+	unregisterTools(m.source())
+}
+
+func (m *mcpClient) request(method string, params interface{}) (json.RawMessage, error) {
+	m.mu.Lock()
+	t := m.transport
+	m.mu.Unlock()
+	if t == nil {
+		return nil, fmt.Errorf("MCP server %s is not connected", m.cfg.Name)
+	}
+	result, err := t.call(method, params)
+	if errors.Is(err, errMCPClosed) {
+		m.disconnect()
+	}
+	return result, err
+}
+
+// listAll follows nextCursor pagination, appending each page's items
+func (m *mcpClient) listAll(method, field string, add func(json.RawMessage) error) error {
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		result, err := m.request(method, params)
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		var page map[string]json.RawMessage
+		if err := json.Unmarshal(result, &page); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		if err := add(page[field]); err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		cursor = ""
+		json.Unmarshal(page["nextCursor"], &cursor)
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+// refresh re-reads the server's tools and resources and re-registers them
+func (m *mcpClient) refresh() error {
+	m.mu.Lock()
+	capable := m.capable
+	m.mu.Unlock()
+
+	var serverTools []mcpTool
+	if capable["tools"] {
+		err := m.listAll("tools/list", "tools", func(raw json.RawMessage) error {
+			var page []mcpTool
+			err := json.Unmarshal(raw, &page)
+			serverTools = append(serverTools, page...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var resources []mcpResource
+	if capable["resources"] {
+		err := m.listAll("resources/list", "resources", func(raw json.RawMessage) error {
+			var page []mcpResource
+			err := json.Unmarshal(raw, &page)
+			resources = append(resources, page...)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	unregisterTools(m.source())
+	var names []string
+	for _, t := range serverTools {
+		t := t
+		name := m.toolName(t.Name)
+		registerTool(Tool{
+			Name:        name,
+			Description: t.Description,
+			Parameters:  t.InputSchema,
+			Source:      m.source(),
+			call: func(arguments json.RawMessage) (string, error) {
+				return m.callTool(t.Name, arguments)
+			},
+		})
+		names = append(names, name)
+	}
+	if len(resources) > 0 {
+		name := m.toolName("read_resource")
+		registerTool(Tool{
+			Name:        name,
+			Description: resourceToolDescription(m.cfg.Name, resources),
+			Parameters:  json.RawMessage(`{"type":"object","properties":{"uri":{"type":"string","description":"URI of the resource to read"}},"required":["uri"]}`),
+			Source:      m.source(),
+			call:        m.readResource,
+		})
+		names = append(names, name)
+	}
+
+	m.mu.Lock()
+	m.tools, m.resources = names, resources
+	m.mu.Unlock()
+	return nil
+}
+
+// toolName namespaces a server's tool so names from different servers
+// cannot collide, keeping to the characters chat APIs accept
+func (m *mcpClient) toolName(name string) string {
+	return mcpToolName.ReplaceAllString(m.cfg.Name+"__"+name, "_")
+}
+
+func resourceToolDescription(server string, resources []mcpResource) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Read a resource from %s. Available resources:", server)
+	for i, r := range resources {
+		if i == 50 {
+			fmt.Fprintf(&b, "\n- and %d more", len(resources)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n- %s (%s)", r.URI, r.Name)
+		if r.Description != "" {
+			fmt.Fprintf(&b, ": %s", r.Description)
+		}
+	}
+	return b.String()
+}
+
+func (m *mcpClient) handleNotification(method string) {
+	switch method {
+	case "notifications/tools/list_changed", "notifications/resources/list_changed":
+		if err := m.refresh(); err != nil {
+			m.fail(err)
+		}
+	}
+}
+
+// mcpContent flattens an MCP content list to text for the model
+func mcpContent(raw json.RawMessage) string {
+	var items []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		MimeType string `json:"mimeType"`
+		Resource *struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"resource"`
+	}
+	json.Unmarshal(raw, &items)
+	var parts []string
+	for _, item := range items {
+		switch {
+		case item.Type == "text":
+			parts = append(parts, item.Text)
+		case item.Resource != nil && item.Resource.Text != "":
+			parts = append(parts, item.Resource.Text)
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content omitted]", item.Type))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (m *mcpClient) callTool(name string, arguments json.RawMessage) (string, error) {
+	result, err := m.request("tools/call", map[string]interface{}{"name": name, "arguments": arguments})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Content json.RawMessage `json:"content"`
+		IsError bool            `json:"isError"`
+	}
+	if err := json.Unmarshal(result, &out); err != nil {
+		return "", err
+	}
+	text := mcpContent(out.Content)
+	if out.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+func (m *mcpClient) readResource(arguments json.RawMessage) (string, error) {
+	var args struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil || args.URI == "" {
+		return "", fmt.Errorf("uri is required")
+	}
+	result, err := m.request("resources/read", map[string]string{"uri": args.URI})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		Contents []struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+			Blob string `json:"blob"`
+		} `json:"contents"`
+	}
+	if err := json.Unmarshal(result, &out); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, c := range out.Contents {
+		if c.Text != "" {
+			parts = append(parts, c.Text)
+		} else if c.Blob != "" {
+			parts = append(parts, fmt.Sprintf("[binary content of %s omitted]", c.URI))
+		}
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+func (m *mcpClient) status() MCPServerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MCPServerStatus{
+		Name:        m.cfg.Name,
+		Transport:   "stdio",
+		Connected:   m.transport != nil,
+		ServerName:  m.serverName,
+		Tools:       append([]string{}, m.tools...),
+		Resources:   len(m.resources),
+		LastError:   m.lastErr,
+		ConnectedAt: m.connectedAt,
+	}
+	if m.cfg.URL != "" {
+		s.Transport = "http"
+	}
+	return s
+}
+
+func handleListMCPServers(c *gin.Context) {
+	servers := []MCPServerStatus{}
+	for _, m := range mcpClients {
+		servers = append(servers, m.status())
+	}
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
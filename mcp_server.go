@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mcpCommand serves MCP over stdio instead of running the HTTP server
+const mcpCommand = "mcp"
+
+// mcpCaller is who is calling a tool; stdio callers are the local operator
+type mcpCaller struct {
+	user  string
+	admin bool
+	stdio bool
+}
+
+// mcpServerTool is a capability of this app exposed to MCP clients
+type mcpServerTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+
+	admin bool
+	// http tools need the HTTP server of this process, which stdio mode
+	// does not run
+	http bool
+	call func(caller mcpCaller, arguments json.RawMessage) (string, error)
+}
+
+// rpcRequest is an incoming JSON-RPC message
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+var (
+	mcpServerEnabled bool
+	mcpMaxLoadTest   time.Duration
+)
+
+func configureMCPServer() {
+	mcpServerEnabled = envBool("MCP_SERVER_ENABLED", false)
+	mcpMaxLoadTest = envDuration("MCP_MAX_LOAD_TEST", 5*time.Minute)
+}
+
+var mcpServerTools = []mcpServerTool{
+	{
+		Name:        "ask_llm",
+		Description: "Ask the chatbot's language model a question and return its answer.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"message":{"type":"string","description":"The question or prompt"},"endpoint":{"type":"string","description":"Serving endpoint to use; defaults to the chat endpoint"}},"required":["message"]}`),
+		call:        mcpAskLLM,
+	},
+	{
+		Name:        "run_load_test",
+		Description: "Run a load test against the chatbot API and return latency and error statistics.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"users":{"type":"integer","minimum":1},"spawn_rate":{"type":"integer","minimum":1,"description":"Requests per second"},"test_time":{"type":"integer","minimum":1,"description":"Duration in seconds"},"target":{"type":"string","enum":["api","chat"],"description":"chat posts message to /api/chat and reports the app/upstream latency split"},"message":{"type":"string"},"name":{"type":"string","description":"Unique among running load tests"},"preset":{"type":"string","description":"Saved preset to run, e.g. smoke; the other arguments override it"}}}`),
+		admin:       true,
+		http:        true,
+		call:        mcpRunLoadTest,
+	},
+	{
+		Name:        "query_usage",
+		Description: "Return request, token, cost and latency totals per time bucket from the usage log.",
+		InputSchema: json.RawMessage(`{"type":"object","properties":{"bucket":{"type":"string","enum":["hour","day"]},"group_by":{"type":"string","enum":["none","user","model"]},"from":{"type":"string","format":"date-time"},"to":{"type":"string","format":"date-time"}}}`),
+		admin:       true,
+		call:        mcpQueryUsage,
+	},
+}
+
+func mcpAskLLM(caller mcpCaller, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Message  string `json:"message"`
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil || args.Message == "" {
+		return "", fmt.Errorf("message is required")
+	}
+	if args.Endpoint == "" {
+		args.Endpoint = llmEndpoint()
+	}
+	if !endpointAllowed(caller.user, args.Endpoint) {
+		return "", fmt.Errorf("endpoint %s is not allowed", args.Endpoint)
+	}
+	if v := checkGuardrails("input", args.Message); v != nil {
+		return v.Message, nil
+	}
+
+	start := time.Now()
+	record := AuditRecord{ID: newID(), Timestamp: start, User: caller.user, Model: args.Endpoint, Prompt: args.Message}
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	content, llmResp, err := completeChat(PriorityInteractive, args.Endpoint, buildChatMessages(args.Message))
+	if err != nil {
+		record.StatusCode, record.Error = upstreamStatus(err), err.Error()
+		return "", fmt.Errorf("error from LLM endpoint")
+	}
+	record.StatusCode = http.StatusOK
+	record.Response = content
+	record.PromptTokens = llmResp.Usage.PromptTokens
+	record.CompletionTokens = llmResp.Usage.CompletionTokens
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+
+	if v := checkGuardrails("output", content); v != nil {
+		return v.Message, nil
+	}
+	content, _ = truncateResponse(postProcessAnswer(args.Message, content))
+	return content, nil
+}
+
+func mcpRunLoadTest(caller mcpCaller, arguments json.RawMessage) (string, error) {
+	if !featureEnabled("load_test") {
+		return "", fmt.Errorf("the load_test feature is disabled")
+	}
+	var args struct {
+		Preset string `json:"preset"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", err
+	}
+	var req LoadTestRequest
+	var preset LoadTestPreset
+	if args.Preset != "" {
+		var ok bool
+		if preset, ok = loadTestPreset(args.Preset); !ok {
+			return "", fmt.Errorf("load test preset %s not found", args.Preset)
+		}
+		req = preset.request()
+	}
+	if err := json.Unmarshal(arguments, &req); err != nil {
+		return "", err
+	}
+	if req.Users <= 0 || req.SpawnRate <= 0 || req.TestTime <= 0 {
+		return "", fmt.Errorf("users, spawn_rate and test_time must be positive")
+	}
+	if req.Target != "" && req.Target != "api" && req.Target != "chat" {
+		return "", fmt.Errorf("target must be api or chat")
+	}
+	if time.Duration(req.TestTime)*time.Second > mcpMaxLoadTest {
+		return "", fmt.Errorf("test_time may be at most %v", mcpMaxLoadTest)
+	}
+	log.Printf("Load test initiated over MCP by %s", caller.user)
+	req.User = caller.user
+	response, err := runLoadTest(req)
+	if err != nil {
+		return "", err
+	}
+	response.Preset, response.PresetVersion = preset.Name, preset.Version
+	out, err := json.Marshal(response)
+	return string(out), err
+}
+
+func mcpQueryUsage(caller mcpCaller, arguments json.RawMessage) (string, error) {
+	var args struct {
+		Bucket  string    `json:"bucket"`
+		GroupBy string    `json:"group_by"`
+		From    time.Time `json:"from"`
+		To      time.Time `json:"to"`
+	}
+	if len(arguments) > 0 {
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return "", err
+		}
+	}
+	if args.Bucket != "" && args.Bucket != "hour" && args.Bucket != "day" {
+		return "", fmt.Errorf("bucket must be hour or day")
+	}
+	if args.GroupBy != "" && args.GroupBy != "none" && args.GroupBy != "user" && args.GroupBy != "model" {
+		return "", fmt.Errorf("group_by must be none, user or model")
+	}
+	usage, err := usageTimeseries(UsageQuery{Bucket: args.Bucket, GroupBy: args.GroupBy, From: args.From, To: args.To})
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(usage)
+	return string(out), err
+}
+
+// visibleTools are the tools caller may list and call
+func visibleTools(caller mcpCaller) []mcpServerTool {
+	var out []mcpServerTool
+	for _, t := range mcpServerTools {
+		if (!t.admin || caller.admin) && (!t.http || !caller.stdio) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// handleMCPMessage answers one JSON-RPC message; notifications get no reply
+func handleMCPMessage(caller mcpCaller, req rpcRequest) *rpcMessage {
+	if len(req.ID) == 0 {
+		return nil
+	}
+	reply := &rpcMessage{JSONRPC: "2.0", ID: req.ID}
+	result := func(v interface{}) *rpcMessage {
+		reply.Result, _ = json.Marshal(v)
+		return reply
+	}
+
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(req.Params, &params)
+		version := mcpProtocolVersion
+		if params.ProtocolVersion == "2024-11-05" {
+			version = params.ProtocolVersion
+		}
+		return result(map[string]interface{}{
+			"protocolVersion": version,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "chatbot-app", "version": "1.0"},
+		})
+	case "ping":
+		return result(map[string]interface{}{})
+	case "tools/list":
+		return result(map[string]interface{}{"tools": visibleTools(caller)})
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			reply.Error = &rpcError{Code: -32602, Message: "invalid params"}
+			return reply
+		}
+		for _, t := range visibleTools(caller) {
+			if t.Name != params.Name {
+				continue
+			}
+			text, err := t.call(caller, params.Arguments)
+			isError := err != nil
+			if isError {
+				text = err.Error()
+			}
+			return result(map[string]interface{}{
+				"content": []map[string]string{{"type": "text", "text": text}},
+				"isError": isError,
+			})
+		}
+		reply.Error = &rpcError{Code: -32602, Message: "unknown tool " + params.Name}
+		return reply
+	}
+	reply.Error = &rpcError{Code: -32601, Message: "method not found"}
+	return reply
+}
+
+// runMCPStdio serves MCP on stdin and stdout until stdin closes. Calls run
+// concurrently so a long load test does not block other requests.
+func runMCPStdio(in io.Reader, out io.Writer) int {
+	caller := mcpCaller{user: "mcp-stdio", admin: true, stdio: true}
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	encoder := json.NewEncoder(out)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var req rpcRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			writeMu.Lock()
+			encoder.Encode(rpcMessage{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: "parse error"}})
+			writeMu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reply := handleMCPMessage(caller, req); reply != nil {
+				writeMu.Lock()
+				encoder.Encode(reply)
+				writeMu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return 0
+}
+
+func runMCPCommand() int {
+	log.SetOutput(scrubbingWriter{w: os.Stderr, sink: "log"})
+	startPlugins()
+	return runMCPStdio(os.Stdin, os.Stdout)
+}
+
+// mcpSSESession is an open legacy SSE connection; replies to messages posted
+// for the session are written to its stream
+type mcpSSESession struct {
+	caller  mcpCaller
+	replies chan *rpcMessage
+}
+
+var (
+	mcpSessionsMu sync.Mutex
+	mcpSessions   = map[string]*mcpSSESession{}
+)
+
+func mcpCallerFor(c *gin.Context) mcpCaller {
+	return mcpCaller{user: requestUser(c), admin: isAdmin(c)}
+}
+
+// admitMCPRequest applies the chat abuse and quota checks to ask_llm calls made over
+// HTTP, so banned users cannot get around them through MCP
+func admitMCPRequest(c *gin.Context, req rpcRequest) bool {
+	if req.Method != "tools/call" {
+		return true
+	}
+	var params struct {
+		Name      string `json:"name"`
+		Arguments struct {
+			Message string `json:"message"`
+		} `json:"arguments"`
+	}
+	json.Unmarshal(req.Params, &params)
+	return params.Name != "ask_llm" || (!rejectAbusive(c, params.Arguments.Message) && !rejectOverQuota(c))
+}
+
+// handleMCPStream implements the streamable HTTP transport without sessions:
+// each POST carries one message and gets the reply as JSON
+func handleMCPStream(c *gin.Context) {
+	var req rpcRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, rpcMessage{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{Code: -32700, Message: "parse error"}})
+		return
+	}
+	if !admitMCPRequest(c, req) {
+		return
+	}
+	reply := handleMCPMessage(mcpCallerFor(c), req)
+	if reply == nil {
+		c.Status(http.StatusAccepted)
+		return
+	}
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleMCPSSE opens a legacy SSE session: the first event names the URL to
+// POST messages to, and replies arrive as message events
+func handleMCPSSE(c *gin.Context) {
+	id := newID()
+	session := &mcpSSESession{caller: mcpCallerFor(c), replies: make(chan *rpcMessage, 16)}
+	mcpSessionsMu.Lock()
+	mcpSessions[id] = session
+	mcpSessionsMu.Unlock()
+	defer func() {
+		mcpSessionsMu.Lock()
+		delete(mcpSessions, id)
+		mcpSessionsMu.Unlock()
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.SSEvent("endpoint", "/mcp/messages?session_id="+id)
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case reply := <-session.replies:
+			data, _ := json.Marshal(reply)
+			c.SSEvent("message", string(data))
+			c.Writer.Flush()
+		case <-keepalive.C:
+			io.WriteString(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+func handleMCPSSEMessage(c *gin.Context) {
+	mcpSessionsMu.Lock()
+	session := mcpSessions[c.Query("session_id")]
+	mcpSessionsMu.Unlock()
+	if session == nil || session.caller.user != requestUser(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown MCP session"})
+		return
+	}
+	var req rpcRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !admitMCPRequest(c, req) {
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+	go func() {
+		if reply := handleMCPMessage(session.caller, req); reply != nil {
+			select {
+			case session.replies <- reply:
+			case <-time.After(time.Minute):
+				log.Printf("Dropped MCP reply for a stalled SSE session")
+			}
+		}
+	}()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVisibleTools(t *testing.T) {
+	tests := []struct {
+		name   string
+		caller mcpCaller
+		want   []string
+	}{
+		{name: "stdio operator", caller: mcpCaller{user: "mcp-stdio", admin: true, stdio: true}, want: []string{"ask_llm", "query_usage"}},
+		{name: "HTTP admin", caller: mcpCaller{user: "admin@example.com", admin: true}, want: []string{"ask_llm", "run_load_test", "query_usage"}},
+		{name: "HTTP user", caller: mcpCaller{user: "user@example.com"}, want: []string{"ask_llm"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, tool := range visibleTools(tt.caller) {
+				got = append(got, tool.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("tools = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A minimal Prometheus text exposition registry. Gauges are read from
+// callbacks at scrape time; counters and histograms are kept per label
+// combination.
+
+type metricSample struct {
+	suffix string   // appended to the family name, e.g. _bucket
+	labels []string // alternating names and values
+	value  float64
+}
+
+type metricFamily struct {
+	name, help, kind string
+	collect          func() []metricSample
+}
+
+var (
+	metricsMu      sync.Mutex
+	metricFamilies []*metricFamily
+)
+
+func registerMetric(name, help, kind string, collect func() []metricSample) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	for _, f := range metricFamilies {
+		if f.name == name {
+			f.help, f.kind, f.collect = help, kind, collect
+			return
+		}
+	}
+	metricFamilies = append(metricFamilies, &metricFamily{name: name, help: help, kind: kind, collect: collect})
+}
+
+// registerGaugeFunc exposes fn as an unlabelled gauge
+func registerGaugeFunc(name, help string, fn func() float64) {
+	registerMetric(name, help, "gauge", func() []metricSample {
+		return []metricSample{{value: fn()}}
+	})
+}
+
+// counterVec is a counter partitioned by label values
+type counterVec struct {
+	mu         sync.Mutex
+	labelNames []string
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	c := &counterVec{labelNames: labelNames, values: map[string]float64{}}
+	registerMetric(name, help, "counter", c.collect)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\x00")] += v
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) collect() []metricSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	samples := make([]metricSample, 0, len(keys))
+	for _, k := range keys {
+		samples = append(samples, metricSample{labels: splitLabels(c.labelNames, k), value: c.values[k]})
+	}
+	return samples
+}
+
+// splitLabels pairs label names with the values joined into a series key
+func splitLabels(names []string, key string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	var labels []string
+	for i, v := range strings.Split(key, "\x00") {
+		labels = append(labels, names[i], v)
+	}
+	return labels
+}
+
+// histogramVec is a histogram partitioned by label values, with cumulative
+// bucket counts as Prometheus expects
+type histogramVec struct {
+	mu         sync.Mutex
+	labelNames []string
+	buckets    []float64
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *histogramVec {
+	h := &histogramVec{labelNames: labelNames, buckets: buckets, series: map[string]*histogramSeries{}}
+	registerMetric(name, help, "histogram", h.collect)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	s := h.series[key]
+	if s == nil {
+		s = &histogramSeries{counts: make([]float64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) collect() []metricSample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var samples []metricSample
+	for _, k := range keys {
+		s, labels := h.series[k], splitLabels(h.labelNames, k)
+		for i, le := range h.buckets {
+			samples = append(samples, metricSample{suffix: "_bucket", labels: append(labels[:len(labels):len(labels)], "le", fmt.Sprint(le)), value: s.counts[i]})
+		}
+		samples = append(samples,
+			metricSample{suffix: "_bucket", labels: append(labels[:len(labels):len(labels)], "le", "+Inf"), value: s.count},
+			metricSample{suffix: "_sum", labels: labels, value: s.sum},
+			metricSample{suffix: "_count", labels: labels, value: s.count})
+	}
+	return samples
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, labels[i], v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func handleMetrics(c *gin.Context) {
+	metricsMu.Lock()
+	families := append([]*metricFamily(nil), metricFamilies...)
+	metricsMu.Unlock()
+
+	var b strings.Builder
+	for _, f := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range f.collect() {
+			fmt.Fprintf(&b, "%s%s%s %g\n", f.name, s.suffix, formatLabels(s.labels), s.value)
+		}
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+// migrateCommand manages the storage schema instead of running the server
+const migrateCommand = "migrate"
+
+// migrateOnStart applies pending migrations when the server starts; when it
+// is off the server refuses a schema older than the binary expects
+var migrateOnStart bool
+
+func migrateMode() bool {
+	return len(os.Args) > 1 && os.Args[1] == migrateCommand
+}
+
+// migrator returns a golang-migrate instance for the backend; close it to
+// release its connection
+func (s *storageBackend) migrator() (*migrate.Migrate, error) {
+	source, err := iofs.New(s.migrations, ".")
+	if err != nil {
+		return nil, err
+	}
+	driver, err := s.migrationDriver()
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.NewWithInstance("iofs", source, s.name, driver)
+	if err != nil {
+		return nil, err
+	}
+	// Another replica may be migrating
+	m.LockTimeout = migrationLockTimeout
+	return m, nil
+}
+
+// latestMigration is the schema version this binary's data model expects
+func (s *storageBackend) latestMigration() (uint, error) {
+	source, err := iofs.New(s.migrations, ".")
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		version = next
+	}
+}
+
+// schemaVersion reads the applied version; 0 means no migration has run
+func schemaVersion(m *migrate.Migrate) (uint, bool, error) {
+	version, dirty, err := m.Version()
+	if err == migrate.ErrNilVersion {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+// prepareSchema migrates the schema to the latest version, or with
+// MIGRATE_ON_START off checks that it is already there
+func prepareSchema(s *storageBackend) error {
+	m, err := s.migrator()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	if migrateOnStart {
+		if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+			return fmt.Errorf("migrations: %v", err)
+		}
+	}
+	version, dirty, err := schemaVersion(m)
+	if err != nil {
+		return err
+	}
+	latest, err := s.latestMigration()
+	if err != nil {
+		return err
+	}
+	switch {
+	case dirty:
+		return fmt.Errorf("schema version %d is dirty after a failed migration; repair it and run `migrate force %d`", version, version)
+	case version < latest:
+		return fmt.Errorf("schema is at version %d but this release needs %d; run `migrate up` or set MIGRATE_ON_START", version, latest)
+	case version > latest:
+		configWarn("%s schema version %d is newer than this release (%d)", s.name, version, latest)
+	}
+	log.Printf("Storage schema at version %d", version)
+	return nil
+}
+
+// runMigrateCommand implements `migrate up [N]`, `migrate down [N]`,
+// `migrate goto V`, `migrate force V` and `migrate version` against the
+// configured STORAGE_BACKEND
+func runMigrateCommand(args []string) int {
+	if storage == nil {
+		log.Printf("No database storage configured; set STORAGE_BACKEND and its connection settings")
+		return 2
+	}
+	m, err := storage.migrator()
+	if err != nil {
+		log.Printf("Failed to open migrations: %v", err)
+		return 2
+	}
+	defer m.Close()
+
+	action := "version"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	var n int
+	if len(args) > 1 {
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 0 {
+			log.Printf("Invalid number %q", args[1])
+			return 2
+		}
+	}
+
+	switch action {
+	case "up":
+		if n > 0 {
+			err = m.Steps(n)
+		} else {
+			err = m.Up()
+		}
+	case "down":
+		// Roll back one migration unless told otherwise
+		if n == 0 {
+			n = 1
+		}
+		err = m.Steps(-n)
+	case "goto", "force":
+		if len(args) < 2 {
+			log.Printf("Usage: migrate %s VERSION", action)
+			return 2
+		}
+		if action == "goto" {
+			err = m.Migrate(uint(n))
+		} else {
+			err = m.Force(n)
+		}
+	case "version":
+	default:
+		log.Printf("Usage: migrate [up [N] | down [N] | goto VERSION | force VERSION | version]")
+		return 2
+	}
+	if err != nil && err != migrate.ErrNoChange {
+		log.Printf("Migration failed: %v", err)
+		return 1
+	}
+
+	version, dirty, err := schemaVersion(m)
+	if err != nil {
+		log.Printf("Failed to read schema version: %v", err)
+		return 1
+	}
+	latest, err := storage.latestMigration()
+	if err != nil {
+		log.Printf("Failed to read migrations: %v", err)
+		return 1
+	}
+	state := ""
+	if dirty {
+		state = " (dirty)"
+	}
+	fmt.Printf("%s schema version %d%s, latest %d\n", storage.name, version, state, latest)
+	return 0
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS audit_records;
+DROP TABLE IF EXISTS conversations;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS conversations (
+    id         STRING NOT NULL,
+    user_id    STRING NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    messages   STRING NOT NULL
+) USING DELTA
+COMMENT 'Chat conversations; messages is a JSON array';
+
+CREATE TABLE IF NOT EXISTS audit_records (
+    id                STRING NOT NULL,
+    ts                TIMESTAMP NOT NULL,
+    user_id           STRING NOT NULL,
+    model             STRING NOT NULL,
+    prompt            STRING NOT NULL,
+    response          STRING NOT NULL,
+    prompt_tokens     INT NOT NULL,
+    completion_tokens INT NOT NULL,
+    cost              DOUBLE NOT NULL,
+    latency_ns        BIGINT NOT NULL,
+    status_code       INT NOT NULL,
+    error             STRING NOT NULL,
+    quality           STRING
+) USING DELTA
+COMMENT 'One row per chat request; quality is the judge score as JSON';
@@ -0,0 +1,3 @@
+ALTER TABLE conversations SET TBLPROPERTIES ('delta.columnMapping.mode' = 'name', 'delta.minReaderVersion' = '2', 'delta.minWriterVersion' = '5');
+
+ALTER TABLE conversations DROP COLUMN settings;
@@ -0,0 +1,3 @@
+ALTER TABLE conversations ADD COLUMNS (
+    settings STRING COMMENT 'Language, model, temperature and persona every turn inherits, as a JSON object'
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS kill_switches (
+    feature    STRING NOT NULL,
+    reason     STRING NOT NULL,
+    engaged_by STRING NOT NULL,
+    engaged_at TIMESTAMP NOT NULL
+) USING DELTA
+COMMENT 'Features switched off by an admin during an incident, read by every replica';
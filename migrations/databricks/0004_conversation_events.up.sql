@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS conversation_events (
+    seq             BIGINT GENERATED ALWAYS AS IDENTITY,
+    id              STRING NOT NULL,
+    conversation_id STRING NOT NULL,
+    user_id         STRING NOT NULL,
+    type            STRING NOT NULL,
+    ts              TIMESTAMP NOT NULL,
+    data            STRING NOT NULL
+) USING DELTA
+COMMENT 'Append-only log of changes to conversations; data is the event as JSON';
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS request_captures (
+    id      STRING NOT NULL,
+    user_id STRING NOT NULL,
+    ts      TIMESTAMP NOT NULL,
+    data    STRING NOT NULL
+) USING DELTA
+COMMENT 'Upstream requests of chat turns kept for replays, by audit record ID; data is the capture as JSON';
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS security_events (
+    ts        TIMESTAMP NOT NULL,
+    event     STRING NOT NULL,
+    kind      STRING NOT NULL,
+    client_ip STRING NOT NULL,
+    subject   STRING NOT NULL,
+    detail    STRING NOT NULL
+) USING DELTA
+COMMENT 'Failed authentications and lockouts';
@@ -0,0 +1,3 @@
+ALTER TABLE audit_records SET TBLPROPERTIES ('delta.columnMapping.mode' = 'name', 'delta.minReaderVersion' = '2', 'delta.minWriterVersion' = '5');
+
+ALTER TABLE audit_records DROP COLUMN client_request_id;
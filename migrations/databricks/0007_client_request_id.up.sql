@@ -0,0 +1,3 @@
+ALTER TABLE audit_records ADD COLUMNS (
+    client_request_id STRING COMMENT 'X-Request-Id sent by the caller or proxy; id is always generated by the server'
+);
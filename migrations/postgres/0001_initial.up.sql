@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS conversations (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL,
+    messages   JSONB NOT NULL DEFAULT '[]'
+);
+
+CREATE INDEX IF NOT EXISTS conversations_user_updated ON conversations (user_id, updated_at DESC);
+
+CREATE TABLE IF NOT EXISTS audit_records (
+    id                TEXT PRIMARY KEY,
+    ts                TIMESTAMPTZ NOT NULL,
+    user_id           TEXT NOT NULL,
+    model             TEXT NOT NULL,
+    prompt            TEXT NOT NULL,
+    response          TEXT NOT NULL DEFAULT '',
+    prompt_tokens     INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    cost              DOUBLE PRECISION NOT NULL DEFAULT 0,
+    latency_ns        BIGINT NOT NULL DEFAULT 0,
+    status_code       INTEGER NOT NULL DEFAULT 0,
+    error             TEXT NOT NULL DEFAULT '',
+    quality           JSONB
+);
+
+CREATE INDEX IF NOT EXISTS audit_records_ts ON audit_records (ts);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS kill_switches (
+    feature    TEXT PRIMARY KEY,
+    reason     TEXT NOT NULL DEFAULT '',
+    engaged_by TEXT NOT NULL,
+    engaged_at TIMESTAMPTZ NOT NULL
+);
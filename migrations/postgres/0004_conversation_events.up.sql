@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS conversation_events (
+    seq             BIGSERIAL PRIMARY KEY,
+    id              TEXT NOT NULL,
+    conversation_id TEXT NOT NULL,
+    user_id         TEXT NOT NULL,
+    type            TEXT NOT NULL,
+    ts              TIMESTAMPTZ NOT NULL,
+    data            JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS conversation_events_conversation ON conversation_events (conversation_id, seq);
+CREATE INDEX IF NOT EXISTS conversation_events_user ON conversation_events (user_id, seq);
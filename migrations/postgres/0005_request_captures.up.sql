@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS request_captures (
+    id      TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    ts      TIMESTAMPTZ NOT NULL,
+    data    JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS request_captures_ts ON request_captures (ts);
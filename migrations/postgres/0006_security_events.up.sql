@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS security_events (
+    id        BIGSERIAL PRIMARY KEY,
+    ts        TIMESTAMPTZ NOT NULL,
+    event     TEXT NOT NULL,
+    kind      TEXT NOT NULL,
+    client_ip TEXT NOT NULL,
+    subject   TEXT NOT NULL,
+    detail    TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS security_events_ts ON security_events (ts);
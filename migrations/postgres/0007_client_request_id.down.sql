@@ -0,0 +1 @@
+ALTER TABLE audit_records DROP COLUMN IF EXISTS client_request_id;
@@ -0,0 +1 @@
+ALTER TABLE audit_records ADD COLUMN IF NOT EXISTS client_request_id TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerMirrored marks a mirrored request, so a staging deployment that
+// mirrors too does not send it on again
+const headerMirrored = "X-Mirrored-Request"
+
+// mirrorJob is a sampled chat request waiting to be replayed to staging
+type mirrorJob struct {
+	path string
+	id   string
+	user string
+	body []byte
+}
+
+// piiPattern replaces personal data in mirrored requests with a marker
+type piiPattern struct {
+	re     *regexp.Regexp
+	marker string
+}
+
+// Personal data that is recognizable by its shape. Cards come before phone
+// numbers, which would match their digits too.
+var builtinPIIPatterns = []piiPattern{
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[EMAIL]"},
+	{regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`), "[SSN]"},
+	{regexp.MustCompile(`\b(?:\d{4}[ -]?){3}\d{1,4}\b`), "[CARD]"},
+	{regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?\(?\b\d{3}\)?[\s.-]\d{3}[\s.-]\d{4}\b`), "[PHONE]"},
+	{regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`), "[IP]"},
+}
+
+var (
+	mirrorURL        string
+	mirrorToken      string
+	mirrorSampleRate float64
+	mirrorMaxBody    int64
+	mirrorWorkers    int
+	mirrorQueue      chan mirrorJob
+	mirrorClient     *http.Client
+	piiPatterns      []piiPattern
+	// mirrorUserKey keys the pseudonyms, so they cannot be found by hashing
+	// known addresses; it changes when the server restarts
+	mirrorUserKey []byte
+
+	mirroredRequests *counterVec
+)
+
+// configureMirroring reads MIRROR_URL, the base URL of a staging deployment,
+// and MIRROR_SAMPLE_RATE, the fraction of chat requests replayed to it.
+// MIRROR_REDACT_PATTERNS adds regular expressions to the personal data
+// removed before a request leaves production.
+func configureMirroring() {
+	mirrorURL = envString("MIRROR_URL", "")
+	mirrorToken = envString("MIRROR_TOKEN", "")
+	mirrorSampleRate = envFloat("MIRROR_SAMPLE_RATE", 0)
+	mirrorMaxBody = envSize("MIRROR_MAX_BODY", 1<<20)
+	mirrorWorkers = envInt("MIRROR_WORKERS", 2)
+	mirrorQueue = make(chan mirrorJob, envInt("MIRROR_QUEUE_SIZE", 100))
+	mirrorClient = &http.Client{Timeout: envDuration("MIRROR_TIMEOUT", 2*time.Minute)}
+	mirrorUserKey = make([]byte, 32)
+	crand.Read(mirrorUserKey)
+	if mirrorSampleRate < 0 || mirrorSampleRate > 1 {
+		configWarn("MIRROR_SAMPLE_RATE must be between 0 and 1, got %v; mirroring is off", mirrorSampleRate)
+		mirrorSampleRate = 0
+	}
+
+	piiPatterns = append([]piiPattern(nil), builtinPIIPatterns...)
+	for _, expr := range envList("MIRROR_REDACT_PATTERNS") {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			configWarn("invalid MIRROR_REDACT_PATTERNS entry %q: %v", expr, err)
+			continue
+		}
+		piiPatterns = append(piiPatterns, piiPattern{re: re, marker: "[REDACTED]"})
+	}
+	mirroredRequests = newCounterVec("chatbot_mirrored_requests_total", "Chat requests replayed to the staging deployment", "result")
+}
+
+func mirroringEnabled() bool {
+	return mirrorURL != "" && mirrorSampleRate > 0
+}
+
+func startMirroring() {
+	if !mirroringEnabled() {
+		return
+	}
+	for i := 0; i < mirrorWorkers; i++ {
+		go func() {
+			for job := range mirrorQueue {
+				replayToStaging(job)
+			}
+		}()
+	}
+	log.Printf("Mirroring %.0f%% of chat requests to %s", mirrorSampleRate*100, mirrorURL)
+}
+
+// mirrorTraffic samples chat requests for replay to staging once production
+// has answered them. Requests production refused are not mirrored, and
+// neither are mirrored ones; when the queue is full the sample is dropped
+// rather than slowing production down.
+func mirrorTraffic() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !mirroringEnabled() || c.GetHeader(headerMirrored) != "" || rand.Float64() >= mirrorSampleRate {
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, mirrorMaxBody+1))
+		c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+		if err != nil || int64(len(body)) > mirrorMaxBody {
+			mirroredRequests.inc("skipped")
+			return
+		}
+
+		c.Next()
+
+		if c.Writer.Status() >= 400 {
+			return
+		}
+		job := mirrorJob{path: c.Request.URL.RequestURI(), id: requestID(c), user: pseudonymize(requestUser(c)), body: mirrorBody(body)}
+		select {
+		case mirrorQueue <- job:
+		default:
+			mirroredRequests.inc("dropped")
+		}
+	}
+}
+
+// replayToStaging sends the request and reads the answer to the end, so a
+// streamed answer is generated in full as it would be for a user
+func replayToStaging(job mirrorJob) {
+	req, err := http.NewRequest(http.MethodPost, mirrorURL+job.path, bytes.NewReader(job.body))
+	if err != nil {
+		log.Printf("Mirroring %s failed: %v", job.id, err)
+		mirroredRequests.inc("failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerMirrored, "1")
+	req.Header.Set(headerRequestID, job.id)
+	req.Header.Set("X-Forwarded-User", job.user)
+	if mirrorToken != "" {
+		req.Header.Set("Authorization", "Bearer "+mirrorToken)
+	}
+	resp, err := mirrorClient.Do(req)
+	if err != nil {
+		log.Printf("Mirroring %s failed: %v", job.id, err)
+		mirroredRequests.inc("failed")
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 400 {
+		log.Printf("Staging answered mirrored request %s with status %d", job.id, resp.StatusCode)
+		mirroredRequests.inc("rejected")
+		return
+	}
+	mirroredRequests.inc("sent")
+}
+
+// mirrorBody is the request as staging receives it. Staging does not have
+// production's conversations, so the turn starts a new one there. The body is
+// redacted once decoded, as the raw JSON can hide personal data behind
+// escapes, such as \u0040 for the @ of an address.
+func mirrorBody(body []byte) []byte {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		// Not JSON, so there are no escapes either
+		return []byte(redactPII(string(body)))
+	}
+	if fields, ok := v.(map[string]interface{}); ok {
+		delete(fields, "conversation_id")
+	}
+	b, err := json.Marshal(redactJSONValues(v))
+	if err != nil {
+		return []byte(redactPII(string(body)))
+	}
+	return b
+}
+
+// redactJSONValues redacts every string in a decoded JSON value, and numbers
+// that are personal data, such as a card number sent as a number
+func redactJSONValues(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redactPII(v)
+	case json.Number:
+		if redacted := redactPII(v.String()); redacted != v.String() {
+			return redacted
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = redactJSONValues(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSONValues(e)
+		}
+	}
+	return v
+}
+
+// redactPII removes personal data and secrets from text
+func redactPII(text string) string {
+	text = scrubSecrets(text)
+	for _, p := range piiPatterns {
+		text = p.re.ReplaceAllString(text, p.marker)
+	}
+	return text
+}
+
+// pseudonymize stands in for the user on staging, so their requests are
+// still grouped together there without revealing who they are
+func pseudonymize(user string) string {
+	mac := hmac.New(sha256.New, mirrorUserKey)
+	mac.Write([]byte(user))
+	return "mirror-" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Notification is a message for the UI outside of a chat answer, such as a
+// delivered reminder or a finished batch job. Seq orders every notification,
+// so clients can ask for the ones after the last they saw.
+type Notification struct {
+	Seq       int64       `json:"seq"`
+	Type      string      `json:"type"` // reminder, quota.warning, maintenance, job.completed, job.failed
+	Title     string      `json:"title"`
+	Message   string      `json:"message,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	Broadcast bool        `json:"broadcast,omitempty"` // sent to every user
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+var (
+	notificationMaxPerUser int
+	notificationRetention  time.Duration
+	quotaWarningPercent    int
+
+	notificationsMu sync.Mutex
+	notificationSeq int64
+	// userNotifications are kept per user, broadcasts once for everyone
+	userNotifications  = map[string][]Notification{}
+	broadcasts         []Notification
+	notificationStream = map[string]map[chan Notification]bool{}
+	// quotaWarned remembers who was warned of which quota on which day
+	quotaWarned = map[string]string{}
+
+	notificationsSent *counterVec
+)
+
+// configureNotifications reads how many notifications are kept per user,
+// NOTIFICATION_MAX_PER_USER, and for how long, NOTIFICATION_RETENTION, and
+// QUOTA_WARNING_PERCENT, the share of a daily quota after which users are
+// warned
+func configureNotifications() {
+	notificationMaxPerUser = envInt("NOTIFICATION_MAX_PER_USER", 100)
+	notificationRetention = envDuration("NOTIFICATION_RETENTION", 7*24*time.Hour)
+	quotaWarningPercent = envInt("QUOTA_WARNING_PERCENT", 80)
+	// Numbering from the start time keeps the cursors clients saved before a
+	// restart behind every new notification
+	notificationSeq = time.Now().UnixMilli()
+	notificationsSent = newCounterVec("chatbot_notifications_total", "Notifications sent to the UI, by type", "type")
+	registerGaugeFunc("chatbot_notification_streams", "Open notification streams", func() float64 {
+		notificationsMu.Lock()
+		defer notificationsMu.Unlock()
+		open := 0
+		for _, subs := range notificationStream {
+			open += len(subs)
+		}
+		return float64(open)
+	})
+}
+
+// notifyUser stores a notification for the user and pushes it to their open
+// streams
+func notifyUser(user string, n Notification) {
+	notificationsMu.Lock()
+	defer notificationsMu.Unlock()
+	n = stampLocked(n)
+	list := pruneNotifications(append(userNotifications[user], n), n.CreatedAt)
+	if notificationMaxPerUser > 0 && len(list) > notificationMaxPerUser {
+		list = list[len(list)-notificationMaxPerUser:]
+	}
+	userNotifications[user] = list
+	for sub := range notificationStream[user] {
+		pushLocked(sub, n)
+	}
+}
+
+// broadcastNotification sends a notification to every user, including those
+// who connect later while it is retained
+func broadcastNotification(n Notification) Notification {
+	notificationsMu.Lock()
+	defer notificationsMu.Unlock()
+	n.Broadcast = true
+	n = stampLocked(n)
+	broadcasts = pruneNotifications(append(broadcasts, n), n.CreatedAt)
+	if notificationMaxPerUser > 0 && len(broadcasts) > notificationMaxPerUser {
+		broadcasts = broadcasts[len(broadcasts)-notificationMaxPerUser:]
+	}
+	for _, subs := range notificationStream {
+		for sub := range subs {
+			pushLocked(sub, n)
+		}
+	}
+	return n
+}
+
+// stampLocked numbers and dates a new notification; notificationsMu must be
+// held
+func stampLocked(n Notification) Notification {
+	notificationSeq++
+	n.Seq, n.CreatedAt = notificationSeq, time.Now()
+	notificationsSent.inc(n.Type)
+	return n
+}
+
+// pushLocked hands n to a stream without waiting for a slow client, which
+// can fetch what it missed instead; notificationsMu must be held
+func pushLocked(sub chan Notification, n Notification) {
+	select {
+	case sub <- n:
+	default:
+	}
+}
+
+func pruneNotifications(list []Notification, now time.Time) []Notification {
+	if notificationRetention <= 0 {
+		return list
+	}
+	i := 0
+	for i < len(list) && now.Sub(list[i].CreatedAt) > notificationRetention {
+		i++
+	}
+	return list[i:]
+}
+
+// notificationsAfter returns the user's and broadcast notifications after
+// seq, oldest first
+func notificationsAfter(user string, seq int64) []Notification {
+	notificationsMu.Lock()
+	defer notificationsMu.Unlock()
+	now := time.Now()
+	own := pruneNotifications(userNotifications[user], now)
+	shared := pruneNotifications(broadcasts, now)
+	out := []Notification{}
+	// Both lists are in sequence order, so merging keeps the order
+	for len(own) > 0 || len(shared) > 0 {
+		var n Notification
+		if len(shared) == 0 || (len(own) > 0 && own[0].Seq < shared[0].Seq) {
+			n, own = own[0], own[1:]
+		} else {
+			n, shared = shared[0], shared[1:]
+		}
+		if n.Seq > seq {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// warnQuota notifies the user once a day for each quota they have used
+// QUOTA_WARNING_PERCENT of
+func warnQuota(user string, now time.Time) {
+	if quotaWarningPercent <= 0 {
+		return
+	}
+	tier := entitlementsFor(user).Tier
+	used := quotas.current(user, now)
+	day := now.UTC().Format("2006-01-02")
+	for _, q := range []struct {
+		kind        string
+		used, limit int
+	}{
+		{"requests", used.requests, tier.RequestsPerDay},
+		{"tokens", used.tokens, tier.TokensPerDay},
+	} {
+		if q.limit <= 0 || q.used*100 < q.limit*quotaWarningPercent {
+			continue
+		}
+		key := user + "\x00" + q.kind
+		notificationsMu.Lock()
+		warned := quotaWarned[key] == day
+		quotaWarned[key] = day
+		notificationsMu.Unlock()
+		if warned {
+			continue
+		}
+		notifyUser(user, Notification{
+			Type:    "quota.warning",
+			Title:   fmt.Sprintf("You have used %d%% of today's %s", q.used*100/q.limit, q.kind),
+			Message: fmt.Sprintf("The %s tier allows %d %s a day; the quota resets at midnight UTC.", tier.Name, q.limit, q.kind),
+			Data:    gin.H{"quota": q.kind, "used": q.used, "limit": q.limit},
+		})
+	}
+}
+
+// notificationCursor is where a client wants to resume: the Last-Event-ID an
+// EventSource sends on reconnect, or the after query parameter
+func notificationCursor(c *gin.Context) int64 {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("after")
+	}
+	seq, _ := strconv.ParseInt(raw, 10, 64)
+	return seq
+}
+
+// handleListNotifications returns the notifications the caller missed after
+// the cursor, or every retained one
+func handleListNotifications(c *gin.Context) {
+	list := notificationsAfter(requestUser(c), notificationCursor(c))
+	notificationsMu.Lock()
+	latest := notificationSeq
+	notificationsMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"notifications": list, "latest": latest})
+}
+
+// handleNotificationStream pushes the caller's notifications as server-sent
+// events. Each event's id is its seq, so a reconnecting EventSource resumes
+// after the last one it received.
+func handleNotificationStream(c *gin.Context) {
+	user := requestUser(c)
+	sub := make(chan Notification, 32)
+	notificationsMu.Lock()
+	if notificationStream[user] == nil {
+		notificationStream[user] = map[chan Notification]bool{}
+	}
+	notificationStream[user][sub] = true
+	notificationsMu.Unlock()
+	defer func() {
+		notificationsMu.Lock()
+		delete(notificationStream[user], sub)
+		if len(notificationStream[user]) == 0 {
+			delete(notificationStream, user)
+		}
+		notificationsMu.Unlock()
+	}()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	// Subscribed first, so nothing falls between the replay and the stream
+	last := notificationCursor(c)
+	send := func(n Notification) {
+		if n.Seq <= last {
+			return
+		}
+		last = n.Seq
+		data, _ := json.Marshal(n)
+		fmt.Fprintf(c.Writer, "id: %d\nevent: notification\ndata: %s\n\n", n.Seq, data)
+	}
+	for _, n := range notificationsAfter(user, last) {
+		send(n)
+	}
+	io.WriteString(c.Writer, ": connected\n\n")
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case n := <-sub:
+			send(n)
+			c.Writer.Flush()
+		case <-keepalive.C:
+			io.WriteString(c.Writer, ": ping\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// handleBroadcastNotification sends a notice such as planned maintenance to
+// every user
+func handleBroadcastNotification(c *gin.Context) {
+	var req struct {
+		Type    string      `json:"type"`
+		Title   string      `json:"title" binding:"required"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Type == "" {
+		req.Type = "maintenance"
+	}
+	n := broadcastNotification(Notification{Type: req.Type, Title: req.Title, Message: req.Message, Data: req.Data})
+	log.Printf("Notification %s broadcast by %s", n.Type, requestUser(c))
+	c.JSON(http.StatusOK, n)
+}
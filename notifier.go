@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"chatbot_studio/server/pkg/webhook"
+)
+
+// Alert represents an operational event sent to the configured notifiers
+type Alert struct {
+	Type      string                 `json:"type"`
+	Severity  string                 `json:"severity"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+}
+
+var (
+	alertWebhookURL string
+	slackWebhookURL string
+	notifyClient    = &http.Client{Timeout: 10 * time.Second}
+
+	// alertHistory keeps the most recent alerts, oldest first, for the
+	// status page
+	alertHistoryMu   sync.Mutex
+	alertHistory     []Alert
+	alertHistorySize int
+
+	failedDeliveriesMu   sync.Mutex
+	failedDeliveries     []FailedDelivery
+	failedDeliveriesSize int
+)
+
+func configureNotifier() {
+	alertWebhookURL = envString("ALERT_WEBHOOK_URL", "")
+	slackWebhookURL = envString("SLACK_WEBHOOK_URL", "")
+	setWebhookSigningSecret(envString("WEBHOOK_SIGNING_SECRET", ""))
+	alertHistorySize = envInt("ALERT_HISTORY_SIZE", 200)
+	failedDeliveriesSize = envInt("WEBHOOK_FAILED_RETAINED", 200)
+}
+
+func recordAlert(alert Alert) {
+	alertHistoryMu.Lock()
+	defer alertHistoryMu.Unlock()
+	alertHistory = append(alertHistory, alert)
+	if alertHistorySize > 0 && len(alertHistory) > alertHistorySize {
+		alertHistory = append([]Alert(nil), alertHistory[len(alertHistory)-alertHistorySize:]...)
+	}
+}
+
+// recentAlerts returns the alerts raised since the given time, newest first
+func recentAlerts(since time.Time) []Alert {
+	alertHistoryMu.Lock()
+	defer alertHistoryMu.Unlock()
+	var alerts []Alert
+	for i := len(alertHistory) - 1; i >= 0 && !alertHistory[i].Timestamp.Before(since); i-- {
+		alerts = append(alerts, alertHistory[i])
+	}
+	return alerts
+}
+
+// notify logs the alert and delivers it asynchronously to the webhook and Slack
+func notify(alert Alert) {
+	if alert.Timestamp.IsZero() {
+		alert.Timestamp = time.Now()
+	}
+	log.Printf("Alert [%s/%s]: %s", alert.Severity, alert.Type, alert.Message)
+	recordAlert(alert)
+
+	if alertWebhookURL != "" {
+		go postJSON(alertWebhookURL, alert)
+	}
+	if slackWebhookURL != "" {
+		text := fmt.Sprintf(":rotating_light: *%s* (%s): %s", alert.Type, alert.Severity, alert.Message)
+		go postJSON(slackWebhookURL, map[string]string{"text": text})
+	}
+}
+
+// FailedDelivery is a callback that could not be delivered, kept so admins
+// can retry it
+type FailedDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// postJSON delivers a callback, signed when WEBHOOK_SIGNING_SECRET is set
+func postJSON(url string, body interface{}) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to encode notification: %v", err)
+		return
+	}
+	if err := deliverJSON(url, payload); err != nil {
+		log.Printf("Failed to send notification: %v", err)
+		recordFailedDelivery(FailedDelivery{ID: newID(), URL: url, Payload: payload, Error: err.Error(), Attempts: 1, FailedAt: time.Now()})
+	}
+}
+
+func deliverJSON(url string, payload []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := webhookSigningSecret(); secret != "" {
+		req.Header.Set(webhook.SignatureHeader, webhook.Sign([]byte(secret), time.Now(), payload))
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordFailedDelivery keeps the most recent WEBHOOK_FAILED_RETAINED failures
+func recordFailedDelivery(d FailedDelivery) {
+	failedDeliveriesMu.Lock()
+	defer failedDeliveriesMu.Unlock()
+	failedDeliveries = append(failedDeliveries, d)
+	if failedDeliveriesSize > 0 && len(failedDeliveries) > failedDeliveriesSize {
+		failedDeliveries = append([]FailedDelivery(nil), failedDeliveries[len(failedDeliveries)-failedDeliveriesSize:]...)
+	}
+}
+
+// takeFailedDeliveries removes and returns every failed delivery
+func takeFailedDeliveries() []FailedDelivery {
+	failedDeliveriesMu.Lock()
+	defer failedDeliveriesMu.Unlock()
+	taken := failedDeliveries
+	failedDeliveries = nil
+	return taken
+}
@@ -0,0 +1,248 @@
+// Package plugin implements out-of-process plugins for the chatbot app.
+//
+// A plugin is a separate executable placed in the app's PLUGIN_DIR. The app
+// starts every plugin at boot and talks to it with JSON-RPC over the plugin's
+// stdin and stdout, so plugins can add tools, guardrails and answer
+// post-processors without changing or recompiling the server. A plugin
+// implements Plugin (embedding Base for the hooks it does not need) and calls
+// Serve from main:
+//
+//	type shouty struct{ plugin.Base }
+//
+//	func (shouty) Describe() plugin.Description {
+//		return plugin.Description{Name: "shouty", PostProcessor: true}
+//	}
+//
+//	func (shouty) PostProcess(prompt, content string) (string, error) {
+//		return strings.ToUpper(content), nil
+//	}
+//
+//	func main() { plugin.Serve(shouty{}) }
+//
+// Plugins must not write anything else to stdout; use stderr for logging.
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// MagicCookieKey and MagicCookieValue are set in a plugin's environment by the
+// host, so a plugin binary run by hand can say what it is instead of hanging
+// on stdin
+const (
+	MagicCookieKey   = "CHATBOT_PLUGIN_MAGIC_COOKIE"
+	MagicCookieValue = "4f0c9c6e-chatbot-plugin-v1"
+)
+
+// ToolSpec describes a tool the model may call
+type ToolSpec struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"` // JSON Schema of the arguments
+}
+
+// Description tells the host which hooks a plugin implements
+type Description struct {
+	Name          string     `json:"name"`
+	Version       string     `json:"version,omitempty"`
+	Guardrail     bool       `json:"guardrail"`
+	PostProcessor bool       `json:"post_processor"`
+	Tools         []ToolSpec `json:"tools,omitempty"`
+}
+
+// Violation is returned by a guardrail that blocks text
+type Violation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Plugin is implemented by plugin binaries
+type Plugin interface {
+	Describe() Description
+	// CheckGuardrail inspects a prompt (stage "input") or answer (stage
+	// "output") and returns a violation to block it
+	CheckGuardrail(stage, text string) (*Violation, error)
+	// PostProcess may rewrite a completed answer
+	PostProcess(prompt, content string) (string, error)
+	// CallTool runs one of the tools listed in the description
+	CallTool(name string, arguments json.RawMessage) (string, error)
+}
+
+// Base implements every hook as a no-op, for embedding
+type Base struct{}
+
+func (Base) CheckGuardrail(stage, text string) (*Violation, error) { return nil, nil }
+
+func (Base) PostProcess(prompt, content string) (string, error) { return content, nil }
+
+func (Base) CallTool(name string, arguments json.RawMessage) (string, error) {
+	return "", fmt.Errorf("unknown tool %s", name)
+}
+
+// Wire types of the RPC protocol
+
+type DescribeArgs struct{}
+
+type GuardrailArgs struct {
+	Stage string `json:"stage"`
+	Text  string `json:"text"`
+}
+
+type GuardrailReply struct {
+	Violation *Violation `json:"violation"`
+}
+
+type PostProcessArgs struct {
+	Prompt  string `json:"prompt"`
+	Content string `json:"content"`
+}
+
+type PostProcessReply struct {
+	Content string `json:"content"`
+}
+
+type ToolArgs struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type ToolReply struct {
+	Content string `json:"content"`
+}
+
+// rpcServer adapts a Plugin to net/rpc's method conventions
+type rpcServer struct {
+	impl Plugin
+}
+
+func (s *rpcServer) Describe(args DescribeArgs, reply *Description) error {
+	*reply = s.impl.Describe()
+	return nil
+}
+
+func (s *rpcServer) CheckGuardrail(args GuardrailArgs, reply *GuardrailReply) error {
+	v, err := s.impl.CheckGuardrail(args.Stage, args.Text)
+	reply.Violation = v
+	return err
+}
+
+func (s *rpcServer) PostProcess(args PostProcessArgs, reply *PostProcessReply) error {
+	content, err := s.impl.PostProcess(args.Prompt, args.Content)
+	reply.Content = content
+	return err
+}
+
+func (s *rpcServer) CallTool(args ToolArgs, reply *ToolReply) error {
+	content, err := s.impl.CallTool(args.Name, args.Arguments)
+	reply.Content = content
+	return err
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error { return nil }
+
+// Serve runs the plugin until the host closes its stdin
+func Serve(p Plugin) {
+	if os.Getenv(MagicCookieKey) != MagicCookieValue {
+		fmt.Fprintln(os.Stderr, "This binary is a chatbot plugin. Place it in the server's PLUGIN_DIR instead of running it directly.")
+		os.Exit(1)
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &rpcServer{impl: p}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{os.Stdin, os.Stdout}))
+}
+
+// ErrTimeout is returned when a plugin does not answer in time
+var ErrTimeout = errors.New("plugin call timed out")
+
+// Client is the host side of a running plugin process
+type Client struct {
+	Path    string
+	cmd     *exec.Cmd
+	rpc     *rpc.Client
+	timeout time.Duration
+}
+
+// Start launches the plugin executable at path
+func Start(path string, timeout time.Duration) (*Client, error) {
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), MagicCookieKey+"="+MagicCookieValue)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	conn := struct {
+		io.Reader
+		io.WriteCloser
+	}{stdout, stdin}
+	return &Client{Path: path, cmd: cmd, rpc: jsonrpc.NewClient(conn), timeout: timeout}, nil
+}
+
+func (c *Client) call(method string, args, reply interface{}) error {
+	call := c.rpc.Go("Plugin."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+func (c *Client) Describe() (Description, error) {
+	var d Description
+	err := c.call("Describe", DescribeArgs{}, &d)
+	return d, err
+}
+
+func (c *Client) CheckGuardrail(stage, text string) (*Violation, error) {
+	var reply GuardrailReply
+	err := c.call("CheckGuardrail", GuardrailArgs{Stage: stage, Text: text}, &reply)
+	return reply.Violation, err
+}
+
+func (c *Client) PostProcess(prompt, content string) (string, error) {
+	var reply PostProcessReply
+	err := c.call("PostProcess", PostProcessArgs{Prompt: prompt, Content: content}, &reply)
+	return reply.Content, err
+}
+
+func (c *Client) CallTool(name string, arguments json.RawMessage) (string, error) {
+	var reply ToolReply
+	err := c.call("CallTool", ToolArgs{Name: name, Arguments: arguments}, &reply)
+	return reply.Content, err
+}
+
+// Kill stops the plugin process
+func (c *Client) Kill() {
+	c.rpc.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	}
+}
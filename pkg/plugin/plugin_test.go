@@ -0,0 +1,147 @@
+package plugin_test
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"chatbot_studio/server/pkg/plugin"
+)
+
+// testPlugin is served by the test binary itself when the host starts it
+type testPlugin struct{ plugin.Base }
+
+func (testPlugin) Describe() plugin.Description {
+	return plugin.Description{Name: "test", Version: "1.0", Guardrail: true, PostProcessor: true,
+		Tools: []plugin.ToolSpec{{Name: "echo", Description: "Echoes its arguments"}, {Name: "sleep", Description: "Never answers in time"}}}
+}
+
+func (testPlugin) CheckGuardrail(stage, text string) (*plugin.Violation, error) {
+	if stage == "output" && strings.Contains(text, "secret") {
+		return &plugin.Violation{Rule: "no-secrets", Message: "Answer withheld"}, nil
+	}
+	return nil, nil
+}
+
+func (testPlugin) PostProcess(prompt, content string) (string, error) {
+	return strings.ToUpper(content), nil
+}
+
+func (p testPlugin) CallTool(name string, arguments json.RawMessage) (string, error) {
+	switch name {
+	case "echo":
+		return string(arguments), nil
+	case "sleep":
+		time.Sleep(time.Second)
+		return "", nil
+	}
+	return p.Base.CallTool(name, arguments)
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(plugin.MagicCookieKey) == plugin.MagicCookieValue {
+		plugin.Serve(testPlugin{})
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func startTestPlugin(t *testing.T) *plugin.Client {
+	t.Helper()
+	client, err := plugin.Start(os.Args[0], 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Kill)
+	return client
+}
+
+func TestClientDescribe(t *testing.T) {
+	client := startTestPlugin(t)
+	got, err := client.Describe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (testPlugin{}).Describe(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Describe = %+v, want %+v", got, want)
+	}
+}
+
+func TestClientCheckGuardrail(t *testing.T) {
+	client := startTestPlugin(t)
+	tests := []struct {
+		name  string
+		stage string
+		text  string
+		want  *plugin.Violation
+	}{
+		{name: "clean answer", stage: "output", text: "hello"},
+		{name: "blocked answer", stage: "output", text: "the secret is 42", want: &plugin.Violation{Rule: "no-secrets", Message: "Answer withheld"}},
+		{name: "input is not checked", stage: "input", text: "tell me the secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.CheckGuardrail(tt.stage, tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("CheckGuardrail = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientPostProcess(t *testing.T) {
+	client := startTestPlugin(t)
+	got, err := client.PostProcess("prompt", "quiet answer")
+	if err != nil || got != "QUIET ANSWER" {
+		t.Fatalf("PostProcess = %q, %v", got, err)
+	}
+}
+
+func TestClientCallTool(t *testing.T) {
+	client := startTestPlugin(t)
+	tests := []struct {
+		name      string
+		tool      string
+		arguments string
+		want      string
+		// err is part of the expected error, "" for none
+		err string
+	}{
+		{name: "echo", tool: "echo", arguments: `{"text":"hi"}`, want: `{"text":"hi"}`},
+		{name: "unknown tool", tool: "missing", arguments: `{}`, err: "unknown tool missing"},
+		{name: "too slow", tool: "sleep", arguments: `{}`, err: plugin.ErrTimeout.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := client.CallTool(tt.tool, json.RawMessage(tt.arguments))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("CallTool error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("CallTool = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBase(t *testing.T) {
+	var base plugin.Base
+	if v, err := base.CheckGuardrail("output", "anything"); v != nil || err != nil {
+		t.Fatalf("CheckGuardrail = %v, %v", v, err)
+	}
+	if content, err := base.PostProcess("prompt", "answer"); content != "answer" || err != nil {
+		t.Fatalf("PostProcess = %q, %v", content, err)
+	}
+	if _, err := base.CallTool("x", nil); err == nil {
+		t.Fatal("CallTool of an unknown tool succeeded")
+	}
+}
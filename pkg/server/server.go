@@ -0,0 +1,73 @@
+// Package server lets code embedded in the chatbot app add middleware and
+// routes without editing main.go. Register from an init function, typically
+// in a package that the app blank-imports:
+//
+//	func init() {
+//		server.Use(myAuditMiddleware)
+//		server.RegisterRoute("GET", "/api/team/hello", helloHandler)
+//	}
+//
+// Registrations are applied once when the HTTP server starts; registering
+// afterwards has no effect.
+package server
+
+import (
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route is a custom route added to the app
+type Route struct {
+	Method   string
+	Path     string
+	Handlers []gin.HandlerFunc
+	// Admin routes are mounted behind the app's admin check, with Path
+	// relative to /api
+	Admin bool
+}
+
+var (
+	mu         sync.Mutex
+	middleware []gin.HandlerFunc
+	routes     []Route
+)
+
+// Use adds middleware that runs for every request, after CORS and before
+// the app's own handlers, in registration order
+func Use(handlers ...gin.HandlerFunc) {
+	mu.Lock()
+	defer mu.Unlock()
+	middleware = append(middleware, handlers...)
+}
+
+// RegisterRoute adds a public route. Paths must not clash with the app's own
+// routes; gin panics at startup if they do.
+func RegisterRoute(method, path string, handlers ...gin.HandlerFunc) {
+	addRoute(Route{Method: method, Path: path, Handlers: handlers})
+}
+
+// RegisterAdminRoute adds a route under /api that only admins may call
+func RegisterAdminRoute(method, path string, handlers ...gin.HandlerFunc) {
+	addRoute(Route{Method: method, Path: path, Handlers: handlers, Admin: true})
+}
+
+func addRoute(r Route) {
+	mu.Lock()
+	defer mu.Unlock()
+	routes = append(routes, r)
+}
+
+// Middleware returns the registered middleware
+func Middleware() []gin.HandlerFunc {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]gin.HandlerFunc(nil), middleware...)
+}
+
+// Routes returns the registered routes
+func Routes() []Route {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Route(nil), routes...)
+}
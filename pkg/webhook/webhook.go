@@ -0,0 +1,138 @@
+// Package webhook signs and verifies the HTTP callbacks the chatbot app
+// sends, such as alerts and batch job completions.
+//
+// When WEBHOOK_SIGNING_SECRET is set, every callback carries a
+// SignatureHeader of the form
+//
+//	t=1700000000,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where v1 is the hex HMAC-SHA256 of the timestamp, a dot and the raw body.
+// Receivers check it with Verify, or VerifyRequest in an HTTP handler:
+//
+//	body, err := webhook.VerifyRequest(r, secret, webhook.DefaultTolerance)
+//	if err != nil {
+//		http.Error(w, err.Error(), http.StatusUnauthorized)
+//		return
+//	}
+//
+// The timestamp is signed too, so a captured callback cannot be replayed
+// once it is older than the tolerance.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a callback
+const SignatureHeader = "X-Chatbot-Signature"
+
+// DefaultTolerance is how far a callback's timestamp may be from the
+// receiver's clock
+const DefaultTolerance = 5 * time.Minute
+
+// DefaultMaxBodySize is the largest body VerifyRequest reads
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	ErrMissingSignature = errors.New("webhook: missing signature")
+	ErrMalformedHeader  = errors.New("webhook: malformed signature header")
+	ErrTimestamp        = errors.New("webhook: timestamp outside tolerance")
+	ErrInvalidSignature = errors.New("webhook: signature does not match")
+	ErrBodyTooLarge     = errors.New("webhook: body too large")
+)
+
+// Sign returns the SignatureHeader value for body sent at t
+func Sign(secret []byte, t time.Time, body []byte) string {
+	ts := t.Unix()
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac(secret, ts, body)))
+}
+
+func mac(secret []byte, ts int64, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strconv.FormatInt(ts, 10)))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks a SignatureHeader value against body. The header may carry
+// several v1 signatures, e.g. while the sender rotates its secret; one match
+// is enough. A tolerance of zero skips the timestamp check.
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	if header == "" {
+		return ErrMissingSignature
+	}
+	var ts int64
+	var signatures [][]byte
+	haveTimestamp := false
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return ErrMalformedHeader
+		}
+		switch key {
+		case "t":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return ErrMalformedHeader
+			}
+			ts, haveTimestamp = n, true
+		case "v1":
+			sig, err := hex.DecodeString(value)
+			if err != nil {
+				return ErrMalformedHeader
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+	if !haveTimestamp || len(signatures) == 0 {
+		return ErrMalformedHeader
+	}
+	if tolerance > 0 {
+		if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+			return ErrTimestamp
+		}
+	}
+	expected := mac(secret, ts, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// VerifyRequest reads and verifies the body of an incoming callback, of at
+// most DefaultMaxBodySize bytes. The body is returned and also restored on r
+// so later handlers can read it.
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) ([]byte, error) {
+	return VerifyRequestLimit(r, secret, tolerance, DefaultMaxBodySize)
+}
+
+// VerifyRequestLimit is VerifyRequest for bodies of at most maxBytes. A larger
+// body is rejected with ErrBodyTooLarge without being read further.
+func VerifyRequestLimit(r *http.Request, secret []byte, tolerance time.Duration, maxBytes int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := Verify(secret, r.Header.Get(SignatureHeader), body, tolerance, time.Now()); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,106 @@
+package webhook_test
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"chatbot_studio/server/pkg/webhook"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("s3cret")
+	sent := time.Unix(1700000000, 0)
+	body := []byte(`{"type":"alert"}`)
+	signed := webhook.Sign(secret, sent, body)
+	// v1 is the signature without the t= part
+	v1 := signed[strings.Index(signed, "v1="):]
+
+	tests := []struct {
+		name      string
+		secret    string
+		header    string
+		body      string
+		tolerance time.Duration
+		now       time.Time
+		want      error
+	}{
+		{name: "valid", secret: "s3cret", header: signed, body: string(body), tolerance: webhook.DefaultTolerance, now: sent},
+		{name: "valid at the edge of the tolerance", secret: "s3cret", header: signed, body: string(body), tolerance: time.Minute, now: sent.Add(time.Minute)},
+		{name: "valid with spaces", secret: "s3cret", header: strings.ReplaceAll(signed, ",", ", "), body: string(body), now: sent},
+		{name: "one of several signatures matches", secret: "s3cret", header: "t=1700000000,v1=00ff," + v1, body: string(body), now: sent},
+		{name: "zero tolerance skips the timestamp", secret: "s3cret", header: signed, body: string(body), now: sent.Add(24 * time.Hour)},
+		{name: "missing", secret: "s3cret", header: "", body: string(body), now: sent, want: webhook.ErrMissingSignature},
+		{name: "no timestamp", secret: "s3cret", header: v1, body: string(body), now: sent, want: webhook.ErrMalformedHeader},
+		{name: "no signature", secret: "s3cret", header: "t=1700000000", body: string(body), now: sent, want: webhook.ErrMalformedHeader},
+		{name: "part without =", secret: "s3cret", header: signed + ",junk", body: string(body), now: sent, want: webhook.ErrMalformedHeader},
+		{name: "bad timestamp", secret: "s3cret", header: "t=soon," + v1, body: string(body), now: sent, want: webhook.ErrMalformedHeader},
+		{name: "bad hex", secret: "s3cret", header: "t=1700000000,v1=zz", body: string(body), now: sent, want: webhook.ErrMalformedHeader},
+		{name: "too old", secret: "s3cret", header: signed, body: string(body), tolerance: time.Minute, now: sent.Add(time.Minute + time.Second), want: webhook.ErrTimestamp},
+		{name: "from the future", secret: "s3cret", header: signed, body: string(body), tolerance: time.Minute, now: sent.Add(-2 * time.Minute), want: webhook.ErrTimestamp},
+		{name: "changed timestamp", secret: "s3cret", header: "t=1700000001," + v1, body: string(body), now: sent, want: webhook.ErrInvalidSignature},
+		{name: "changed body", secret: "s3cret", header: signed, body: `{"type":"other"}`, now: sent, want: webhook.ErrInvalidSignature},
+		{name: "wrong secret", secret: "other", header: signed, body: string(body), now: sent, want: webhook.ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := webhook.Verify([]byte(tt.secret), tt.header, []byte(tt.body), tt.tolerance, tt.now)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("s3cret")
+	body := `{"type":"batch.completed"}`
+	large := strings.Repeat("x", webhook.DefaultMaxBodySize+1)
+
+	tests := []struct {
+		name   string
+		body   string
+		header string
+		// limit is passed to VerifyRequestLimit, or 0 for VerifyRequest
+		limit int64
+		want  error
+	}{
+		{name: "signed now", body: body, header: webhook.Sign(secret, time.Now(), []byte(body))},
+		{name: "signed an hour ago", body: body, header: webhook.Sign(secret, time.Now().Add(-time.Hour), []byte(body)), want: webhook.ErrTimestamp},
+		{name: "unsigned", body: body, want: webhook.ErrMissingSignature},
+		{name: "at the limit", body: body, header: webhook.Sign(secret, time.Now(), []byte(body)), limit: int64(len(body))},
+		{name: "past the limit", body: body, header: webhook.Sign(secret, time.Now(), []byte(body)), limit: int64(len(body)) - 1, want: webhook.ErrBodyTooLarge},
+		{name: "past the default limit", body: large, header: webhook.Sign(secret, time.Now(), []byte(large)), want: webhook.ErrBodyTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/hook", strings.NewReader(tt.body))
+			if tt.header != "" {
+				r.Header.Set(webhook.SignatureHeader, tt.header)
+			}
+			var got []byte
+			var err error
+			if tt.limit > 0 {
+				got, err = webhook.VerifyRequestLimit(r, secret, webhook.DefaultTolerance, tt.limit)
+			} else {
+				got, err = webhook.VerifyRequest(r, secret, webhook.DefaultTolerance)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("VerifyRequest = %v, want %v", err, tt.want)
+			}
+			if err == nil && string(got) != tt.body {
+				t.Fatalf("body = %q, want %q", got, tt.body)
+			}
+			if errors.Is(err, webhook.ErrBodyTooLarge) {
+				return
+			}
+			// Later handlers can still read the body
+			if again, _ := io.ReadAll(r.Body); string(again) != tt.body {
+				t.Fatalf("restored body = %q, want %q", again, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"chatbot_studio/server/pkg/plugin"
+)
+
+// loadedPlugin is a running plugin process and what it registered
+type loadedPlugin struct {
+	client *plugin.Client
+	desc   plugin.Description
+
+	mu       sync.Mutex
+	failures int
+	lastErr  string
+}
+
+// PluginInfo describes a plugin for the admin API
+type PluginInfo struct {
+	Name          string   `json:"name"`
+	Version       string   `json:"version,omitempty"`
+	Path          string   `json:"path"`
+	Guardrail     bool     `json:"guardrail"`
+	PostProcessor bool     `json:"post_processor"`
+	Tools         []string `json:"tools,omitempty"`
+	Failures      int      `json:"failures"`
+	LastError     string   `json:"last_error,omitempty"`
+}
+
+var (
+	pluginDir        string
+	pluginTimeout    time.Duration
+	pluginFailClosed bool
+
+	plugins []*loadedPlugin
+)
+
+func configurePlugins() {
+	pluginDir = envString("PLUGIN_DIR", "")
+	pluginTimeout = envDuration("PLUGIN_TIMEOUT", 5*time.Second)
+	pluginFailClosed = envBool("PLUGIN_GUARDRAIL_FAIL_CLOSED", false)
+}
+
+// startPlugins launches every executable in PLUGIN_DIR. A plugin that fails
+// to start or describe itself is logged and skipped.
+func startPlugins() {
+	if pluginDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(pluginDir)
+	if err != nil {
+		log.Printf("Warning: cannot read PLUGIN_DIR %s: %v", pluginDir, err)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		path := filepath.Join(pluginDir, entry.Name())
+		client, err := plugin.Start(path, pluginTimeout)
+		if err != nil {
+			log.Printf("Warning: failed to start plugin %s: %v", path, err)
+			continue
+		}
+		desc, err := client.Describe()
+		if err != nil || desc.Name == "" {
+			log.Printf("Warning: plugin %s did not describe itself: %v", path, err)
+			client.Kill()
+			continue
+		}
+
+		p := &loadedPlugin{client: client, desc: desc}
+		plugins = append(plugins, p)
+		for _, spec := range desc.Tools {
+			spec := spec
+			registerTool(Tool{
+				Name:        spec.Name,
+				Description: spec.Description,
+				Parameters:  spec.Parameters,
+				Source:      "plugin:" + desc.Name,
+				call: func(arguments json.RawMessage) (string, error) {
+					out, err := client.CallTool(spec.Name, arguments)
+					p.observe(err)
+					return out, err
+				},
+			})
+		}
+		log.Printf("Loaded plugin %s from %s (guardrail=%v, post_processor=%v, tools=%d)",
+			desc.Name, path, desc.Guardrail, desc.PostProcessor, len(desc.Tools))
+	}
+}
+
+func (p *loadedPlugin) observe(err error) {
+	if err == nil {
+		return
+	}
+	log.Printf("Plugin %s failed: %v", p.desc.Name, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures++
+	p.lastErr = err.Error()
+}
+
+// checkPluginGuardrails asks each guardrail plugin about text. A plugin that
+// errors allows the text unless PLUGIN_GUARDRAIL_FAIL_CLOSED is set.
+func checkPluginGuardrails(stage, text string) *GuardrailViolation {
+	for _, p := range plugins {
+		if !p.desc.Guardrail {
+			continue
+		}
+		v, err := p.client.CheckGuardrail(stage, text)
+		p.observe(err)
+		if err != nil {
+			if pluginFailClosed {
+				return &GuardrailViolation{Rule: "plugin:" + p.desc.Name, Stage: stage, Message: defaultPolicyMessage}
+			}
+			continue
+		}
+		if v != nil {
+			if v.Message == "" {
+				v.Message = defaultPolicyMessage
+			}
+			return &GuardrailViolation{Rule: v.Rule, Stage: stage, Message: v.Message}
+		}
+	}
+	return nil
+}
+
+// postProcessAnswer runs the post-processor plugins in name order; a plugin
+// that errors leaves the answer unchanged
+func postProcessAnswer(prompt, content string) string {
+	for _, p := range plugins {
+		if !p.desc.PostProcessor {
+			continue
+		}
+		out, err := p.client.PostProcess(prompt, content)
+		p.observe(err)
+		if err == nil {
+			content = out
+		}
+	}
+	return content
+}
+
+func handleListPlugins(c *gin.Context) {
+	infos := []PluginInfo{}
+	for _, p := range plugins {
+		info := PluginInfo{
+			Name:          p.desc.Name,
+			Version:       p.desc.Version,
+			Path:          p.client.Path,
+			Guardrail:     p.desc.Guardrail,
+			PostProcessor: p.desc.PostProcessor,
+		}
+		for _, t := range p.desc.Tools {
+			info.Tools = append(info.Tools, t.Name)
+		}
+		p.mu.Lock()
+		info.Failures, info.LastError = p.failures, p.lastErr
+		p.mu.Unlock()
+		infos = append(infos, info)
+	}
+	c.JSON(http.StatusOK, gin.H{"plugins": infos, "tools": listTools()})
+}
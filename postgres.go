@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+	migratepostgres "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/lib/pq"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// newPostgresStorage connects to dsn
+func newPostgresStorage(dsn string) (*storageBackend, error) {
+	if dsn == "" {
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(envInt("DATABASE_MAX_CONNS", 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	migrations, err := fs.Sub(postgresMigrations, "migrations/postgres")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &storageBackend{
+		name:               "postgres",
+		db:                 db,
+		audit:              &postgresAuditStore{db: db},
+		conversations:      &postgresConversationStore{db: db},
+		killSwitches:       &postgresKillSwitchStore{db: db},
+		conversationEvents: &postgresConversationEventStore{db: db},
+		requestCaptures:    &postgresRequestCaptureStore{db: db},
+		securityEvents:     &postgresSecurityEventStore{db: db},
+		migrations:         migrations,
+		migrationDriver: func() (database.Driver, error) {
+			return postgresMigrationDriver(db)
+		},
+	}, nil
+}
+
+// postgresMigrationDriver runs migrations on a connection of its own, which
+// closing the driver returns to the pool
+func postgresMigrationDriver(db *sql.DB) (database.Driver, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	driver, err := migratepostgres.WithConnection(ctx, conn, &migratepostgres.Config{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return driver, nil
+}
+
+// postgresAuditStore keeps audit records in the audit_records table
+type postgresAuditStore struct {
+	db *sql.DB
+}
+
+const auditColumns = `id, ts, user_id, model, prompt, response, prompt_tokens, completion_tokens,
+	cost, latency_ns, status_code, error, quality, client_request_id`
+
+func (s *postgresAuditStore) Add(record AuditRecord) {
+	quality, err := marshalQuality(record.Quality)
+	if err != nil {
+		log.Printf("Failed to store audit record %s: %v", record.ID, err)
+		return
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err = s.db.ExecContext(ctx, `INSERT INTO audit_records (`+auditColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		record.ID, record.Timestamp, record.User, record.Model, record.Prompt, record.Response,
+		record.PromptTokens, record.CompletionTokens, record.Cost, int64(record.Latency),
+		record.StatusCode, record.Error, quality, record.ClientRequestID)
+	if err != nil {
+		log.Printf("Failed to store audit record %s: %v", record.ID, err)
+	}
+}
+
+func (s *postgresAuditStore) List(from, to time.Time) []AuditRecord {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE ts >= $1 AND ts < $2 ORDER BY ts`, from, to)
+	if err != nil {
+		log.Printf("Failed to list audit records: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var out []AuditRecord
+	for rows.Next() {
+		r, err := scanAuditRecord(rows)
+		if err != nil {
+			log.Printf("Failed to read audit record: %v", err)
+			return out
+		}
+		out = append(out, r)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list audit records: %v", err)
+	}
+	return out
+}
+
+func (s *postgresAuditStore) Update(id string, fn func(*AuditRecord)) bool {
+	ctx, cancel := storageContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to update audit record %s: %v", id, err)
+		return false
+	}
+	defer tx.Rollback()
+
+	r, err := scanAuditRecord(tx.QueryRowContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to update audit record %s: %v", id, err)
+		return false
+	}
+	fn(&r)
+
+	quality, err := marshalQuality(r.Quality)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE audit_records SET response = $2, prompt_tokens = $3,
+			completion_tokens = $4, cost = $5, latency_ns = $6, status_code = $7, error = $8, quality = $9
+			WHERE id = $1`,
+			id, r.Response, r.PromptTokens, r.CompletionTokens, r.Cost, int64(r.Latency),
+			r.StatusCode, r.Error, quality)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to update audit record %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+func (s *postgresAuditStore) Get(id string) (AuditRecord, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	r, err := scanAuditRecord(s.db.QueryRowContext(ctx, `SELECT `+auditColumns+` FROM audit_records
+		WHERE id = $1`, id))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get audit record %s: %v", id, err)
+		}
+		return AuditRecord{}, false
+	}
+	return r, true
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAuditRecord(row rowScanner) (AuditRecord, error) {
+	var r AuditRecord
+	var latency int64
+	var quality []byte
+	// Databricks rows written before the column was added hold NULL
+	var clientRequestID sql.NullString
+	err := row.Scan(&r.ID, &r.Timestamp, &r.User, &r.Model, &r.Prompt, &r.Response,
+		&r.PromptTokens, &r.CompletionTokens, &r.Cost, &latency, &r.StatusCode, &r.Error, &quality, &clientRequestID)
+	if err != nil {
+		return r, err
+	}
+	r.Latency, r.ClientRequestID = time.Duration(latency), clientRequestID.String
+	if quality != nil {
+		if err := json.Unmarshal(quality, &r.Quality); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// marshalQuality encodes a score for a nullable JSON column
+func marshalQuality(q *QualityScore) (interface{}, error) {
+	if q == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// postgresConversationStore keeps conversations in the conversations table,
+// with the messages and settings of each as JSONB
+type postgresConversationStore struct {
+	db *sql.DB
+}
+
+func (s *postgresConversationStore) Create(user string) Conversation {
+	now := time.Now()
+	conv := Conversation{ID: newID(), User: user, CreatedAt: now, UpdatedAt: now}
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO conversations (id, user_id, created_at, updated_at, messages)
+		VALUES ($1, $2, $3, $4, '[]')`, conv.ID, conv.User, conv.CreatedAt, conv.UpdatedAt)
+	if err != nil {
+		log.Printf("Failed to store conversation %s: %v", conv.ID, err)
+	}
+	return conv
+}
+
+func (s *postgresConversationStore) Get(id string) (Conversation, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	conv, err := scanConversation(s.db.QueryRowContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return Conversation{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to load conversation %s: %v", id, err)
+		return Conversation{}, false
+	}
+	return conv, true
+}
+
+func (s *postgresConversationStore) Update(id string, fn func(*Conversation)) bool {
+	ctx, cancel := storageContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to update conversation %s: %v", id, err)
+		return false
+	}
+	defer tx.Rollback()
+
+	conv, err := scanConversation(tx.QueryRowContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE id = $1 FOR UPDATE`, id))
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Failed to update conversation %s: %v", id, err)
+		return false
+	}
+	fn(&conv)
+	conv.UpdatedAt = time.Now()
+
+	messages, settings, err := marshalConversation(conv)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `UPDATE conversations SET updated_at = $2, messages = $3, settings = $4 WHERE id = $1`,
+			id, conv.UpdatedAt, messages, settings)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to update conversation %s: %v", id, err)
+		return false
+	}
+	return true
+}
+
+func (s *postgresConversationStore) List(user string) []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE user_id = $1 ORDER BY updated_at DESC`, user)
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *postgresConversationStore) All() []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations ORDER BY created_at`)
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *postgresConversationStore) Put(conv Conversation) {
+	messages, settings, err := marshalConversation(conv)
+	if err == nil {
+		ctx, cancel := storageContext()
+		defer cancel()
+		_, err = s.db.ExecContext(ctx, `INSERT INTO conversations (id, user_id, created_at, updated_at, messages, settings)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (id) DO UPDATE SET user_id = $2, created_at = $3, updated_at = $4, messages = $5, settings = $6`,
+			conv.ID, conv.User, conv.CreatedAt, conv.UpdatedAt, messages, settings)
+	}
+	if err != nil {
+		log.Printf("Failed to store conversation %s: %v", conv.ID, err)
+	}
+}
+
+func (s *postgresConversationStore) Inactive(before time.Time, limit int) []Conversation {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT id, user_id, created_at, updated_at, messages, settings
+		FROM conversations WHERE updated_at < $1 ORDER BY updated_at LIMIT $2`, before, limit)
+	if err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+		return []Conversation{}
+	}
+	defer rows.Close()
+	return scanConversations(rows)
+}
+
+func (s *postgresConversationStore) Delete(id string) bool {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM conversations WHERE id = $1`, id)
+	if err != nil {
+		log.Printf("Failed to delete conversation %s: %v", id, err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n > 0
+}
+
+// scanConversations reads rows until the end or the first bad row
+func scanConversations(rows *sql.Rows) []Conversation {
+	out := []Conversation{}
+	for rows.Next() {
+		conv, err := scanConversation(rows)
+		if err != nil {
+			log.Printf("Failed to read conversation: %v", err)
+			return out
+		}
+		out = append(out, conv)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list conversations: %v", err)
+	}
+	return out
+}
+
+func scanConversation(row rowScanner) (Conversation, error) {
+	var conv Conversation
+	var messages, settings []byte
+	if err := row.Scan(&conv.ID, &conv.User, &conv.CreatedAt, &conv.UpdatedAt, &messages, &settings); err != nil {
+		return conv, err
+	}
+	if err := json.Unmarshal(messages, &conv.Messages); err != nil {
+		return conv, err
+	}
+	// Rows written before the settings column was added have none
+	if len(settings) == 0 {
+		return conv, nil
+	}
+	return conv, json.Unmarshal(settings, &conv.Settings)
+}
+
+// marshalConversation encodes the JSON columns of a conversation
+func marshalConversation(conv Conversation) (messages, settings string, err error) {
+	m, err := json.Marshal(conv.Messages)
+	if err != nil {
+		return "", "", err
+	}
+	st, err := json.Marshal(conv.Settings)
+	return string(m), string(st), err
+}
+
+// postgresKillSwitchStore keeps engaged kill switches in the kill_switches
+// table, one row per feature
+type postgresKillSwitchStore struct {
+	db *sql.DB
+}
+
+func (s *postgresKillSwitchStore) List() ([]KillSwitch, error) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT feature, reason, engaged_by, engaged_at FROM kill_switches`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanKillSwitches(rows)
+}
+
+func (s *postgresKillSwitchStore) Engage(sw KillSwitch) error {
+	ctx, cancel := storageContext()
+	defer cancel()
+	_, err := s.db.ExecContext(ctx, `INSERT INTO kill_switches (feature, reason, engaged_by, engaged_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (feature) DO UPDATE SET reason = $2, engaged_by = $3, engaged_at = $4`,
+		sw.Feature, sw.Reason, sw.EngagedBy, sw.EngagedAt)
+	return err
+}
+
+func (s *postgresKillSwitchStore) Release(feature string) (bool, error) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM kill_switches WHERE feature = $1`, feature)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+func scanKillSwitches(rows *sql.Rows) ([]KillSwitch, error) {
+	var switches []KillSwitch
+	for rows.Next() {
+		var sw KillSwitch
+		if err := rows.Scan(&sw.Feature, &sw.Reason, &sw.EngagedBy, &sw.EngagedAt); err != nil {
+			return nil, err
+		}
+		switches = append(switches, sw)
+	}
+	return switches, rows.Err()
+}
+
+// postgresConversationEventStore keeps the conversation event log in the
+// conversation_events table, with each event as JSONB
+type postgresConversationEventStore struct {
+	db *sql.DB
+}
+
+func (s *postgresConversationEventStore) Append(events ...ConversationEvent) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("Failed to store conversation events: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `INSERT INTO conversation_events (id, conversation_id, user_id, type, ts, data)
+				VALUES ($1, $2, $3, $4, $5, $6)`, e.ID, e.ConversationID, e.User, e.Type, e.At, string(data))
+		}
+		if err != nil {
+			log.Printf("Failed to store conversation event %s: %v", e.ID, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to store conversation events: %v", err)
+	}
+}
+
+func (s *postgresConversationEventStore) Conversation(id string) []ConversationEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, data FROM conversation_events WHERE conversation_id = $1 ORDER BY seq`, id)
+	if err != nil {
+		log.Printf("Failed to load events of conversation %s: %v", id, err)
+		return []ConversationEvent{}
+	}
+	defer rows.Close()
+	return scanConversationEvents(rows)
+}
+
+func (s *postgresConversationEventStore) Drop(id string) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM conversation_events WHERE conversation_id = $1`, id); err != nil {
+		log.Printf("Failed to drop events of conversation %s: %v", id, err)
+	}
+}
+
+func (s *postgresConversationEventStore) Since(user string, seq int64, before time.Time, limit int) []ConversationEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT seq, data FROM conversation_events
+		WHERE user_id = $1 AND seq > $2 AND seq < COALESCE(
+			(SELECT MIN(seq) FROM conversation_events WHERE user_id = $1 AND seq > $2 AND ts >= $3), 9223372036854775807)
+		ORDER BY seq LIMIT $4`, user, seq, before, limit)
+	if err != nil {
+		log.Printf("Failed to load conversation events of %s: %v", user, err)
+		return []ConversationEvent{}
+	}
+	defer rows.Close()
+	return scanConversationEvents(rows)
+}
+
+func (s *postgresConversationEventStore) Latest(before time.Time) int64 {
+	ctx, cancel := storageContext()
+	defer cancel()
+	var seq int64
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(seq), 0) FROM conversation_events WHERE ts < $1`, before).Scan(&seq); err != nil {
+		log.Printf("Failed to read the latest conversation event: %v", err)
+	}
+	return seq
+}
+
+// Forgotten is 0, the table keeps every event
+func (s *postgresConversationEventStore) Forgotten() int64 { return 0 }
+
+func scanConversationEvents(rows *sql.Rows) []ConversationEvent {
+	events := []ConversationEvent{}
+	for rows.Next() {
+		var seq int64
+		var data string
+		var e ConversationEvent
+		if err := rows.Scan(&seq, &data); err != nil {
+			log.Printf("Failed to read conversation event: %v", err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			log.Printf("Failed to decode conversation event %d: %v", seq, err)
+			continue
+		}
+		e.Seq = seq
+		events = append(events, e)
+	}
+	return events
+}
+
+// postgresRequestCaptureStore keeps captured requests in the
+// request_captures table, with each capture as JSONB
+type postgresRequestCaptureStore struct {
+	db *sql.DB
+}
+
+func (s *postgresRequestCaptureStore) Add(capture RequestCapture) {
+	data, err := json.Marshal(capture)
+	if err != nil {
+		log.Printf("Failed to store captured request %s: %v", capture.ID, err)
+		return
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO request_captures (id, user_id, ts, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`, capture.ID, capture.User, capture.At, string(data)); err != nil {
+		log.Printf("Failed to store captured request %s: %v", capture.ID, err)
+	}
+}
+
+func (s *postgresRequestCaptureStore) Get(id string) (RequestCapture, bool) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	return scanRequestCapture(id, s.db.QueryRowContext(ctx, `SELECT data FROM request_captures WHERE id = $1`, id))
+}
+
+func (s *postgresRequestCaptureStore) Prune(before time.Time) int {
+	ctx, cancel := storageContext()
+	defer cancel()
+	result, err := s.db.ExecContext(ctx, `DELETE FROM request_captures WHERE ts < $1`, before)
+	if err != nil {
+		log.Printf("Failed to prune captured requests: %v", err)
+		return 0
+	}
+	n, _ := result.RowsAffected()
+	return int(n)
+}
+
+func scanRequestCapture(id string, row *sql.Row) (RequestCapture, bool) {
+	var data string
+	var capture RequestCapture
+	if err := row.Scan(&data); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Failed to get captured request %s: %v", id, err)
+		}
+		return capture, false
+	}
+	if err := json.Unmarshal([]byte(data), &capture); err != nil {
+		log.Printf("Failed to decode captured request %s: %v", id, err)
+		return capture, false
+	}
+	return capture, true
+}
+
+// postgresSecurityEventStore keeps security events in the security_events
+// table
+type postgresSecurityEventStore struct {
+	db *sql.DB
+}
+
+func (s *postgresSecurityEventStore) Add(e SecurityEvent) {
+	ctx, cancel := storageContext()
+	defer cancel()
+	if _, err := s.db.ExecContext(ctx, `INSERT INTO security_events (ts, event, kind, client_ip, subject, detail)
+		VALUES ($1, $2, $3, $4, $5, $6)`, e.Timestamp, e.Event, e.Kind, e.ClientIP, e.Subject, e.Detail); err != nil {
+		log.Printf("Failed to store security event: %v", err)
+	}
+}
+
+func (s *postgresSecurityEventStore) Recent(limit int) []SecurityEvent {
+	ctx, cancel := storageContext()
+	defer cancel()
+	rows, err := s.db.QueryContext(ctx, `SELECT ts, event, kind, client_ip, subject, detail FROM security_events
+		ORDER BY ts DESC LIMIT $1`, limit)
+	if err != nil {
+		log.Printf("Failed to list security events: %v", err)
+		return []SecurityEvent{}
+	}
+	defer rows.Close()
+	return scanSecurityEvents(rows)
+}
+
+func scanSecurityEvents(rows *sql.Rows) []SecurityEvent {
+	events := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		if err := rows.Scan(&e.Timestamp, &e.Event, &e.Kind, &e.ClientIP, &e.Subject, &e.Detail); err != nil {
+			log.Printf("Failed to read security event: %v", err)
+			return events
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Failed to list security events: %v", err)
+	}
+	return events
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Priority is the scheduling class of an upstream call
+type Priority int
+
+const (
+	// PriorityInteractive is used for requests a user is waiting on
+	PriorityInteractive Priority = iota
+	// PriorityBatch is used for comparisons, evaluations and background jobs
+	PriorityBatch
+)
+
+func (p Priority) String() string {
+	if p == PriorityBatch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+// parsePriority maps a request's priority field, defaulting to interactive
+func parsePriority(s string) (Priority, bool) {
+	switch s {
+	case "", "interactive":
+		return PriorityInteractive, true
+	case "batch":
+		return PriorityBatch, true
+	}
+	return PriorityInteractive, false
+}
+
+var errUpstreamQueueTimeout = errors.New("timed out waiting for an upstream slot")
+
+// PoolStats is a snapshot of the upstream worker pool
+type PoolStats struct {
+	Limit             int  `json:"limit"`
+	MinLimit          int  `json:"min_limit"`
+	MaxLimit          int  `json:"max_limit"`
+	Adaptive          bool `json:"adaptive"`
+	BatchLimit        int  `json:"batch_limit"`
+	InFlight          int  `json:"in_flight"`
+	BatchInFlight     int  `json:"batch_in_flight"`
+	QueuedInteractive int  `json:"queued_interactive"`
+	QueuedBatch       int  `json:"queued_batch"`
+	Decreases         int  `json:"decreases"`
+}
+
+// upstreamPool bounds concurrent upstream chat calls. Waiting interactive
+// calls are always granted a slot before waiting batch calls, and batch calls
+// never hold more than batchLimit slots so interactive traffic keeps headroom.
+type upstreamPool struct {
+	mu            sync.Mutex
+	limit         int
+	batchLimit    int
+	inFlight      int
+	batchInFlight int
+	waiters       [2][]chan struct{}
+	timeout       time.Duration
+
+	// AIMD state, see observe
+	adaptive      bool
+	minLimit      int
+	maxLimit      int
+	batchShare    float64
+	window        float64
+	latencyTarget time.Duration
+	backoff       float64
+	lastDecrease  time.Time
+	decreases     int
+}
+
+var pool *upstreamPool
+
+func configurePriority() {
+	limit := envInt("UPSTREAM_CONCURRENCY", 16)
+	if limit < 1 {
+		limit = 1
+	}
+	batchLimit := envInt("UPSTREAM_BATCH_CONCURRENCY", (limit+1)/2)
+	if batchLimit < 1 || batchLimit > limit {
+		batchLimit = limit
+	}
+	pool = &upstreamPool{
+		limit:         limit,
+		batchLimit:    batchLimit,
+		timeout:       envDuration("UPSTREAM_QUEUE_TIMEOUT", 30*time.Second),
+		adaptive:      envBool("UPSTREAM_ADAPTIVE_CONCURRENCY", false),
+		minLimit:      envInt("UPSTREAM_MIN_CONCURRENCY", 1),
+		maxLimit:      limit,
+		batchShare:    float64(batchLimit) / float64(limit),
+		window:        float64(limit),
+		latencyTarget: envDuration("UPSTREAM_LATENCY_TARGET", 10*time.Second),
+		backoff:       envFloat("UPSTREAM_BACKOFF_FACTOR", 0.5),
+	}
+	if pool.minLimit < 1 || pool.minLimit > limit {
+		pool.minLimit = 1
+	}
+	if pool.backoff <= 0 || pool.backoff >= 1 {
+		pool.backoff = 0.5
+	}
+
+	registerGaugeFunc("chatbot_upstream_concurrency_limit", "Current upstream concurrency limit", func() float64 { return float64(pool.stats().Limit) })
+	registerGaugeFunc("chatbot_upstream_in_flight", "Upstream chat calls in flight", func() float64 { return float64(pool.stats().InFlight) })
+	registerMetric("chatbot_upstream_queued", "Upstream chat calls waiting for a slot", "gauge", func() []metricSample {
+		stats := pool.stats()
+		return []metricSample{
+			{labels: []string{"priority", "interactive"}, value: float64(stats.QueuedInteractive)},
+			{labels: []string{"priority", "batch"}, value: float64(stats.QueuedBatch)},
+		}
+	})
+	registerMetric("chatbot_upstream_limit_decreases_total", "Times the adaptive controller reduced the limit", "counter", func() []metricSample {
+		return []metricSample{{value: float64(pool.stats().Decreases)}}
+	})
+	upstreamResponses = newCounterVec("chatbot_upstream_responses_total", "Upstream chat responses by status code", "status")
+}
+
+var upstreamResponses *counterVec
+
+// observe feeds an upstream outcome to the AIMD controller: 429s, 503s and
+// responses slower than the latency target cut the limit multiplicatively
+// (at most once per target interval), healthy responses grow it by roughly
+// one slot per window of calls
+func (p *upstreamPool) observe(status int, latency time.Duration) {
+	if status > 0 {
+		upstreamResponses.inc(strconv.Itoa(status))
+	}
+	if !p.adaptive {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable || latency > p.latencyTarget:
+		if now.Sub(p.lastDecrease) < p.latencyTarget {
+			return
+		}
+		p.window = math.Max(float64(p.minLimit), p.window*p.backoff)
+		p.lastDecrease = now
+		p.decreases++
+	case status >= 200 && status < 300:
+		p.window = math.Min(float64(p.maxLimit), p.window+1/p.window)
+	default:
+		return
+	}
+
+	limit := int(p.window)
+	if limit == p.limit {
+		return
+	}
+	if limit < p.limit {
+		log.Printf("Upstream concurrency limit reduced to %d", limit)
+	}
+	p.limit = limit
+	p.batchLimit = int(math.Max(1, math.Floor(float64(limit)*p.batchShare)))
+	p.grant()
+}
+
+// acquire waits for a slot and returns the function that releases it
+func (p *upstreamPool) acquire(ctx context.Context, prio Priority) (func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	p.mu.Lock()
+	if p.available(prio) && len(p.waiters[PriorityInteractive]) == 0 && (prio == PriorityInteractive || len(p.waiters[PriorityBatch]) == 0) {
+		p.take(prio)
+		p.mu.Unlock()
+		return p.releaser(prio), nil
+	}
+	ready := make(chan struct{})
+	p.waiters[prio] = append(p.waiters[prio], ready)
+	p.mu.Unlock()
+
+	select {
+	case <-ready:
+		return p.releaser(prio), nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		granted := !p.removeWaiter(prio, ready)
+		p.mu.Unlock()
+		if granted {
+			// The slot arrived while giving up; hand it on
+			p.release(prio)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errUpstreamQueueTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (p *upstreamPool) removeWaiter(prio Priority, ready chan struct{}) bool {
+	for i, w := range p.waiters[prio] {
+		if w == ready {
+			p.waiters[prio] = append(p.waiters[prio][:i], p.waiters[prio][i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *upstreamPool) available(prio Priority) bool {
+	if p.inFlight >= p.limit {
+		return false
+	}
+	return prio == PriorityInteractive || p.batchInFlight < p.batchLimit
+}
+
+func (p *upstreamPool) take(prio Priority) {
+	p.inFlight++
+	if prio == PriorityBatch {
+		p.batchInFlight++
+	}
+}
+
+func (p *upstreamPool) releaser(prio Priority) func() {
+	var once sync.Once
+	return func() { once.Do(func() { p.release(prio) }) }
+}
+
+func (p *upstreamPool) release(prio Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.inFlight--
+	if prio == PriorityBatch {
+		p.batchInFlight--
+	}
+	p.grant()
+}
+
+// grant hands free slots to waiters, interactive first
+func (p *upstreamPool) grant() {
+	for _, prio := range []Priority{PriorityInteractive, PriorityBatch} {
+		for len(p.waiters[prio]) > 0 && p.available(prio) {
+			ready := p.waiters[prio][0]
+			p.waiters[prio] = p.waiters[prio][1:]
+			p.take(prio)
+			close(ready)
+		}
+	}
+}
+
+func (p *upstreamPool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return PoolStats{
+		Limit:             p.limit,
+		MinLimit:          p.minLimit,
+		MaxLimit:          p.maxLimit,
+		Adaptive:          p.adaptive,
+		Decreases:         p.decreases,
+		BatchLimit:        p.batchLimit,
+		InFlight:          p.inFlight,
+		BatchInFlight:     p.batchInFlight,
+		QueuedInteractive: len(p.waiters[PriorityInteractive]),
+		QueuedBatch:       len(p.waiters[PriorityBatch]),
+	}
+}
+
+// acquireChatSlot reserves an upstream slot for a handler, writing a 503 and
+// returning nil when none frees up in time or the outbound rate cap sheds it
+func acquireChatSlot(c *gin.Context, prio Priority) func() {
+	release, err := acquireUpstream(c.Request.Context(), prio)
+	if err != nil {
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is busy, please retry"})
+		return nil
+	}
+	return release
+}
+
+func handlePoolStats(c *gin.Context) {
+	c.JSON(http.StatusOK, pool.stats())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Persona is a named system prompt a chat request can select
+type Persona struct {
+	Name         string `json:"name"`
+	Description  string `json:"description,omitempty"`
+	SystemPrompt string `json:"system_prompt"`
+}
+
+// PromptConfig is the system prompt sent ahead of every conversation and the
+// personas that replace it on request
+type PromptConfig struct {
+	System   string    `json:"system"`
+	Personas []Persona `json:"personas"`
+}
+
+var (
+	promptsMu sync.RWMutex
+	prompts   PromptConfig
+)
+
+func configurePrompts() {
+	promptsMu.Lock()
+	defer promptsMu.Unlock()
+	prompts = PromptConfig{System: envString("SYSTEM_PROMPT", ""), Personas: []Persona{}}
+}
+
+func (cfg PromptConfig) validate() error {
+	seen := map[string]bool{}
+	for _, p := range cfg.Personas {
+		if p.Name == "" || p.SystemPrompt == "" {
+			return fmt.Errorf("personas need a name and a system prompt")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate persona %s", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	return nil
+}
+
+func currentPrompts() PromptConfig {
+	promptsMu.RLock()
+	defer promptsMu.RUnlock()
+	return PromptConfig{System: prompts.System, Personas: append([]Persona{}, prompts.Personas...)}
+}
+
+func setPrompts(cfg PromptConfig) {
+	promptsMu.Lock()
+	defer promptsMu.Unlock()
+	prompts = cfg
+}
+
+// defaultSystemPrompt is used when a request names no persona
+func defaultSystemPrompt() string {
+	promptsMu.RLock()
+	defer promptsMu.RUnlock()
+	return prompts.System
+}
+
+// systemPromptFor returns the system prompt of the named persona, or the
+// default one for an empty name; ok is false for an unknown persona
+func systemPromptFor(persona string) (string, bool) {
+	promptsMu.RLock()
+	defer promptsMu.RUnlock()
+	if persona == "" {
+		return prompts.System, true
+	}
+	for _, p := range prompts.Personas {
+		if p.Name == persona {
+			return p.SystemPrompt, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QualityScore is the judge model's assessment of a production answer
+type QualityScore struct {
+	Helpfulness  float64   `json:"helpfulness"`
+	Groundedness float64   `json:"groundedness"`
+	Rationale    string    `json:"rationale,omitempty"`
+	Judge        string    `json:"judge"`
+	JudgedAt     time.Time `json:"judged_at"`
+}
+
+// QualityPoint aggregates judged answers in one time bucket
+type QualityPoint struct {
+	Start            time.Time `json:"start"`
+	Judged           int       `json:"judged"`
+	MeanHelpfulness  float64   `json:"mean_helpfulness"`
+	MeanGroundedness float64   `json:"mean_groundedness"`
+}
+
+type judgeJob struct {
+	record    AuditRecord
+	grounding string
+}
+
+var (
+	judgeSampleRate float64
+	judgeQueue      chan judgeJob
+)
+
+func configureQuality() {
+	judgeSampleRate = envFloat("JUDGE_SAMPLE_RATE", 0)
+	judgeQueue = make(chan judgeJob, envInt("JUDGE_QUEUE_SIZE", 100))
+}
+
+func startQualityEvaluator() {
+	if judgeEndpoint == "" || judgeSampleRate <= 0 {
+		return
+	}
+	go func() {
+		for job := range judgeQueue {
+			score, err := judgeAnswer(job.record.Prompt, job.record.Response, job.grounding)
+			if err != nil {
+				log.Printf("Quality scoring failed for %s: %v", job.record.ID, err)
+				continue
+			}
+			auditStore.Update(job.record.ID, func(r *AuditRecord) { r.Quality = score })
+		}
+	}()
+}
+
+// sampleForJudging queues a sampled fraction of successful answers for
+// scoring; when the queue is full the sample is dropped rather than blocking
+func sampleForJudging(record AuditRecord, grounding string) {
+	if judgeEndpoint == "" || judgeSampleRate <= 0 || record.Response == "" || rand.Float64() >= judgeSampleRate {
+		return
+	}
+	select {
+	case judgeQueue <- judgeJob{record: record, grounding: grounding}:
+	default:
+	}
+}
+
+func judgeAnswer(prompt, answer, grounding string) (*QualityScore, error) {
+	instructions := "You grade chatbot answers. Reply with only a JSON object " +
+		`{"helpfulness": <1-5>, "groundedness": <1-5>, "rationale": "<one sentence>"}. ` +
+		"Helpfulness rates how well the answer addresses the question. Groundedness rates how well the answer " +
+		"is supported by the provided context, or, without context, how free it is of unsupported claims."
+
+	content := fmt.Sprintf("Question:\n%s\n\nAnswer:\n%s", prompt, answer)
+	if grounding != "" {
+		content = fmt.Sprintf("Context:\n%s\n\n%s", grounding, content)
+	}
+
+	reply, _, err := completeChat(PriorityBatch, judgeEndpoint, []ChatMessage{
+		{Role: "system", Content: instructions},
+		{Role: "user", Content: content},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := strings.Index(reply, "{"), strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("judge reply is not JSON: %q", reply)
+	}
+	var verdict struct {
+		Helpfulness  float64 `json:"helpfulness"`
+		Groundedness float64 `json:"groundedness"`
+		Rationale    string  `json:"rationale"`
+	}
+	if err := json.Unmarshal([]byte(reply[start:end+1]), &verdict); err != nil {
+		return nil, fmt.Errorf("parse judge reply: %v", err)
+	}
+
+	// Scale the 1-5 ratings to 0-1
+	return &QualityScore{
+		Helpfulness:  clamp01((verdict.Helpfulness - 1) / 4),
+		Groundedness: clamp01((verdict.Groundedness - 1) / 4),
+		Rationale:    verdict.Rationale,
+		Judge:        judgeEndpoint,
+		JudgedAt:     time.Now(),
+	}, nil
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+func handleQualityTrends(c *gin.Context) {
+	var q UsageQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if q.Bucket == "" {
+		q.Bucket = "day"
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if q.From.IsZero() {
+		q.From = q.To.AddDate(0, 0, -30)
+	}
+
+	points := map[time.Time]*QualityPoint{}
+	for _, r := range auditStore.List(q.From, q.To) {
+		if r.Quality == nil {
+			continue
+		}
+		start := bucketStart(r.Timestamp, q.Bucket)
+		p := points[start]
+		if p == nil {
+			p = &QualityPoint{Start: start}
+			points[start] = p
+		}
+		p.Judged++
+		p.MeanHelpfulness += r.Quality.Helpfulness
+		p.MeanGroundedness += r.Quality.Groundedness
+	}
+
+	series := []QualityPoint{}
+	for _, p := range points {
+		p.MeanHelpfulness /= float64(p.Judged)
+		p.MeanGroundedness /= float64(p.Judged)
+		series = append(series, *p)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Start.Before(series[j].Start) })
+
+	c.JSON(http.StatusOK, gin.H{"bucket": q.Bucket, "from": q.From, "to": q.To, "sample_rate": judgeSampleRate, "points": series})
+}
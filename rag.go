@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Chunk is a retrievable piece of an ingested document
+type Chunk struct {
+	ID       string `json:"id"`
+	Document string `json:"document"`
+	Index    int    `json:"index"`
+	Text     string `json:"text"`
+
+	Embedding []float32 `json:"-"`
+}
+
+// Document represents an ingested volume file
+type Document struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	IngestedAt   time.Time `json:"ingested_at"`
+	Chunks       []Chunk   `json:"-"`
+
+	content string
+}
+
+// IngestStatus reports the progress of the latest sync of a corpus
+type IngestStatus struct {
+	State         string    `json:"state"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	FilesSeen     int       `json:"files_seen"`
+	FilesIngested int       `json:"files_ingested"`
+	FilesSkipped  int       `json:"files_skipped"`
+	FilesRemoved  int       `json:"files_removed"`
+	FilesFailed   int       `json:"files_failed"`
+	Errors        []string  `json:"errors,omitempty"`
+	Documents     int       `json:"documents"`
+	Chunks        int       `json:"chunks"`
+}
+
+// corpus is a named set of documents synced from one volume path
+type corpus struct {
+	name       string
+	volumePath string
+
+	mu        sync.RWMutex
+	chunking  ChunkConfig
+	documents map[string]*Document
+	status    IngestStatus
+	version   int
+
+	searchMu    sync.Mutex
+	searchIndex *bm25Index
+}
+
+// retrievalIndex holds every corpus available for retrieval
+type retrievalIndex struct {
+	mu      sync.RWMutex
+	corpora map[string]*corpus
+}
+
+const defaultCorpus = "default"
+
+var (
+	ragIndex        = &retrievalIndex{corpora: map[string]*corpus{}}
+	ragMaxFileBytes int64
+)
+
+// File types we can index as plain text
+var ingestibleExtensions = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".csv": true, ".json": true,
+	".yaml": true, ".yml": true, ".html": true, ".py": true, ".go": true, ".sql": true,
+	".scala": true, ".java": true, ".js": true, ".ts": true, ".sh": true, ".r": true,
+}
+
+// CorpusConfig describes one corpus in RAG_CORPORA
+type CorpusConfig struct {
+	Name       string       `json:"name"`
+	VolumePath string       `json:"volume_path"`
+	Chunking   *ChunkConfig `json:"chunking"`
+}
+
+func configureRAG() {
+	ragMaxFileBytes = envSize("RAG_MAX_FILE_BYTES", 5<<20)
+	defaults := defaultChunkConfig()
+	if err := defaults.validate(); err != nil {
+		configWarn("invalid default chunking configuration: %v", err)
+		defaults = ChunkConfig{Size: 1000, Overlap: 200, Splitter: "fixed"}
+	}
+
+	if volumePath := envString("RAG_VOLUME_PATH", ""); volumePath != "" {
+		ragIndex.add(defaultCorpus, volumePath, defaults)
+	}
+
+	if raw := lookupEnv("RAG_CORPORA", ""); raw != "" {
+		var configs []CorpusConfig
+		if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+			configWarn("invalid RAG_CORPORA: %v", err)
+			return
+		}
+		for _, cfg := range configs {
+			chunking := defaults
+			if cfg.Chunking != nil {
+				chunking = *cfg.Chunking
+			}
+			if cfg.Name == "" || cfg.VolumePath == "" {
+				configWarn("skipping RAG corpus without name or volume_path")
+				continue
+			}
+			if err := chunking.validate(); err != nil {
+				configWarn("invalid chunking for corpus %s: %v", cfg.Name, err)
+				chunking = defaults
+			}
+			ragIndex.add(cfg.Name, cfg.VolumePath, chunking)
+		}
+	}
+}
+
+func (idx *retrievalIndex) add(name, volumePath string, chunking ChunkConfig) *corpus {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	c := &corpus{
+		name:       name,
+		volumePath: path.Clean(volumePath),
+		chunking:   chunking,
+		documents:  map[string]*Document{},
+		status:     IngestStatus{State: "idle"},
+	}
+	idx.corpora[name] = c
+	return c
+}
+
+func (idx *retrievalIndex) get(name string) *corpus {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.corpora[name]
+}
+
+func (idx *retrievalIndex) list() []*corpus {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	var out []*corpus
+	for _, c := range idx.corpora {
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// startSync begins an incremental sync in the background, returning false if
+// one is already running
+func (c *corpus) startSync() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status.State == "running" {
+		return false
+	}
+	c.status = IngestStatus{State: "running", StartedAt: time.Now(), Documents: len(c.documents), Chunks: c.status.Chunks}
+	go c.sync()
+	return true
+}
+
+// sync re-ingests new and modified files and drops files that disappeared
+func (c *corpus) sync() {
+	files, err := walkVolume(c.volumePath)
+	if err != nil {
+		log.Printf("Failed to list volume %s: %v", c.volumePath, err)
+		c.finishSync(fmt.Sprintf("list %s: %v", c.volumePath, err))
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, f := range files {
+		seen[f.Path] = true
+		c.mu.Lock()
+		c.status.FilesSeen++
+		existing := c.documents[f.Path]
+		c.mu.Unlock()
+
+		if !ingestibleExtensions[strings.ToLower(path.Ext(f.Path))] || f.Size > ragMaxFileBytes {
+			c.recordSkip()
+			continue
+		}
+		if existing != nil && existing.Size == f.Size && existing.LastModified.Equal(f.LastModified) {
+			c.recordSkip()
+			continue
+		}
+
+		data, err := downloadVolumeFile(f.Path, ragMaxFileBytes)
+		if err != nil || !utf8.Valid(data) {
+			if err == nil {
+				err = fmt.Errorf("not valid UTF-8 text")
+			}
+			c.mu.Lock()
+			c.status.FilesFailed++
+			c.status.Errors = append(c.status.Errors, fmt.Sprintf("%s: %v", f.Path, err))
+			c.mu.Unlock()
+			continue
+		}
+
+		doc := &Document{Path: f.Path, Size: f.Size, LastModified: f.LastModified, IngestedAt: time.Now(), content: string(data)}
+		doc.Chunks = chunkText(doc.Path, doc.content, c.chunkConfig())
+		embedErr := embedChunks(doc.Chunks)
+
+		c.mu.Lock()
+		if embedErr != nil {
+			c.status.Errors = append(c.status.Errors, fmt.Sprintf("%s: embedding failed: %v", f.Path, embedErr))
+		}
+		c.documents[f.Path] = doc
+		c.version++
+		c.status.FilesIngested++
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	for p := range c.documents {
+		if !seen[p] {
+			delete(c.documents, p)
+			c.version++
+			c.status.FilesRemoved++
+		}
+	}
+	c.mu.Unlock()
+
+	c.finishSync("")
+}
+
+func (c *corpus) recordSkip() {
+	c.mu.Lock()
+	c.status.FilesSkipped++
+	c.mu.Unlock()
+}
+
+func (c *corpus) finishSync(failure string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.status.State = "completed"
+	if failure != "" {
+		c.status.State = "failed"
+		c.status.Errors = append(c.status.Errors, failure)
+	}
+	c.status.FinishedAt = time.Now()
+	c.status.Documents = len(c.documents)
+	c.status.Chunks = 0
+	for _, d := range c.documents {
+		c.status.Chunks += len(d.Chunks)
+	}
+}
+
+func (c *corpus) chunkConfig() ChunkConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.chunking
+}
+
+// reindex re-chunks and re-embeds every stored document with the current
+// configuration
+func (c *corpus) reindex() (int, int) {
+	cfg := c.chunkConfig()
+	c.mu.RLock()
+	docs := make([]*Document, 0, len(c.documents))
+	for _, d := range c.documents {
+		docs = append(docs, d)
+	}
+	c.mu.RUnlock()
+
+	rechunked := make(map[*Document][]Chunk, len(docs))
+	for _, d := range docs {
+		chunks := chunkText(d.Path, d.content, cfg)
+		if err := embedChunks(chunks); err != nil {
+			log.Printf("Failed to embed %s during reindex: %v", d.Path, err)
+		}
+		rechunked[d] = chunks
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := 0
+	for d, chunks := range rechunked {
+		d.Chunks = chunks
+		total += len(chunks)
+	}
+	c.version++
+	c.status.Chunks = total
+	return len(docs), total
+}
+
+func (c *corpus) statusSnapshot() IngestStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := c.status
+	status.Errors = append([]string(nil), c.status.Errors...)
+	return status
+}
+
+func (c *corpus) documentList() []Document {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	docs := []Document{}
+	for _, d := range c.documents {
+		docs = append(docs, *d)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Path < docs[j].Path })
+	return docs
+}
+
+// corpusFromRequest resolves the corpus query parameter, writing an error if
+// it isn't configured
+func corpusFromRequest(c *gin.Context) *corpus {
+	name := c.DefaultQuery("corpus", defaultCorpus)
+	corp := ragIndex.get(name)
+	if corp == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Corpus %q is not configured", name)})
+	}
+	return corp
+}
+
+func handleListVolumeFiles(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+
+	dir := c.DefaultQuery("path", corp.volumePath)
+	if !withinVolume(corp.volumePath, dir) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "path must be inside the corpus volume path"})
+		return
+	}
+
+	entries, err := listVolumeDirectory(dir)
+	if err != nil {
+		log.Printf("Failed to list volume directory %s: %v", dir, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to list volume directory"})
+		return
+	}
+
+	corp.mu.RLock()
+	files := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		_, indexed := corp.documents[e.Path]
+		files = append(files, gin.H{
+			"path":          e.Path,
+			"name":          e.Name,
+			"is_directory":  e.IsDirectory,
+			"file_size":     e.Size,
+			"last_modified": e.LastModified,
+			"indexed":       indexed,
+		})
+	}
+	corp.mu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{"corpus": corp.name, "path": dir, "files": files})
+}
+
+func handleRAGSync(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+	if !corp.startSync() {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already running", "status": corp.statusSnapshot()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"corpus": corp.name, "status": corp.statusSnapshot()})
+}
+
+func handleRAGStatus(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"corpus":      corp.name,
+		"volume_path": corp.volumePath,
+		"status":      corp.statusSnapshot(),
+		"documents":   corp.documentList(),
+	})
+}
+
+func handleListCorpora(c *gin.Context) {
+	corpora := []gin.H{}
+	for _, corp := range ragIndex.list() {
+		corp.mu.RLock()
+		corpora = append(corpora, gin.H{
+			"name":        corp.name,
+			"volume_path": corp.volumePath,
+			"chunking":    corp.chunking,
+			"documents":   len(corp.documents),
+			"state":       corp.status.State,
+		})
+		corp.mu.RUnlock()
+	}
+	c.JSON(http.StatusOK, gin.H{"corpora": corpora})
+}
+
+func handleUpdateChunking(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+
+	var cfg ChunkConfig
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	corp.mu.Lock()
+	corp.chunking = cfg
+	corp.mu.Unlock()
+	version := recordConfigChange(c, "chunking for corpus "+corp.name)
+
+	c.JSON(http.StatusOK, gin.H{"corpus": corp.name, "chunking": cfg, "config_version": version})
+}
+
+func handleRAGReindex(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+	if corp.statusSnapshot().State == "running" {
+		c.JSON(http.StatusConflict, gin.H{"error": "A sync is already running"})
+		return
+	}
+
+	documents, chunks := corp.reindex()
+	c.JSON(http.StatusOK, gin.H{"corpus": corp.name, "chunking": corp.chunkConfig(), "documents": documents, "chunks": chunks})
+}
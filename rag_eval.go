@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EvalCase is a question and the source documents that should answer it
+type EvalCase struct {
+	Question        string   `json:"question"`
+	ExpectedSources []string `json:"expected_sources"`
+}
+
+// EvalCaseResult reports how one question ranked its expected sources
+type EvalCaseResult struct {
+	Question      string   `json:"question"`
+	Retrieved     []string `json:"retrieved"`
+	FirstRelevant int      `json:"first_relevant_rank"`
+	Recall        float64  `json:"recall"`
+}
+
+// EvalReport aggregates retrieval quality across the eval set
+type EvalReport struct {
+	Corpus          string           `json:"corpus"`
+	K               int              `json:"k"`
+	Cases           int              `json:"cases"`
+	RecallAtK       float64          `json:"recall_at_k"`
+	MRR             float64          `json:"mrr"`
+	RetrievalConfig RetrievalConfig  `json:"retrieval_config"`
+	Chunking        ChunkConfig      `json:"chunking"`
+	Results         []EvalCaseResult `json:"results"`
+}
+
+// EvalRequest optionally overrides the stored eval set and k
+type EvalRequest struct {
+	K     int        `json:"k"`
+	Cases []EvalCase `json:"cases"`
+}
+
+// loadEvalSet reads the stored question/expected-source pairs from RAG_EVAL_SET
+func loadEvalSet() ([]EvalCase, error) {
+	path := envString("RAG_EVAL_SET", "rag_eval.json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cases []EvalCase
+	err = json.Unmarshal(data, &cases)
+	return cases, err
+}
+
+func handleRAGEval(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+
+	var req EvalRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.K <= 0 {
+		req.K = 5
+	}
+
+	cases := req.Cases
+	if len(cases) == 0 {
+		stored, err := loadEvalSet()
+		if err != nil {
+			log.Printf("Failed to load RAG eval set: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load eval set"})
+			return
+		}
+		cases = stored
+	}
+	if len(cases) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No eval cases provided or stored"})
+		return
+	}
+
+	report, err := evaluateRetrieval(corp, cases, req.K)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// evaluateRetrieval computes recall@k and mean reciprocal rank, counting a
+// retrieved chunk as relevant when its document path matches or ends with an
+// expected source
+func evaluateRetrieval(corp *corpus, cases []EvalCase, k int) (EvalReport, error) {
+	report := EvalReport{
+		Corpus:          corp.name,
+		K:               k,
+		Cases:           len(cases),
+		RetrievalConfig: retrievalConfig,
+		Chunking:        corp.chunkConfig(),
+	}
+
+	var recallSum, rrSum float64
+	for _, ec := range cases {
+		results, err := retrieve(corp, ec.Question, k)
+		if err != nil {
+			return report, err
+		}
+
+		res := EvalCaseResult{Question: ec.Question}
+		found := map[string]bool{}
+		for rank, r := range results {
+			res.Retrieved = append(res.Retrieved, r.ID)
+			for _, expected := range ec.ExpectedSources {
+				if r.Document == expected || strings.HasSuffix(r.Document, "/"+strings.TrimPrefix(expected, "/")) {
+					found[expected] = true
+					if res.FirstRelevant == 0 {
+						res.FirstRelevant = rank + 1
+					}
+				}
+			}
+		}
+
+		if len(ec.ExpectedSources) > 0 {
+			res.Recall = float64(len(found)) / float64(len(ec.ExpectedSources))
+		}
+		if res.FirstRelevant > 0 {
+			rrSum += 1 / float64(res.FirstRelevant)
+		}
+		recallSum += res.Recall
+		report.Results = append(report.Results, res)
+	}
+
+	report.RecallAtK = recallSum / float64(len(cases))
+	report.MRR = rrSum / float64(len(cases))
+	return report, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+// While the serving endpoint or token is missing the server runs degraded:
+// the UI, health checks and admin routes work, routes that call the model
+// answer 503, and the credentials are looked for again periodically.
+var (
+	degraded         atomic.Bool
+	degradedMu       sync.Mutex
+	degradedProblems []string
+	credentialsRetry time.Duration
+)
+
+// missingCredentials lists the required variables that are not set
+func missingCredentials() []string {
+	var missing []string
+	if llmEndpoint() == "" {
+		missing = append(missing, "SERVING_ENDPOINT_NAME is not set")
+	}
+	if databricksToken() == "" {
+		missing = append(missing, "DATABRICKS_TOKEN is not set")
+	}
+	return missing
+}
+
+// configureReadiness enters degraded mode when credentials are missing
+func configureReadiness() {
+	credentialsRetry = envDuration("CREDENTIALS_RETRY_INTERVAL", 10*time.Second)
+	if missing := missingCredentials(); len(missing) > 0 {
+		for _, problem := range missing {
+			configWarn("%s; starting in degraded mode", problem)
+		}
+		setDegraded(missing)
+	}
+}
+
+func setDegraded(problems []string) {
+	degradedMu.Lock()
+	degradedProblems = problems
+	degradedMu.Unlock()
+	degraded.Store(len(problems) > 0)
+}
+
+func readinessProblems() []string {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+	return append([]string{}, degradedProblems...)
+}
+
+// watchCredentials re-reads the environment and .env file until the missing
+// credentials appear, then leaves degraded mode
+func watchCredentials() {
+	if !degraded.Load() {
+		return
+	}
+	go func() {
+		for degraded.Load() {
+			time.Sleep(credentialsRetry)
+			// Load keeps variables that are already set
+			godotenv.Load()
+			if llmEndpoint() == "" {
+				setLLMEndpoint(lookupEnv("SERVING_ENDPOINT_NAME", ""))
+			}
+			if databricksToken() == "" {
+				setDatabricksToken(lookupEnv("DATABRICKS_TOKEN", ""))
+			}
+			if databricksHost() == "" {
+				setDatabricksHost(lookupEnv("DATABRICKS_HOST", ""))
+			}
+			missing := missingCredentials()
+			setDegraded(missing)
+			if len(missing) == 0 {
+				log.Printf("Credentials found, leaving degraded mode")
+			}
+		}
+	}()
+}
+
+// requireCredentials answers 503 while degraded, before handlers that call
+// the model read the credentials
+func requireCredentials(c *gin.Context) {
+	if !degraded.Load() {
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(credentialsRetry.Seconds())))
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"error":    "The server is not configured yet",
+		"problems": readinessProblems(),
+	})
+}
+
+// handleHealthz reports that the process is up
+func handleHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz reports whether chat can be served, and what is missing if not
+func handleReadyz(c *gin.Context) {
+	if degraded.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "degraded", "problems": readinessProblems()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
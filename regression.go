@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegressionCase is a curated prompt with its approved baseline answer
+type RegressionCase struct {
+	ID            string  `json:"id"`
+	Prompt        string  `json:"prompt"`
+	Baseline      string  `json:"baseline"`
+	MinSimilarity float64 `json:"min_similarity,omitempty"`
+}
+
+// RegressionResult compares one fresh answer to its baseline
+type RegressionResult struct {
+	ID         string   `json:"id"`
+	Prompt     string   `json:"prompt"`
+	Output     string   `json:"output"`
+	Baseline   string   `json:"baseline"`
+	Similarity float64  `json:"similarity"`
+	JudgeScore *float64 `json:"judge_score,omitempty"`
+	Passed     bool     `json:"passed"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// RegressionReport summarizes a suite run
+type RegressionReport struct {
+	Suite       string             `json:"suite"`
+	Model       string             `json:"model"`
+	Cases       int                `json:"cases"`
+	Passed      int                `json:"passed"`
+	Regressions int                `json:"regressions"`
+	Results     []RegressionResult `json:"results"`
+}
+
+var (
+	regressionSuitePath string
+	regressionThreshold float64
+	judgeEndpoint       string
+)
+
+func configureRegression() {
+	regressionSuitePath = envString("REGRESSION_SUITE", "regression_suite.json")
+	regressionThreshold = envFloat("REGRESSION_MIN_SIMILARITY", 0.6)
+	judgeEndpoint = envString("JUDGE_ENDPOINT_NAME", "")
+}
+
+func loadRegressionSuite(path string) ([]RegressionCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []RegressionCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	return cases, nil
+}
+
+func saveRegressionSuite(path string, cases []RegressionCase) error {
+	data, err := json.MarshalIndent(cases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// runRegressionSuite replays every prompt against the configured endpoint
+// with a small amount of parallelism
+func runRegressionSuite(cases []RegressionCase, endpoint string) RegressionReport {
+	report := RegressionReport{Suite: regressionSuitePath, Model: endpoint, Cases: len(cases)}
+	report.Results = make([]RegressionResult, len(cases))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 4)
+	for i, rc := range cases {
+		wg.Add(1)
+		go func(i int, rc RegressionCase) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			report.Results[i] = runRegressionCase(rc, endpoint)
+		}(i, rc)
+	}
+	wg.Wait()
+
+	for _, r := range report.Results {
+		if r.Passed {
+			report.Passed++
+		} else {
+			report.Regressions++
+		}
+	}
+	return report
+}
+
+func runRegressionCase(rc RegressionCase, endpoint string) RegressionResult {
+	result := RegressionResult{ID: rc.ID, Prompt: rc.Prompt, Baseline: rc.Baseline}
+
+	output, _, err := completeChat(PriorityBatch, endpoint, buildChatMessages(rc.Prompt))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Output = output
+	result.Similarity = textSimilarity(output, rc.Baseline)
+
+	threshold := rc.MinSimilarity
+	if threshold == 0 {
+		threshold = regressionThreshold
+	}
+	result.Passed = result.Similarity >= threshold
+
+	if judgeEndpoint != "" {
+		score, err := judgeEquivalence(rc.Prompt, rc.Baseline, output)
+		if err != nil {
+			log.Printf("Judge scoring failed for %s: %v", rc.ID, err)
+		} else {
+			result.JudgeScore = &score
+			// A confident judge verdict overrides lexical similarity
+			result.Passed = score >= 0.7
+		}
+	}
+	return result
+}
+
+// textSimilarity is the cosine similarity of the term frequency vectors
+func textSimilarity(a, b string) float64 {
+	ta, tb := map[string]float64{}, map[string]float64{}
+	for _, t := range tokenize(a) {
+		ta[t]++
+	}
+	for _, t := range tokenize(b) {
+		tb[t]++
+	}
+
+	var dot, na, nb float64
+	for t, v := range ta {
+		dot += v * tb[t]
+		na += v * v
+	}
+	for _, v := range tb {
+		nb += v * v
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+var judgeScorePattern = regexp.MustCompile(`\b(10|[0-9])\b`)
+
+// judgeEquivalence asks the judge model whether the candidate answer is at
+// least as good as the baseline, returning a score between 0 and 1
+func judgeEquivalence(prompt, baseline, candidate string) (float64, error) {
+	instructions := "You compare two answers to the same question. Reply with a single integer from 0 to 10, " +
+		"where 10 means the candidate is at least as correct and helpful as the baseline and 0 means it is much worse."
+	content := fmt.Sprintf("Question:\n%s\n\nBaseline answer:\n%s\n\nCandidate answer:\n%s", prompt, baseline, candidate)
+
+	reply, _, err := completeChat(PriorityBatch, judgeEndpoint, []ChatMessage{
+		{Role: "system", Content: instructions},
+		{Role: "user", Content: content},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return parseJudgeScore(reply)
+}
+
+func parseJudgeScore(reply string) (float64, error) {
+	match := judgeScorePattern.FindString(reply)
+	if match == "" {
+		return 0, fmt.Errorf("judge reply has no score: %q", reply)
+	}
+	n, _ := strconv.Atoi(match)
+	return float64(n) / 10, nil
+}
+
+func handleRunRegression(c *gin.Context) {
+	cases, err := loadRegressionSuite(regressionSuitePath)
+	if err != nil {
+		log.Printf("Failed to load regression suite: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load regression suite"})
+		return
+	}
+	if len(cases) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Regression suite is empty"})
+		return
+	}
+
+	endpoint := c.DefaultQuery("endpoint", llmEndpoint())
+	c.JSON(http.StatusOK, runRegressionSuite(cases, endpoint))
+}
+
+// runRegressionCommand implements `main regress`, exiting non-zero when any
+// case regressed so it can gate a rollout
+func runRegressionCommand(args []string) int {
+	fs := flag.NewFlagSet("regress", flag.ExitOnError)
+	suite := fs.String("suite", regressionSuitePath, "path to the regression suite")
+	endpoint := fs.String("endpoint", llmEndpoint(), "serving endpoint to test")
+	update := fs.Bool("update-baselines", false, "record the current outputs as the new baselines")
+	fs.Parse(args)
+
+	regressionSuitePath = *suite
+	cases, err := loadRegressionSuite(*suite)
+	if err != nil {
+		log.Printf("Failed to load regression suite: %v", err)
+		return 2
+	}
+
+	report := runRegressionSuite(cases, *endpoint)
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+
+	if *update {
+		for i, r := range report.Results {
+			if r.Error == "" {
+				cases[i].Baseline = r.Output
+			}
+		}
+		if err := saveRegressionSuite(*suite, cases); err != nil {
+			log.Printf("Failed to save baselines: %v", err)
+			return 2
+		}
+		log.Printf("Updated baselines in %s", *suite)
+		return 0
+	}
+
+	if report.Regressions > 0 {
+		log.Printf("%d of %d cases regressed", report.Regressions, report.Cases)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reminderToolSource is the source of the built-in reminder tool
+const reminderToolSource = "builtin:reminders"
+
+// Channels a reminder can be delivered through
+const (
+	reminderUI    = "ui"    // a notification, and a message in the conversation it was set from
+	reminderEmail = "email" // mail to the user's address, through SMTP_HOST
+	reminderSlack = "slack" // a post to REMINDER_SLACK_WEBHOOK_URL
+)
+
+// Reminder is a message the bot delivers to a user at a later time
+type Reminder struct {
+	ID             string     `json:"id"`
+	User           string     `json:"user"`
+	ConversationID string     `json:"conversation_id,omitempty"`
+	Message        string     `json:"message"`
+	Channel        string     `json:"channel"`
+	DueAt          time.Time  `json:"due_at"`
+	Status         string     `json:"status"` // pending, delivered, failed, cancelled
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// reminderRequest is the body of POST /api/reminders and the arguments of
+// the create_reminder tool; DueAt or DelayMinutes says when
+type reminderRequest struct {
+	Message        string `json:"message"`
+	DueAt          string `json:"due_at"`
+	DelayMinutes   int    `json:"delay_minutes"`
+	Channel        string `json:"channel"`
+	ConversationID string `json:"conversation_id"`
+}
+
+var (
+	remindersEnabled   bool
+	reminderInterval   time.Duration
+	reminderMaxAhead   time.Duration
+	reminderMaxPerUser int
+	reminderRetention  time.Duration
+	reminderSlackURL   string
+
+	remindersMu sync.Mutex
+	reminders   = map[string]*Reminder{}
+
+	remindersDelivered *counterVec
+)
+
+// configureReminders reads the reminder settings. With REMINDERS_ENABLED the
+// model can set reminders for the user, and users can manage them through
+// /api/reminders.
+func configureReminders() {
+	remindersEnabled = envBool("REMINDERS_ENABLED", false)
+	reminderInterval = envDuration("REMINDER_INTERVAL", 30*time.Second)
+	reminderMaxAhead = envDuration("REMINDER_MAX_AHEAD", 365*24*time.Hour)
+	reminderMaxPerUser = envInt("REMINDER_MAX_PER_USER", 50)
+	reminderRetention = envDuration("REMINDER_RETENTION", 7*24*time.Hour)
+	reminderSlackURL = envString("REMINDER_SLACK_WEBHOOK_URL", "")
+	remindersDelivered = newCounterVec("chatbot_reminders_total", "Reminders set and delivered, by channel and outcome", "channel", "outcome")
+
+	unregisterTools(reminderToolSource)
+	if remindersEnabled {
+		registerReminderTool()
+	}
+}
+
+// reminderChannels lists the channels that are configured
+func reminderChannels() []string {
+	channels := []string{reminderUI}
+	if smtpHost != "" && smtpFrom != nil {
+		channels = append(channels, reminderEmail)
+	}
+	if reminderSlackURL != "" {
+		channels = append(channels, reminderSlack)
+	}
+	return channels
+}
+
+func registerReminderTool() {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"message":       map[string]interface{}{"type": "string", "description": "What to remind the user of, written to them"},
+			"due_at":        map[string]interface{}{"type": "string", "description": "When to remind them, in RFC 3339 with the time zone offset"},
+			"delay_minutes": map[string]interface{}{"type": "integer", "description": "Minutes from now, instead of due_at, e.g. 1440 for tomorrow"},
+			"channel":       map[string]interface{}{"type": "string", "enum": reminderChannels(), "description": "How to deliver it; ui, a message in this chat, when the user did not say"},
+		},
+		"required": []string{"message"},
+	})
+	registerTool(Tool{
+		Name: "create_reminder",
+		Description: "Set a reminder for the user, such as when they say \"remind me tomorrow to ...\". " +
+			"Give either due_at or delay_minutes, and tell the user when it will be delivered.",
+		Parameters: raw,
+		Source:     reminderToolSource,
+		call: func(json.RawMessage) (string, error) {
+			return "", errors.New("reminders can only be set from a chat")
+		},
+		callIn: func(session *toolSession, arguments json.RawMessage) (string, error) {
+			var req reminderRequest
+			if err := json.Unmarshal(arguments, &req); err != nil {
+				return "", fmt.Errorf("invalid arguments: %v", err)
+			}
+			req.ConversationID = session.conversationID
+			r, err := createReminder(session.user, req)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Reminder %s set for %s through %s.", r.ID, r.DueAt.Format(time.RFC1123Z), r.Channel), nil
+		},
+	})
+}
+
+// createReminder checks and stores a reminder for user
+func createReminder(user string, req reminderRequest) (Reminder, error) {
+	now := time.Now()
+	r := Reminder{
+		ID:             newID(),
+		User:           user,
+		ConversationID: req.ConversationID,
+		Message:        strings.TrimSpace(req.Message),
+		Channel:        req.Channel,
+		Status:         "pending",
+		CreatedAt:      now,
+	}
+	if r.Channel == "" {
+		r.Channel = reminderUI
+	}
+	switch {
+	case req.DueAt != "":
+		due, err := time.Parse(time.RFC3339, req.DueAt)
+		if err != nil {
+			return r, errors.New("due_at must be an RFC 3339 time such as 2026-03-02T09:00:00+01:00")
+		}
+		r.DueAt = due
+	case req.DelayMinutes > 0:
+		r.DueAt = now.Add(time.Duration(req.DelayMinutes) * time.Minute)
+	default:
+		return r, errors.New("due_at or delay_minutes is required")
+	}
+	switch {
+	case r.Message == "":
+		return r, errors.New("message is required")
+	case !containsFold(reminderChannels(), r.Channel):
+		return r, fmt.Errorf("channel must be one of %s", strings.Join(reminderChannels(), ", "))
+	case r.Channel == reminderEmail && userAddress(user) == "":
+		return r, errors.New("email reminders need the user to be signed in with an email address")
+	case !r.DueAt.After(now):
+		return r, errors.New("the reminder time is in the past")
+	case reminderMaxAhead > 0 && r.DueAt.Sub(now) > reminderMaxAhead:
+		return r, fmt.Errorf("reminders can be set at most %s ahead", reminderMaxAhead)
+	}
+
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	pending := 0
+	for _, other := range reminders {
+		if other.User == user && other.Status == "pending" {
+			pending++
+		}
+	}
+	if reminderMaxPerUser > 0 && pending >= reminderMaxPerUser {
+		return r, fmt.Errorf("at most %d reminders can be pending", reminderMaxPerUser)
+	}
+	stored := r
+	reminders[r.ID] = &stored
+	remindersDelivered.inc(r.Channel, "set")
+	return r, nil
+}
+
+// startReminderScheduler delivers due reminders every REMINDER_INTERVAL
+func startReminderScheduler() {
+	if !remindersEnabled {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(reminderInterval)
+			deliverDueReminders(time.Now())
+		}
+	}()
+}
+
+// deliverDueReminders delivers the reminders due by now, and forgets
+// finished ones older than REMINDER_RETENTION
+func deliverDueReminders(now time.Time) {
+	var due []Reminder
+	remindersMu.Lock()
+	for id, r := range reminders {
+		switch {
+		case r.Status == "pending" && !r.DueAt.After(now):
+			// Claimed so a slow delivery is not picked up again
+			r.Status = "delivering"
+			due = append(due, *r)
+		case r.Status != "pending" && r.Status != "delivering" && now.Sub(r.DueAt) > reminderRetention:
+			delete(reminders, id)
+		}
+	}
+	remindersMu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].DueAt.Before(due[j].DueAt) })
+	for _, r := range due {
+		err := deliverReminder(r)
+		delivered := time.Now()
+		remindersMu.Lock()
+		if stored, ok := reminders[r.ID]; ok {
+			stored.Status, stored.DeliveredAt = "delivered", &delivered
+			if err != nil {
+				stored.Status, stored.DeliveredAt, stored.Error = "failed", nil, err.Error()
+			}
+		}
+		remindersMu.Unlock()
+		if err != nil {
+			log.Printf("Failed to deliver reminder %s through %s: %v", r.ID, r.Channel, err)
+			remindersDelivered.inc(r.Channel, "failed")
+			continue
+		}
+		remindersDelivered.inc(r.Channel, "delivered")
+	}
+}
+
+func deliverReminder(r Reminder) error {
+	switch r.Channel {
+	case reminderUI:
+		if r.ConversationID != "" {
+			msg := Message{ID: newID(), Role: "assistant", Content: "Reminder: " + r.Message, CreatedAt: time.Now(), Status: messageCompleted}
+			if !conversationStore.Update(r.ConversationID, func(conv *Conversation) {
+				conv.Messages = append(conv.Messages, msg)
+			}) {
+				return errors.New("the conversation no longer exists")
+			}
+		}
+		notifyUser(r.User, Notification{
+			Type:    "reminder",
+			Title:   "Reminder",
+			Message: r.Message,
+			Data:    gin.H{"reminder_id": r.ID, "conversation_id": r.ConversationID},
+		})
+		return nil
+	case reminderEmail:
+		to := []string{userAddress(r.User)}
+		subject := r.Message
+		if i := strings.IndexByte(subject, '\n'); i >= 0 {
+			subject = subject[:i]
+		}
+		msg, err := composeMail("", to, nil, "Reminder: "+subject, r.Message, "")
+		if err != nil {
+			return err
+		}
+		return deliverMail(to, msg)
+	case reminderSlack:
+		payload, _ := json.Marshal(map[string]string{"text": fmt.Sprintf(":alarm_clock: Reminder for %s: %s", r.User, r.Message)})
+		return deliverJSON(reminderSlackURL, payload)
+	}
+	return fmt.Errorf("unknown channel %s", r.Channel)
+}
+
+// pendingReminders returns the reminders still to be delivered, for the
+// state archive
+func pendingReminders() []Reminder {
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	out := []Reminder{}
+	for _, r := range reminders {
+		if r.Status == "pending" {
+			out = append(out, *r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DueAt.Before(out[j].DueAt) })
+	return out
+}
+
+// restoreReminders stores the pending reminders of an archive, returning how
+// many it restored; overdue ones are delivered on the next run
+func restoreReminders(list []Reminder) int {
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	restored := 0
+	for _, r := range list {
+		if r.Status != "pending" {
+			continue
+		}
+		stored := r
+		reminders[r.ID] = &stored
+		restored++
+	}
+	return restored
+}
+
+func handleCreateReminder(c *gin.Context) {
+	var req reminderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ConversationID != "" {
+		if conv, ok := conversationStore.Get(req.ConversationID); !ok || conv.User != requestUser(c) {
+			conversationNotFound(c, req.ConversationID)
+			return
+		}
+	}
+	r, err := createReminder(requestUser(c), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, r)
+}
+
+// handleListReminders lists the caller's reminders, soonest first, the
+// pending ones unless status says otherwise
+func handleListReminders(c *gin.Context) {
+	user, status := requestUser(c), c.DefaultQuery("status", "pending")
+	remindersMu.Lock()
+	out := []Reminder{}
+	for _, r := range reminders {
+		if r.User == user && (status == "all" || r.Status == status) {
+			out = append(out, *r)
+		}
+	}
+	remindersMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].DueAt.Before(out[j].DueAt) })
+	c.JSON(http.StatusOK, gin.H{"reminders": out, "channels": reminderChannels()})
+}
+
+func handleCancelReminder(c *gin.Context) {
+	remindersMu.Lock()
+	defer remindersMu.Unlock()
+	r, ok := reminders[c.Param("id")]
+	if !ok || r.User != requestUser(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reminder not found"})
+		return
+	}
+	if r.Status != "pending" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Reminder was already " + r.Status})
+		return
+	}
+	r.Status = "cancelled"
+	remindersDelivered.inc(r.Channel, "cancelled")
+	c.JSON(http.StatusOK, *r)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestCapture is the upstream request of a chat turn as it was sent,
+// kept under the turn's audit record ID so the turn can be replayed
+type RequestCapture struct {
+	ID       string    `json:"id"`
+	At       time.Time `json:"at"`
+	User     string    `json:"user"`
+	Endpoint string    `json:"endpoint"`
+	Persona  string    `json:"persona,omitempty"`
+	Language string    `json:"language,omitempty"`
+	Prompt   string    `json:"prompt"`
+	// Payload holds the history, system prompt and retrieved context the
+	// turn was answered with
+	Payload ChatPayload `json:"payload"`
+}
+
+// RequestCaptureStore keeps captured requests for replays
+type RequestCaptureStore interface {
+	Add(capture RequestCapture)
+	Get(id string) (RequestCapture, bool)
+	// Prune removes captures taken before the cutoff, returning how many
+	Prune(before time.Time) int
+}
+
+// memoryRequestCaptureStore keeps the last max captures
+type memoryRequestCaptureStore struct {
+	mu       sync.RWMutex
+	captures []RequestCapture
+	max      int
+}
+
+func (s *memoryRequestCaptureStore) Add(capture RequestCapture) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.captures = append(s.captures, capture)
+	if s.max > 0 && len(s.captures) > s.max {
+		s.captures = append([]RequestCapture(nil), s.captures[len(s.captures)-s.max:]...)
+	}
+}
+
+func (s *memoryRequestCaptureStore) Get(id string) (RequestCapture, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.captures) - 1; i >= 0; i-- {
+		if s.captures[i].ID == id {
+			return s.captures[i], true
+		}
+	}
+	return RequestCapture{}, false
+}
+
+func (s *memoryRequestCaptureStore) Prune(before time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.captures[:0]
+	for _, capture := range s.captures {
+		if !capture.At.Before(before) {
+			kept = append(kept, capture)
+		}
+	}
+	pruned := len(s.captures) - len(kept)
+	s.captures = kept
+	return pruned
+}
+
+var (
+	replayCaptures       RequestCaptureStore
+	replayCapture        bool
+	replayCaptureMaxSize int64
+	replayRetention      time.Duration
+)
+
+// configureReplay keeps the upstream request of every chat turn for
+// REPLAY_CAPTURE_RETENTION, in the database when there is one
+func configureReplay() {
+	replayCapture = envBool("REPLAY_CAPTURE", true)
+	replayCaptureMaxSize = envSize("REPLAY_CAPTURE_MAX_BYTES", 256<<10)
+	replayRetention = envDuration("REPLAY_CAPTURE_RETENTION", 7*24*time.Hour)
+	if storage != nil {
+		replayCaptures = storage.requestCaptures
+	} else {
+		replayCaptures = &memoryRequestCaptureStore{max: envInt("REPLAY_CAPTURE_MAX", 1000)}
+	}
+}
+
+// startReplayPruning removes expired captures every hour
+func startReplayPruning() {
+	if !replayCapture || replayRetention <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Hour) {
+			if n := replayCaptures.Prune(time.Now().Add(-replayRetention)); n > 0 {
+				log.Printf("Pruned %d captured requests older than %s", n, replayRetention)
+			}
+		}
+	}()
+}
+
+// captureRequest keeps the payload of the turn audited as record, unless it
+// is larger than REPLAY_CAPTURE_MAX_BYTES. It is stored in the background so
+// the turn does not wait on the database.
+func captureRequest(record AuditRecord, req ChatRequest, endpoint string, payload *ChatPayload) {
+	if !replayCapture {
+		return
+	}
+	capture := RequestCapture{ID: record.ID, At: record.Timestamp, User: record.User, Endpoint: endpoint,
+		Persona: req.Persona, Language: req.Language, Prompt: req.Message, Payload: *payload}
+	capture.Payload.Stream = false
+	// The turn goes on appending tool rounds to its own copy
+	capture.Payload.Messages = append([]ChatMessage(nil), payload.Messages...)
+	data, err := json.Marshal(capture)
+	if err != nil || int64(len(data)) > replayCaptureMaxSize {
+		return
+	}
+	go replayCaptures.Add(capture)
+}
+
+// ReplayAnswer is one answer to a replayed request
+type ReplayAnswer struct {
+	Model            string        `json:"model"`
+	Content          string        `json:"content"`
+	FinishReason     string        `json:"finish_reason,omitempty"`
+	ToolCalls        []ToolCall    `json:"tool_calls,omitempty"`
+	PromptTokens     int           `json:"prompt_tokens"`
+	CompletionTokens int           `json:"completion_tokens"`
+	Latency          time.Duration `json:"latency"`
+	StatusCode       int           `json:"status_code"`
+	Error            string        `json:"error,omitempty"`
+}
+
+// ReplayResult compares a turn's recorded answer with the answer to the same
+// request now
+type ReplayResult struct {
+	RequestID string `json:"request_id"`
+	// ReplayID is the audit record of the replay
+	ReplayID       string       `json:"replay_id"`
+	Endpoint       string       `json:"endpoint"`
+	CurrentPrompts bool         `json:"current_prompts"`
+	Original       ReplayAnswer `json:"original"`
+	Replay         ReplayAnswer `json:"replay"`
+	// Diff is left out when the answers are too long to compare
+	Diff *MessageDiff `json:"diff,omitempty"`
+	// Payload is what the endpoint was sent
+	Payload *ChatPayload `json:"payload"`
+}
+
+// handleReplayRequest sends the captured request of an audited turn again,
+// to the endpoint that answered it or the one in the body, and diffs the
+// answer against the recorded one. With current_prompts the system prompt,
+// retrieved context and tools are those configured now, for trying out a
+// prompt change on a real conversation. Tool calls in the answer are
+// reported, not run, so a replay changes nothing.
+func handleReplayRequest(c *gin.Context) {
+	var req struct {
+		Endpoint       string `json:"endpoint"`
+		CurrentPrompts bool   `json:"current_prompts"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	id := c.Param("id")
+	record, ok := auditStore.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Audit record not found"})
+		return
+	}
+	capture, ok := replayCaptures.Get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The request was not captured, or its capture has expired"})
+		return
+	}
+
+	endpoint := capture.Endpoint
+	if req.Endpoint != "" {
+		endpoint = req.Endpoint
+	}
+	payload := capture.Payload
+	payload.Messages = append([]ChatMessage(nil), payload.Messages...)
+	if req.CurrentPrompts {
+		payload.Messages = withCurrentPrompts(payload.Messages, capture)
+		payload.Tools = toolDefinitions()
+	}
+
+	result := ReplayResult{RequestID: id, ReplayID: newID(), Endpoint: endpoint, CurrentPrompts: req.CurrentPrompts,
+		Original: ReplayAnswer{Model: record.Model, Content: record.Response, PromptTokens: record.PromptTokens,
+			CompletionTokens: record.CompletionTokens, Latency: record.Latency, StatusCode: record.StatusCode, Error: record.Error}}
+	result.Payload, _ = adaptPayload(endpoint, &payload)
+
+	release, err := acquireUpstream(c.Request.Context(), PriorityBatch)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	var llmResp LLMResponse
+	start := time.Now()
+	err = invokeEndpoint(endpoint, &payload, &llmResp)
+	release()
+	replay := &result.Replay
+	replay.Model, replay.Latency, replay.StatusCode = endpoint, time.Since(start), upstreamStatus(err)
+	pool.observe(replay.StatusCode, replay.Latency)
+	if err != nil {
+		replay.Error = err.Error()
+	} else {
+		rateLimiter.chargeTokens(llmResp.Usage.TotalTokens)
+		replay.PromptTokens, replay.CompletionTokens = llmResp.Usage.PromptTokens, llmResp.Usage.CompletionTokens
+		if len(llmResp.Choices) > 0 {
+			choice := llmResp.Choices[0]
+			replay.Content, replay.FinishReason, replay.ToolCalls = choice.Message.Content, choice.FinishReason, choice.Message.ToolCalls
+		}
+	}
+	// Replays cost like any other call and are audited as the admin's
+	recordAudit(AuditRecord{ID: result.ReplayID, Timestamp: start, User: requestUser(c), Model: endpoint, Prompt: record.Prompt,
+		Response: replay.Content, PromptTokens: replay.PromptTokens, CompletionTokens: replay.CompletionTokens,
+		Cost: estimateCost(replay.PromptTokens, replay.CompletionTokens), Latency: replay.Latency, StatusCode: replay.StatusCode, Error: replay.Error})
+	log.Printf("%s replayed request %s against %s", requestUser(c), id, endpoint)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, result)
+		return
+	}
+
+	if diff, ok := compareAnswers(DiffSide{ID: id, Source: "audit", Model: record.Model, Content: record.Response},
+		DiffSide{ID: result.ReplayID, Source: "replay", Model: endpoint, Content: replay.Content}); ok {
+		result.Diff = &diff
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// withCurrentPrompts swaps the captured system prompt and retrieved context
+// for the ones the turn would get now, keeping the history and the prompt
+func withCurrentPrompts(messages []ChatMessage, capture RequestCapture) []ChatMessage {
+	rest := messages
+	for len(rest) > 0 && rest[0].Role == "system" {
+		rest = rest[1:]
+	}
+	var out []ChatMessage
+	if system := chatSystemPrompt(capture.Persona, capture.Language); system != "" {
+		out = append(out, ChatMessage{Role: "system", Content: system})
+	}
+	if grounding := retrievalContext(capture.Prompt); grounding != "" {
+		out = append(out, ChatMessage{Role: "system", Content: grounding})
+	}
+	return append(out, rest...)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportMessage is one message as shown in a report
+type reportMessage struct {
+	Who       string
+	Role      string
+	Time      time.Time
+	Body      template.HTML
+	Tables    string
+	Policy    string
+	Truncated bool
+	Stopped   bool
+}
+
+var (
+	inlineCodePattern = regexp.MustCompile("`([^`]+)`")
+	boldPattern       = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	italicPattern     = regexp.MustCompile(`\*([^*\s][^*]*)\*`)
+	linkPattern       = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	orderedItem       = regexp.MustCompile(`^\d+[.)]\s+`)
+	headingPattern    = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+)
+
+// The styles are inline on the elements as well as in the head, since many
+// mail clients drop style sheets
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, -apple-system, Segoe UI, sans-serif; max-width: 760px; margin: 2rem auto; color: #1f2937; line-height: 1.5; }
+.meta { color: #6b7280; font-size: .9rem; }
+.message { border: 1px solid #e5e7eb; border-radius: 8px; padding: .75rem 1rem; margin: 1rem 0; }
+.user { background: #eff6ff; } .assistant { background: #ffffff; }
+pre { background: #f3f4f6; padding: .75rem; border-radius: 6px; overflow-x: auto; white-space: pre-wrap; }
+code { font-family: ui-monospace, Menlo, Consolas, monospace; font-size: .9em; }
+table { border-collapse: collapse; margin: .5rem 0; } th, td { border: 1px solid #d1d5db; padding: .25rem .5rem; text-align: left; }
+blockquote { border-left: 3px solid #d1d5db; margin: .5rem 0; padding-left: .75rem; color: #4b5563; }
+.note { color: #b45309; font-size: .85rem; }
+</style>
+</head>
+<body style="font-family: system-ui, sans-serif; max-width: 760px; margin: 2rem auto; color: #1f2937; line-height: 1.5;">
+<h1 style="font-size: 1.5rem;">{{.Title}}</h1>
+<p class="meta" style="color: #6b7280; font-size: .9rem;">{{.User}} · started {{.Conversation.CreatedAt.Format "Jan 2, 2006 15:04 MST"}} · last updated {{.Conversation.UpdatedAt.Format "Jan 2, 2006 15:04 MST"}} · {{len .Messages}} messages{{with .Settings}}<br>{{.}}{{end}}{{with .Escalation}}<br>Handed to a support agent ({{.Reason}}), {{.Status}}{{end}}</p>
+{{range .Messages}}<div class="message {{.Role}}" style="border: 1px solid #e5e7eb; border-radius: 8px; padding: .75rem 1rem; margin: 1rem 0;{{if eq .Role "user"}} background: #eff6ff;{{end}}">
+<p class="meta" style="color: #6b7280; font-size: .9rem; margin: 0 0 .5rem;"><strong>{{.Who}}</strong> · {{.Time.Format "Jan 2 15:04"}}</p>
+{{.Body}}
+{{with .Tables}}<details><summary class="meta">Attached data</summary><pre style="background: #f3f4f6; padding: .75rem; white-space: pre-wrap;">{{.}}</pre></details>{{end}}
+{{with .Policy}}<p class="note" style="color: #b45309; font-size: .85rem;">Answer replaced by the {{.}} policy</p>{{end}}
+{{if .Truncated}}<p class="note" style="color: #b45309; font-size: .85rem;">Answer was cut short</p>{{else if .Stopped}}<p class="note" style="color: #b45309; font-size: .85rem;">Answer was stopped before it finished</p>{{end}}
+</div>
+{{end}}
+<p class="meta" style="color: #6b7280; font-size: .9rem;">Conversation {{.Conversation.ID}} · report generated {{.GeneratedAt.Format "Jan 2, 2006 15:04 MST"}}</p>
+</body>
+</html>
+`))
+
+// handleConversationReport renders the conversation as a self-contained HTML
+// page for emailing or archiving; download=true serves it as a file. Message
+// text is rendered from Markdown with everything but a fixed set of tags
+// escaped, and the page loads nothing and runs no script.
+func handleConversationReport(c *gin.Context) {
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	messages := make([]reportMessage, 0, len(conv.Messages))
+	for _, m := range conv.Messages {
+		if m.Content == "" && m.Status == messageGenerating {
+			continue
+		}
+		rm := reportMessage{Who: "You", Role: m.Role, Time: m.CreatedAt, Body: renderMarkdownHTML(m.Content),
+			Tables: m.Tables, Policy: m.Policy, Truncated: m.Truncated, Stopped: m.Stopped}
+		switch {
+		case m.Agent != "":
+			rm.Who = m.Agent + " (support)"
+		case m.Role == "assistant":
+			rm.Who = "Assistant"
+		case m.Role != "user":
+			rm.Who = m.Role
+		}
+		messages = append(messages, rm)
+	}
+
+	data := gin.H{
+		"Title":        reportTitle(conv),
+		"User":         conv.User,
+		"Conversation": conv,
+		"Messages":     messages,
+		"Settings":     describeSettings(conv.Settings),
+		"Escalation":   escalationOf(conv.ID),
+		"GeneratedAt":  time.Now(),
+	}
+	if c.Query("download") == "true" {
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "conversation-"+conv.ID+".html"))
+	}
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := reportTemplate.Execute(c.Writer, data); err != nil {
+		c.Error(err)
+	}
+}
+
+// reportTitle is the conversation's opening question, shortened
+func reportTitle(conv Conversation) string {
+	for _, m := range conv.Messages {
+		if m.Role == "user" && strings.TrimSpace(m.Content) != "" {
+			title := strings.Join(strings.Fields(m.Content), " ")
+			if len(title) > 80 {
+				title = title[:utf8Boundary(title, 80)] + "…"
+			}
+			return title
+		}
+	}
+	return "Conversation"
+}
+
+func describeSettings(s ChatSettings) string {
+	var parts []string
+	if s.Persona != "" {
+		parts = append(parts, "persona "+s.Persona)
+	}
+	if s.Model != "" {
+		parts = append(parts, "model "+s.Model)
+	}
+	if s.Language != "" {
+		parts = append(parts, "answers in "+s.Language)
+	}
+	if s.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature %g", *s.Temperature))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// renderMarkdownHTML renders the Markdown a chat answer uses: paragraphs,
+// headings, lists, quotes, code blocks, pipe tables, emphasis, inline code
+// and links. All text is escaped first, so the only markup in the result is
+// the tags added here, and links are kept only for http, https and mailto.
+func renderMarkdownHTML(content string) template.HTML {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + strings.Join(para, "<br>") + "</p>\n")
+			para = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>\n")
+		case strings.Contains(trimmed, "|") && i+1 < len(lines) && tableSeparatorPattern.MatchString(strings.TrimSpace(lines[i+1])):
+			flush()
+			b.WriteString("<table>\n<tr>")
+			header := markdownCells(trimmed)
+			for _, cell := range header {
+				b.WriteString("<th>" + renderInline(cell) + "</th>")
+			}
+			b.WriteString("</tr>\n")
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|"); i++ {
+				b.WriteString("<tr>")
+				for _, cell := range markdownCells(strings.TrimSpace(lines[i])) {
+					b.WriteString("<td>" + renderInline(cell) + "</td>")
+				}
+				b.WriteString("</tr>\n")
+			}
+			i--
+			b.WriteString("</table>\n")
+		case headingPattern.MatchString(trimmed):
+			flush()
+			m := headingPattern.FindStringSubmatch(trimmed)
+			// The report's own headings come first
+			level := len(m[1]) + 2
+			if level > 6 {
+				level = 6
+			}
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", level, renderInline(m[2]), level)
+		case isBullet(trimmed) || orderedItem.MatchString(trimmed):
+			flush()
+			tag := "ul"
+			if orderedItem.MatchString(trimmed) {
+				tag = "ol"
+			}
+			b.WriteString("<" + tag + ">\n")
+			for ; i < len(lines); i++ {
+				item := strings.TrimSpace(lines[i])
+				if tag == "ul" && isBullet(item) {
+					item = item[2:]
+				} else if loc := orderedItem.FindStringIndex(item); tag == "ol" && loc != nil {
+					item = item[loc[1]:]
+				} else {
+					break
+				}
+				b.WriteString("<li>" + renderInline(item) + "</li>\n")
+			}
+			i--
+			b.WriteString("</" + tag + ">\n")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, renderInline(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"))))
+			}
+			i--
+			b.WriteString("<blockquote>" + strings.Join(quote, "<br>") + "</blockquote>\n")
+		default:
+			para = append(para, renderInline(trimmed))
+		}
+	}
+	flush()
+	return template.HTML(b.String())
+}
+
+func isBullet(line string) bool {
+	return strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") || strings.HasPrefix(line, "+ ")
+}
+
+// renderInline escapes a line of text and marks up its code spans, emphasis
+// and links. Code spans are left as they are written.
+func renderInline(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range inlineCodePattern.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(renderEmphasis(text[last:loc[0]]))
+		b.WriteString("<code>" + html.EscapeString(text[loc[2]:loc[3]]) + "</code>")
+		last = loc[1]
+	}
+	b.WriteString(renderEmphasis(text[last:]))
+	return b.String()
+}
+
+func renderEmphasis(text string) string {
+	escaped := html.EscapeString(text)
+	escaped = linkPattern.ReplaceAllStringFunc(escaped, func(match string) string {
+		m := linkPattern.FindStringSubmatch(match)
+		target := html.UnescapeString(m[2])
+		lower := strings.ToLower(target)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") && !strings.HasPrefix(lower, "mailto:") {
+			return m[1]
+		}
+		// Asterisks in the address would otherwise be read as emphasis
+		href := strings.ReplaceAll(html.EscapeString(target), "*", "&#42;")
+		return `<a href="` + href + `" rel="noopener noreferrer">` + m[1] + `</a>`
+	})
+	escaped = boldPattern.ReplaceAllString(escaped, "<strong>$1</strong>")
+	return italicPattern.ReplaceAllString(escaped, "<em>$1</em>")
+}
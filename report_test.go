@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderEmphasis(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "a < b & c", want: "a &lt; b &amp; c"},
+		{name: "script", in: "<script>alert(1)</script>", want: "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{name: "bold and italic", in: "**bold** and *italic*", want: "<strong>bold</strong> and <em>italic</em>"},
+		{name: "https link", in: "[docs](https://example.com/a?b=1&c=2)",
+			want: `<a href="https://example.com/a?b=1&amp;c=2" rel="noopener noreferrer">docs</a>`},
+		{name: "mailto link", in: "[mail](mailto:a@example.com)", want: `<a href="mailto:a@example.com" rel="noopener noreferrer">mail</a>`},
+		{name: "javascript link", in: "[click](javascript:alert(1))", want: "click)"},
+		{name: "javascript link in mixed case", in: "[click](JaVaScRiPt:alert`1`)", want: "click"},
+		{name: "data link", in: "[click](data:text/html;base64,PHNjcmlwdD4=)", want: "click"},
+		{name: "relative link", in: "[click](/api/admin)", want: "click"},
+		{name: "double quote in target", in: `[x](https://example.com/"onmouseover="alert(1))`,
+			want: `<a href="https://example.com/&#34;onmouseover=&#34;alert(1" rel="noopener noreferrer">x</a>)`},
+		{name: "single quote in target", in: `[x](https://example.com/'onmouseover='alert(1))`,
+			want: `<a href="https://example.com/&#39;onmouseover=&#39;alert(1" rel="noopener noreferrer">x</a>)`},
+		{name: "asterisks in target", in: "*see* [x](https://example.com/*a*b*) *now*",
+			want: `<em>see</em> <a href="https://example.com/&#42;a&#42;b&#42;" rel="noopener noreferrer">x</a> <em>now</em>`},
+		{name: "bold markers in target", in: "[x](https://example.com/**a**)",
+			want: `<a href="https://example.com/&#42;&#42;a&#42;&#42;" rel="noopener noreferrer">x</a>`},
+		{name: "emphasis in link text", in: "[**x**](https://example.com)", want: `<a href="https://example.com" rel="noopener noreferrer"><strong>x</strong></a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderEmphasis(tt.in); got != tt.want {
+				t.Fatalf("renderEmphasis(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "paragraph", in: "one\ntwo\n\nthree", want: "<p>one<br>two</p>\n<p>three</p>\n"},
+		{name: "script", in: "<script>alert(1)</script>", want: "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{name: "script in code block", in: "```html\n<script>alert(1)</script>\n```", want: "<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></pre>\n"},
+		{name: "script in inline code", in: "run `<img src=x onerror=alert(1)>`", want: "<p>run <code>&lt;img src=x onerror=alert(1)&gt;</code></p>\n"},
+		{name: "javascript link in heading", in: "# [x](javascript:alert(1))", want: "<h3>x)</h3>\n"},
+		{name: "data link in list", in: "- [x](data:text/html;base64,PHNjcmlwdD4=)", want: "<ul>\n<li>x</li>\n</ul>\n"},
+		{name: "link in table", in: "| a | b |\n|---|---|\n| [x](https://example.com/\"q) | <b> |",
+			want: "<table>\n<tr><th>a</th><th>b</th></tr>\n<tr><td><a href=\"https://example.com/&#34;q\" rel=\"noopener noreferrer\">x</a></td><td>&lt;b&gt;</td></tr>\n</table>\n"},
+		{name: "quote", in: "> *quoted* <i>", want: "<blockquote><em>quoted</em> &lt;i&gt;</blockquote>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(renderMarkdownHTML(tt.in))
+			if got != tt.want {
+				t.Fatalf("renderMarkdownHTML(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+			// Only the tags added by the renderer are markup
+			lower := strings.ToLower(got)
+			for _, unsafe := range []string{"<script", "<img", "<b>", "<i>", `href="javascript:`, `href="data:`} {
+				if strings.Contains(lower, unsafe) {
+					t.Fatalf("rendered %q", unsafe)
+				}
+			}
+		})
+	}
+}
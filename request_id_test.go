@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		// header is the caller's X-Request-Id, and internal the ID of a
+		// request the server makes to itself
+		header   string
+		internal string
+	}{
+		{name: "untagged request"},
+		{name: "caller's ID is not reused", header: "reused"},
+		{name: "request the server makes to itself", header: "reused", internal: "job-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/api/chat", nil)
+			if tt.header != "" {
+				c.Request.Header.Set(headerRequestID, tt.header)
+			}
+			if tt.internal != "" {
+				c.Request = c.Request.WithContext(context.WithValue(context.Background(), requestIDKey{}, tt.internal))
+			}
+
+			id := requestID(c)
+			switch {
+			case id == "" || id == tt.header:
+				t.Fatalf("requestID = %q with X-Request-Id %q", id, tt.header)
+			case tt.internal != "" && id != tt.internal:
+				t.Fatalf("requestID = %q, want %q", id, tt.internal)
+			case requestID(c) != id:
+				t.Fatal("requestID changed within the request")
+			case w.Header().Get(headerRequestID) != id:
+				t.Fatalf("response X-Request-Id = %q, want %q", w.Header().Get(headerRequestID), id)
+			}
+			if got := clientRequestID(c); got != tt.header {
+				t.Fatalf("clientRequestID = %q, want %q", got, tt.header)
+			}
+		})
+	}
+}
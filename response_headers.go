@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Chat responses carry per-request performance headers so API consumers and
+// browser devtools can see them without parsing the body
+const (
+	headerRequestID        = "X-Request-Id"
+	headerModel            = "X-Model"
+	headerUpstreamLatency  = "X-Upstream-Latency-Ms"
+	headerPromptTokens     = "X-Tokens-Prompt"
+	headerCompletionTokens = "X-Tokens-Completion"
+	headerRateLimit        = "X-RateLimit-Limit"
+	headerRateRemaining    = "X-RateLimit-Remaining"
+	headerRateReset        = "X-RateLimit-Reset"
+	headerQuotaRemaining   = "X-Quota-Remaining"
+)
+
+// exposedHeaders are readable by browser scripts on cross-origin requests
+var exposedHeaders = []string{headerRequestID, headerModel, headerUpstreamLatency, headerPromptTokens, headerCompletionTokens,
+	headerRateLimit, headerRateRemaining, headerRateReset, headerQuotaRemaining, headerCache, "Retry-After"}
+
+// setUpstreamHeaders reports the endpoint that answered and how long it took
+func setUpstreamHeaders(c *gin.Context, model string, upstream time.Duration) {
+	c.Header(headerModel, model)
+	c.Header(headerUpstreamLatency, strconv.FormatInt(upstream.Milliseconds(), 10))
+}
+
+func setTokenHeaders(c *gin.Context, prompt, completion int) {
+	c.Header(headerPromptTokens, strconv.Itoa(prompt))
+	c.Header(headerCompletionTokens, strconv.Itoa(completion))
+}
+
+// setQuotaHeaders reports the caller's daily allowance as of admitting this
+// request, which is counted as made. Limits the tier does not set are left
+// out; the reset is in seconds.
+func setQuotaHeaders(c *gin.Context, tier QuotaTier, status QuotaStatus, now time.Time) {
+	if tier.RequestsPerDay <= 0 && tier.TokensPerDay <= 0 {
+		return
+	}
+	c.Header(headerRateReset, strconv.Itoa(int(math.Ceil(status.ResetsAt.Sub(now).Seconds()))))
+	if r := status.RequestsRemaining; r != nil {
+		c.Header(headerRateLimit, strconv.Itoa(tier.RequestsPerDay))
+		c.Header(headerRateRemaining, strconv.Itoa(max(*r-1, 0)))
+	}
+	if t := status.TokensRemaining; t != nil {
+		c.Header(headerQuotaRemaining, strconv.Itoa(*t))
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetrievalResult is a chunk ranked for a query
+type RetrievalResult struct {
+	Chunk
+	Score       float64  `json:"score"`
+	BM25Score   float64  `json:"bm25_score"`
+	VectorScore float64  `json:"vector_score"`
+	RerankScore *float64 `json:"rerank_score,omitempty"`
+}
+
+// RetrievalConfig controls how keyword and vector scores are fused
+type RetrievalConfig struct {
+	BM25Weight       float64 `json:"bm25_weight"`
+	VectorWeight     float64 `json:"vector_weight"`
+	EmbeddingModel   string  `json:"embedding_endpoint"`
+	RerankModel      string  `json:"rerank_endpoint"`
+	RerankCandidates int     `json:"rerank_candidates"`
+	TopK             int     `json:"top_k"`
+}
+
+var (
+	retrievalConfig RetrievalConfig
+	ragChatEnabled  bool
+	ragChatCorpus   string
+)
+
+func configureRetrieval() {
+	retrievalConfig = RetrievalConfig{
+		BM25Weight:       envFloat("RAG_BM25_WEIGHT", 0.5),
+		VectorWeight:     envFloat("RAG_VECTOR_WEIGHT", 0.5),
+		EmbeddingModel:   envString("EMBEDDING_ENDPOINT_NAME", ""),
+		RerankModel:      envString("RERANK_ENDPOINT_NAME", ""),
+		RerankCandidates: envInt("RAG_RERANK_CANDIDATES", 20),
+		TopK:             envInt("RAG_TOP_K", 4),
+	}
+	ragChatEnabled = envBool("RAG_CHAT_ENABLED", false)
+	ragChatCorpus = envString("RAG_CHAT_CORPUS", defaultCorpus)
+}
+
+// bm25Index holds the term statistics of a corpus at one version
+type bm25Index struct {
+	version   int
+	chunks    []*Chunk
+	termFreqs []map[string]int
+	lengths   []int
+	docFreq   map[string]int
+	avgLength float64
+}
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+func buildBM25(chunks []*Chunk, version int) *bm25Index {
+	idx := &bm25Index{version: version, chunks: chunks, docFreq: map[string]int{}}
+	total := 0
+	for _, ch := range chunks {
+		tf := map[string]int{}
+		terms := tokenize(ch.Text)
+		for _, t := range terms {
+			tf[t]++
+		}
+		for t := range tf {
+			idx.docFreq[t]++
+		}
+		idx.termFreqs = append(idx.termFreqs, tf)
+		idx.lengths = append(idx.lengths, len(terms))
+		total += len(terms)
+	}
+	if len(chunks) > 0 {
+		idx.avgLength = float64(total) / float64(len(chunks))
+	}
+	return idx
+}
+
+func (idx *bm25Index) score(query []string) []float64 {
+	scores := make([]float64, len(idx.chunks))
+	n := float64(len(idx.chunks))
+	for _, term := range uniqueStrings(query) {
+		df := float64(idx.docFreq[term])
+		if df == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for i, tf := range idx.termFreqs {
+			f := float64(tf[term])
+			if f == 0 {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(idx.lengths[i])/idx.avgLength
+			scores[i] += idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+	return scores
+}
+
+// bm25 returns the keyword index of the corpus, rebuilding it if documents
+// changed since it was last built
+func (c *corpus) bm25() *bm25Index {
+	c.searchMu.Lock()
+	defer c.searchMu.Unlock()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.searchIndex == nil || c.searchIndex.version != c.version {
+		var chunks []*Chunk
+		for _, d := range c.documents {
+			for i := range d.Chunks {
+				chunks = append(chunks, &d.Chunks[i])
+			}
+		}
+		c.searchIndex = buildBM25(chunks, c.version)
+	}
+	return c.searchIndex
+}
+
+// retrieve ranks the chunks of a corpus for the query by fusing min-max
+// normalized BM25 and cosine similarity scores, then optionally reranks
+func retrieve(c *corpus, query string, k int) ([]RetrievalResult, error) {
+	cfg := retrievalConfig
+	idx := c.bm25()
+	if len(idx.chunks) == 0 {
+		return []RetrievalResult{}, nil
+	}
+
+	bm25Scores := normalizeScores(idx.score(tokenize(query)))
+	vectorScores := make([]float64, len(idx.chunks))
+	vectorWeight := cfg.VectorWeight
+	if cfg.EmbeddingModel != "" && vectorWeight > 0 {
+		embeddings, err := embedTexts([]string{query})
+		if err != nil {
+			log.Printf("Query embedding failed, using keyword search only: %v", err)
+			vectorWeight = 0
+		} else {
+			for i, ch := range idx.chunks {
+				vectorScores[i] = cosineSimilarity(embeddings[0], ch.Embedding)
+			}
+		}
+	} else {
+		vectorWeight = 0
+	}
+
+	results := make([]RetrievalResult, len(idx.chunks))
+	for i, ch := range idx.chunks {
+		results[i] = RetrievalResult{
+			Chunk:       *ch,
+			BM25Score:   bm25Scores[i],
+			VectorScore: vectorScores[i],
+			Score:       cfg.BM25Weight*bm25Scores[i] + vectorWeight*vectorScores[i],
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+
+	if cfg.RerankModel != "" {
+		candidates := cfg.RerankCandidates
+		if candidates < k {
+			candidates = k
+		}
+		if candidates < len(results) {
+			results = results[:candidates]
+		}
+		if err := rerank(query, results); err != nil {
+			log.Printf("Rerank failed, using fused scores: %v", err)
+		}
+	}
+
+	if k < len(results) {
+		results = results[:k]
+	}
+	return results, nil
+}
+
+func normalizeScores(scores []float64) []float64 {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range scores {
+		lo = math.Min(lo, s)
+		hi = math.Max(hi, s)
+	}
+	out := make([]float64, len(scores))
+	if hi <= lo {
+		return out
+	}
+	for i, s := range scores {
+		out[i] = (s - lo) / (hi - lo)
+	}
+	return out
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// embedTexts calls the embedding serving endpoint in batches
+func embedTexts(texts []string) ([][]float32, error) {
+	const batchSize = 16
+
+	var out [][]float32
+	for start := 0; start < len(texts); start += batchSize {
+		end := start + batchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+
+		var resp struct {
+			Data []struct {
+				Index     int       `json:"index"`
+				Embedding []float32 `json:"embedding"`
+			} `json:"data"`
+		}
+		if err := invokeEndpoint(retrievalConfig.EmbeddingModel, map[string]interface{}{"input": texts[start:end]}, &resp); err != nil {
+			return nil, err
+		}
+		if len(resp.Data) != end-start {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", end-start, len(resp.Data))
+		}
+		batch := make([][]float32, end-start)
+		for i, d := range resp.Data {
+			if d.Index >= 0 && d.Index < len(batch) {
+				batch[d.Index] = d.Embedding
+			} else {
+				batch[i] = d.Embedding
+			}
+		}
+		out = append(out, batch...)
+	}
+	return out, nil
+}
+
+// embedChunks fills in chunk embeddings when an embedding endpoint is configured
+func embedChunks(chunks []Chunk) error {
+	if retrievalConfig.EmbeddingModel == "" || len(chunks) == 0 {
+		return nil
+	}
+	texts := make([]string, len(chunks))
+	for i, ch := range chunks {
+		texts[i] = ch.Text
+	}
+	embeddings, err := embedTexts(texts)
+	if err != nil {
+		return err
+	}
+	for i := range chunks {
+		chunks[i].Embedding = embeddings[i]
+	}
+	return nil
+}
+
+// rerank reorders results in place using the reranker endpoint scores
+func rerank(query string, results []RetrievalResult) error {
+	documents := make([]string, len(results))
+	for i, r := range results {
+		documents[i] = r.Text
+	}
+
+	var resp struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	if err := invokeEndpoint(retrievalConfig.RerankModel, map[string]interface{}{"query": query, "documents": documents}, &resp); err != nil {
+		return err
+	}
+
+	for _, r := range resp.Results {
+		if r.Index >= 0 && r.Index < len(results) {
+			score := r.RelevanceScore
+			results[r.Index].RerankScore = &score
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i].RerankScore, results[j].RerankScore
+		if a == nil || b == nil {
+			return a != nil
+		}
+		return *a > *b
+	})
+	return nil
+}
+
+// groundingPreamble starts the retrieved context message, which tells it
+// apart from the system prompt
+const groundingPreamble = "Answer using the following context when it is relevant. Cite the source path of any context you use.\n"
+
+// retrievalContext builds the system message grounding the chat answer, or
+// returns an empty string when retrieval is disabled or finds nothing
+func retrievalContext(query string) string {
+	if !ragChatEnabled || !featureEnabled("rag") {
+		return ""
+	}
+	corp := ragIndex.get(ragChatCorpus)
+	if corp == nil {
+		return ""
+	}
+
+	results, err := retrieve(corp, query, retrievalConfig.TopK)
+	if err != nil {
+		log.Printf("Retrieval failed: %v", err)
+		return ""
+	}
+	if len(results) == 0 || results[0].Score <= 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(groundingPreamble)
+	for _, r := range results {
+		fmt.Fprintf(&b, "\n[source: %s]\n%s\n", r.Document, r.Text)
+	}
+	return b.String()
+}
+
+func handleRAGSearch(c *gin.Context) {
+	corp := corpusFromRequest(c)
+	if corp == nil {
+		return
+	}
+
+	query := c.Query("q")
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q is required"})
+		return
+	}
+	k := retrievalConfig.TopK
+	if v := c.Query("k"); v != "" {
+		if _, err := fmt.Sscanf(v, "%d", &k); err != nil || k <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "k must be a positive integer"})
+			return
+		}
+	}
+
+	results, err := retrieve(corp, query, k)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"corpus": corp.name, "query": query, "results": results})
+}
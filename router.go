@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Prompt categories the router tells apart
+var routeCategories = []string{"code", "sql", "summarization", "general"}
+
+var (
+	sqlPattern           = regexp.MustCompile(`(?i)(\bselect\b[\s\S]+\bfrom\b|\binsert\s+into\b|\bupdate\s+\w+\s+set\b|\bdelete\s+from\b|\bcreate\s+(table|view)\b|\bgroup\s+by\b|\bsql\b)`)
+	codePattern          = regexp.MustCompile("(?i)(```|\\b(func|def|class|import|return|const|public static)\\b|=>|\\b(python|golang|javascript|typescript|java|rust|c\\+\\+|regex|stack trace|exception|compile|refactor|unit test)\\b)")
+	summarizationPattern = regexp.MustCompile(`(?i)\b(summari[sz]e|summary|tl;?dr|key points|condense|recap)\b`)
+)
+
+const classifierPrompt = "Classify the user's request into exactly one category: code, sql, summarization or general. Answer with the category only."
+
+// classifierMaxPrompt is how many bytes of the prompt the classifier sees;
+// the start is enough to tell the category
+const classifierMaxPrompt = 2000
+
+var (
+	promptRoutes       map[string]string
+	classifierEndpoint string
+	classifierTimeout  time.Duration
+
+	routingDecisions *counterVec
+)
+
+// configureRouter reads PROMPT_ROUTES, e.g. "code=code-llm,sql=sql-llm",
+// which maps prompt categories to the endpoints that should answer them
+func configureRouter() {
+	promptRoutes = map[string]string{}
+	for _, route := range envList("PROMPT_ROUTES") {
+		category, endpoint, _ := strings.Cut(route, "=")
+		category, endpoint = strings.TrimSpace(category), strings.TrimSpace(endpoint)
+		if !knownCategory(category) || endpoint == "" {
+			configWarn("invalid PROMPT_ROUTES entry %q, want <category>=<endpoint> with a category of %v", route, routeCategories)
+			continue
+		}
+		promptRoutes[category] = endpoint
+	}
+	classifierEndpoint = envString("ROUTER_CLASSIFIER_ENDPOINT", "")
+	classifierTimeout = envDuration("ROUTER_CLASSIFIER_TIMEOUT", 2*time.Second)
+	routingDecisions = newCounterVec("chatbot_routing_decisions_total", "Chat requests routed by prompt category", "category", "endpoint", "classifier")
+}
+
+func knownCategory(category string) bool {
+	for _, c := range routeCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// routePrompt picks the endpoint for the prompt's category. Requests whose
+// endpoint a request script already changed keep it, as do categories
+// without a route.
+func routePrompt(endpoint, prompt string) string {
+	if len(promptRoutes) == 0 || endpoint != llmEndpoint() {
+		return endpoint
+	}
+	category, classifier := classifyPrompt(prompt)
+	routed, ok := promptRoutes[category]
+	if !ok {
+		routed = endpoint
+	}
+	routingDecisions.inc(category, routed, classifier)
+	log.Printf("Routed %s prompt to %s (classified by %s)", category, routed, classifier)
+	return routed
+}
+
+// classifyPrompt asks ROUTER_CLASSIFIER_ENDPOINT for the category when one is
+// set, and falls back to heuristics when there is none or it does not answer
+// in time with a known category
+func classifyPrompt(prompt string) (string, string) {
+	if classifierEndpoint != "" {
+		if category, ok := classifyWithModel(prompt); ok {
+			return category, "model"
+		}
+	}
+	return classifyHeuristically(prompt), "heuristic"
+}
+
+// classifierInput is the start of the prompt the classifier sees, cut
+// between characters so it stays valid UTF-8
+func classifierInput(prompt string) string {
+	if len(prompt) > classifierMaxPrompt {
+		return prompt[:utf8Boundary(prompt, classifierMaxPrompt)]
+	}
+	return prompt
+}
+
+func classifyWithModel(prompt string) (string, bool) {
+	prompt = classifierInput(prompt)
+	answer := make(chan string, 1)
+	go func() {
+		content, _, err := completeChat(PriorityInteractive, classifierEndpoint, []ChatMessage{
+			{Role: "system", Content: classifierPrompt},
+			{Role: "user", Content: prompt},
+		})
+		if err != nil {
+			log.Printf("Prompt classifier failed: %v", err)
+		}
+		answer <- content
+	}()
+	select {
+	case content := <-answer:
+		category := strings.Trim(strings.ToLower(strings.TrimSpace(content)), ".\"'`")
+		return category, knownCategory(category)
+	case <-time.After(classifierTimeout):
+		log.Printf("Prompt classifier timed out after %s", classifierTimeout)
+		return "", false
+	}
+}
+
+// classifyHeuristically checks SQL before code, as SQL prompts also look
+// like code
+func classifyHeuristically(prompt string) string {
+	switch {
+	case sqlPattern.MatchString(prompt):
+		return "sql"
+	case codePattern.MatchString(prompt):
+		return "code"
+	case summarizationPattern.MatchString(prompt):
+		return "summarization"
+	}
+	return "general"
+}
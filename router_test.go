@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestClassifierInput(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt string
+		want   int
+	}{
+		{name: "short", prompt: "summarize this", want: len("summarize this")},
+		{name: "at the limit", prompt: strings.Repeat("a", classifierMaxPrompt), want: classifierMaxPrompt},
+		{name: "ascii past the limit", prompt: strings.Repeat("a", classifierMaxPrompt+10), want: classifierMaxPrompt},
+		// "é" is two bytes and "€" three, so the limit falls inside one
+		{name: "two-byte character across the limit", prompt: strings.Repeat("a", classifierMaxPrompt-1) + "é", want: classifierMaxPrompt - 1},
+		{name: "three-byte characters", prompt: strings.Repeat("€", classifierMaxPrompt), want: classifierMaxPrompt / 3 * 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := classifierInput(tt.prompt)
+			if len(got) != tt.want || !utf8.ValidString(got) || !strings.HasPrefix(tt.prompt, got) {
+				t.Fatalf("classifierInput kept %d bytes (valid UTF-8 %v), want %d", len(got), utf8.ValidString(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+	"github.com/gin-gonic/gin"
+)
+
+// RequestScript is an admin-defined expression evaluated for every chat
+// request. Depending on Action it rejects the request (the expression returns
+// true), picks the serving endpoint (returns a non-empty name) or rewrites the
+// message (returns the new message).
+type RequestScript struct {
+	Name    string `json:"name" binding:"required"`
+	Action  string `json:"action" binding:"required,oneof=reject model transform"`
+	Expr    string `json:"expr" binding:"required"`
+	Message string `json:"message,omitempty"` // shown to the caller on reject
+
+	program *vm.Program
+}
+
+// scriptEnv is what an expression can see about the request
+type scriptEnv struct {
+	Message       string            `expr:"message"`
+	Priority      string            `expr:"priority"`
+	Model         string            `expr:"model"`
+	User          string            `expr:"user"`
+	Path          string            `expr:"path"`
+	Deterministic bool              `expr:"deterministic"`
+	Headers       map[string]string `expr:"headers"` // lower-cased names
+
+	budget *scriptBudget
+}
+
+// scriptBudget is what is left of one evaluation's steps and time
+type scriptBudget struct {
+	steps    int
+	deadline time.Time
+}
+
+// Step is called by the VM before every iteration of a loop, which is all an
+// expression can spend unbounded time on. Past REQUEST_SCRIPT_MAX_STEPS or
+// REQUEST_SCRIPT_TIMEOUT it panics, which the VM turns into an error, so the
+// evaluation ends there instead of running on in the background.
+func (e scriptEnv) Step() bool {
+	b := e.budget
+	if b == nil {
+		return true
+	}
+	b.steps++
+	if scriptMaxSteps > 0 && b.steps > scriptMaxSteps {
+		panic(fmt.Errorf("exceeded %d steps", scriptMaxSteps))
+	}
+	if b.steps%64 == 0 && time.Now().After(b.deadline) {
+		panic(fmt.Errorf("timed out after %v", scriptTimeout))
+	}
+	return true
+}
+
+// scriptStepper makes every loop body call Step first. A body B becomes
+// "Step() ? B : nil", which keeps the type of B.
+type scriptStepper struct{}
+
+func (scriptStepper) Visit(node *ast.Node) {
+	if predicate, ok := (*node).(*ast.PredicateNode); ok {
+		predicate.Node = &ast.ConditionalNode{
+			Cond: &ast.CallNode{Callee: &ast.IdentifierNode{Value: "Step"}},
+			Exp1: predicate.Node,
+			Exp2: &ast.NilNode{},
+		}
+	}
+}
+
+// ScriptStats counts how a script has fared since it was loaded
+type ScriptStats struct {
+	Runs    int    `json:"runs"`
+	Matches int    `json:"matches"`
+	Errors  int    `json:"errors"`
+	LastErr string `json:"last_error,omitempty"`
+}
+
+const (
+	scriptMaxNodes    = 500
+	defaultRejectText = "This request was rejected by a request policy."
+)
+
+var (
+	scriptsMu      sync.RWMutex
+	requestScripts []RequestScript
+	scriptStats    = map[string]*ScriptStats{}
+
+	scriptTimeout      time.Duration
+	scriptMaxSteps     int
+	scriptMemoryBudget uint
+)
+
+func configureScripts() {
+	scriptTimeout = envDuration("REQUEST_SCRIPT_TIMEOUT", 50*time.Millisecond)
+	scriptMaxSteps = envInt("REQUEST_SCRIPT_MAX_STEPS", 100000)
+	scriptMemoryBudget = uint(envInt("REQUEST_SCRIPT_MEMORY_BUDGET", 100000))
+
+	path := envString("REQUEST_SCRIPTS_FILE", "")
+	if path == "" {
+		return
+	}
+	var scripts []RequestScript
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &scripts)
+	}
+	if err == nil {
+		err = setRequestScripts(scripts)
+	}
+	if err != nil {
+		configWarn("failed to load request scripts from %s: %v", path, err)
+	}
+}
+
+func compileScript(s *RequestScript) error {
+	opts := []expr.Option{expr.Env(scriptEnv{}), expr.MaxNodes(scriptMaxNodes), expr.Patch(scriptStepper{})}
+	switch s.Action {
+	case "reject":
+		opts = append(opts, expr.AsBool())
+	case "model", "transform":
+		opts = append(opts, expr.AsKind(reflect.String))
+	default:
+		return fmt.Errorf("script %s: unknown action %q", s.Name, s.Action)
+	}
+	program, err := expr.Compile(s.Expr, opts...)
+	if err != nil {
+		return fmt.Errorf("script %s: %v", s.Name, err)
+	}
+	s.program = program
+	return nil
+}
+
+// setRequestScripts compiles and installs scripts, replacing the current set
+// only if every script compiles
+func setRequestScripts(scripts []RequestScript) error {
+	seen := map[string]bool{}
+	for i := range scripts {
+		if seen[scripts[i].Name] {
+			return fmt.Errorf("duplicate script name %s", scripts[i].Name)
+		}
+		seen[scripts[i].Name] = true
+		if err := compileScript(&scripts[i]); err != nil {
+			return err
+		}
+	}
+
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+	requestScripts = scripts
+	scriptStats = map[string]*ScriptStats{}
+	for _, s := range scripts {
+		scriptStats[s.Name] = &ScriptStats{}
+	}
+	return nil
+}
+
+// evalScript runs a program with the step, time and memory limits. The VM
+// checks them itself, so an evaluation over its limits stops with an error.
+func evalScript(program *vm.Program, env scriptEnv) (out interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, fmt.Errorf("panic: %v", r)
+		}
+	}()
+	env.budget = &scriptBudget{deadline: time.Now().Add(scriptTimeout)}
+	machine := vm.VM{MemoryBudget: scriptMemoryBudget}
+	return machine.Run(program, env)
+}
+
+// applyRequestScripts runs the scripts in order against req, rewriting its
+// message as transforms dictate, and returns the endpoint to use, starting
+// from the model the request settled on. A script that fails is skipped. On
+// reject it writes the 403 and returns false.
+func applyRequestScripts(c *gin.Context, req *ChatRequest) (string, bool) {
+	scriptsMu.RLock()
+	scripts := requestScripts
+	scriptsMu.RUnlock()
+
+	endpoint := llmEndpoint()
+	if req.Model != "" {
+		endpoint = req.Model
+	}
+	if len(scripts) == 0 {
+		return endpoint, true
+	}
+
+	headers := map[string]string{}
+	for name, values := range c.Request.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	env := scriptEnv{
+		Priority:      req.Priority,
+		User:          requestUser(c),
+		Path:          c.Request.URL.Path,
+		Deterministic: req.Deterministic,
+		Headers:       headers,
+	}
+
+	for _, s := range scripts {
+		env.Message, env.Model = req.Message, endpoint
+		out, err := evalScript(s.program, env)
+		matched := false
+		if err == nil {
+			switch s.Action {
+			case "reject":
+				matched = out.(bool)
+			case "model":
+				name := out.(string)
+				if name != "" && name != endpoint {
+					if !compareAllowed(name) {
+						err = fmt.Errorf("endpoint %s is not allowed", name)
+						break
+					}
+					endpoint, matched = name, true
+				}
+			case "transform":
+				if msg := out.(string); msg != req.Message {
+					req.Message, matched = msg, true
+				}
+			}
+		}
+		recordScriptRun(s.Name, matched, err)
+
+		if matched && s.Action == "reject" {
+			message := s.Message
+			if message == "" {
+				message = defaultRejectText
+			}
+			log.Printf("Request script %s rejected request", s.Name)
+			c.JSON(http.StatusForbidden, gin.H{"error": message, "policy": "script:" + s.Name})
+			return "", false
+		}
+	}
+	return endpoint, true
+}
+
+func recordScriptRun(name string, matched bool, err error) {
+	if err != nil {
+		log.Printf("Request script %s failed: %v", name, err)
+	}
+	scriptsMu.Lock()
+	defer scriptsMu.Unlock()
+	stats, ok := scriptStats[name]
+	if !ok {
+		return
+	}
+	stats.Runs++
+	if matched {
+		stats.Matches++
+	}
+	if err != nil {
+		stats.Errors++
+		stats.LastErr = err.Error()
+	}
+}
+
+func handleListScripts(c *gin.Context) {
+	scriptsMu.RLock()
+	defer scriptsMu.RUnlock()
+	type scriptInfo struct {
+		RequestScript
+		Stats ScriptStats `json:"stats"`
+	}
+	out := []scriptInfo{}
+	for _, s := range requestScripts {
+		out = append(out, scriptInfo{RequestScript: s, Stats: *scriptStats[s.Name]})
+	}
+	c.JSON(http.StatusOK, gin.H{"scripts": out})
+}
+
+// handleSetScripts replaces every script. The change is not persisted; put
+// the scripts in REQUEST_SCRIPTS_FILE to keep them across restarts.
+func handleSetScripts(c *gin.Context) {
+	var scripts []RequestScript
+	if err := c.ShouldBindJSON(&scripts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := setRequestScripts(scripts); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	version := recordConfigChange(c, fmt.Sprintf("replace request scripts (%d)", len(scripts)))
+	log.Printf("Request scripts replaced by %s (%d scripts)", requestUser(c), len(scripts))
+	c.JSON(http.StatusOK, gin.H{"scripts": len(scripts), "config_version": version})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalScriptLimits(t *testing.T) {
+	steps, timeout := scriptMaxSteps, scriptTimeout
+	t.Cleanup(func() { scriptMaxSteps, scriptTimeout = steps, timeout })
+
+	tests := []struct {
+		name     string
+		action   string
+		expr     string
+		maxSteps int
+		timeout  time.Duration
+		want     interface{}
+		// err is part of the expected error, "" for none
+		err string
+	}{
+		{name: "no loop", action: "reject", expr: `message contains "x"`, maxSteps: 10, timeout: time.Second, want: true},
+		{name: "loop within the steps", action: "reject", expr: `any(1..5, # == 5)`, maxSteps: 10, timeout: time.Second, want: true},
+		{name: "loop body keeps its type", action: "transform", expr: `join(map(1..3, string(#)), ",")`, maxSteps: 10, timeout: time.Second, want: "1,2,3"},
+		{name: "loop over the steps", action: "reject", expr: `any(1..50, # == 50)`, maxSteps: 10, timeout: time.Second, err: "exceeded 10 steps"},
+		{name: "nested loops count every step", action: "reject", expr: `any(1..5, any(1..5, # == 6))`, maxSteps: 20, timeout: time.Second, err: "exceeded 20 steps"},
+		{name: "loop over the time", action: "reject", expr: `any(1..1000, any(1..1000, # == 0))`, timeout: time.Nanosecond, err: "timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scriptMaxSteps, scriptTimeout = tt.maxSteps, tt.timeout
+			script := RequestScript{Name: tt.name, Action: tt.action, Expr: tt.expr}
+			if err := compileScript(&script); err != nil {
+				t.Fatal(err)
+			}
+			out, err := evalScript(script.program, scriptEnv{Message: "xyz"})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || out != tt.want {
+				t.Fatalf("got %v, %v, want %v", out, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const redactedSecret = "[REDACTED]"
+
+// secretPattern matches a secret; the match is replaced with repl, which
+// may keep submatches around the redaction marker
+type secretPattern struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// Credentials that are recognizable without knowing them
+var builtinSecretPatterns = []secretPattern{
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9\-._~+/]+=*`), "$1 " + redactedSecret},
+	{regexp.MustCompile(`\bdapi[0-9a-f]{32}(-\d+)?\b`), redactedSecret},
+	{regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), redactedSecret},
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`), redactedSecret},
+	{regexp.MustCompile(`(?i)\b(api[_-]?key|access[_-]?token|client[_-]?secret|password|secret|token|sig)(["']?\s*[:=]\s*["']?)[^\s"'&,;]+`), "$1$2" + redactedSecret},
+	// The password of credentials in a URL
+	{regexp.MustCompile(`(://[^/\s:@]+:)[^/\s@]+@`), "$1" + redactedSecret + "@"},
+}
+
+var (
+	secretPatterns []secretPattern
+
+	// secretValues replaces the values of secret settings; it is rebuilt
+	// when settings change, e.g. after a key rotation
+	secretValuesMu       sync.Mutex
+	secretValues         *strings.Replacer
+	secretValuesRevision = -1
+
+	secretsRedacted *counterVec
+)
+
+// configureScrubbing redacts credentials from every log line, the access
+// log and error responses: the built-in patterns, the values of settings
+// that hold secrets, and the regular expressions in SECRET_PATTERNS
+func configureScrubbing() {
+	secretPatterns = append([]secretPattern(nil), builtinSecretPatterns...)
+	for _, expr := range envList("SECRET_PATTERNS") {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			configWarn("invalid SECRET_PATTERNS entry %q: %v", expr, err)
+			continue
+		}
+		secretPatterns = append(secretPatterns, secretPattern{re: re, repl: redactedSecret})
+	}
+	secretsRedacted = newCounterVec("chatbot_secrets_redacted_total", "Log lines and error responses that had secrets redacted", "sink")
+	log.SetOutput(scrubbingWriter{w: os.Stderr, sink: "log"})
+	gin.DefaultWriter = scrubbingWriter{w: os.Stdout, sink: "log"}
+	gin.DefaultErrorWriter = scrubbingWriter{w: os.Stderr, sink: "log"}
+}
+
+// scrubSecrets returns text with every known secret replaced
+func scrubSecrets(text string) string {
+	secretValuesMu.Lock()
+	if rev := configRevision(); rev != secretValuesRevision {
+		var pairs []string
+		for _, v := range secretSettingValues() {
+			pairs = append(pairs, v, redactedSecret)
+		}
+		secretValues, secretValuesRevision = strings.NewReplacer(pairs...), rev
+	}
+	replacer := secretValues
+	secretValuesMu.Unlock()
+
+	text = replacer.Replace(text)
+	for _, p := range secretPatterns {
+		text = p.re.ReplaceAllString(text, p.repl)
+	}
+	return text
+}
+
+// scrubbingWriter redacts secrets from what is written through it
+type scrubbingWriter struct {
+	w    io.Writer
+	sink string
+}
+
+func (s scrubbingWriter) Write(p []byte) (int, error) {
+	text := string(p)
+	scrubbed := scrubSecrets(text)
+	if scrubbed != text {
+		secretsRedacted.inc(s.sink)
+	}
+	if _, err := io.WriteString(s.w, scrubbed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// scrubbedErrorWriter redacts secrets from error responses, which often
+// quote upstream errors; successful responses are the user's own content
+// and pass through untouched
+type scrubbedErrorWriter struct {
+	gin.ResponseWriter
+}
+
+func (w scrubbedErrorWriter) Write(p []byte) (int, error) {
+	if w.Status() < 400 {
+		return w.ResponseWriter.Write(p)
+	}
+	text := string(p)
+	scrubbed := scrubSecrets(text)
+	if scrubbed != text {
+		secretsRedacted.inc("response")
+	}
+	if _, err := w.ResponseWriter.WriteString(scrubbed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w scrubbedErrorWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func scrubErrorResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = scrubbedErrorWriter{c.Writer}
+		c.Next()
+	}
+}
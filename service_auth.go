@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+)
+
+// serviceIdentityKey holds the identity of a caller that presented a valid
+// service token, for requestUser
+const serviceIdentityKey = "service_identity"
+
+var (
+	jwksURL          string
+	jwtAudience      string
+	jwtIssuer        string
+	jwtIdentityClaim string
+	jwtVerifier      *oidc.IDTokenVerifier
+	serviceTokens    *counterVec
+)
+
+// configureServiceAuth enables bearer token validation for internal services
+// that call the API directly rather than through the workspace proxy. Tokens
+// are checked against the keys at JWT_JWKS_URL and must be issued for
+// JWT_AUDIENCE; JWT_ISSUER is only checked when set.
+func configureServiceAuth() {
+	jwksURL = envString("JWT_JWKS_URL", "")
+	jwtAudience = envString("JWT_AUDIENCE", "")
+	jwtIssuer = envString("JWT_ISSUER", "")
+	jwtIdentityClaim = envString("JWT_IDENTITY_CLAIM", "sub")
+	if jwksURL == "" {
+		return
+	}
+	if jwtAudience == "" {
+		configWarn("JWT_JWKS_URL is set without JWT_AUDIENCE; service tokens are disabled")
+		return
+	}
+	keys := oidc.NewRemoteKeySet(context.Background(), jwksURL)
+	jwtVerifier = oidc.NewVerifier(jwtIssuer, keys, &oidc.Config{
+		ClientID:        jwtAudience,
+		SkipIssuerCheck: jwtIssuer == "",
+	})
+	serviceTokens = newCounterVec("chatbot_service_tokens_total", "Service tokens checked, by result", "result")
+	log.Printf("Service tokens: audience %s, identity claim %s", jwtAudience, jwtIdentityClaim)
+}
+
+// serviceAuth verifies a bearer token when one is sent. Requests without one
+// pass through and are identified by the proxy headers as before; a token
+// that fails verification is rejected rather than ignored.
+func serviceAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jwtVerifier == nil {
+			c.Next()
+			return
+		}
+		scheme, raw, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || raw == "" {
+			c.Next()
+			return
+		}
+		fingerprint := credentialKey(raw)
+		if rejectLockedOut(c, authServiceToken, fingerprint) {
+			return
+		}
+		identity, err := verifyServiceToken(c.Request.Context(), raw)
+		if err != nil {
+			serviceTokens.inc("rejected")
+			log.Printf("Rejected service token %s from %s: %v", fingerprint, c.ClientIP(), err)
+			authFailed(c, authServiceToken, fingerprint, err.Error())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid service token"})
+			return
+		}
+		authSucceeded(c, authServiceToken, fingerprint)
+		serviceTokens.inc("accepted")
+		c.Set(serviceIdentityKey, identity)
+		c.Next()
+	}
+}
+
+// verifyServiceToken checks the token's signature, audience and expiry and
+// returns the identity claim
+func verifyServiceToken(ctx context.Context, raw string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	token, err := jwtVerifier.Verify(ctx, raw)
+	if err != nil {
+		return "", err
+	}
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		return "", err
+	}
+	identity, _ := claims[jwtIdentityClaim].(string)
+	if identity == "" {
+		return "", fmt.Errorf("token has no %q claim", jwtIdentityClaim)
+	}
+	return identity, nil
+}
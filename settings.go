@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChatSettings are what a chat turn is answered with besides its prompt. A
+// conversation stores its own, which every turn inherits; a request can
+// override any of them for that turn.
+type ChatSettings struct {
+	Language    string   `json:"language,omitempty"` // answer in this language, e.g. German
+	Model       string   `json:"model,omitempty"`    // serving endpoint
+	Temperature *float64 `json:"temperature,omitempty"`
+	Persona     string   `json:"persona,omitempty"`
+}
+
+const maxLanguageLength = 64
+
+// overrides returns the settings the request sets for this turn
+func (req ChatRequest) overrides() ChatSettings {
+	return ChatSettings{Language: strings.TrimSpace(req.Language), Model: req.Model, Temperature: req.Temperature, Persona: req.Persona}
+}
+
+// inherit fills what s leaves unset from the settings beneath it
+func (s ChatSettings) inherit(from ChatSettings) ChatSettings {
+	if s.Language == "" {
+		s.Language = from.Language
+	}
+	if s.Model == "" {
+		s.Model = from.Model
+	}
+	if s.Temperature == nil {
+		s.Temperature = from.Temperature
+	}
+	if s.Persona == "" {
+		s.Persona = from.Persona
+	}
+	return s
+}
+
+// validateSettings explains why identity may not use the settings, or
+// returns ""
+func validateSettings(identity string, s ChatSettings) string {
+	if _, ok := systemPromptFor(s.Persona); !ok {
+		return "Unknown persona: " + s.Persona
+	}
+	if s.Model != "" && !endpointAllowed(identity, s.Model) {
+		return "Model is not allowed: " + s.Model
+	}
+	if s.Temperature != nil && (*s.Temperature < 0 || *s.Temperature > 2) {
+		return "temperature must be between 0 and 2"
+	}
+	if len(s.Language) > maxLanguageLength || strings.ContainsAny(s.Language, "\r\n") {
+		return fmt.Sprintf("language must be a single line of at most %d characters", maxLanguageLength)
+	}
+	return ""
+}
+
+// resolveChatSettings settles the settings of a chat turn in one place: what
+// the request sets, else what its conversation stores, else the server's
+// defaults. The result is written back to req, so the handlers, scripts and
+// transcripts downstream all read the same values. It writes the 400 and
+// returns false when the caller may not use them, except for a model they may
+// not use when entitlements fall back to the chat endpoint instead.
+func resolveChatSettings(c *gin.Context, req *ChatRequest) bool {
+	var stored ChatSettings
+	if req.ConversationID != "" {
+		// A conversation that is missing is reported when it is loaded
+		if conv, ok := conversationStore.Get(req.ConversationID); ok && conv.User == requestUser(c) {
+			stored = conv.Settings
+		}
+	}
+	s := req.overrides().inherit(stored)
+	if s.Model != "" && modelFallback() && !endpointAllowed(requestUser(c), s.Model) {
+		log.Printf("Answering with the chat endpoint instead of %s, which %s may not use", s.Model, requestUser(c))
+		modelFallbacks.inc(s.Model)
+		s.Model = ""
+	}
+	if msg := validateSettings(requestUser(c), s); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return false
+	}
+	req.Language, req.Model, req.Temperature, req.Persona = s.Language, s.Model, s.Temperature, s.Persona
+	return true
+}
+
+// chatSystemPrompt is the persona's system prompt, told which language to
+// answer in when one is set
+func chatSystemPrompt(persona, language string) string {
+	system, _ := systemPromptFor(persona)
+	if language == "" {
+		return system
+	}
+	instruction := "Always answer in " + language + ", whatever language the user writes in."
+	if system == "" {
+		return instruction
+	}
+	return system + "\n\n" + instruction
+}
+
+// keepFirstTurnSettings stores the settings a new conversation was started
+// with, so its later turns inherit them
+func keepFirstTurnSettings(conv *Conversation, req ChatRequest) {
+	s := req.overrides()
+	if conv.ID == "" || s == (ChatSettings{}) {
+		return
+	}
+	conversationStore.Update(conv.ID, func(stored *Conversation) {
+		stored.Settings = s
+	})
+	conv.Settings = s
+}
+
+func handleGetConversationSettings(c *gin.Context) {
+	conv, ok := conversationStore.Get(c.Param("id"))
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, c.Param("id"))
+		return
+	}
+	c.JSON(http.StatusOK, conv.Settings)
+}
+
+// handleSetConversationSettings replaces the conversation's settings; what
+// the body leaves out falls back to the server's defaults
+func handleSetConversationSettings(c *gin.Context) {
+	var s ChatSettings
+	if err := c.ShouldBindJSON(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.Language = strings.TrimSpace(s.Language)
+	if msg := validateSettings(requestUser(c), s); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	id := c.Param("id")
+	conv, ok := conversationStore.Get(id)
+	if !ok || conv.User != requestUser(c) {
+		conversationNotFound(c, id)
+		return
+	}
+	conversationStore.Update(id, func(conv *Conversation) {
+		conv.Settings = s
+	})
+	c.JSON(http.StatusOK, s)
+}
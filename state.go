@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stateArchiveVersion is bumped whenever the archive layout changes; imports
+// of newer archives are refused
+const stateArchiveVersion = 1
+
+// StateArchive is the runtime state an admin can change without a redeploy,
+// for backup, restore and promotion between environments. Settings that come
+// from the environment are not included.
+type StateArchive struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	RuntimeConfig
+	Bans          []Ban          `json:"bans"`
+	Conversations []Conversation `json:"conversations"`
+	// Reminders are the ones still to be delivered
+	Reminders []Reminder `json:"reminders"`
+}
+
+// RuntimeConfig is the configuration admins can change through the API. On
+// import or rollback a nil section is left untouched and an empty one clears it.
+type RuntimeConfig struct {
+	Scripts      []RequestScript        `json:"scripts"`
+	Chunking     map[string]ChunkConfig `json:"chunking"`
+	Prompts      *PromptConfig          `json:"prompts"`
+	Entitlements *EntitlementsConfig    `json:"entitlements"`
+	Features     map[string]bool        `json:"features"`
+	// LoadTestPresets are keyed by preset name
+	LoadTestPresets map[string]LoadTestPreset `json:"load_test_presets"`
+}
+
+// StateImportResult counts what an import restored
+type StateImportResult struct {
+	Scripts       int      `json:"scripts"`
+	Chunking      int      `json:"chunking"`
+	Bans          int      `json:"bans"`
+	Conversations int      `json:"conversations"`
+	Reminders     int      `json:"reminders"`
+	Skipped       []string `json:"skipped,omitempty"`
+}
+
+func currentRuntimeConfig() RuntimeConfig {
+	cfg := RuntimeConfig{Chunking: map[string]ChunkConfig{}}
+
+	scriptsMu.RLock()
+	cfg.Scripts = append([]RequestScript{}, requestScripts...)
+	scriptsMu.RUnlock()
+
+	for _, corp := range ragIndex.list() {
+		corp.mu.RLock()
+		cfg.Chunking[corp.name] = corp.chunking
+		corp.mu.RUnlock()
+	}
+	p, e := currentPrompts(), currentEntitlements()
+	cfg.Prompts, cfg.Entitlements = &p, &e
+	cfg.Features = currentFeatures()
+	cfg.LoadTestPresets = currentLoadTestPresets()
+	return cfg
+}
+
+func (cfg RuntimeConfig) validate() error {
+	for name, chunking := range cfg.Chunking {
+		if err := chunking.validate(); err != nil {
+			return fmt.Errorf("chunking for corpus %s: %v", name, err)
+		}
+	}
+	if cfg.Prompts != nil {
+		if err := cfg.Prompts.validate(); err != nil {
+			return fmt.Errorf("prompts: %v", err)
+		}
+	}
+	if cfg.Entitlements != nil {
+		if err := cfg.Entitlements.validate(); err != nil {
+			return fmt.Errorf("entitlements: %v", err)
+		}
+	}
+	if err := validateFeatures(cfg.Features); err != nil {
+		return err
+	}
+	if err := validateLoadTestPresets(cfg.LoadTestPresets); err != nil {
+		return fmt.Errorf("load test presets: %v", err)
+	}
+	return nil
+}
+
+// apply installs cfg, returning the count of chunking settings applied and
+// notes on what was skipped. Scripts are installed first and reject the whole
+// change if any fails to compile.
+func (cfg RuntimeConfig) apply() (int, []string, error) {
+	if cfg.Scripts != nil {
+		if err := setRequestScripts(cfg.Scripts); err != nil {
+			return 0, nil, err
+		}
+	}
+	applied := 0
+	var skipped []string
+	for name, chunking := range cfg.Chunking {
+		corp := ragIndex.get(name)
+		if corp == nil {
+			skipped = append(skipped, "chunking for unknown corpus "+name)
+			continue
+		}
+		corp.mu.Lock()
+		corp.chunking = chunking
+		corp.mu.Unlock()
+		applied++
+	}
+	if cfg.Prompts != nil {
+		setPrompts(*cfg.Prompts)
+	}
+	if cfg.Entitlements != nil {
+		setEntitlements(*cfg.Entitlements)
+	}
+	if cfg.Features != nil {
+		setFeatures(cfg.Features)
+	}
+	if cfg.LoadTestPresets != nil {
+		setLoadTestPresets(cfg.LoadTestPresets)
+	}
+	return applied, skipped, nil
+}
+
+func exportState(withConversations bool) StateArchive {
+	archive := StateArchive{
+		Version:       stateArchiveVersion,
+		ExportedAt:    time.Now().UTC(),
+		RuntimeConfig: currentRuntimeConfig(),
+		Bans:          abuse.activeBans(time.Now()),
+		Reminders:     pendingReminders(),
+	}
+	if withConversations {
+		archive.Conversations = conversationStore.All()
+	}
+	return archive
+}
+
+// validateArchive checks everything that can be rejected before any state
+// changes, so a bad archive is refused as a whole
+func validateArchive(archive StateArchive) error {
+	if archive.Version < 1 || archive.Version > stateArchiveVersion {
+		return fmt.Errorf("unsupported archive version %d (this server reads up to %d)", archive.Version, stateArchiveVersion)
+	}
+	if err := archive.RuntimeConfig.validate(); err != nil {
+		return err
+	}
+	for _, conv := range archive.Conversations {
+		if conv.ID == "" || conv.User == "" {
+			return fmt.Errorf("conversations need an id and a user")
+		}
+	}
+	for _, r := range archive.Reminders {
+		if r.ID == "" || r.User == "" || r.DueAt.IsZero() {
+			return fmt.Errorf("reminders need an id, a user and a due time")
+		}
+	}
+	return nil
+}
+
+func importState(archive StateArchive) (StateImportResult, error) {
+	var result StateImportResult
+	if err := validateArchive(archive); err != nil {
+		return result, err
+	}
+	applied, skipped, err := archive.RuntimeConfig.apply()
+	if err != nil {
+		return result, err
+	}
+	result.Scripts, result.Chunking, result.Skipped = len(archive.Scripts), applied, skipped
+
+	result.Bans = abuse.restoreBans(archive.Bans, time.Now())
+	if expired := len(archive.Bans) - result.Bans; expired > 0 {
+		result.Skipped = append(result.Skipped, fmt.Sprintf("%d expired bans", expired))
+	}
+
+	for _, conv := range archive.Conversations {
+		conversationStore.Put(conv)
+		result.Conversations++
+	}
+	result.Reminders = restoreReminders(archive.Reminders)
+	return result, nil
+}
+
+// handleExportState downloads the state archive; pass conversations=false to
+// leave conversations out
+func handleExportState(c *gin.Context) {
+	archive := exportState(c.DefaultQuery("conversations", "true") != "false")
+	log.Printf("State exported by %s", requestUser(c))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		"chatbot-state-"+archive.ExportedAt.Format("20060102-150405")+".json"))
+	c.JSON(http.StatusOK, archive)
+}
+
+func handleImportState(c *gin.Context) {
+	var archive StateArchive
+	if err := c.ShouldBindJSON(&archive); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := importState(archive)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	recordConfigChange(c, "state import")
+	log.Printf("State imported by %s: %d scripts, %d chunking settings, %d bans, %d conversations, %d reminders",
+		requestUser(c), result.Scripts, result.Chunking, result.Bans, result.Conversations, result.Reminders)
+	c.JSON(http.StatusOK, result)
+}
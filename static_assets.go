@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetManifest is the asset-manifest.json the React build writes
+type assetManifest struct {
+	Files       map[string]string `json:"files"`
+	Entrypoints []string          `json:"entrypoints"`
+}
+
+var (
+	staticCacheControl     string
+	staticSurrogateControl string
+	indexCacheControl      string
+	indexSurrogateControl  string
+	apiSurrogateControl    string
+	assetManifestEnabled   bool
+	// staticAssetBaseURL is where a CDN serves the build, e.g.
+	// "https://cdn.example.com/chat"; empty when the app serves it
+	staticAssetBaseURL string
+)
+
+// configureStaticAssets reads the cache headers for the React build. The
+// files under /static have content hashes in their names, so they are cached
+// for good by default, while index.html, which points at them, is
+// revalidated on every load.
+func configureStaticAssets() {
+	staticCacheControl = envString("STATIC_CACHE_CONTROL", "public, max-age=31536000, immutable")
+	staticSurrogateControl = envString("STATIC_SURROGATE_CONTROL", "")
+	indexCacheControl = envString("INDEX_CACHE_CONTROL", "no-cache")
+	indexSurrogateControl = envString("INDEX_SURROGATE_CONTROL", "")
+	apiSurrogateControl = envString("API_SURROGATE_CONTROL", "no-store")
+	assetManifestEnabled = envBool("ASSET_MANIFEST_ENABLED", false)
+	staticAssetBaseURL = strings.TrimSuffix(envString("STATIC_ASSET_BASE_URL", ""), "/")
+}
+
+// setCacheHeaders sets Cache-Control and Surrogate-Control, removing the ones
+// left empty
+func setCacheHeaders(c *gin.Context, cacheControl, surrogateControl string) {
+	for name, value := range map[string]string{"Cache-Control": cacheControl, "Surrogate-Control": surrogateControl} {
+		if value == "" {
+			c.Writer.Header().Del(name)
+		} else {
+			c.Header(name, value)
+		}
+	}
+}
+
+// apiSurrogateHeaders keeps a CDN in front of the app from caching anything
+// but the build. Static and index responses replace the header.
+func apiSurrogateHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if apiSurrogateControl != "" {
+			c.Header("Surrogate-Control", apiSurrogateControl)
+		}
+	}
+}
+
+// staticCacheHeaders sets the long-lived headers on files under root that
+// exist. Missing files fall through to index.html, which must not be cached
+// as if it were one of them.
+func staticCacheHeaders(root string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+c.Param("filepath"))))
+		if fileExists(name) {
+			setCacheHeaders(c, staticCacheControl, staticSurrogateControl)
+		}
+	}
+}
+
+// serveIndex serves the React app for every path no route matched
+func serveIndex(root string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		indexPath := filepath.Join(root, "index.html")
+		if !fileExists(indexPath) {
+			log.Printf("Index file not found at: %s", indexPath)
+			c.String(http.StatusNotFound, "File not found")
+			return
+		}
+		setCacheHeaders(c, indexCacheControl, indexSurrogateControl)
+		c.File(indexPath)
+	}
+}
+
+// handleAssetManifest returns the build's asset manifest with the paths
+// turned into URLs under STATIC_ASSET_BASE_URL, so a deploy can push the
+// files to a CDN or warm it, and clients can preload them
+func handleAssetManifest(root string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		data, err := os.ReadFile(filepath.Join(root, "asset-manifest.json"))
+		if err != nil {
+			log.Printf("Asset manifest unavailable: %v", err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "asset manifest not found"})
+			return
+		}
+		var manifest assetManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			log.Printf("Asset manifest unreadable: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "asset manifest unreadable"})
+			return
+		}
+		for name, file := range manifest.Files {
+			manifest.Files[name] = assetURL(file)
+		}
+		for i, file := range manifest.Entrypoints {
+			manifest.Entrypoints[i] = assetURL(file)
+		}
+		// The manifest changes with every build, like index.html
+		setCacheHeaders(c, indexCacheControl, indexSurrogateControl)
+		c.JSON(http.StatusOK, gin.H{"base_url": staticAssetBaseURL, "files": manifest.Files, "entrypoints": manifest.Entrypoints})
+	}
+}
+
+// assetURL places a manifest path, which the build writes with or without a
+// leading slash, under STATIC_ASSET_BASE_URL
+func assetURL(file string) string {
+	if strings.Contains(file, "://") {
+		return file
+	}
+	return staticAssetBaseURL + "/" + strings.TrimPrefix(file, "/")
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Status values, from best to worst
+const (
+	statusOperational = "operational"
+	statusDegraded    = "degraded"
+	statusDown        = "down"
+	statusUnknown     = "unknown"
+)
+
+// statusWindow is how recent traffic must be to judge the serving endpoint
+const statusWindow = 15 * time.Minute
+
+// StatusComponent is the health of one part of the service
+type StatusComponent struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// StatusIncident is an alert raised in the last day. Alerts about individual
+// users are left out, since the page is not limited to admins.
+type StatusIncident struct {
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// StatusPoint is one hour of chat traffic
+type StatusPoint struct {
+	Start        time.Time `json:"start"`
+	Requests     int       `json:"requests"`
+	Errors       int       `json:"errors"`
+	ErrorRate    float64   `json:"error_rate"`
+	LatencyP95Ms float64   `json:"latency_p95_ms"`
+}
+
+// StatusPage summarizes service health for stakeholders without admin access
+type StatusPage struct {
+	Status      string            `json:"status"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Components  []StatusComponent `json:"components"`
+	Incidents   []StatusIncident  `json:"incidents"`
+	History     []StatusPoint     `json:"history"`
+}
+
+func buildStatusPage(now time.Time) StatusPage {
+	page := StatusPage{
+		GeneratedAt: now,
+		Components:  []StatusComponent{chatStatus(), servingEndpointStatus(now), credentialsComponentStatus(), upstreamCapacityStatus()},
+		Incidents:   []StatusIncident{},
+		History:     statusHistory(now),
+	}
+	page.Status = statusOperational
+	for _, comp := range page.Components {
+		if statusRank(comp.Status) > statusRank(page.Status) {
+			page.Status = comp.Status
+		}
+	}
+	for _, alert := range recentAlerts(now.Add(-24 * time.Hour)) {
+		if alert.Type == "abuse" || alert.Type == "security" || alert.Details["user"] != nil {
+			continue
+		}
+		page.Incidents = append(page.Incidents, StatusIncident{Type: alert.Type, Severity: alert.Severity, Message: alert.Message, Timestamp: alert.Timestamp})
+	}
+	return page
+}
+
+// statusRank orders statuses for picking the overall one; unknown components
+// do not make the service look worse
+func statusRank(status string) int {
+	switch status {
+	case statusDegraded:
+		return 1
+	case statusDown:
+		return 2
+	}
+	return 0
+}
+
+func chatStatus() StatusComponent {
+	comp := StatusComponent{Name: "Chat", Status: statusOperational}
+	if degraded.Load() {
+		comp.Status, comp.Detail = statusDown, "The server is not configured yet"
+	}
+	return comp
+}
+
+// servingEndpointStatus judges the model from the error rate of recent chat
+// requests
+func servingEndpointStatus(now time.Time) StatusComponent {
+	comp := StatusComponent{Name: "Serving endpoint", Status: statusUnknown, Detail: "No recent requests"}
+	stats := summarizeWindow(auditStore.List(now.Add(-statusWindow), now))
+	if stats.requests == 0 {
+		return comp
+	}
+	rate := stats.errorRate()
+	comp.Detail = fmt.Sprintf("%.1f%% errors over the last %s, mean latency %s", rate*100, statusWindow, stats.meanLatency().Round(time.Millisecond))
+	switch {
+	case rate >= 0.75:
+		comp.Status = statusDown
+	case rate >= 0.1:
+		comp.Status = statusDegraded
+	default:
+		comp.Status = statusOperational
+	}
+	return comp
+}
+
+func credentialsComponentStatus() StatusComponent {
+	comp := StatusComponent{Name: "Workspace credentials", Status: statusUnknown, Detail: "Not checked yet"}
+	credentialMu.Lock()
+	defer credentialMu.Unlock()
+	if credentialStatus == nil {
+		return comp
+	}
+	switch {
+	case !credentialStatus.Valid:
+		comp.Status, comp.Detail = statusDown, "The last check failed"
+	case credentialStatus.ExpiresAt != nil && time.Until(*credentialStatus.ExpiresAt) < credentialExpiryWarning:
+		comp.Status, comp.Detail = statusDegraded, "The token expires in "+credentialStatus.ExpiresIn
+	default:
+		comp.Status, comp.Detail = statusOperational, ""
+	}
+	return comp
+}
+
+func upstreamCapacityStatus() StatusComponent {
+	stats := pool.stats()
+	comp := StatusComponent{Name: "Upstream capacity", Status: statusOperational,
+		Detail: fmt.Sprintf("%d of %d slots in use", stats.InFlight, stats.Limit)}
+	if stats.Limit < stats.MaxLimit || stats.QueuedInteractive > 0 {
+		comp.Status = statusDegraded
+		comp.Detail += fmt.Sprintf(", limit reduced from %d, %d requests queued", stats.MaxLimit, stats.QueuedInteractive)
+	}
+	return comp
+}
+
+// statusHistory buckets the last 24 hours of the audit log by hour, including
+// hours without traffic
+func statusHistory(now time.Time) []StatusPoint {
+	from := bucketStart(now.Add(-23*time.Hour), "hour")
+	byHour := map[time.Time]*UsagePoint{}
+	for _, series := range aggregateUsage(auditStore.List(from, now), "hour", "none") {
+		for _, p := range series.Points {
+			byHour[p.Start] = p
+		}
+	}
+	points := make([]StatusPoint, 0, 24)
+	for start := from; !start.After(now); start = start.Add(time.Hour) {
+		point := StatusPoint{Start: start}
+		if p := byHour[start]; p != nil {
+			point.Requests, point.Errors, point.LatencyP95Ms = p.Requests, p.Errors, p.LatencyP95Ms
+			point.ErrorRate = float64(p.Errors) / float64(p.Requests)
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// statusBar is one column of a status page graph
+type statusBar struct {
+	X, Y, Height float64
+	Label        string
+}
+
+const (
+	statusBarWidth    = 20.0
+	statusGraphHeight = 60.0
+)
+
+func statusBars(points []StatusPoint, value func(StatusPoint) float64, label func(StatusPoint) string) []statusBar {
+	max := 0.0
+	for _, p := range points {
+		if v := value(p); v > max {
+			max = v
+		}
+	}
+	bars := make([]statusBar, len(points))
+	for i, p := range points {
+		h := 0.0
+		if max > 0 {
+			h = value(p) / max * statusGraphHeight
+		}
+		bars[i] = statusBar{X: float64(i) * statusBarWidth, Y: statusGraphHeight - h, Height: h,
+			Label: p.Start.Format("15:04") + ": " + label(p)}
+	}
+	return bars
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>Chatbot status</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 720px; margin: 2rem auto; color: #1f2937; }
+.operational { color: #15803d; } .degraded { color: #b45309; } .down { color: #b91c1c; } .unknown { color: #6b7280; }
+table { width: 100%; border-collapse: collapse; } td { padding: .4rem 0; border-bottom: 1px solid #e5e7eb; }
+.detail { color: #6b7280; font-size: .9rem; } svg { width: 100%; height: 80px; } rect { fill: #3b82f6; } .errors rect { fill: #ef4444; }
+</style>
+</head>
+<body>
+<h1>Chatbot status: <span class="{{.Page.Status}}">{{.Page.Status}}</span></h1>
+<table>
+{{range .Page.Components}}<tr><td>{{.Name}}<div class="detail">{{.Detail}}</div></td><td class="{{.Status}}">{{.Status}}</td></tr>
+{{end}}</table>
+<h2>Requests, last 24 hours</h2>
+<svg viewBox="0 0 {{.Width}} {{.Height}}" preserveAspectRatio="none">{{range .Requests}}<rect x="{{.X}}" y="{{.Y}}" width="18" height="{{.Height}}"><title>{{.Label}}</title></rect>{{end}}</svg>
+<h2>Error rate</h2>
+<svg class="errors" viewBox="0 0 {{.Width}} {{.Height}}" preserveAspectRatio="none">{{range .Errors}}<rect x="{{.X}}" y="{{.Y}}" width="18" height="{{.Height}}"><title>{{.Label}}</title></rect>{{end}}</svg>
+<h2>p95 latency</h2>
+<svg viewBox="0 0 {{.Width}} {{.Height}}" preserveAspectRatio="none">{{range .Latency}}<rect x="{{.X}}" y="{{.Y}}" width="18" height="{{.Height}}"><title>{{.Label}}</title></rect>{{end}}</svg>
+<h2>Incidents, last 24 hours</h2>
+{{if .Page.Incidents}}<table>
+{{range .Page.Incidents}}<tr><td>{{.Message}}<div class="detail">{{.Timestamp.Format "Jan 2 15:04 MST"}} · {{.Type}}</div></td><td class="{{if eq .Severity "critical"}}down{{else}}degraded{{end}}">{{.Severity}}</td></tr>
+{{end}}</table>{{else}}<p>No incidents.</p>{{end}}
+<p class="detail">Updated {{.Page.GeneratedAt.Format "Jan 2 15:04:05 MST"}} · <a href="?format=json">JSON</a></p>
+</body>
+</html>
+`))
+
+// handleStatus serves the status page as HTML, or as JSON with format=json
+// or an Accept header preferring it
+func handleStatus(c *gin.Context) {
+	page := buildStatusPage(time.Now())
+	if c.Query("format") == "json" || c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON {
+		c.JSON(http.StatusOK, page)
+		return
+	}
+
+	data := gin.H{
+		"Page":   page,
+		"Width":  float64(len(page.History)) * statusBarWidth,
+		"Height": statusGraphHeight,
+		"Requests": statusBars(page.History, func(p StatusPoint) float64 { return float64(p.Requests) },
+			func(p StatusPoint) string { return fmt.Sprintf("%d requests", p.Requests) }),
+		"Errors": statusBars(page.History, func(p StatusPoint) float64 { return p.ErrorRate },
+			func(p StatusPoint) string { return fmt.Sprintf("%.1f%% errors", p.ErrorRate*100) }),
+		"Latency": statusBars(page.History, func(p StatusPoint) float64 { return p.LatencyP95Ms },
+			func(p StatusPoint) string { return fmt.Sprintf("%.0f ms", p.LatencyP95Ms) }),
+	}
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(c.Writer, data); err != nil {
+		c.Error(err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4/database"
+)
+
+// storageBackend holds the stores of a database backend. It is nil when data
+// is kept in memory.
+type storageBackend struct {
+	name          string
+	db            *sql.DB
+	audit         AuditStore
+	conversations ConversationStore
+	killSwitches  KillSwitchStore
+	// conversationEvents is the log conversations are projected from
+	conversationEvents ConversationEventStore
+	// requestCaptures keeps chat requests for replays
+	requestCaptures RequestCaptureStore
+	securityEvents  SecurityEventStore
+
+	// migrations holds the backend's numbered up and down SQL files, applied
+	// through the golang-migrate driver returned by migrationDriver
+	migrations      fs.FS
+	migrationDriver func() (database.Driver, error)
+}
+
+var (
+	storage        *storageBackend
+	storageTimeout time.Duration
+	// migrationLockTimeout is how long to wait for a replica that is
+	// migrating the schema
+	migrationLockTimeout time.Duration
+)
+
+// configureStorage connects the database selected by STORAGE_BACKEND. It runs
+// before the subsystems that keep persistent data so they can use it. A
+// database that cannot be used stops the server rather than have it keep
+// data in memory and lose it on restart; --validate-config reports it.
+func configureStorage() {
+	storage = nil
+	storageTimeout = envDuration("STORAGE_TIMEOUT", 5*time.Second)
+	migrateOnStart = envBool("MIGRATE_ON_START", true)
+	migrationLockTimeout = envDuration("MIGRATION_LOCK_TIMEOUT", 5*time.Minute)
+
+	var s *storageBackend
+	var err error
+	backend := envString("STORAGE_BACKEND", "memory")
+	switch backend {
+	case "memory":
+		return
+	case "postgres":
+		s, err = newPostgresStorage(lookupEnv("DATABASE_URL", ""))
+	case "databricks":
+		s, err = newDatabricksStorage()
+	default:
+		err = fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+	// The migrate command manages the schema itself
+	if err == nil && !migrateMode() {
+		if err = prepareSchema(s); err != nil {
+			s.db.Close()
+		}
+	}
+	if err != nil {
+		if validateMode() {
+			configWarn("cannot use %s storage: %v", backend, err)
+			return
+		}
+		log.Fatalf("Cannot use %s storage: %v", backend, err)
+	}
+	log.Printf("Storing conversations and audit records in %s", s.name)
+	storage = s
+}
+
+func storageContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), storageTimeout)
+}
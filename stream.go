@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamChunk is one server-sent chunk of a streaming chat completion
+type StreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string          `json:"content"`
+			ToolCalls []toolCallDelta `json:"tool_calls,omitempty"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+var (
+	// streamClient has no overall timeout; streams are bounded by the request context
+	streamClient = &http.Client{}
+
+	guardrailStreamWindow   int
+	guardrailStreamHoldback int
+)
+
+func configureStreaming() {
+	guardrailStreamWindow = envInt("GUARDRAIL_STREAM_WINDOW", 4096)
+	guardrailStreamHoldback = envInt("GUARDRAIL_STREAM_HOLDBACK", 64)
+	configureStreamBuffer()
+	configureStreamLimit()
+	configureStreamParser()
+}
+
+// admitChatRequest applies abuse detection, quotas and input guardrails, writing the
+// rejection and returning false when the prompt must not be sent upstream
+func admitChatRequest(c *gin.Context, prompt string) bool {
+	if rejectAbusive(c, prompt) || rejectOverQuota(c) {
+		return false
+	}
+	if v := checkGuardrails("input", prompt); v != nil {
+		log.Printf("Guardrail %s blocked input", v.Rule)
+		c.JSON(http.StatusBadRequest, gin.H{"error": v.Message, "policy": v.Rule})
+		return false
+	}
+	return true
+}
+
+// openUpstreamStream starts a streaming completion and returns the response
+// body; the caller must close it. Endpoints that cannot stream answer in one
+// chunk.
+func openUpstreamStream(ctx context.Context, endpoint string, payload *ChatPayload) (io.ReadCloser, int, error) {
+	if !capabilitiesOf(endpoint).Streaming {
+		return completeAsStream(ctx, endpoint, payload)
+	}
+	payload.Stream = true
+	httpReq, err := newUpstreamRequest(ctx, endpoint, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := httpReq.do(streamClient)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer closeBody(resp.Body)
+		return nil, resp.StatusCode, fmt.Errorf("endpoint %s returned %d: %s", endpoint, resp.StatusCode, readErrorBody(resp.Body))
+	}
+	return resp.Body, resp.StatusCode, nil
+}
+
+// readStreamChunks calls fn for every chunk of an OpenAI style SSE stream
+// until it ends or fn returns false
+func readStreamChunks(body io.Reader, fn func(StreamChunk) bool) error {
+	var decodeErr error
+	err := readStreamFrames(body, func(data []byte) bool {
+		var chunk StreamChunk
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			if streamSkipMalformed {
+				streamFramesSkipped.inc("invalid_chunk")
+				log.Printf("Skipped upstream stream chunk: %v", err)
+				return true
+			}
+			decodeErr = fmt.Errorf("decode stream chunk: %v", err)
+			return false
+		}
+		return fn(chunk)
+	})
+	if decodeErr != nil {
+		return decodeErr
+	}
+	return err
+}
+
+// chatStream proxies a streaming completion as server-sent events. Emitted
+// text is scanned against the output guardrails as it arrives; on a violation
+// generation is cancelled upstream and a policy event replaces the rest. The
+// answer is stored with the conversation even when the stream is cut short.
+// Tool calls are answered between rounds, and calls held for confirmation are
+// announced with action_required events.
+func chatStream(c *gin.Context) {
+	var req ChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	prio, ok := parsePriority(req.Priority)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "priority must be interactive or batch"})
+		return
+	}
+	if !resolveChatSettings(c, &req) {
+		return
+	}
+	system := chatSystemPrompt(req.Persona, req.Language)
+	endpoint, ok := applyRequestScripts(c, &req)
+	if !ok {
+		return
+	}
+	if !attachRequestTables(c, &req) {
+		return
+	}
+	if !admitChatRequest(c, req.Message) {
+		return
+	}
+	endpoint = routePrompt(endpoint, req.Message)
+	conv, found := conversationForChat(c, req)
+	if !found {
+		return
+	}
+	if !req.DryRun && escalateChat(c, conv, req, true) {
+		return
+	}
+	messages := attachTables(buildConversationMessages(system, conv.Messages, req.Message), req.tables)
+	payload := chatPayload(messages)
+	payload.Temperature = req.Temperature
+	determinism := applyDeterminism(payload, endpoint, req)
+	if defs := toolDefinitions(); len(defs) > 0 {
+		payload.Tools = defs
+	}
+	if req.DryRun {
+		payload.Stream = true
+		respondDryRun(c, endpoint, conv, payload)
+		return
+	}
+	payload = applyCapabilities(endpoint, payload)
+	budget := promptBudget(payload)
+	endStream := acquireUserStream(c)
+	if endStream == nil {
+		return
+	}
+	defer endStream()
+	// The slot is held for the whole stream
+	release := acquireChatSlot(c, prio)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	start := time.Now()
+	record := AuditRecord{
+		ID:              requestID(c),
+		ClientRequestID: clientRequestID(c),
+		Timestamp:       start,
+		User:            requestUser(c),
+		Model:           endpoint,
+		Prompt:          req.Message,
+	}
+	captureRequest(record, req, endpoint, payload)
+	defer func() {
+		record.Latency = time.Since(start)
+		recordAudit(record)
+	}()
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	upstreamStart := time.Now()
+	body, status, err := openUpstreamStream(ctx, endpoint, payload)
+	pool.observe(status, time.Since(upstreamStart))
+	if err != nil {
+		log.Printf("Failed to open upstream stream: %v", err)
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		record.StatusCode, record.Error = status, "Error from LLM endpoint"
+		c.JSON(status, gin.H{"error": "Error from LLM endpoint"})
+		return
+	}
+	// Replaced by the stream of each tool-call round
+	defer func() { body.Close() }()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	// Latency here is the time to the first byte; token counts are only known
+	// at the end, so they come in the done event
+	setUpstreamHeaders(c, endpoint, time.Since(upstreamStart))
+	c.Status(http.StatusOK)
+	record.StatusCode = http.StatusOK
+
+	out := newStreamBuffer(c)
+	defer out.close()
+	send := func(event string, data interface{}) { out.send(event, data) }
+	text := newStreamGuard(func(text string) {
+		out.sendText("delta", text, func(text string) interface{} { return gin.H{"content": text} })
+	})
+	prompt, answer := beginTurn(conv, req)
+	send("start", gin.H{"conversation_id": conv.ID, "message_id": answer.ID, "prompt_id": prompt.ID})
+	sendStatus := func(m Message) { send("status", gin.H{"message_id": m.ID, "status": m.Status}) }
+	sendStatus(prompt)
+	sendStatus(answer)
+	promptRead := false
+
+	stopped, truncated := false, false
+	session := &toolSession{user: record.User, conversationID: conv.ID}
+	firstPrompt := 0
+	// Tool calls end a round; their results are sent back and the answer
+	// continues in the next round's stream
+	for round := 0; ; round++ {
+		var calls []ToolCall
+		roundStart := len(text.String())
+		promptTokens, completionTokens := 0, 0
+		err = readStreamChunks(body, func(chunk StreamChunk) bool {
+			if chunk.Usage != nil {
+				promptTokens, completionTokens = chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens
+			}
+			if len(chunk.Choices) > 0 {
+				calls = mergeToolCallDeltas(calls, chunk.Choices[0].Delta.ToolCalls)
+				if chunk.Choices[0].FinishReason == "length" {
+					truncated = true
+				}
+			}
+			if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+				return true
+			}
+			if !promptRead {
+				// The model has started answering
+				promptRead, prompt.Status = true, messageRead
+				setMessageStatus(conv.ID, prompt.ID, messageRead)
+				sendStatus(prompt)
+			}
+			if text.write(chunk.Choices[0].Delta.Content) {
+				return true
+			}
+			if v := text.violation; v != nil {
+				log.Printf("Guardrail %s stopped generation mid-stream", v.Rule)
+				record.Error = "generation stopped by guardrail " + v.Rule
+				send("policy", gin.H{"policy": v.Rule, "message": v.Message})
+				stopped, answer.Policy = true, v.Rule
+			} else {
+				truncated = true
+			}
+			cancel()
+			return false
+		})
+		if round == 0 {
+			firstPrompt = promptTokens
+		}
+		record.PromptTokens += promptTokens
+		record.CompletionTokens += completionTokens
+		if stopped || truncated || err != nil || len(calls) == 0 {
+			break
+		}
+		if round == maxToolRounds {
+			err = fmt.Errorf("model still calling tools after %d rounds", maxToolRounds)
+			break
+		}
+
+		held := len(session.pending)
+		payload.Messages = answerToolCalls(session, payload.Messages, text.String()[roundStart:], calls)
+		// The client learns of a held call while the model is still
+		// explaining it, and answers it through /api/actions
+		for _, action := range session.pending[held:] {
+			send("action_required", action)
+		}
+		body.Close()
+		next, _, openErr := openUpstreamStream(ctx, endpoint, payload)
+		if openErr != nil {
+			err = openErr
+			break
+		}
+		body = next
+	}
+
+	record.Response = text.String()
+	rateLimiter.chargeTokens(record.PromptTokens + record.CompletionTokens)
+	record.Cost = estimateCost(record.PromptTokens, record.CompletionTokens)
+	// Before tool rounds add their own prompts
+	learnTokenRatio(endpoint, budget.Total, firstPrompt)
+	budget.calibrate(firstPrompt)
+	budget.observe()
+	if stopped {
+		answer.Content = text.Sent()
+		sendStatus(finishTurn(conv, req, endpoint, prompt, answer))
+		return
+	}
+	if err != nil {
+		// Keep what the client already received so the answer can be continued
+		log.Printf("Upstream stream failed: %v", err)
+		record.Error = "stream interrupted"
+		answer.Content, answer.Stopped, answer.Status = text.Sent(), true, messageFailed
+		sendStatus(finishTurn(conv, req, endpoint, prompt, answer))
+		send("error", gin.H{"error": "Stream from LLM endpoint was interrupted"})
+		return
+	}
+
+	full := text.finish()
+	record.Response = full
+	answer.Content, answer.Truncated, answer.Charts = full, truncated, chartSpecs(full)
+	sendStatus(finishTurn(conv, req, endpoint, prompt, answer))
+	if truncated {
+		send("truncated", gin.H{"message_id": answer.ID})
+	}
+	for _, spec := range answer.Charts {
+		send("chart", gin.H{"message_id": answer.ID, "spec": spec})
+	}
+	done := gin.H{"prompt_tokens": record.PromptTokens, "completion_tokens": record.CompletionTokens}
+	if determinism != nil {
+		done["determinism"] = determinism
+	}
+	if req.Debug {
+		done["token_budget"] = budget
+	}
+	if len(session.pending) > 0 {
+		done["pending_actions"] = session.pending
+	}
+	if e := escalateUncertain(conv, full); e != nil {
+		send("escalated", e)
+	}
+	send("done", done)
+}
+
+// utf8Boundary moves i back to the start of the rune containing it
+func utf8Boundary(s string, i int) int {
+	for i > 0 && i < len(s) && s[i]&0xC0 == 0x80 {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	streamBufferLimit   int64
+	streamCoalesceDelay time.Duration
+	streamCoalesceBytes int64
+
+	// Totals across all open streams, for /metrics
+	streamBufferedBytes  atomic.Int64
+	streamBufferPeak     atomic.Int64
+	streamBackpressure   *counterVec
+	streamBufferedEvents *counterVec
+)
+
+func configureStreamBuffer() {
+	streamBufferLimit = envSize("STREAM_BUFFER_BYTES", 256<<10)
+	streamCoalesceDelay = envDuration("STREAM_COALESCE_DELAY", 0)
+	streamCoalesceBytes = envSize("STREAM_COALESCE_BYTES", 0)
+	registerGaugeFunc("chatbot_stream_buffer_bytes", "Bytes of server-sent events waiting for slow clients",
+		func() float64 { return float64(streamBufferedBytes.Load()) })
+	registerGaugeFunc("chatbot_stream_buffer_peak_bytes", "Most bytes any single stream has buffered",
+		func() float64 { return float64(streamBufferPeak.Load()) })
+	streamBackpressure = newCounterVec("chatbot_stream_backpressure_pauses_total", "Times an upstream read paused because the client buffer was full")
+	streamBufferedEvents = newCounterVec("chatbot_stream_events_total", "Server-sent events queued for clients")
+}
+
+type sseEvent struct {
+	name string
+	data string
+	// encode, set for text deltas, turns the text in data into the event
+	// payload once the deltas it may have been merged with are known
+	encode func(text string) interface{}
+}
+
+// coalescing holds text deltas back, merging them into fewer events and
+// flushes, until STREAM_COALESCE_DELAY has passed since the first of them
+// or STREAM_COALESCE_BYTES are waiting
+func coalescing() bool {
+	return streamCoalesceDelay > 0 || streamCoalesceBytes > 0
+}
+
+// streamBuffer decouples reading the upstream from writing to the client.
+// Events queue up to streamBufferLimit bytes; past that send blocks, so the
+// upstream read pauses until the client catches up instead of memory growing.
+// Only the buffer's writer goroutine touches the response after it starts.
+type streamBuffer struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []sseEvent
+	queuedAt time.Time
+	bytes    int64
+	closed   bool
+	aborted  bool
+	done     chan struct{}
+	stop     func() bool
+}
+
+// newStreamBuffer starts writing to c. When the client goes away queued
+// events are dropped and pending sends return.
+func newStreamBuffer(c *gin.Context) *streamBuffer {
+	b := &streamBuffer{done: make(chan struct{})}
+	b.cond = sync.NewCond(&b.mu)
+	b.stop = context.AfterFunc(c.Request.Context(), b.abort)
+	go b.write(c)
+	return b
+}
+
+// send queues an event, waiting while the buffer is full. A single event
+// larger than the whole buffer is still accepted once the buffer is empty.
+// Like c.SSEvent, strings are sent as is and anything else as JSON. It
+// reports false when the stream was aborted.
+func (b *streamBuffer) send(event string, data interface{}) bool {
+	payload, ok := data.(string)
+	if !ok {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return false
+		}
+		payload = string(encoded)
+	}
+	return b.enqueue(sseEvent{name: event, data: payload})
+}
+
+// sendText queues a text delta, which encode turns into the event payload.
+// While coalescing, it is merged into a delta of the same event still
+// waiting in the queue.
+func (b *streamBuffer) sendText(event, text string, encode func(text string) interface{}) bool {
+	return b.enqueue(sseEvent{name: event, data: text, encode: encode})
+}
+
+func (b *streamBuffer) enqueue(ev sseEvent) bool {
+	size := int64(len(ev.data) + len(ev.name))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	paused := false
+	for !b.aborted && len(b.queue) > 0 && b.bytes+size > streamBufferLimit {
+		if !paused {
+			paused = true
+			streamBackpressure.inc()
+		}
+		b.cond.Wait()
+	}
+	if b.aborted {
+		return false
+	}
+	if n := len(b.queue); n > 0 && coalescing() && ev.encode != nil && b.queue[n-1].encode != nil && b.queue[n-1].name == ev.name {
+		b.queue[n-1].data += ev.data
+	} else {
+		if n == 0 {
+			b.queuedAt = time.Now()
+			if streamCoalesceDelay > 0 {
+				time.AfterFunc(streamCoalesceDelay, b.wake)
+			}
+		}
+		b.queue = append(b.queue, ev)
+		streamBufferedEvents.inc()
+	}
+	b.bytes += size
+	streamBufferedBytes.Add(size)
+	for peak := streamBufferPeak.Load(); b.bytes > peak && !streamBufferPeak.CompareAndSwap(peak, b.bytes); peak = streamBufferPeak.Load() {
+	}
+	b.cond.Broadcast()
+	return true
+}
+
+func (b *streamBuffer) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// ready reports whether the writer should take the queue. Deltas are held
+// while coalescing; any other event, such as done, flushes them at once.
+func (b *streamBuffer) ready() bool {
+	switch {
+	case b.aborted || b.closed:
+		return true
+	case len(b.queue) == 0:
+		return false
+	case !coalescing():
+		return true
+	}
+	// b.bytes also counts events the writer is still sending
+	var queued int64
+	for _, ev := range b.queue {
+		if ev.encode == nil {
+			return true
+		}
+		queued += int64(len(ev.data) + len(ev.name))
+	}
+	if streamCoalesceBytes > 0 && queued >= streamCoalesceBytes {
+		return true
+	}
+	return streamCoalesceDelay > 0 && time.Since(b.queuedAt) >= streamCoalesceDelay
+}
+
+func (b *streamBuffer) write(c *gin.Context) {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		for !b.ready() {
+			b.cond.Wait()
+		}
+		if b.aborted || len(b.queue) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		events := b.queue
+		b.queue = nil
+		b.mu.Unlock()
+
+		var size int64
+		for _, ev := range events {
+			size += int64(len(ev.data) + len(ev.name))
+			if ev.encode != nil {
+				encoded, err := json.Marshal(ev.encode(ev.data))
+				if err != nil {
+					continue
+				}
+				ev.data = string(encoded)
+			}
+			c.SSEvent(ev.name, ev.data)
+		}
+		c.Writer.Flush()
+
+		b.mu.Lock()
+		// abort has already discounted everything, including these events
+		if !b.aborted {
+			b.bytes -= size
+			streamBufferedBytes.Add(-size)
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// abort drops whatever is still queued, e.g. after the client went away
+func (b *streamBuffer) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.aborted {
+		b.aborted = true
+		streamBufferedBytes.Add(-b.bytes)
+		b.bytes, b.queue = 0, nil
+	}
+	b.cond.Broadcast()
+}
+
+// close flushes what is queued and waits for the writer, so the handler does
+// not return while the response is still being written
+func (b *streamBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	<-b.done
+	b.stop()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gatedWriter is a client that reads nothing until it is opened; writing is
+// closed once the first write is waiting
+type gatedWriter struct {
+	*httptest.ResponseRecorder
+	open    chan struct{}
+	writing chan struct{}
+	once    sync.Once
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.writing) })
+	<-w.open
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *gatedWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// returnsWithin reports whether fn returns within d, and what it returned
+func returnsWithin(d time.Duration, fn func() bool) (returned, result bool) {
+	done := make(chan bool, 1)
+	go func() { done <- fn() }()
+	select {
+	case result = <-done:
+		return true, result
+	case <-time.After(d):
+		return false, false
+	}
+}
+
+func TestStreamBufferBackpressure(t *testing.T) {
+	limit, delay, size := streamBufferLimit, streamCoalesceDelay, streamCoalesceBytes
+	t.Cleanup(func() { streamBufferLimit, streamCoalesceDelay, streamCoalesceBytes = limit, delay, size })
+	streamCoalesceDelay, streamCoalesceBytes = 0, 0
+	// Every event is "m" and 9 bytes of data, 10 bytes in the buffer
+	event := strings.Repeat("x", 9)
+
+	tests := []struct {
+		name  string
+		limit int64
+		// sends are made while the client reads nothing; then the client
+		// catches up, or goes away when abort is set
+		sends     int
+		abort     bool
+		wantBlock bool
+	}{
+		{name: "within the limit", limit: 100, sends: 5},
+		{name: "oversized event into an empty buffer", limit: 5, sends: 1},
+		{name: "full buffer blocks until the client reads", limit: 25, sends: 3, wantBlock: true},
+		{name: "client going away releases a blocked send", limit: 25, sends: 3, abort: true, wantBlock: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamBufferLimit = tt.limit
+			w := &gatedWriter{ResponseRecorder: httptest.NewRecorder(), open: make(chan struct{}), writing: make(chan struct{})}
+			c, _ := gin.CreateTestContext(w)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c.Request = httptest.NewRequest("GET", "/api/chat/stream", nil).WithContext(ctx)
+			b := newStreamBuffer(c)
+
+			for i := 0; i < tt.sends-1; i++ {
+				if returned, ok := returnsWithin(time.Second, func() bool { return b.send("m", event) }); !returned || !ok {
+					t.Fatalf("send %d blocked below the limit", i+1)
+				}
+				if i == 0 {
+					// The first event is stuck on its way to the client
+					<-w.writing
+				}
+			}
+			last := make(chan bool, 1)
+			go func() { last <- b.send("m", event) }()
+			select {
+			case ok := <-last:
+				if tt.wantBlock {
+					t.Fatal("last send did not wait for the client")
+				}
+				if !ok {
+					t.Fatal("last send failed")
+				}
+			case <-time.After(50 * time.Millisecond):
+				if !tt.wantBlock {
+					t.Fatal("last send blocked below the limit")
+				}
+			}
+
+			// A client that went away reads nothing more
+			if tt.abort {
+				cancel()
+			} else {
+				close(w.open)
+			}
+			if tt.wantBlock {
+				select {
+				case ok := <-last:
+					if ok == tt.abort {
+						t.Fatalf("blocked send returned %v after abort %v", ok, tt.abort)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("blocked send never returned")
+				}
+			}
+			if tt.abort {
+				close(w.open)
+			}
+			b.close()
+			if !tt.abort {
+				if got := strings.Count(w.Body.String(), event); got != tt.sends {
+					t.Fatalf("client got %d events, want %d", got, tt.sends)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import "strings"
+
+// streamGuard collects a streamed answer and releases it to the client only
+// after the output guardrails have seen it. The last GUARDRAIL_STREAM_HOLDBACK
+// bytes are held back so a violation completed by the next delta is never
+// forwarded, and the answer is capped at MAX_RESPONSE_CHARS.
+type streamGuard struct {
+	text strings.Builder
+	sent int
+	send func(text string)
+
+	// violation is the guardrail that stopped the answer
+	violation *GuardrailViolation
+	// truncated is set when the answer went over MAX_RESPONSE_CHARS
+	truncated bool
+}
+
+func newStreamGuard(send func(text string)) *streamGuard {
+	return &streamGuard{send: send}
+}
+
+// write adds a delta and sends what is safe to send. It is false when
+// generation should stop, because a guardrail tripped or the answer is too
+// long.
+func (g *streamGuard) write(delta string) bool {
+	g.text.WriteString(delta)
+	full := g.text.String()
+	// The window always covers the text not sent yet, so whatever finish
+	// flushes has been scanned, even after a delta longer than the window
+	start := 0
+	if guardrailStreamWindow > 0 {
+		start = min(max(len(full)-guardrailStreamWindow, 0), g.sent)
+	}
+	if v := checkGuardrails("output", full[start:]); v != nil {
+		g.violation = v
+		return false
+	}
+	if maxResponseChars > 0 && len(full) > maxResponseChars {
+		g.truncated = true
+		return false
+	}
+	if flushTo := len(full) - guardrailStreamHoldback; flushTo > g.sent {
+		flushTo = utf8Boundary(full, flushTo)
+		g.send(full[g.sent:flushTo])
+		g.sent = flushTo
+	}
+	return true
+}
+
+// String is all of the answer received so far
+func (g *streamGuard) String() string {
+	return g.text.String()
+}
+
+// Sent is the part of the answer the client has
+func (g *streamGuard) Sent() string {
+	return g.text.String()[:g.sent]
+}
+
+// finish sends the held-back tail of an answer that was not stopped and
+// returns the answer, cut to MAX_RESPONSE_CHARS but never to less than the
+// client already has
+func (g *streamGuard) finish() string {
+	full, _ := truncateResponseAfter(g.text.String(), g.sent)
+	if g.sent < len(full) {
+		g.send(full[g.sent:])
+		g.sent = len(full)
+	}
+	return full
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestStreamGuard(t *testing.T) {
+	rules, window, holdback, maxChars := guardrailRules, guardrailStreamWindow, guardrailStreamHoldback, maxResponseChars
+	t.Cleanup(func() {
+		guardrailRules, guardrailStreamWindow, guardrailStreamHoldback, maxResponseChars = rules, window, holdback, maxChars
+	})
+	guardrailRules = []GuardrailRule{{Name: "secret", AppliesTo: "output", re: regexp.MustCompile(`SECRET`)}}
+
+	tests := []struct {
+		name     string
+		window   int
+		holdback int
+		maxChars int
+		deltas   []string
+		// violation is the rule expected to stop the answer
+		violation string
+		truncated bool
+		// answer is what finish returns, for answers that were not stopped
+		answer string
+	}{
+		{name: "plain answer", window: 4096, holdback: 4, deltas: []string{"Hello ", "world"}, answer: "Hello world"},
+		{name: "violation completed by the next delta", window: 4096, holdback: 8,
+			deltas: []string{"abc SEC", "RET xyz"}, violation: "secret"},
+		{name: "violation in the delta that hits the length cap", window: 4096, holdback: 4, maxChars: 20,
+			deltas: []string{"aaaa aaaa aaaa ", "bb SECRET"}, violation: "secret"},
+		{name: "violation in a delta longer than the window", window: 8, deltas: []string{strings.Repeat("x", 16) + "SECRET" + strings.Repeat("x", 16)},
+			violation: "secret"},
+		{name: "truncation never drops sent text", window: 4096, maxChars: 30,
+			deltas: []string{strings.Repeat("word ", 6), "more"}, truncated: true, answer: strings.Repeat("word ", 6)},
+		{name: "truncation at a sentence", window: 4096, holdback: 40, maxChars: 20,
+			deltas: []string{"A short one. And then ", "more text"}, truncated: true, answer: "A short one."},
+		{name: "truncation closes a code fence", window: 4096, holdback: 64, maxChars: 24,
+			deltas: []string{"```go\nfunc main() {\n\tprintln()\n", "}\n```"}, truncated: true, answer: "```go\nfunc main() {\n\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			guardrailStreamWindow, guardrailStreamHoldback, maxResponseChars = tt.window, tt.holdback, tt.maxChars
+			var sent strings.Builder
+			g := newStreamGuard(func(text string) { sent.WriteString(text) })
+			stopped := false
+			for _, delta := range tt.deltas {
+				if !g.write(delta) {
+					stopped = true
+					break
+				}
+			}
+			if sent.String() != g.Sent() {
+				t.Fatalf("client got %q, guard reports %q", sent.String(), g.Sent())
+			}
+			if tt.violation != "" {
+				if g.violation == nil || g.violation.Rule != tt.violation {
+					t.Fatalf("violation = %v, want %s", g.violation, tt.violation)
+				}
+				if strings.Contains(sent.String(), "SEC") {
+					t.Fatalf("client got unscanned text %q", sent.String())
+				}
+				return
+			}
+			if stopped != tt.truncated || g.truncated != tt.truncated {
+				t.Fatalf("stopped = %v, truncated = %v, want %v", stopped, g.truncated, tt.truncated)
+			}
+			before := sent.String()
+			answer := g.finish()
+			if answer != tt.answer {
+				t.Fatalf("answer = %q, want %q", answer, tt.answer)
+			}
+			if sent.String() != answer || !strings.HasPrefix(answer, before) {
+				t.Fatalf("client got %q for answer %q", sent.String(), answer)
+			}
+		})
+	}
+}
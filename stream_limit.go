@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	streamsPerUser int
+
+	userStreamsMu sync.Mutex
+	userStreams   = map[string]int{}
+
+	streamLimitRejections *counterVec
+)
+
+// configureStreamLimit reads STREAMS_PER_USER, the number of answers one
+// user may have streaming at once; a quota tier's max_streams overrides it
+// for its members, and 0 means no limit
+func configureStreamLimit() {
+	streamsPerUser = envInt("STREAMS_PER_USER", 3)
+	streamLimitRejections = newCounterVec("chatbot_stream_limit_rejections_total", "Streaming requests rejected because the user had too many streams open")
+	registerGaugeFunc("chatbot_active_streams", "Answers being streamed", func() float64 {
+		userStreamsMu.Lock()
+		defer userStreamsMu.Unlock()
+		total := 0
+		for _, n := range userStreams {
+			total += n
+		}
+		return float64(total)
+	})
+}
+
+// streamLimitFor returns how many streams user may have open at once
+func streamLimitFor(user string) int {
+	if tier := entitlementsFor(user).Tier; tier.MaxStreams > 0 {
+		return tier.MaxStreams
+	}
+	return streamsPerUser
+}
+
+// acquireUserStream counts a stream against the caller's limit, returning the
+// function that ends it, or writes a 429 and returns nil when the caller
+// already has as many streams open as allowed
+func acquireUserStream(c *gin.Context) func() {
+	user := requestUser(c)
+	limit := streamLimitFor(user)
+	if limit <= 0 {
+		return func() {}
+	}
+	userStreamsMu.Lock()
+	if userStreams[user] >= limit {
+		userStreamsMu.Unlock()
+		streamLimitRejections.inc()
+		log.Printf("Rejected stream for %s: %d streams already open", user, limit)
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("Too many answers streaming at once (limit %d); wait for one to finish before starting another", limit),
+			"limit": limit,
+		})
+		return nil
+	}
+	userStreams[user]++
+	userStreamsMu.Unlock()
+
+	return func() {
+		userStreamsMu.Lock()
+		defer userStreamsMu.Unlock()
+		if userStreams[user]--; userStreams[user] <= 0 {
+			delete(userStreams, user)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+var (
+	// streamDoneMarkers are data payloads that end a stream, and
+	// streamDoneEvents event names that do
+	streamDoneMarkers map[string]bool
+	streamDoneEvents  map[string]bool
+	// streamErrorEvents are event names whose data is an upstream error
+	streamErrorEvents   map[string]bool
+	streamMaxFrameBytes int64
+	// streamSkipMalformed drops frames that are not JSON instead of failing
+	// the stream
+	streamSkipMalformed bool
+	streamFramesSkipped *counterVec
+)
+
+// configureStreamParser sets how upstream streams are read. Endpoints other
+// than Databricks' own may end streams with other markers or event names.
+func configureStreamParser() {
+	streamDoneMarkers = map[string]bool{}
+	for _, marker := range envList("STREAM_DONE_MARKERS") {
+		streamDoneMarkers[marker] = true
+	}
+	if len(streamDoneMarkers) == 0 {
+		streamDoneMarkers["[DONE]"] = true
+	}
+	if streamDoneEvents = envSet("STREAM_DONE_EVENTS"); streamDoneEvents == nil {
+		streamDoneEvents = map[string]bool{"done": true, "message_stop": true}
+	}
+	if streamErrorEvents = envSet("STREAM_ERROR_EVENTS"); streamErrorEvents == nil {
+		streamErrorEvents = map[string]bool{"error": true}
+	}
+	streamMaxFrameBytes = envSize("STREAM_MAX_FRAME_BYTES", 1<<20)
+	switch mode := strings.ToLower(envString("STREAM_MALFORMED_FRAMES", "fail")); mode {
+	case "fail":
+	case "skip":
+		streamSkipMalformed = true
+	default:
+		configWarn("STREAM_MALFORMED_FRAMES must be fail or skip, not %q", mode)
+	}
+	streamFramesSkipped = newCounterVec("chatbot_stream_frames_skipped_total", "Malformed upstream stream frames skipped, by reason", "reason")
+}
+
+// errStreamCutOff is returned when a stream ends partway through a frame
+var errStreamCutOff = errors.New("upstream stream ended partway through a chunk")
+
+// readStreamFrames reads an upstream server-sent event stream and calls fn
+// with the JSON data of every frame, until a done marker or event, EOF or fn
+// returns false. It tolerates what streams do in practice: keep-alive
+// comments, CRLF line ends, a byte order mark, data fields without the space
+// and JSON split over several data lines, which are joined until they parse.
+// Frames are normally ended by a blank line, but JSON that parses is handed
+// on at once, for endpoints that leave the blank lines out.
+func readStreamFrames(body io.Reader, fn func(data []byte) bool) error {
+	r := bufio.NewReaderSize(body, 64*1024)
+	var event string
+	var data []byte
+	// malformed drops the pending frame, or fails the stream
+	malformed := func(reason string, err error) error {
+		data = data[:0]
+		if !streamSkipMalformed {
+			return err
+		}
+		streamFramesSkipped.inc(reason)
+		log.Printf("Skipped malformed upstream stream frame: %v", err)
+		return nil
+	}
+	for first := true; ; first = false {
+		line, err := readStreamLine(r)
+		if errors.Is(err, errStreamLineTooLong) {
+			if err := malformed("oversized", fmt.Errorf("stream line longer than %d bytes", streamMaxFrameBytes)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if first {
+			line = bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))
+		}
+		eof := errors.Is(err, io.EOF)
+
+		switch {
+		case len(line) == 0:
+			// A blank line ends the frame; data still pending never parsed
+			if len(data) > 0 && streamErrorEvents[event] {
+				return fmt.Errorf("upstream stream error: %s", data)
+			}
+			if len(data) > 0 {
+				if err := malformed("invalid_json", fmt.Errorf("decode stream chunk: %.200q is not JSON", data)); err != nil {
+					return err
+				}
+			}
+			event = ""
+		case line[0] == ':':
+			// A comment, usually a keep-alive
+		default:
+			field, value, _ := bytes.Cut(line, []byte(":"))
+			value = bytes.TrimPrefix(value, []byte(" "))
+			switch string(field) {
+			case "event":
+				event = strings.ToLower(strings.TrimSpace(string(value)))
+				if streamDoneEvents[event] {
+					return nil
+				}
+			case "data":
+				value = bytes.TrimSpace(value)
+				if len(data) == 0 && streamDoneMarkers[string(value)] {
+					return nil
+				}
+				// Data lines of one frame are joined with line feeds, as
+				// the event stream format has it
+				if len(data) > 0 {
+					data = append(data, '\n')
+				}
+				data = append(data, value...)
+				if int64(len(data)) > streamMaxFrameBytes {
+					if err := malformed("oversized", fmt.Errorf("stream chunk longer than %d bytes", streamMaxFrameBytes)); err != nil {
+						return err
+					}
+					continue
+				}
+				if len(data) == 0 || !json.Valid(data) {
+					break
+				}
+				if streamErrorEvents[event] {
+					return fmt.Errorf("upstream stream error: %s", streamErrorMessage(data))
+				}
+				frame := data
+				data = nil
+				if !fn(frame) {
+					return nil
+				}
+			}
+		}
+		if eof {
+			if len(data) > 0 {
+				return errStreamCutOff
+			}
+			return nil
+		}
+	}
+}
+
+var errStreamLineTooLong = errors.New("stream line too long")
+
+// readStreamLine reads one line without its line end. A line longer than
+// STREAM_MAX_FRAME_BYTES is read to its end and dropped, so one runaway
+// line cannot exhaust memory.
+func readStreamLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	tooLong := false
+	for {
+		part, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, part...)
+			if int64(len(line)) > streamMaxFrameBytes+2 {
+				line, tooLong = nil, true
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if tooLong && (err == nil || errors.Is(err, io.EOF)) {
+			return nil, errStreamLineTooLong
+		}
+		return bytes.TrimRight(line, "\r\n"), err
+	}
+}
+
+// streamErrorMessage picks the message out of an error frame, in the shapes
+// OpenAI and Anthropic style endpoints send, or returns the frame itself
+func streamErrorMessage(data []byte) string {
+	var body struct {
+		Message string `json:"message"`
+		Error   struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		if body.Error.Message != "" {
+			return body.Error.Message
+		}
+		if body.Message != "" {
+			return body.Message
+		}
+	}
+	return string(data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadStreamFrames(t *testing.T) {
+	maxFrame, skip := streamMaxFrameBytes, streamSkipMalformed
+	t.Cleanup(func() { streamMaxFrameBytes, streamSkipMalformed = maxFrame, skip })
+
+	tests := []struct {
+		name     string
+		stream   string
+		skip     bool
+		maxFrame int64
+		frames   []string
+		// err is the error expected, matched by errors.Is or by its text
+		err error
+	}{
+		{name: "frames", stream: "data: {\"a\":1}\n\ndata: {\"a\":2}\n\n", frames: []string{`{"a":1}`, `{"a":2}`}},
+		{name: "json split across data lines", stream: "data: {\"a\":\ndata: 1}\n\n", frames: []string{"{\"a\":\n1}"}},
+		{name: "number split across data lines", stream: "data: {\"n\":12\ndata: 34}\n\n",
+			err: errors.New(`decode stream chunk: "{\"n\":12\n34}" is not JSON`)},
+		{name: "crlf and byte order mark", stream: "\xef\xbb\xbfdata: {\"a\":1}\r\n\r\ndata:{\"a\":2}\r\n\r\n", frames: []string{`{"a":1}`, `{"a":2}`}},
+		{name: "keep-alive comments", stream: ": ping\n\ndata: {\"a\":1}\n\n: ping\n\n", frames: []string{`{"a":1}`}},
+		{name: "missing blank lines", stream: "data: {\"a\":1}\ndata: {\"a\":2}\n", frames: []string{`{"a":1}`, `{"a":2}`}},
+		{name: "done marker", stream: "data: {\"a\":1}\n\ndata: [DONE]\n\ndata: {\"a\":2}\n\n", frames: []string{`{"a":1}`}},
+		{name: "done event", stream: "data: {\"a\":1}\n\nevent: message_stop\ndata: {}\n\n", frames: []string{`{"a":1}`}},
+		{name: "error event", stream: "data: {\"a\":1}\n\nevent: error\ndata: {\"error\":{\"message\":\"overloaded\"}}\n\n",
+			frames: []string{`{"a":1}`}, err: errors.New("upstream stream error: overloaded")},
+		{name: "error event without json", stream: "event: error\ndata: overloaded\n\n", err: errors.New("upstream stream error: overloaded")},
+		{name: "invalid json fails", stream: "data: nope\n\ndata: {\"a\":1}\n\n", err: errors.New(`decode stream chunk: "nope" is not JSON`)},
+		{name: "invalid json skipped", stream: "data: nope\n\ndata: {\"a\":1}\n\n", skip: true, frames: []string{`{"a":1}`}},
+		{name: "oversized line fails", stream: "data: {\"a\":\"" + strings.Repeat("x", 100) + "\"}\n\ndata: {\"a\":1}\n\n", maxFrame: 64,
+			err: errors.New("stream line longer than 64 bytes")},
+		{name: "oversized line skipped", stream: "data: {\"a\":\"" + strings.Repeat("x", 100) + "\"}\n\ndata: {\"a\":1}\n\n", maxFrame: 64, skip: true,
+			frames: []string{`{"a":1}`}},
+		{name: "oversized frame skipped", stream: strings.Repeat("data: [\"xxxxxxxxxxxxxxxxxxxx\",\n", 4) + "\ndata: {\"a\":1}\n\n", maxFrame: 64, skip: true,
+			frames: []string{`{"a":1}`}},
+		{name: "cut off mid-frame fails", stream: "data: {\"a\":1}\n\ndata: {\"a\":", frames: []string{`{"a":1}`}, err: errStreamCutOff},
+		{name: "cut off mid-frame in skip mode", stream: "data: {\"a\":1}\n\ndata: {\"a\":", skip: true, frames: []string{`{"a":1}`}, err: errStreamCutOff},
+		{name: "last frame without line end", stream: "data: {\"a\":1}", frames: []string{`{"a":1}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamSkipMalformed, streamMaxFrameBytes = tt.skip, tt.maxFrame
+			if tt.maxFrame == 0 {
+				streamMaxFrameBytes = 1 << 20
+			}
+			var frames []string
+			err := readStreamFrames(strings.NewReader(tt.stream), func(data []byte) bool {
+				frames = append(frames, string(data))
+				return true
+			})
+			if strings.Join(frames, "|") != strings.Join(tt.frames, "|") {
+				t.Errorf("frames = %q, want %q", frames, tt.frames)
+			}
+			switch {
+			case tt.err == nil && err != nil:
+				t.Errorf("err = %v, want none", err)
+			case tt.err != nil && !errors.Is(err, tt.err) && (err == nil || err.Error() != tt.err.Error()):
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadStreamFramesStopsWhenAsked(t *testing.T) {
+	calls := 0
+	err := readStreamFrames(strings.NewReader("data: {\"a\":1}\n\ndata: {\"a\":2}\n\n"), func([]byte) bool {
+		calls++
+		return false
+	})
+	if err != nil || calls != 1 {
+		t.Fatalf("calls = %d, err = %v; want 1 call and no error", calls, err)
+	}
+}
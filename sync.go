@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	syncPageSize int
+	// syncSettleDelay holds back events this recent. A database assigns seq
+	// when an event is inserted, so a write still committing can show up
+	// after a later one has been synced past.
+	syncSettleDelay time.Duration
+)
+
+func configureSync() {
+	syncPageSize = envInt("SYNC_PAGE_SIZE", 500)
+	syncSettleDelay = envDuration("SYNC_SETTLE_DELAY", 2*time.Second)
+}
+
+// handleSync returns the caller's conversation events after the cursor, in
+// the order they happened. A client with no cursor, or one older than the
+// log still keeps, gets a reset: all its conversations as they are now and
+// the cursor they are current to, after which it applies events as they
+// come. Every event carries the whole message or conversation it leaves
+// behind, so applying one twice does no harm and the last by seq wins.
+func handleSync(c *gin.Context) {
+	cursor, err := strconv.ParseInt(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil || cursor < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cursor must be a seq returned by an earlier sync"})
+		return
+	}
+	limit := syncPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	user := requestUser(c)
+	before := time.Now().Add(-syncSettleDelay)
+	if cursor == 0 || cursor < conversationEvents.Forgotten() {
+		// The cursor is read first: a change made while the conversations
+		// are listed is sent again with the next events, which is harmless
+		latest := conversationEvents.Latest(before)
+		c.JSON(http.StatusOK, gin.H{"reset": true, "cursor": latest, "conversations": conversationStore.List(user),
+			"events": []ConversationEvent{}, "has_more": false})
+		return
+	}
+	events := conversationEvents.Since(user, cursor, before, limit)
+	if len(events) > 0 {
+		cursor = events[len(events)-1].Seq
+	}
+	c.JSON(http.StatusOK, gin.H{"cursor": cursor, "events": events, "has_more": len(events) == limit})
+}
+
+// messageChangedSince finds the last event after seq that changed the
+// message, including the conversation being restored over it. A client
+// sends the cursor its copy of the message is current to as base_seq; with
+// none there is nothing to check.
+func messageChangedSince(convID, messageID string, seq int64) (ConversationEvent, bool) {
+	var last ConversationEvent
+	changed := false
+	if seq <= 0 {
+		return last, false
+	}
+	for _, e := range conversationEvents.Conversation(convID) {
+		if e.Seq > seq && (e.MessageID == messageID || e.Conversation != nil) {
+			last, changed = e, true
+		}
+	}
+	return last, changed
+}
+
+// syncConflict answers a change based on a stale copy of the message with
+// 409 and the server's copy, which wins. The client applies it and may
+// retry its change on top.
+func syncConflict(c *gin.Context, conv Conversation, e ConversationEvent) {
+	var current *Message
+	for _, m := range conv.Messages {
+		if m.ID == c.Param("message_id") {
+			m := m
+			current = &m
+		}
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": "The message was changed since base_seq", "seq": e.Seq,
+		"conversation_id": conv.ID, "message_id": c.Param("message_id"), "message": current})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TableAttachment is a small dataset sent with a chat turn so the user can
+// ask about it. Content is CSV with a header row, or JSON: an array of
+// objects, or an array of arrays whose first row names the columns.
+type TableAttachment struct {
+	Name    string `json:"name"`
+	Format  string `json:"format"` // csv or json; guessed from the content when empty
+	Content string `json:"content"`
+}
+
+// table is an attachment parsed into columns and rows of cells
+type table struct {
+	name    string
+	format  string
+	columns []string
+	rows    [][]string
+}
+
+var (
+	tableMaxBytes     int
+	tableMaxCount     int
+	tableMaxRows      int
+	tableMaxColumns   int
+	tableMaxCellChars int
+
+	tablesAttached *counterVec
+)
+
+// configureTables reads the limits on attached tables: TABLE_MAX_BYTES for
+// the content of each, TABLE_MAX_COUNT per turn, TABLE_MAX_COLUMNS, and
+// TABLE_MAX_ROWS and TABLE_MAX_CELL_CHARS for how much of it is shown to the
+// model. Columns are summarized from every row.
+func configureTables() {
+	tableMaxBytes = envInt("TABLE_MAX_BYTES", 256*1024)
+	tableMaxCount = envInt("TABLE_MAX_COUNT", 5)
+	tableMaxRows = envInt("TABLE_MAX_ROWS", 50)
+	tableMaxColumns = envInt("TABLE_MAX_COLUMNS", 50)
+	tableMaxCellChars = envInt("TABLE_MAX_CELL_CHARS", 100)
+	tablesAttached = newCounterVec("chatbot_table_attachments_total", "Tables attached to chat turns, by format", "format")
+}
+
+// attachRequestTables parses and renders the request's tables for the model,
+// keeping the text on req for the prompt and the stored message. It writes
+// the error and returns false for a table that is malformed, too large or
+// blocked by the input guardrails.
+func attachRequestTables(c *gin.Context, req *ChatRequest) bool {
+	if len(req.Tables) == 0 {
+		return true
+	}
+	if len(req.Tables) > tableMaxCount {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d tables can be attached", tableMaxCount)})
+		return false
+	}
+	parsed := make([]table, 0, len(req.Tables))
+	for i, att := range req.Tables {
+		if att.Name == "" {
+			att.Name = fmt.Sprintf("table%d", i+1)
+		}
+		if tableMaxBytes > 0 && len(att.Content) > tableMaxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Table %s is larger than %d bytes", att.Name, tableMaxBytes)})
+			return false
+		}
+		t, err := parseTable(att)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Table %s: %v", att.Name, err)})
+			return false
+		}
+		parsed = append(parsed, t)
+	}
+	rendered := renderTables(parsed)
+	if v := checkGuardrails("input", rendered); v != nil {
+		log.Printf("Guardrail %s blocked an attached table", v.Rule)
+		c.JSON(http.StatusBadRequest, gin.H{"error": v.Message, "policy": v.Rule})
+		return false
+	}
+	for _, t := range parsed {
+		tablesAttached.inc(t.format)
+	}
+	req.tables = rendered
+	return true
+}
+
+func parseTable(att TableAttachment) (table, error) {
+	format := strings.ToLower(att.Format)
+	if format == "" {
+		format = "csv"
+		if trimmed := strings.TrimSpace(att.Content); strings.HasPrefix(trimmed, "[") {
+			format = "json"
+		}
+	}
+	t := table{name: att.Name, format: format}
+	var err error
+	switch format {
+	case "csv":
+		t.columns, t.rows, err = parseCSVTable(att.Content)
+	case "json":
+		t.columns, t.rows, err = parseJSONTable(att.Content)
+	default:
+		return t, fmt.Errorf("format must be csv or json")
+	}
+	if err != nil {
+		return t, err
+	}
+	if len(t.columns) == 0 {
+		return t, fmt.Errorf("no columns")
+	}
+	if tableMaxColumns > 0 && len(t.columns) > tableMaxColumns {
+		return t, fmt.Errorf("more than %d columns", tableMaxColumns)
+	}
+	return t, nil
+}
+
+func parseCSVTable(content string) ([]string, [][]string, error) {
+	r := csv.NewReader(strings.NewReader(content))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, nil
+	}
+	columns, rows := records[0], records[1:]
+	for i, row := range rows {
+		// Short rows are padded, long ones cut to the header
+		if len(row) != len(columns) {
+			rows[i] = append(row, make([]string, len(columns))...)[:len(columns)]
+		}
+	}
+	return columns, rows, nil
+}
+
+func parseJSONTable(content string) ([]string, [][]string, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(content), &items); err != nil {
+		return nil, nil, fmt.Errorf("content must be a JSON array: %v", err)
+	}
+	if len(items) == 0 {
+		return nil, nil, nil
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(items[0]), []byte("[")) {
+		var header []interface{}
+		json.Unmarshal(items[0], &header)
+		columns := make([]string, len(header))
+		for i, v := range header {
+			columns[i] = jsonCell(v)
+		}
+		rows := make([][]string, 0, len(items)-1)
+		for _, item := range items[1:] {
+			var values []json.RawMessage
+			if err := json.Unmarshal(item, &values); err != nil {
+				return nil, nil, fmt.Errorf("every row must be an array like the header")
+			}
+			row := make([]string, len(columns))
+			for i := range row {
+				if i < len(values) {
+					row[i] = jsonCell(decodeJSONValue(values[i]))
+				}
+			}
+			rows = append(rows, row)
+		}
+		return columns, rows, nil
+	}
+
+	// Objects may have different keys; the columns are all of them, in the
+	// order they first appear
+	var columns []string
+	index := map[string]int{}
+	objects := make([]map[string]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		keys, obj, err := orderedObject(item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("every row must be an object")
+		}
+		for _, k := range keys {
+			if _, ok := index[k]; !ok {
+				index[k] = len(columns)
+				columns = append(columns, k)
+			}
+		}
+		objects = append(objects, obj)
+	}
+	rows := make([][]string, 0, len(objects))
+	for _, obj := range objects {
+		row := make([]string, len(columns))
+		for k, raw := range obj {
+			row[index[k]] = jsonCell(decodeJSONValue(raw))
+		}
+		rows = append(rows, row)
+	}
+	return columns, rows, nil
+}
+
+// decodeJSONValue decodes a value, keeping numbers as they were written
+func decodeJSONValue(raw json.RawMessage) interface{} {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	dec.Decode(&v)
+	return v
+}
+
+// orderedObject decodes a JSON object, returning its keys in document order
+func orderedObject(raw json.RawMessage) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, fmt.Errorf("not an object")
+	}
+	var keys []string
+	obj := map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, nil, err
+		}
+		if _, seen := obj[key]; !seen {
+			keys = append(keys, key)
+		}
+		obj[key] = value
+	}
+	return keys, obj, nil
+}
+
+// jsonCell formats a JSON value as a cell: scalars as they read, nested
+// values as compact JSON and null as empty
+func jsonCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// columnSummary describes one column from all of its values
+type columnSummary struct {
+	kind     string // integer, number, boolean, date or text
+	empty    int
+	distinct int
+	min, max string
+	example  string
+}
+
+const maxDistinctTracked = 1000
+
+func summarizeColumn(t table, col int) columnSummary {
+	s := columnSummary{}
+	kinds := map[string]bool{"integer": true, "number": true, "boolean": true, "date": true}
+	seen := map[string]bool{}
+	var values []string
+	for _, row := range t.rows {
+		v := strings.TrimSpace(row[col])
+		if v == "" {
+			s.empty++
+			continue
+		}
+		values = append(values, v)
+		if len(seen) < maxDistinctTracked {
+			seen[v] = true
+		}
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			kinds["integer"] = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			kinds["number"] = false
+		}
+		if _, err := strconv.ParseBool(v); err != nil || len(v) == 1 {
+			kinds["boolean"] = false
+		}
+		if _, ok := parseTableDate(v); !ok {
+			kinds["date"] = false
+		}
+	}
+	s.distinct = len(seen)
+	s.kind = "text"
+	if len(values) == 0 {
+		s.kind = "empty"
+		return s
+	}
+	for _, k := range []string{"integer", "number", "boolean", "date"} {
+		if kinds[k] {
+			s.kind = k
+			break
+		}
+	}
+	switch s.kind {
+	case "integer", "number":
+		lo, hi := 0.0, 0.0
+		for i, v := range values {
+			f, _ := strconv.ParseFloat(v, 64)
+			if i == 0 || f < lo {
+				lo, s.min = f, v
+			}
+			if i == 0 || f > hi {
+				hi, s.max = f, v
+			}
+		}
+	case "date":
+		var lo, hi time.Time
+		for i, v := range values {
+			d, _ := parseTableDate(v)
+			if i == 0 || d.Before(lo) {
+				lo, s.min = d, v
+			}
+			if i == 0 || d.After(hi) {
+				hi, s.max = d, v
+			}
+		}
+	case "text":
+		s.example = values[0]
+	}
+	return s
+}
+
+func parseTableDate(v string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if d, err := time.Parse(layout, v); err == nil {
+			return d, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (s columnSummary) String() string {
+	parts := []string{s.kind}
+	switch {
+	case s.min != "" && s.kind == "date":
+		parts = append(parts, "from "+s.min+" to "+s.max)
+	case s.min != "":
+		parts = append(parts, "min "+s.min, "max "+s.max)
+	case s.kind == "text" || s.kind == "boolean":
+		distinct := strconv.Itoa(s.distinct)
+		if s.distinct >= maxDistinctTracked {
+			distinct = "over " + distinct
+		}
+		parts = append(parts, distinct+" distinct")
+	}
+	if s.example != "" {
+		parts = append(parts, "e.g. "+strconv.Quote(clipCell(s.example)))
+	}
+	if s.empty > 0 {
+		parts = append(parts, fmt.Sprintf("%d empty", s.empty))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// renderTables formats the tables for the model: a schema summary of each,
+// then its first rows as a Markdown table
+func renderTables(tables []table) string {
+	var b strings.Builder
+	b.WriteString("The user attached the following data. Answer questions about it from the summaries and rows below, and say when the rows shown are not enough to answer.\n")
+	for _, t := range tables {
+		fmt.Fprintf(&b, "\nTable %q (%s): rows: %d, columns: %d\n", t.name, t.format, len(t.rows), len(t.columns))
+		b.WriteString("Columns:\n")
+		for i, name := range t.columns {
+			fmt.Fprintf(&b, "- %s: %s\n", clipCell(name), summarizeColumn(t, i))
+		}
+		shown := t.rows
+		if tableMaxRows >= 0 && len(shown) > tableMaxRows {
+			shown = shown[:tableMaxRows]
+		}
+		if len(shown) == 0 {
+			continue
+		}
+		if len(shown) < len(t.rows) {
+			fmt.Fprintf(&b, "First %d of %d rows:\n", len(shown), len(t.rows))
+		} else {
+			b.WriteString("Rows:\n")
+		}
+		writeMarkdownRow(&b, t.columns)
+		b.WriteString("|" + strings.Repeat(" --- |", len(t.columns)) + "\n")
+		for _, row := range shown {
+			writeMarkdownRow(&b, row)
+		}
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+func writeMarkdownRow(b *strings.Builder, cells []string) {
+	b.WriteString("|")
+	for _, cell := range cells {
+		cell = strings.ReplaceAll(clipCell(cell), "|", `\|`)
+		b.WriteString(" " + cell + " |")
+	}
+	b.WriteString("\n")
+}
+
+// clipCell puts a value on one line of at most TABLE_MAX_CELL_CHARS
+func clipCell(v string) string {
+	v = strings.Join(strings.Fields(v), " ")
+	if tableMaxCellChars > 0 && len(v) > tableMaxCellChars {
+		v = v[:utf8Boundary(v, tableMaxCellChars)] + "…"
+	}
+	return v
+}
+
+// attachTables adds rendered tables to the last message, the user's prompt
+func attachTables(messages []ChatMessage, tables string) []ChatMessage {
+	if tables == "" || len(messages) == 0 {
+		return messages
+	}
+	last := &messages[len(messages)-1]
+	last.Content += "\n\n" + tables
+	return messages
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Telemetry event types the browser reports
+const (
+	telemetryWebVital    = "web_vital"
+	telemetryRenderError = "render_error"
+	telemetryTTFT        = "ttft"
+)
+
+// TelemetryEvent is one measurement from the React app. Times are in
+// milliseconds; CLS is unitless.
+type TelemetryEvent struct {
+	Type string `json:"type"`
+	// Name is the web vital: LCP, FCP, INP, TTFB, FID or CLS
+	Name  string  `json:"name,omitempty"`
+	Value float64 `json:"value"`
+	// Streaming tells a streamed answer's first token from a whole response
+	Streaming bool `json:"streaming,omitempty"`
+	// UpstreamMs is the X-Upstream-Latency-Ms of the answer, so the time the
+	// browser waited beyond the model's own latency can be measured
+	UpstreamMs *float64 `json:"upstream_ms,omitempty"`
+	RequestID  string   `json:"request_id,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	Component  string   `json:"component,omitempty"`
+}
+
+type TelemetryBatch struct {
+	Events []TelemetryEvent `json:"events" binding:"required"`
+}
+
+// webVitalBuckets in seconds, around the good and poor thresholds
+var webVitalBuckets = []float64{0.1, 0.2, 0.5, 0.8, 1, 1.8, 2.5, 3, 4, 6, 10}
+
+var clsBuckets = []float64{0.01, 0.05, 0.1, 0.15, 0.25, 0.5, 1}
+
+// knownWebVitals bounds the name label; other names are rejected
+var knownWebVitals = map[string]bool{"LCP": true, "FCP": true, "INP": true, "TTFB": true, "FID": true}
+
+var (
+	telemetryEnabled   bool
+	telemetryMaxEvents int
+	telemetryMaxBody   int64
+
+	clientWebVitals    *histogramVec
+	clientCLS          *histogramVec
+	clientTTFT         *histogramVec
+	clientOverhead     *histogramVec
+	clientRenderErrors *counterVec
+	telemetryRejected  *counterVec
+)
+
+// configureTelemetry sets up the browser metrics. Time to first token uses
+// the server's request latency buckets so the two can be compared directly.
+func configureTelemetry() {
+	telemetryEnabled = envBool("TELEMETRY_ENABLED", true)
+	telemetryMaxEvents = envInt("TELEMETRY_MAX_EVENTS", 100)
+	telemetryMaxBody = envSize("TELEMETRY_MAX_BODY", 64<<10)
+	clientWebVitals = newHistogramVec("chatbot_client_web_vitals_seconds", "Web Vitals timings reported by browsers", webVitalBuckets, "name")
+	clientCLS = newHistogramVec("chatbot_client_cumulative_layout_shift", "Cumulative layout shift reported by browsers", clsBuckets)
+	clientTTFT = newHistogramVec("chatbot_client_time_to_first_token_seconds", "Time from sending a chat message to its first token, as seen by the browser", httpLatencyBuckets, "mode")
+	clientOverhead = newHistogramVec("chatbot_client_overhead_seconds", "Browser time to first token beyond the upstream latency of the answer", httpLatencyBuckets, "mode")
+	clientRenderErrors = newCounterVec("chatbot_client_render_errors_total", "Render errors reported by browsers")
+	telemetryRejected = newCounterVec("chatbot_telemetry_events_rejected_total", "Telemetry events rejected as invalid", "type")
+}
+
+func (e TelemetryEvent) validate() error {
+	if e.Value < 0 {
+		return fmt.Errorf("value must not be negative")
+	}
+	switch e.Type {
+	case telemetryWebVital:
+		if e.Name != "CLS" && !knownWebVitals[e.Name] {
+			return fmt.Errorf("unknown web vital %q", e.Name)
+		}
+	case telemetryTTFT:
+		if e.UpstreamMs != nil && *e.UpstreamMs < 0 {
+			return fmt.Errorf("upstream_ms must not be negative")
+		}
+	case telemetryRenderError:
+	default:
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+	return nil
+}
+
+// record adds a valid event to the metrics. Render errors are also logged,
+// shortened, with the component and request they happened in.
+func (e TelemetryEvent) record(user string) {
+	switch e.Type {
+	case telemetryWebVital:
+		if e.Name == "CLS" {
+			clientCLS.observe(e.Value)
+		} else {
+			clientWebVitals.observe(e.Value/1000, e.Name)
+		}
+	case telemetryTTFT:
+		mode := "chat"
+		if e.Streaming {
+			mode = "stream"
+		}
+		clientTTFT.observe(e.Value/1000, mode)
+		if e.UpstreamMs != nil {
+			clientOverhead.observe(max(e.Value-*e.UpstreamMs, 0)/1000, mode)
+		}
+	case telemetryRenderError:
+		clientRenderErrors.inc()
+		log.Printf("Client render error for %s in %s (request %s): %.500s", user, e.Component, e.RequestID, e.Message)
+	}
+}
+
+// handleTelemetry accepts a batch of browser measurements. Invalid events are
+// skipped and counted, so one bad event does not lose the rest of the batch.
+func handleTelemetry(c *gin.Context) {
+	if !telemetryEnabled {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, telemetryMaxBody)
+	var batch TelemetryBatch
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if telemetryMaxEvents > 0 && len(batch.Events) > telemetryMaxEvents {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("At most %d events per request", telemetryMaxEvents)})
+		return
+	}
+	user := requestUser(c)
+	accepted := 0
+	var rejected []string
+	for i, e := range batch.Events {
+		if err := e.validate(); err != nil {
+			label := e.Type
+			if label != telemetryWebVital && label != telemetryTTFT && label != telemetryRenderError {
+				label = "unknown"
+			}
+			telemetryRejected.inc(label)
+			rejected = append(rejected, fmt.Sprintf("event %d: %v", i, err))
+			continue
+		}
+		e.record(user)
+		accepted++
+	}
+	resp := gin.H{"accepted": accepted}
+	if len(rejected) > 0 {
+		resp["rejected"] = rejected
+	}
+	c.JSON(http.StatusAccepted, resp)
+}
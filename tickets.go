@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ticketToolSource is the source of the built-in ticket tools
+const ticketToolSource = "builtin:tickets"
+
+// TicketInfo is what the ticket tools tell the model about a ticket
+type TicketInfo struct {
+	System   string `json:"system"`
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	Summary  string `json:"summary,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Priority string `json:"priority,omitempty"`
+	Assignee string `json:"assignee,omitempty"`
+}
+
+// ticketRequest is the arguments of create_ticket; the fields are mapped onto
+// the system's own with its field map
+type ticketRequest struct {
+	System      string `json:"system"`
+	Summary     string `json:"summary"`
+	Description string `json:"description"`
+	Priority    string `json:"priority"`
+	Category    string `json:"category"`
+}
+
+// ticketSystem is a ticketing service tickets can be filed in and looked up
+type ticketSystem interface {
+	backend() *ticketBackend
+	create(fields map[string]interface{}) (TicketInfo, error)
+	get(key string) (TicketInfo, error)
+}
+
+// ticketBackend holds what both systems need: where they are, how to sign
+// in and how the canonical fields map to theirs
+type ticketBackend struct {
+	name       string
+	label      string
+	baseURL    string
+	user       string
+	password   string
+	fieldMap   map[string]string
+	priorities map[string]string
+}
+
+var (
+	ticketSystems = map[string]ticketSystem{}
+	ticketClient  *http.Client
+
+	// ticketKeyPattern keeps keys from smuggling clauses into lookups
+	ticketKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+var ticketPriorities = []string{"low", "medium", "high", "critical"}
+
+// configureTickets reads the Jira and ServiceNow settings and registers the
+// create_ticket and get_ticket tools when at least one is complete
+func configureTickets() {
+	ticketSystems = map[string]ticketSystem{}
+	ticketClient = &http.Client{Timeout: envDuration("TICKET_TIMEOUT", 15*time.Second)}
+
+	if base := envString("JIRA_URL", ""); base != "" {
+		b := &ticketBackend{
+			name:     "jira",
+			label:    "Jira",
+			baseURL:  strings.TrimRight(base, "/"),
+			user:     envString("JIRA_EMAIL", ""),
+			password: envString("JIRA_API_TOKEN", ""),
+			fieldMap: ticketMapSetting("JIRA_FIELD_MAP", map[string]string{
+				"summary": "summary", "description": "description", "priority": "priority.name",
+			}),
+			priorities: ticketMapSetting("JIRA_PRIORITY_MAP", map[string]string{
+				"low": "Low", "medium": "Medium", "high": "High", "critical": "Highest",
+			}),
+		}
+		project := envString("JIRA_PROJECT", "")
+		if b.user == "" || b.password == "" || project == "" {
+			configWarn("JIRA_URL is set but JIRA_EMAIL, JIRA_API_TOKEN or JIRA_PROJECT is missing; the Jira ticket tools are disabled")
+		} else {
+			ticketSystems[b.name] = &jiraTickets{ticketBackend: b, project: project, issueType: envString("JIRA_ISSUE_TYPE", "Task")}
+		}
+	}
+
+	if base := envString("SERVICENOW_URL", ""); base != "" {
+		b := &ticketBackend{
+			name:     "servicenow",
+			label:    "ServiceNow",
+			baseURL:  strings.TrimRight(base, "/"),
+			user:     envString("SERVICENOW_USER", ""),
+			password: envString("SERVICENOW_PASSWORD", ""),
+			fieldMap: ticketMapSetting("SERVICENOW_FIELD_MAP", map[string]string{
+				"summary": "short_description", "description": "description", "priority": "urgency", "category": "category",
+			}),
+			priorities: ticketMapSetting("SERVICENOW_PRIORITY_MAP", map[string]string{
+				"low": "3", "medium": "2", "high": "1", "critical": "1",
+			}),
+		}
+		if b.user == "" || b.password == "" {
+			configWarn("SERVICENOW_URL is set but SERVICENOW_USER or SERVICENOW_PASSWORD is missing; the ServiceNow ticket tools are disabled")
+		} else {
+			ticketSystems[b.name] = &serviceNowTickets{ticketBackend: b, table: envString("SERVICENOW_TABLE", "incident")}
+		}
+	}
+
+	unregisterTools(ticketToolSource)
+	if len(ticketSystems) > 0 {
+		registerTicketTools()
+	}
+}
+
+// ticketMapSetting reads a JSON object of strings laid over defaults; an
+// empty value removes an entry
+func ticketMapSetting(key string, defaults map[string]string) map[string]string {
+	out := map[string]string{}
+	for k, v := range defaults {
+		out[k] = v
+	}
+	raw := lookupEnv(key, "")
+	if raw == "" {
+		return out
+	}
+	var override map[string]string
+	if err := json.Unmarshal([]byte(raw), &override); err != nil {
+		configWarn("invalid %s: %v", key, err)
+		return out
+	}
+	for k, v := range override {
+		if v == "" {
+			delete(out, k)
+		} else {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func ticketSystemNames() []string {
+	names := make([]string, 0, len(ticketSystems))
+	for name := range ticketSystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func registerTicketTools() {
+	names := ticketSystemNames()
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = ticketSystems[name].backend().label
+	}
+	systemParam := map[string]interface{}{"type": "string", "enum": names, "description": "Ticketing system to use"}
+	withSystem := func(properties map[string]interface{}, required ...string) json.RawMessage {
+		if len(names) > 1 {
+			properties["system"] = systemParam
+			required = append(required, "system")
+		}
+		raw, _ := json.Marshal(map[string]interface{}{"type": "object", "properties": properties, "required": required})
+		return raw
+	}
+
+	registerTool(Tool{
+		Name: "create_ticket",
+		Description: fmt.Sprintf("File a support ticket in %s when the user's problem cannot be solved in the chat or they ask for one. "+
+			"The user is asked to confirm before it is filed. Write a short summary and a description with the steps already tried.", strings.Join(labels, " or ")),
+		Parameters: withSystem(map[string]interface{}{
+			"summary":     map[string]interface{}{"type": "string", "description": "One-line title of the problem"},
+			"description": map[string]interface{}{"type": "string", "description": "What happened, what the user expected and what was tried"},
+			"priority":    map[string]interface{}{"type": "string", "enum": ticketPriorities},
+			"category":    map[string]interface{}{"type": "string", "description": "Area of the problem, such as access, hardware or billing"},
+		}, "summary", "description"),
+		Source:  ticketToolSource,
+		Confirm: true,
+		call: func(arguments json.RawMessage) (string, error) {
+			return createTicket("", arguments)
+		},
+		callAs:   createTicket,
+		describe: describeTicket,
+	})
+	registerTool(Tool{
+		Name:        "get_ticket",
+		Description: fmt.Sprintf("Look up a %s ticket by its key or number, such as SUP-123 or INC0010001, to report its status to the user.", strings.Join(labels, " or ")),
+		Parameters: withSystem(map[string]interface{}{
+			"key": map[string]interface{}{"type": "string", "description": "Ticket key or number"},
+		}, "key"),
+		Source: ticketToolSource,
+		call:   getTicket,
+	})
+}
+
+// ticketSystemFor picks the system named in a call, which may be left out
+// when only one is configured
+func ticketSystemFor(name string) (ticketSystem, error) {
+	if name == "" && len(ticketSystems) == 1 {
+		name = ticketSystemNames()[0]
+	}
+	s, ok := ticketSystems[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown ticketing system %q; use one of %s", name, strings.Join(ticketSystemNames(), ", "))
+	}
+	return s, nil
+}
+
+func parseTicketRequest(arguments json.RawMessage) (ticketRequest, error) {
+	var req ticketRequest
+	if err := json.Unmarshal(arguments, &req); err != nil {
+		return req, fmt.Errorf("invalid arguments: %v", err)
+	}
+	req.Summary, req.Priority = strings.TrimSpace(req.Summary), strings.ToLower(strings.TrimSpace(req.Priority))
+	if req.Summary == "" {
+		return req, errors.New("summary is required")
+	}
+	if req.Priority != "" && !slices.Contains(ticketPriorities, req.Priority) {
+		return req, fmt.Errorf("priority must be one of %s", strings.Join(ticketPriorities, ", "))
+	}
+	return req, nil
+}
+
+// describeTicket checks a create_ticket call before it is held, so the model
+// can fix a bad one while the user is still in the chat
+func describeTicket(arguments json.RawMessage) (string, error) {
+	req, err := parseTicketRequest(arguments)
+	if err != nil {
+		return "", err
+	}
+	system, err := ticketSystemFor(req.System)
+	if err != nil {
+		return "", err
+	}
+	label := system.backend().label
+	if req.Priority != "" {
+		return fmt.Sprintf("create a %s ticket %q with %s priority", label, req.Summary, req.Priority), nil
+	}
+	return fmt.Sprintf("create a %s ticket %q", label, req.Summary), nil
+}
+
+// createTicket files the ticket a confirmed call describes, noting who
+// reported it in the description
+func createTicket(user string, arguments json.RawMessage) (string, error) {
+	req, err := parseTicketRequest(arguments)
+	if err != nil {
+		return "", err
+	}
+	system, err := ticketSystemFor(req.System)
+	if err != nil {
+		return "", err
+	}
+	cfg := system.backend()
+	if user != "" {
+		req.Description = strings.TrimSpace(req.Description + "\n\nReported by " + user + " through the chatbot.")
+	}
+	values := map[string]string{"summary": req.Summary, "description": req.Description, "category": req.Category}
+	if req.Priority != "" {
+		values["priority"] = cfg.priorities[req.Priority]
+	}
+	info, err := system.create(mapTicketFields(cfg.fieldMap, values))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Created %s ticket %s: %s", cfg.label, info.Key, info.URL), nil
+}
+
+func getTicket(arguments json.RawMessage) (string, error) {
+	var args struct {
+		System string `json:"system"`
+		Key    string `json:"key"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	if !ticketKeyPattern.MatchString(strings.TrimSpace(args.Key)) {
+		return "", errors.New("key must be a ticket key or number")
+	}
+	system, err := ticketSystemFor(args.System)
+	if err != nil {
+		return "", err
+	}
+	info, err := system.get(strings.TrimSpace(args.Key))
+	if err != nil {
+		return "", err
+	}
+	out, _ := json.Marshal(info)
+	return string(out), nil
+}
+
+// mapTicketFields places each canonical value at the dotted path its field
+// map names; a path ending in [] takes the value as a one-element list
+func mapTicketFields(fieldMap map[string]string, values map[string]string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for field, value := range values {
+		path := fieldMap[field]
+		if path == "" || value == "" {
+			continue
+		}
+		var v interface{} = value
+		if strings.HasSuffix(path, "[]") {
+			path, v = strings.TrimSuffix(path, "[]"), []string{value}
+		}
+		parts := strings.Split(path, ".")
+		node := out
+		for _, part := range parts[:len(parts)-1] {
+			next, ok := node[part].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				node[part] = next
+			}
+			node = next
+		}
+		node[parts[len(parts)-1]] = v
+	}
+	return out
+}
+
+func (b *ticketBackend) backend() *ticketBackend { return b }
+
+// do sends a request to the system and decodes its JSON answer into out
+func (b *ticketBackend) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, b.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(b.user, b.password)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := ticketClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s is unreachable: %v", b.label, err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode == http.StatusNotFound && method == http.MethodGet {
+		return errTicketNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %d: %s", b.label, resp.StatusCode, readErrorBody(resp.Body))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(out)
+}
+
+var errTicketNotFound = errors.New("no ticket with that key")
+
+// jiraTickets files Jira issues through the REST API v2, which takes plain
+// text descriptions
+type jiraTickets struct {
+	*ticketBackend
+	project   string
+	issueType string
+}
+
+func (j *jiraTickets) create(fields map[string]interface{}) (TicketInfo, error) {
+	fields["project"] = map[string]interface{}{"key": j.project}
+	fields["issuetype"] = map[string]interface{}{"name": j.issueType}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := j.do(http.MethodPost, "/rest/api/2/issue", map[string]interface{}{"fields": fields}, &created); err != nil {
+		return TicketInfo{}, err
+	}
+	return TicketInfo{System: j.name, Key: created.Key, URL: j.baseURL + "/browse/" + created.Key}, nil
+}
+
+func (j *jiraTickets) get(key string) (TicketInfo, error) {
+	var issue struct {
+		Key    string `json:"key"`
+		Fields struct {
+			Summary string `json:"summary"`
+			Status  struct {
+				Name string `json:"name"`
+			} `json:"status"`
+			Priority *struct {
+				Name string `json:"name"`
+			} `json:"priority"`
+			Assignee *struct {
+				DisplayName string `json:"displayName"`
+			} `json:"assignee"`
+		} `json:"fields"`
+	}
+	path := "/rest/api/2/issue/" + url.PathEscape(key) + "?fields=summary,status,priority,assignee"
+	if err := j.do(http.MethodGet, path, nil, &issue); err != nil {
+		return TicketInfo{}, err
+	}
+	info := TicketInfo{System: j.name, Key: issue.Key, URL: j.baseURL + "/browse/" + issue.Key, Summary: issue.Fields.Summary, Status: issue.Fields.Status.Name}
+	if issue.Fields.Priority != nil {
+		info.Priority = issue.Fields.Priority.Name
+	}
+	if issue.Fields.Assignee != nil {
+		info.Assignee = issue.Fields.Assignee.DisplayName
+	}
+	return info, nil
+}
+
+// serviceNowTickets files records in a ServiceNow table through the Table API
+type serviceNowTickets struct {
+	*ticketBackend
+	table string
+}
+
+func (s *serviceNowTickets) recordURL(sysID string) string {
+	return s.baseURL + "/nav_to.do?uri=" + url.QueryEscape(s.table+".do?sys_id="+sysID)
+}
+
+func (s *serviceNowTickets) create(fields map[string]interface{}) (TicketInfo, error) {
+	var created struct {
+		Result struct {
+			Number string `json:"number"`
+			SysID  string `json:"sys_id"`
+		} `json:"result"`
+	}
+	if err := s.do(http.MethodPost, "/api/now/table/"+url.PathEscape(s.table), fields, &created); err != nil {
+		return TicketInfo{}, err
+	}
+	return TicketInfo{System: s.name, Key: created.Result.Number, URL: s.recordURL(created.Result.SysID)}, nil
+}
+
+func (s *serviceNowTickets) get(key string) (TicketInfo, error) {
+	query := url.Values{
+		"sysparm_query":                  {"number=" + key},
+		"sysparm_limit":                  {"1"},
+		"sysparm_display_value":          {"true"},
+		"sysparm_exclude_reference_link": {"true"},
+	}
+	var found struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	if err := s.do(http.MethodGet, "/api/now/table/"+url.PathEscape(s.table)+"?"+query.Encode(), nil, &found); err != nil {
+		return TicketInfo{}, err
+	}
+	if len(found.Result) == 0 {
+		return TicketInfo{}, errTicketNotFound
+	}
+	record := found.Result[0]
+	field := func(name string) string {
+		v, _ := record[name].(string)
+		return v
+	}
+	return TicketInfo{
+		System:   s.name,
+		Key:      field("number"),
+		URL:      s.recordURL(field("sys_id")),
+		Summary:  field(s.fieldMap["summary"]),
+		Status:   field("state"),
+		Priority: field(s.fieldMap["priority"]),
+		Assignee: field("assigned_to"),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rough per-message cost of the chat template's role markers
+const messageOverheadTokens = 4
+
+var promptTokenBuckets = []float64{16, 64, 256, 1024, 4096, 16384, 65536, 131072}
+
+var promptTokens *histogramVec
+
+func configureTokenBudget() {
+	promptTokens = newHistogramVec("chatbot_prompt_tokens", "Prompt tokens per chat request by part of the prompt", promptTokenBuckets, "part")
+}
+
+// TokenBudget attributes a request's prompt tokens to the parts of the
+// prompt, to show what is filling the context window
+type TokenBudget struct {
+	System  int `json:"system"`
+	Context int `json:"context"`
+	History int `json:"history"`
+	User    int `json:"user"`
+	Tools   int `json:"tools"`
+	Total   int `json:"total"`
+	// Estimated is false once the parts were scaled to the prompt tokens the
+	// endpoint reported
+	Estimated bool `json:"estimated"`
+}
+
+// estimateTokens approximates a tokenizer at four characters per token
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// promptBudget estimates the budget of a payload as assembled by
+// buildConversationMessages: system prompt and retrieved context first,
+// then history, then the new user message
+func promptBudget(payload *ChatPayload) TokenBudget {
+	b := TokenBudget{Estimated: true}
+	for i, m := range payload.Messages {
+		n := estimateTokens(m.Content) + messageOverheadTokens
+		switch {
+		case i == len(payload.Messages)-1 && m.Role == "user":
+			b.User += n
+		case m.Role == "system" && strings.HasPrefix(m.Content, groundingPreamble):
+			b.Context += n
+		case m.Role == "system" && i == 0:
+			b.System += n
+		default:
+			b.History += n
+		}
+	}
+	if len(payload.Tools) > 0 {
+		defs, _ := json.Marshal(payload.Tools)
+		b.Tools = estimateTokens(string(defs))
+	}
+	b.Total = b.System + b.Context + b.History + b.User + b.Tools
+	return b
+}
+
+// calibrate scales the estimates so they add up to the prompt tokens the
+// endpoint reported for this payload
+func (b *TokenBudget) calibrate(reported int) {
+	if reported <= 0 || b.Total == 0 {
+		return
+	}
+	scale := float64(reported) / float64(b.Total)
+	parts := []*int{&b.System, &b.Context, &b.History, &b.User, &b.Tools}
+	sum := 0
+	largest := parts[0]
+	for _, p := range parts {
+		*p = int(float64(*p)*scale + 0.5)
+		sum += *p
+		if *p > *largest {
+			largest = p
+		}
+	}
+	// Rounding error goes to the largest part
+	*largest += reported - sum
+	b.Total, b.Estimated = reported, false
+}
+
+func (b TokenBudget) observe() {
+	promptTokens.observe(float64(b.System), "system")
+	promptTokens.observe(float64(b.Context), "context")
+	promptTokens.observe(float64(b.History), "history")
+	promptTokens.observe(float64(b.User), "user")
+	promptTokens.observe(float64(b.Tools), "tools")
+}
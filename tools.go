@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tool is a function the model may call during a chat
+type Tool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Source      string          `json:"source"` // where the tool was registered from, e.g. plugin:<name>
+	// Confirm holds calls until the user confirms them, for tools with
+	// side effects outside the app
+	Confirm bool `json:"confirm,omitempty"`
+
+	call func(arguments json.RawMessage) (string, error)
+	// callAs, when set, is used instead of call for confirmed calls, for
+	// tools that act on behalf of the user who confirmed
+	callAs func(user string, arguments json.RawMessage) (string, error)
+	// callIn, when set, is used instead of call for tools that act within
+	// the chat they were called from
+	callIn func(session *toolSession, arguments json.RawMessage) (string, error)
+	// describe checks a call and summarizes it for the user to confirm, as a
+	// phrase such as "create a Jira ticket ..."; the arguments are shown when
+	// it is nil
+	describe func(arguments json.RawMessage) (string, error)
+}
+
+// toolSession is the chat a round of tool calls belongs to; calls that need
+// confirmation are collected in pending
+type toolSession struct {
+	user           string
+	conversationID string
+	pending        []PendingAction
+}
+
+// ToolCall is a tool invocation requested by the model
+type ToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// toolCallDelta is a fragment of a tool call in a streamed completion; the
+// fragments of one call share its index and their arguments are joined
+type toolCallDelta struct {
+	Index int `json:"index"`
+	ToolCall
+}
+
+// maxToolRounds bounds how many times one chat may go back to the model with
+// tool results
+const maxToolRounds = 5
+
+var (
+	toolsMu sync.RWMutex
+	tools   = map[string]Tool{}
+)
+
+// registerTool makes a tool available to chats; a later registration with the
+// same name replaces the earlier one
+func registerTool(t Tool) {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	if prev, ok := tools[t.Name]; ok {
+		log.Printf("Warning: tool %s from %s replaces the one from %s", t.Name, t.Source, prev.Source)
+	}
+	tools[t.Name] = t
+}
+
+// unregisterTools removes every tool registered from source
+func unregisterTools(source string) {
+	toolsMu.Lock()
+	defer toolsMu.Unlock()
+	for name, t := range tools {
+		if t.Source == source {
+			delete(tools, name)
+		}
+	}
+}
+
+func listTools() []Tool {
+	toolsMu.RLock()
+	defer toolsMu.RUnlock()
+	out := make([]Tool, 0, len(tools))
+	for _, t := range tools {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// toolDefinitions returns the tools in the chat completions "tools" format
+func toolDefinitions() []map[string]interface{} {
+	if !featureEnabled("tools") {
+		return nil
+	}
+	var defs []map[string]interface{}
+	for _, t := range listTools() {
+		fn := map[string]interface{}{"name": t.Name, "description": t.Description}
+		if len(t.Parameters) > 0 {
+			fn["parameters"] = t.Parameters
+		} else {
+			fn["parameters"] = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+		}
+		defs = append(defs, map[string]interface{}{"type": "function", "function": fn})
+	}
+	return defs
+}
+
+// callTool runs a tool; failures are reported back to the model as the
+// tool's output rather than failing the chat. Tools that need confirmation
+// are not run: the call is held for the user and the model is told so.
+func callTool(session *toolSession, name, arguments string) string {
+	toolsMu.RLock()
+	t, ok := tools[name]
+	toolsMu.RUnlock()
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %s", name)
+	}
+
+	if arguments == "" {
+		arguments = "{}"
+	}
+	if t.Confirm {
+		action, err := holdToolCall(session, t, json.RawMessage(arguments))
+		if err != nil {
+			return fmt.Sprintf("error: %v", err)
+		}
+		return fmt.Sprintf("Not done yet: this needs the user's confirmation, which they have been asked for as action %s (%s). "+
+			"Tell the user what will happen and that it only happens once they confirm; do not say it is done.", action.ID, action.Summary)
+	}
+	start := time.Now()
+	var out string
+	var err error
+	if t.callIn != nil && session != nil {
+		out, err = t.callIn(session, json.RawMessage(arguments))
+	} else {
+		out, err = t.call(json.RawMessage(arguments))
+	}
+	log.Printf("Tool %s finished in %v", name, time.Since(start))
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return out
+}
+
+// resolveToolCalls answers the tool calls in resp and asks the model again,
+// until it produces an answer without tool calls. The usage of every round is
+// added to the returned response.
+func resolveToolCalls(endpoint string, payload *ChatPayload, resp *LLMResponse, session *toolSession) (*LLMResponse, error) {
+	messages := append([]ChatMessage(nil), payload.Messages...)
+
+	for round := 0; len(resp.Choices) > 0 && len(resp.Choices[0].Message.ToolCalls) > 0; round++ {
+		if round == maxToolRounds {
+			return nil, fmt.Errorf("model still calling tools after %d rounds", maxToolRounds)
+		}
+		messages = answerToolCalls(session, messages, resp.Choices[0].Message.Content, resp.Choices[0].Message.ToolCalls)
+		payload.Messages = messages
+
+		var next LLMResponse
+		if err := invokeEndpoint(endpoint, payload, &next); err != nil {
+			return nil, err
+		}
+		next.Usage.PromptTokens += resp.Usage.PromptTokens
+		next.Usage.CompletionTokens += resp.Usage.CompletionTokens
+		next.Usage.TotalTokens += resp.Usage.TotalTokens
+		resp = &next
+	}
+	return resp, nil
+}
+
+// answerToolCalls appends the model's message calling tools, and the output
+// of each call, to messages
+func answerToolCalls(session *toolSession, messages []ChatMessage, content string, calls []ToolCall) []ChatMessage {
+	messages = append(messages, ChatMessage{Role: "assistant", Content: content, ToolCalls: calls})
+	for _, call := range calls {
+		messages = append(messages, ChatMessage{Role: "tool", ToolCallID: call.ID, Content: callTool(session, call.Function.Name, call.Function.Arguments)})
+	}
+	return messages
+}
+
+// mergeToolCallDeltas adds the tool call fragments of one streamed chunk to
+// the calls assembled so far
+func mergeToolCallDeltas(calls []ToolCall, deltas []toolCallDelta) []ToolCall {
+	for _, d := range deltas {
+		if d.Index < 0 || d.Index >= 64 {
+			continue
+		}
+		for len(calls) <= d.Index {
+			calls = append(calls, ToolCall{Type: "function"})
+		}
+		call := &calls[d.Index]
+		if d.ID != "" {
+			call.ID = d.ID
+		}
+		if d.Function.Name != "" {
+			call.Function.Name = d.Function.Name
+		}
+		call.Function.Arguments += d.Function.Arguments
+	}
+	return calls
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// TranscriptEvent is a completed conversation turn, posted to
+// TRANSCRIPT_WEBHOOK_URL for downstream systems such as a CRM or ticketing
+type TranscriptEvent struct {
+	Type           string    `json:"type"`
+	ConversationID string    `json:"conversation_id"`
+	User           string    `json:"user"`
+	Persona        string    `json:"persona"`
+	Tags           []string  `json:"tags,omitempty"`
+	Endpoint       string    `json:"endpoint"`
+	Prompt         Message   `json:"prompt"`
+	Answer         Message   `json:"answer"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+var (
+	transcriptWebhookURL string
+	transcriptTags       map[string]bool
+	transcriptPersonas   map[string]bool
+)
+
+// configureTranscripts reads TRANSCRIPT_WEBHOOK_URL and the filters on which
+// turns are sent: TRANSCRIPT_WEBHOOK_TAGS and TRANSCRIPT_WEBHOOK_PERSONAS,
+// either of which sends every turn when unset
+func configureTranscripts() {
+	transcriptWebhookURL = envString("TRANSCRIPT_WEBHOOK_URL", "")
+	transcriptTags = envSet("TRANSCRIPT_WEBHOOK_TAGS")
+	transcriptPersonas = envSet("TRANSCRIPT_WEBHOOK_PERSONAS")
+}
+
+// wantsTranscript reports whether a turn passes both filters
+func wantsTranscript(persona string, tags []string) bool {
+	if transcriptPersonas != nil && !transcriptPersonas[strings.ToLower(persona)] {
+		return false
+	}
+	if transcriptTags == nil {
+		return true
+	}
+	for _, tag := range tags {
+		if transcriptTags[strings.ToLower(tag)] {
+			return true
+		}
+	}
+	return false
+}
+
+// publishTranscript posts the turn when a transcript webhook is configured.
+// Delivery is signed and, when it fails, kept for the admin retry like every
+// other callback.
+func publishTranscript(conv Conversation, req ChatRequest, endpoint string, prompt, answer Message) {
+	if transcriptWebhookURL == "" {
+		return
+	}
+	// The default persona is matched and reported as "default"
+	persona := req.Persona
+	if persona == "" {
+		persona = "default"
+	}
+	if !wantsTranscript(persona, req.Tags) {
+		return
+	}
+	go postJSON(transcriptWebhookURL, TranscriptEvent{
+		Type:           "conversation.turn",
+		ConversationID: conv.ID,
+		User:           conv.User,
+		Persona:        persona,
+		Tags:           req.Tags,
+		Endpoint:       endpoint,
+		Prompt:         prompt,
+		Answer:         answer,
+		Timestamp:      answer.CreatedAt,
+	})
+}
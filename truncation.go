@@ -0,0 +1,43 @@
+package main
+
+import "strings"
+
+var (
+	maxResponseChars  int
+	maxResponseTokens int
+)
+
+func configureTruncation() {
+	maxResponseChars = envInt("MAX_RESPONSE_CHARS", 50000)
+	maxResponseTokens = envInt("MAX_RESPONSE_TOKENS", 0)
+}
+
+// truncateResponse cuts content to MAX_RESPONSE_CHARS at the last paragraph,
+// sentence or word boundary, closing an open code fence
+func truncateResponse(content string) (string, bool) {
+	return truncateResponseAfter(content, 0)
+}
+
+// truncateResponseAfter is truncateResponse for an answer whose first keep
+// bytes were already streamed; the cut never goes below them
+func truncateResponseAfter(content string, keep int) (string, bool) {
+	if maxResponseChars <= 0 || len(content) <= maxResponseChars {
+		return content, false
+	}
+
+	cut := max(utf8Boundary(content, maxResponseChars), keep)
+	head := content[:cut]
+	for _, sep := range []string{"\n\n", ". ", "\n", " "} {
+		if i := strings.LastIndex(head, sep); i > cut/2 && i+len(sep) >= keep {
+			head = head[:i+len(sep)]
+			break
+		}
+	}
+	if trimmed := strings.TrimRight(head, " "); len(trimmed) >= keep {
+		head = trimmed
+	}
+	if strings.Count(head, "```")%2 == 1 {
+		head += "\n```"
+	}
+	return head, true
+}
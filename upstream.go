@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var upstreamClient = &http.Client{Timeout: 2 * time.Minute}
+
+const (
+	// maxErrorBody bounds how much of an error response is kept for logs
+	maxErrorBody = 4096
+	// maxResponseBody caps a decoded endpoint response, so a misbehaving
+	// endpoint cannot make the server buffer without bound
+	maxResponseBody = 16 << 20
+	// maxDrainBody is how much unread response is discarded so the
+	// connection can be reused; larger leftovers close the connection
+	maxDrainBody = 64 << 10
+)
+
+// readErrorBody reads the start of an error response
+func readErrorBody(r io.Reader) string {
+	body, _ := io.ReadAll(io.LimitReader(r, maxErrorBody))
+	return strings.TrimSpace(string(body))
+}
+
+// closeBody discards what is left of a response body before closing it
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBody))
+	body.Close()
+}
+
+// ChatPayload is the request body for a chat completion
+type ChatPayload struct {
+	Messages    []ChatMessage            `json:"messages"`
+	MaxTokens   int                      `json:"max_tokens,omitempty"`
+	Temperature *float64                 `json:"temperature,omitempty"`
+	TopP        *float64                 `json:"top_p,omitempty"`
+	Seed        *int64                   `json:"seed,omitempty"`
+	Tools       []map[string]interface{} `json:"tools,omitempty"`
+	Stream      bool                     `json:"stream,omitempty"`
+}
+
+// upstreamError is a non-200 response from a serving endpoint
+type upstreamError struct {
+	Endpoint   string
+	StatusCode int
+	Body       string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("endpoint %s returned %d: %s", e.Endpoint, e.StatusCode, e.Body)
+}
+
+// payloadBuffers recycles request body buffers across upstream calls.
+// Buffers that grew past maxPooledBuffer are left to the GC instead of
+// pinning the memory.
+var payloadBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+const maxPooledBuffer = 1 << 20
+
+// pooledPayload is an encoded request body in a pooled buffer. The first
+// body and those GetBody makes for retries and redirects all read the same
+// bytes, so the buffer goes back to the pool only once the call is over and
+// the transport has closed every body.
+type pooledPayload struct {
+	buf *bytes.Buffer
+	// refs counts the open bodies, plus one for the call until it is over
+	refs atomic.Int32
+}
+
+func (p *pooledPayload) body() io.ReadCloser {
+	p.refs.Add(1)
+	return &pooledBody{Reader: bytes.NewReader(p.buf.Bytes()), payload: p}
+}
+
+func (p *pooledPayload) release() {
+	if p.refs.Add(-1) == 0 && p.buf.Cap() <= maxPooledBuffer {
+		p.buf.Reset()
+		payloadBuffers.Put(p.buf)
+	}
+}
+
+// pooledBody is one read of a pooled payload
+type pooledBody struct {
+	*bytes.Reader
+	payload *pooledPayload
+	once    sync.Once
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(b.payload.release)
+	return nil
+}
+
+// releasingBody releases the payload of the call once the response body is
+// closed
+type releasingBody struct {
+	io.ReadCloser
+	payload *pooledPayload
+	once    sync.Once
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.payload.release)
+	return err
+}
+
+// upstreamRequest is an invocation request whose body is a pooled payload
+type upstreamRequest struct {
+	*http.Request
+	payload *pooledPayload
+}
+
+// do sends the request. The payload is released when the response body is
+// closed, or straight away when the call fails.
+func (r *upstreamRequest) do(client *http.Client) (*http.Response, error) {
+	resp, err := client.Do(r.Request)
+	if err != nil {
+		r.payload.release()
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, payload: r.payload}
+	return resp, nil
+}
+
+// newUpstreamRequest encodes payload into a pooled buffer and builds the
+// invocation request for a serving endpoint
+func newUpstreamRequest(ctx context.Context, endpoint string, payload interface{}) (*upstreamRequest, error) {
+	if chat, ok := payload.(*ChatPayload); ok {
+		payload = applyCapabilities(endpoint, chat)
+	}
+	pooled := &pooledPayload{buf: payloadBuffers.Get().(*bytes.Buffer)}
+	pooled.refs.Store(1)
+	if err := json.NewEncoder(pooled.buf).Encode(payload); err != nil {
+		pooled.release()
+		return nil, err
+	}
+
+	requestURL := fmt.Sprintf("https://%s/serving-endpoints/%s/invocations", databricksHost(), endpoint)
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", requestURL, nil)
+	if err != nil {
+		pooled.release()
+		return nil, err
+	}
+	httpReq.Body = pooled.body()
+	httpReq.GetBody = func() (io.ReadCloser, error) { return pooled.body(), nil }
+	httpReq.ContentLength = int64(pooled.buf.Len())
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", databricksToken()))
+	return &upstreamRequest{Request: httpReq, payload: pooled}, nil
+}
+
+// invokeEndpoint posts a JSON payload to a serving endpoint and decodes the
+// JSON response into out
+func invokeEndpoint(endpoint string, payload interface{}, out interface{}) error {
+	httpReq, err := newUpstreamRequest(context.Background(), endpoint, payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := httpReq.do(upstreamClient)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return &upstreamError{Endpoint: endpoint, StatusCode: resp.StatusCode, Body: readErrorBody(resp.Body)}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseBody)).Decode(out)
+}
+
+// upstreamStatus maps an invokeEndpoint error to the HTTP status it carried,
+// 200 for success and 0 for transport failures
+func upstreamStatus(err error) int {
+	var ue *upstreamError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.As(err, &ue):
+		return ue.StatusCode
+	}
+	return 0
+}
+
+// buildChatMessages assembles the messages sent upstream for a user prompt,
+// including any retrieved grounding context
+func buildChatMessages(prompt string) []ChatMessage {
+	return buildConversationMessages(defaultSystemPrompt(), nil, prompt)
+}
+
+// buildConversationMessages replays earlier turns of a conversation ahead of
+// the new prompt, after the system prompt and any retrieved context
+func buildConversationMessages(system string, history []Message, prompt string) []ChatMessage {
+	messages := make([]ChatMessage, 0, len(history)+3)
+	if system != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: system})
+	}
+	if grounding := retrievalContext(prompt); grounding != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: grounding})
+	}
+	for _, m := range history {
+		if m.Content != "" {
+			messages = attachTables(append(messages, ChatMessage{Role: m.Role, Content: m.Content}), m.Tables)
+		}
+	}
+	return append(messages, ChatMessage{Role: "user", Content: prompt})
+}
+
+// chatPayload builds the request body for a chat completion
+func chatPayload(messages []ChatMessage) *ChatPayload {
+	return &ChatPayload{Messages: messages, MaxTokens: maxResponseTokens}
+}
+
+// groundingOf returns the retrieved context message, if any
+func groundingOf(messages []ChatMessage) string {
+	for _, m := range messages {
+		if m.Role != "system" {
+			break
+		}
+		if strings.HasPrefix(m.Content, groundingPreamble) {
+			return m.Content
+		}
+	}
+	return ""
+}
+
+// completeChat sends the messages to a chat endpoint at the given priority and
+// returns the first choice's content
+func completeChat(prio Priority, endpoint string, messages []ChatMessage) (string, *LLMResponse, error) {
+	release, err := acquireUpstream(context.Background(), prio)
+	if err != nil {
+		return "", nil, err
+	}
+	defer release()
+
+	var llmResp LLMResponse
+	start := time.Now()
+	err = invokeEndpoint(endpoint, chatPayload(messages), &llmResp)
+	llmResp.latency = time.Since(start)
+	pool.observe(upstreamStatus(err), llmResp.latency)
+	if err != nil {
+		return "", nil, err
+	}
+	rateLimiter.chargeTokens(llmResp.Usage.TotalTokens)
+	if len(llmResp.Choices) == 0 || llmResp.Choices[0].Message.Content == "" {
+		return "", nil, fmt.Errorf("invalid response structure from endpoint %s", endpoint)
+	}
+	return llmResp.Choices[0].Message.Content, &llmResp, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// upstreamProxy picks the proxy for a call to a serving endpoint; nil means
+// a direct connection
+var upstreamProxy func(*http.Request) (*url.URL, error)
+
+// configureUpstreamProxy honors HTTPS_PROXY, HTTP_PROXY and NO_PROXY like
+// any Go client. UPSTREAM_PROXY_URL sends serving endpoint calls through
+// another proxy, still skipping the NO_PROXY hosts; credentials can be part
+// of the URL or given as UPSTREAM_PROXY_USER and UPSTREAM_PROXY_PASSWORD.
+func configureUpstreamProxy() {
+	cfg := httpproxy.FromEnvironment()
+	if raw := envString("UPSTREAM_PROXY_URL", ""); raw != "" {
+		proxyURL, err := url.Parse(raw)
+		if err != nil || proxyURL.Host == "" {
+			configWarn("invalid UPSTREAM_PROXY_URL %q, want e.g. http://proxy.example.com:3128", raw)
+		} else {
+			if user := envString("UPSTREAM_PROXY_USER", ""); user != "" {
+				proxyURL.User = url.UserPassword(user, envString("UPSTREAM_PROXY_PASSWORD", ""))
+			}
+			cfg.HTTPSProxy, cfg.HTTPProxy = proxyURL.String(), proxyURL.String()
+			log.Printf("Upstream calls go through proxy %s", proxyURL.Redacted())
+		}
+	}
+	proxyFor := cfg.ProxyFunc()
+	upstreamProxy = func(req *http.Request) (*url.URL, error) {
+		return proxyFor(req.URL)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errUpstreamRateLimited = errors.New("upstream rate limit exceeded")
+
+// tokenBucket refills at rate per second up to burst. Reservations may drive
+// it negative, which later callers wait out.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = math.Max(1, rate)
+	}
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// using them, or false without taking anything when that exceeds maxWait
+func (b *tokenBucket) reserve(n float64, maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	var wait time.Duration
+	if b.tokens < n {
+		wait = time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return wait, false
+	}
+	b.tokens -= n
+	return wait, true
+}
+
+// charge takes n tokens after the fact
+func (b *tokenBucket) charge(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+}
+
+func (b *tokenBucket) available() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens
+}
+
+// upstreamLimiter caps outbound request and token rates to the serving
+// endpoint's provisioned throughput, independently of per-user limits
+type upstreamLimiter struct {
+	requests *tokenBucket // nil when unlimited
+	tokens   *tokenBucket // tokens per second, nil when unlimited
+	maxWait  time.Duration
+
+	mu   sync.Mutex
+	shed int64
+}
+
+// RateLimitStats is a snapshot of the outbound rate limiter
+type RateLimitStats struct {
+	MaxQPS             float64  `json:"max_qps"`
+	MaxTokensPerMinute float64  `json:"max_tokens_per_minute"`
+	RequestsAvailable  *float64 `json:"requests_available,omitempty"`
+	TokensAvailable    *float64 `json:"tokens_available,omitempty"`
+	Shed               int64    `json:"shed"`
+}
+
+var rateLimiter *upstreamLimiter
+
+func configureUpstreamRate() {
+	rateLimiter = &upstreamLimiter{maxWait: envDuration("UPSTREAM_RATE_MAX_WAIT", 5*time.Second)}
+	if qps := envFloat("UPSTREAM_MAX_QPS", 0); qps > 0 {
+		rateLimiter.requests = newTokenBucket(qps, envFloat("UPSTREAM_BURST", 0))
+	}
+	if tpm := envFloat("UPSTREAM_MAX_TOKENS_PER_MINUTE", 0); tpm > 0 {
+		rateLimiter.tokens = newTokenBucket(tpm/60, tpm)
+	}
+}
+
+// wait blocks until the next upstream call fits under the caps, shedding it
+// when that would take longer than UPSTREAM_RATE_MAX_WAIT
+func (l *upstreamLimiter) wait(ctx context.Context) error {
+	var delay time.Duration
+	if l.tokens != nil {
+		// Token usage is only known afterwards; wait out any debt first
+		d, ok := l.tokens.reserve(0, l.maxWait)
+		if !ok {
+			return l.shedOne()
+		}
+		delay = d
+	}
+	if l.requests != nil {
+		d, ok := l.requests.reserve(1, l.maxWait-delay)
+		if !ok {
+			return l.shedOne()
+		}
+		if d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *upstreamLimiter) shedOne() error {
+	l.mu.Lock()
+	l.shed++
+	l.mu.Unlock()
+	return errUpstreamRateLimited
+}
+
+// chargeTokens records the tokens an upstream call consumed
+func (l *upstreamLimiter) chargeTokens(n int) {
+	if l.tokens != nil && n > 0 {
+		l.tokens.charge(float64(n))
+	}
+}
+
+func (l *upstreamLimiter) stats() RateLimitStats {
+	l.mu.Lock()
+	stats := RateLimitStats{Shed: l.shed}
+	l.mu.Unlock()
+
+	if l.requests != nil {
+		stats.MaxQPS = l.requests.rate
+		available := l.requests.available()
+		stats.RequestsAvailable = &available
+	}
+	if l.tokens != nil {
+		stats.MaxTokensPerMinute = l.tokens.rate * 60
+		available := l.tokens.available()
+		stats.TokensAvailable = &available
+	}
+	return stats
+}
+
+// acquireUpstream takes a worker pool slot and waits for the outbound rate
+// limiter, returning the function that frees the slot
+func acquireUpstream(ctx context.Context, prio Priority) (func(), error) {
+	release, err := pool.acquire(ctx, prio)
+	if err != nil {
+		return nil, err
+	}
+	if err := rateLimiter.wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+func handleUpstreamRateStats(c *gin.Context) {
+	c.JSON(http.StatusOK, rateLimiter.stats())
+}
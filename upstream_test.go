@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpstreamRequestResendsBody(t *testing.T) {
+	tests := []struct {
+		name string
+		// first answers the first request; the second gets the body echoed
+		first func(w http.ResponseWriter, r *http.Request)
+	}{
+		{name: "307 redirect", first: func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, r.URL.Path+"?again=1", http.StatusTemporaryRedirect)
+		}},
+		{name: "308 redirect", first: func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, r.URL.Path+"?again=1", http.StatusPermanentRedirect)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					io.Copy(io.Discard, r.Body)
+					tt.first(w, r)
+					return
+				}
+				io.Copy(w, r.Body)
+			}))
+			defer server.Close()
+			previous := databricksHost()
+			setDatabricksHost(strings.TrimPrefix(server.URL, "https://"))
+			defer setDatabricksHost(previous)
+
+			payload := map[string]interface{}{"messages": []ChatMessage{{Role: "user", Content: "hello"}}}
+			req, err := newUpstreamRequest(context.Background(), "test", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := req.do(server.Client())
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if calls != 2 || !strings.Contains(string(body), `"content":"hello"`) {
+				t.Fatalf("%d calls, second body %q", calls, body)
+			}
+			if refs := req.payload.refs.Load(); refs != 0 {
+				t.Fatalf("%d references to the payload left", refs)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UpstreamTLS is the TLS setup for calls to serving endpoints, for gateways
+// with a private CA or that require client certificates
+type UpstreamTLS struct {
+	CABundle   string `json:"ca_bundle,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// endpointTransports routes each upstream call through the transport of its
+// serving endpoint, falling back to the default one
+type endpointTransports struct {
+	fallback  http.RoundTripper
+	endpoints map[string]http.RoundTripper
+}
+
+func (t *endpointTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.endpoints[servingEndpointOf(req.URL.Path)]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// servingEndpointOf returns the endpoint name of a /serving-endpoints/ path
+func servingEndpointOf(path string) string {
+	rest, ok := strings.CutPrefix(path, "/serving-endpoints/")
+	if !ok {
+		return ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return name
+}
+
+// configureUpstreamTLS reads UPSTREAM_CA_BUNDLE, UPSTREAM_CLIENT_CERT and
+// UPSTREAM_CLIENT_KEY for every endpoint, and UPSTREAM_TLS_FILE, a JSON
+// object of endpoint name to UpstreamTLS whose empty fields take the
+// defaults, for the endpoints that differ
+func configureUpstreamTLS() {
+	defaults := UpstreamTLS{
+		CABundle:   envString("UPSTREAM_CA_BUNDLE", ""),
+		ClientCert: envString("UPSTREAM_CLIENT_CERT", ""),
+		ClientKey:  envString("UPSTREAM_CLIENT_KEY", ""),
+		ServerName: envString("UPSTREAM_TLS_SERVER_NAME", ""),
+	}
+	transports := &endpointTransports{endpoints: map[string]http.RoundTripper{}}
+	fallback, err := newUpstreamTransport(defaults)
+	if err != nil {
+		configWarn("upstream TLS: %v", err)
+		fallback, _ = newUpstreamTransport(UpstreamTLS{})
+	}
+	transports.fallback = fallback
+
+	if path := envString("UPSTREAM_TLS_FILE", ""); path != "" {
+		var overrides map[string]UpstreamTLS
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &overrides)
+		}
+		if err != nil {
+			configWarn("failed to load upstream TLS settings from %s: %v", path, err)
+		}
+		for endpoint, cfg := range overrides {
+			t, err := newUpstreamTransport(cfg.withDefaults(defaults))
+			if err != nil {
+				configWarn("upstream TLS for endpoint %s: %v", endpoint, err)
+				continue
+			}
+			transports.endpoints[endpoint] = t
+		}
+		log.Printf("Upstream TLS: %d endpoints with their own settings", len(transports.endpoints))
+	}
+	upstreamClient.Transport = transports
+	streamClient.Transport = transports
+}
+
+func (cfg UpstreamTLS) withDefaults(defaults UpstreamTLS) UpstreamTLS {
+	if cfg.CABundle == "" {
+		cfg.CABundle = defaults.CABundle
+	}
+	if cfg.ClientCert == "" && cfg.ClientKey == "" {
+		cfg.ClientCert, cfg.ClientKey = defaults.ClientCert, defaults.ClientKey
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = defaults.ServerName
+	}
+	return cfg
+}
+
+// newUpstreamTransport builds a transport like http.DefaultTransport, using
+// the upstream proxy, with the CA bundle added to the system roots and the
+// client certificate presented
+func newUpstreamTransport(cfg UpstreamTLS) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = upstreamProxy
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
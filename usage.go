@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageQuery represents the time-series query parameters
+type UsageQuery struct {
+	Bucket  string    `form:"bucket" binding:"omitempty,oneof=hour day"`
+	GroupBy string    `form:"group_by" binding:"omitempty,oneof=none user model"`
+	From    time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To      time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// UsagePoint aggregates the requests that fell into one time bucket
+type UsagePoint struct {
+	Start            time.Time `json:"start"`
+	Requests         int       `json:"requests"`
+	Errors           int       `json:"errors"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	LatencyMeanMs    float64   `json:"latency_mean_ms"`
+	LatencyP95Ms     float64   `json:"latency_p95_ms"`
+
+	latencies []float64
+}
+
+// UsageSeries is the list of buckets for one group key
+type UsageSeries struct {
+	Key    string        `json:"key"`
+	Points []*UsagePoint `json:"points"`
+}
+
+// UsageTimeseriesResponse represents the usage dashboard payload
+type UsageTimeseriesResponse struct {
+	Bucket  string        `json:"bucket"`
+	GroupBy string        `json:"group_by"`
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Series  []UsageSeries `json:"series"`
+}
+
+func handleUsageTimeseries(c *gin.Context) {
+	var q UsageQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	usage, err := usageTimeseries(q)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, usage)
+}
+
+// usageTimeseries fills in the query defaults and aggregates the audit log
+func usageTimeseries(q UsageQuery) (UsageTimeseriesResponse, error) {
+	if q.Bucket == "" {
+		q.Bucket = "hour"
+	}
+	if q.GroupBy == "" {
+		q.GroupBy = "none"
+	}
+	if q.To.IsZero() {
+		q.To = time.Now()
+	}
+	if q.From.IsZero() {
+		if q.Bucket == "day" {
+			q.From = q.To.AddDate(0, 0, -30)
+		} else {
+			q.From = q.To.Add(-24 * time.Hour)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return UsageTimeseriesResponse{}, errors.New("from must be before to")
+	}
+
+	return UsageTimeseriesResponse{
+		Bucket:  q.Bucket,
+		GroupBy: q.GroupBy,
+		From:    q.From,
+		To:      q.To,
+		Series:  aggregateUsage(auditStore.List(q.From, q.To), q.Bucket, q.GroupBy),
+	}, nil
+}
+
+func aggregateUsage(records []AuditRecord, bucket, groupBy string) []UsageSeries {
+	points := map[string]map[time.Time]*UsagePoint{}
+
+	for _, r := range records {
+		key := "all"
+		switch groupBy {
+		case "user":
+			key = r.User
+		case "model":
+			key = r.Model
+		}
+
+		start := bucketStart(r.Timestamp, bucket)
+		if points[key] == nil {
+			points[key] = map[time.Time]*UsagePoint{}
+		}
+		p := points[key][start]
+		if p == nil {
+			p = &UsagePoint{Start: start}
+			points[key][start] = p
+		}
+
+		p.Requests++
+		if r.StatusCode != http.StatusOK {
+			p.Errors++
+		}
+		p.PromptTokens += r.PromptTokens
+		p.CompletionTokens += r.CompletionTokens
+		p.Cost += r.Cost
+		p.latencies = append(p.latencies, float64(r.Latency)/float64(time.Millisecond))
+	}
+
+	series := []UsageSeries{}
+	for key, byStart := range points {
+		s := UsageSeries{Key: key}
+		for _, p := range byStart {
+			p.LatencyMeanMs = mean(p.latencies)
+			p.LatencyP95Ms = percentile(p.latencies, 95)
+			s.Points = append(s.Points, p)
+		}
+		sort.Slice(s.Points, func(i, j int) bool { return s.Points[i].Start.Before(s.Points[j].Start) })
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Key < series[j].Key })
+	return series
+}
+
+func bucketStart(t time.Time, bucket string) time.Time {
+	t = t.UTC()
+	if bucket == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// percentile uses the nearest-rank method on a copy of values
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// validateConfigFlag runs the configuration checks instead of the server
+const validateConfigFlag = "--validate-config"
+
+func validateMode() bool {
+	return len(os.Args) > 1 && os.Args[1] == validateConfigFlag
+}
+
+// endpointCheck is the outcome of probing one serving endpoint
+type endpointCheck struct {
+	Name    string
+	Purpose string
+	Problem string
+}
+
+// checkServingEndpoint looks the endpoint up with the configured token, which
+// proves both that the workspace is reachable and that the token is valid
+func checkServingEndpoint(name string) string {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/api/2.0/serving-endpoints/%s", databricksHost(), name), nil)
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("Authorization", "Bearer "+databricksToken())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("workspace unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fmt.Sprintf("credentials rejected (%d)", resp.StatusCode)
+	case http.StatusNotFound:
+		return "endpoint does not exist"
+	default:
+		return fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+
+	var info struct {
+		State struct {
+			Ready string `json:"ready"`
+		} `json:"state"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&info) == nil && info.State.Ready != "" && info.State.Ready != "READY" {
+		return fmt.Sprintf("endpoint is %s", info.State.Ready)
+	}
+	return ""
+}
+
+// configuredEndpoints lists every serving endpoint the configuration refers to
+func configuredEndpoints() []endpointCheck {
+	checks := []endpointCheck{{Name: llmEndpoint(), Purpose: "chat"}}
+	add := func(name, purpose string) {
+		if name != "" {
+			checks = append(checks, endpointCheck{Name: name, Purpose: purpose})
+		}
+	}
+	add(judgeEndpoint, "judge")
+	add(retrievalConfig.EmbeddingModel, "embedding")
+	add(retrievalConfig.RerankModel, "rerank")
+	for _, e := range compareEndpoints {
+		add(e, "compare")
+	}
+	return checks
+}
+
+// runValidateConfig implements --validate-config: it prints the redacted
+// effective configuration, probes the endpoints and exits non-zero on any
+// problem, without starting the server
+func runValidateConfig() int {
+	fmt.Println("Effective configuration:")
+	for _, s := range effectiveConfig() {
+		suffix := ""
+		if s.Default {
+			suffix = " (default)"
+		} else if s.Source != s.Key {
+			suffix = " (from " + s.Source + ")"
+		}
+		fmt.Printf("  %s=%s%s\n", s.Key, s.Value, suffix)
+	}
+
+	problems := append([]string(nil), configProblems...)
+	if llmEndpoint() == "" {
+		problems = append(problems, "SERVING_ENDPOINT_NAME (or CHATBOT_ENDPOINT) is not set")
+	}
+	if databricksToken() == "" {
+		problems = append(problems, "DATABRICKS_TOKEN (or CHATBOT_TOKEN) is not set")
+	}
+	if databricksHost() == "" {
+		problems = append(problems, "DATABRICKS_HOST (or CHATBOT_HOST) is not set")
+	}
+
+	if llmEndpoint() != "" && databricksToken() != "" && databricksHost() != "" {
+		fmt.Println("Endpoints:")
+		for _, check := range configuredEndpoints() {
+			status := "ok"
+			if problem := checkServingEndpoint(check.Name); problem != "" {
+				status = problem
+				problems = append(problems, fmt.Sprintf("%s endpoint %s: %s", check.Purpose, check.Name, problem))
+			}
+			fmt.Printf("  %s (%s): %s\n", check.Name, check.Purpose, status)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Println("Problems:")
+		for _, p := range problems {
+			fmt.Printf("  - %s\n", p)
+		}
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// VolumeEntry represents a file or directory in a Unity Catalog Volume
+type VolumeEntry struct {
+	Path         string    `json:"path"`
+	Name         string    `json:"name"`
+	IsDirectory  bool      `json:"is_directory"`
+	Size         int64     `json:"file_size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// filesAPIURL builds a workspace Files API URL for an absolute volume path
+func filesAPIURL(kind, p string) string {
+	return fmt.Sprintf("https://%s/api/2.0/fs/%s%s", databricksHost(), kind, (&url.URL{Path: p}).EscapedPath())
+}
+
+func filesAPIGet(requestURL string) (*http.Response, error) {
+	httpReq, err := http.NewRequest("GET", requestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", databricksToken()))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer closeBody(resp.Body)
+		return nil, fmt.Errorf("files API returned %d: %s", resp.StatusCode, readErrorBody(resp.Body))
+	}
+	return resp, nil
+}
+
+// listVolumeDirectory returns the direct children of a volume directory
+func listVolumeDirectory(dir string) ([]VolumeEntry, error) {
+	var entries []VolumeEntry
+	pageToken := ""
+
+	for {
+		requestURL := filesAPIURL("directories", dir)
+		if pageToken != "" {
+			requestURL += "?page_token=" + url.QueryEscape(pageToken)
+		}
+
+		resp, err := filesAPIGet(requestURL)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Path         string `json:"path"`
+				Name         string `json:"name"`
+				IsDirectory  bool   `json:"is_directory"`
+				FileSize     int64  `json:"file_size"`
+				LastModified int64  `json:"last_modified"`
+			} `json:"contents"`
+			NextPageToken string `json:"next_page_token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			entries = append(entries, VolumeEntry{
+				Path:         c.Path,
+				Name:         c.Name,
+				IsDirectory:  c.IsDirectory,
+				Size:         c.FileSize,
+				LastModified: time.UnixMilli(c.LastModified).UTC(),
+			})
+		}
+
+		if page.NextPageToken == "" {
+			return entries, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// walkVolume lists every file below root
+func walkVolume(root string) ([]VolumeEntry, error) {
+	var files []VolumeEntry
+	pending := []string{root}
+
+	for len(pending) > 0 {
+		dir := pending[0]
+		pending = pending[1:]
+
+		entries, err := listVolumeDirectory(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDirectory {
+				pending = append(pending, e.Path)
+			} else {
+				files = append(files, e)
+			}
+		}
+	}
+	return files, nil
+}
+
+func downloadVolumeFile(p string, maxBytes int64) ([]byte, error) {
+	resp, err := filesAPIGet(filesAPIURL("files", p))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, maxBytes))
+}
+
+// withinVolume reports whether p is root or a path below it
+func withinVolume(root, p string) bool {
+	root = path.Clean(root)
+	p = path.Clean(p)
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// One WebSocket on /api/chat/ws carries any number of chat streams, each
+// named by the client. A stream runs through /api/chat/stream like a long
+// poll does, and its events come back as frames tagged with the stream's ID.
+// Each stream sends only as many events as the client granted it credits
+// for, so a slow panel holds up its own stream and no other.
+
+// wsFrame is a message in either direction. The client sends start, credit,
+// cancel and ping frames; the server sends event, end, error and pong frames.
+type wsFrame struct {
+	Type   string `json:"type"`
+	Stream string `json:"stream,omitempty"`
+	// Request is the /api/chat/stream body of a start frame
+	Request json.RawMessage `json:"request,omitempty"`
+	// Credits is how many more events the stream may send: the first window
+	// on start, more on credit
+	Credits int             `json:"credits,omitempty"`
+	Event   string          `json:"event,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	// Status and Error of an end frame report how the stream finished; an
+	// error frame rejects the client's frame
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+var (
+	wsMaxStreams     int
+	wsInitialCredits int
+	wsMaxFrameBytes  int
+	wsAllowedOrigins map[string]bool
+
+	wsMu          sync.Mutex
+	wsConnections int
+	wsStreams     int
+
+	wsEventsSent *counterVec
+)
+
+// configureWebSocket reads WS_MAX_STREAMS, the concurrent streams of one
+// connection, WS_INITIAL_CREDITS, the events a stream may send before the
+// client grants more, WS_MAX_FRAME_BYTES and WS_ALLOWED_ORIGINS, the origins
+// besides the app's own that may connect
+func configureWebSocket() {
+	wsMaxStreams = envInt("WS_MAX_STREAMS", 8)
+	wsInitialCredits = envInt("WS_INITIAL_CREDITS", 64)
+	wsMaxFrameBytes = envInt("WS_MAX_FRAME_BYTES", 1<<20)
+	wsAllowedOrigins = envSet("WS_ALLOWED_ORIGINS")
+	wsEventsSent = newCounterVec("chatbot_websocket_events_total", "Stream events sent over WebSockets, by event", "event")
+	registerGaugeFunc("chatbot_websocket_connections", "Open chat WebSockets", func() float64 {
+		wsMu.Lock()
+		defer wsMu.Unlock()
+		return float64(wsConnections)
+	})
+	registerGaugeFunc("chatbot_websocket_streams", "Chat streams running over WebSockets", func() float64 {
+		wsMu.Lock()
+		defer wsMu.Unlock()
+		return float64(wsStreams)
+	})
+}
+
+// wsConn is one client connection and the streams running over it
+type wsConn struct {
+	ws     *websocket.Conn
+	codec  websocket.Codec
+	header http.Header
+	remote string
+	ctx    context.Context
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	streams map[string]*wsStream
+}
+
+// wsStream is one chat stream of a connection. It is the stream handler's
+// http.ResponseWriter, turning each server-sent event into a frame.
+type wsStream struct {
+	id     string
+	conn   *wsConn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	header http.Header
+	status int
+	// pending holds a partial event, or the whole body of a rejection
+	pending bytes.Buffer
+
+	mu      sync.Mutex
+	credits int
+	granted chan struct{}
+}
+
+// handleChatWebSocket upgrades the request and serves frames until the
+// client disconnects, which stops its streams
+func handleChatWebSocket(c *gin.Context) {
+	header := c.Request.Header.Clone()
+	for name := range header {
+		if strings.HasPrefix(name, "Sec-Websocket-") {
+			header.Del(name)
+		}
+	}
+	header.Del("Upgrade")
+	header.Del("Connection")
+	header.Set("Content-Type", "application/json")
+
+	server := websocket.Server{
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			if err := checkWebSocketOrigin(config, req); err != nil {
+				return err
+			}
+			return negotiateWebSocketProtocol(config, req)
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = wsMaxFrameBytes
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			conn := &wsConn{ws: ws, codec: wsCodec(ws), header: header, remote: c.Request.RemoteAddr, ctx: ctx, streams: map[string]*wsStream{}}
+			wsMu.Lock()
+			wsConnections++
+			wsMu.Unlock()
+			defer func() {
+				wsMu.Lock()
+				wsConnections--
+				wsMu.Unlock()
+			}()
+			conn.serve()
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// checkWebSocketOrigin lets browsers connect from the app's own origin and
+// WS_ALLOWED_ORIGINS only, since the identity headers come with the request
+// whichever page opened it. Clients that send no Origin are not browsers.
+func checkWebSocketOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(u.Host, req.Host) || wsAllowedOrigins[strings.ToLower(origin)] {
+		return nil
+	}
+	return fmt.Errorf("origin %s is not allowed", origin)
+}
+
+func (conn *wsConn) serve() {
+	for {
+		var frame wsFrame
+		if err := conn.codec.Receive(conn.ws, &frame); err != nil {
+			var syntax *json.SyntaxError
+			switch {
+			case errors.As(err, &syntax):
+				conn.send(wsFrame{Type: "error", Error: "frames must be JSON"})
+				continue
+			case errors.Is(err, errMalformedFrame):
+				conn.send(wsFrame{Type: "error", Error: err.Error()})
+				continue
+			}
+			return
+		}
+		switch frame.Type {
+		case "start":
+			conn.start(frame)
+		case "credit":
+			if s := conn.stream(frame.Stream); s != nil && frame.Credits > 0 {
+				s.grant(frame.Credits)
+			}
+		case "cancel":
+			if s := conn.stream(frame.Stream); s != nil {
+				s.cancel()
+			}
+		case "ping":
+			conn.send(wsFrame{Type: "pong"})
+		default:
+			conn.send(wsFrame{Type: "error", Stream: frame.Stream, Error: "unknown frame type " + frame.Type})
+		}
+	}
+}
+
+func (conn *wsConn) send(frame wsFrame) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	return conn.codec.Send(conn.ws, frame)
+}
+
+func (conn *wsConn) stream(id string) *wsStream {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.streams[id]
+}
+
+// start runs the frame's request as a new stream of the connection
+func (conn *wsConn) start(frame wsFrame) {
+	if frame.Stream == "" {
+		conn.send(wsFrame{Type: "error", Error: "start needs a stream ID"})
+		return
+	}
+	credits := frame.Credits
+	if credits <= 0 {
+		credits = wsInitialCredits
+	}
+	ctx, cancel := context.WithCancel(conn.ctx)
+	s := &wsStream{id: frame.Stream, conn: conn, ctx: ctx, cancel: cancel, header: http.Header{}, credits: credits, granted: make(chan struct{}, 1)}
+	conn.mu.Lock()
+	_, taken := conn.streams[frame.Stream]
+	full := len(conn.streams) >= wsMaxStreams
+	if !taken && !full {
+		conn.streams[frame.Stream] = s
+	}
+	conn.mu.Unlock()
+	switch {
+	case taken:
+		cancel()
+		conn.send(wsFrame{Type: "error", Stream: frame.Stream, Error: "stream is already running"})
+		return
+	case full:
+		cancel()
+		conn.send(wsFrame{Type: "error", Stream: frame.Stream, Error: fmt.Sprintf("at most %d streams can run on one connection", wsMaxStreams)})
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/chat/stream", bytes.NewReader(frame.Request))
+	if err != nil {
+		s.end()
+		return
+	}
+	// The stream runs as the caller
+	req.Header = conn.header.Clone()
+	req.RemoteAddr = conn.remote
+	wsMu.Lock()
+	wsStreams++
+	wsMu.Unlock()
+	go func() {
+		defer func() {
+			wsMu.Lock()
+			wsStreams--
+			wsMu.Unlock()
+		}()
+		pollRouter.ServeHTTP(s, req)
+		s.end()
+	}()
+}
+
+func (s *wsStream) grant(credits int) {
+	s.mu.Lock()
+	s.credits += credits
+	s.mu.Unlock()
+	select {
+	case s.granted <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for a credit, failing once the stream is cancelled or the
+// connection is gone
+func (s *wsStream) take() error {
+	for {
+		s.mu.Lock()
+		if s.credits > 0 {
+			s.credits--
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.granted:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+}
+
+func (s *wsStream) Header() http.Header { return s.header }
+
+func (s *wsStream) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+}
+
+// Write forwards each complete server-sent event as a frame, waiting for
+// credit first; other responses are rejections, kept whole for the end frame
+func (s *wsStream) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	s.pending.Write(p)
+	if s.status != http.StatusOK {
+		return len(p), nil
+	}
+	for {
+		frame, rest, ok := bytes.Cut(s.pending.Bytes(), []byte("\n\n"))
+		if !ok {
+			break
+		}
+		name, data := parseSSEFrame(string(frame))
+		s.pending = *bytes.NewBuffer(append([]byte(nil), rest...))
+		if name == "" {
+			continue
+		}
+		if err := s.take(); err != nil {
+			return 0, err
+		}
+		if err := s.conn.send(wsFrame{Type: "event", Stream: s.id, Event: name, Data: json.RawMessage(data)}); err != nil {
+			s.cancel()
+			return 0, err
+		}
+		wsEventsSent.inc(name)
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Flush() {}
+
+// end reports how the stream finished and frees its ID
+func (s *wsStream) end() {
+	s.cancel()
+	s.conn.mu.Lock()
+	delete(s.conn.streams, s.id)
+	s.conn.mu.Unlock()
+	frame := wsFrame{Type: "end", Stream: s.id, Status: s.status}
+	if s.status != http.StatusOK {
+		var failed struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(s.pending.Bytes(), &failed)
+		frame.Error = failed.Error
+	}
+	// Fails when the connection is gone, which is why the stream ended
+	s.conn.send(frame)
+}
+
+// parseSSEFrame returns the event name and data of one server-sent event;
+// comments such as keepalives have no name
+func parseSSEFrame(frame string) (name, data string) {
+	for _, line := range strings.Split(frame, "\n") {
+		if v, ok := strings.CutPrefix(line, "event:"); ok {
+			name = strings.TrimSpace(v)
+		} else if v, ok := strings.CutPrefix(line, "data:"); ok {
+			data = v
+		}
+	}
+	return name, data
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Clients pick the framing of /api/chat/ws with Sec-WebSocket-Protocol.
+// chatbot.protobuf frames are the chatbot.v1.Frame messages of
+// proto/chat_stream.proto, one per binary message; chatbot.json, and no
+// subprotocol at all, are the JSON text frames.
+const (
+	wsProtocolJSON     = "chatbot.json"
+	wsProtocolProtobuf = "chatbot.protobuf"
+)
+
+// wsFrameTypes are the Frame.Type enum values, in order
+var wsFrameTypes = []string{"", "start", "credit", "cancel", "ping", "event", "end", "error", "pong"}
+
+// Field numbers of chatbot.v1.Frame
+const (
+	wsFieldType protowire.Number = iota + 1
+	wsFieldStream
+	wsFieldRequest
+	wsFieldCredits
+	wsFieldEvent
+	wsFieldData
+	wsFieldStatus
+	wsFieldError
+	wsFieldContent
+)
+
+var errMalformedFrame = errors.New("frames must be chatbot.v1.Frame messages")
+
+var wsProtobuf = websocket.Codec{Marshal: marshalWSFrame, Unmarshal: unmarshalWSFrame}
+
+// negotiateWebSocketProtocol picks the framing from the subprotocols the
+// client offers, preferring protobuf; a client offering neither is refused
+func negotiateWebSocketProtocol(config *websocket.Config, req *http.Request) error {
+	if len(config.Protocol) == 0 {
+		return nil
+	}
+	offered := config.Protocol
+	for _, protocol := range []string{wsProtocolProtobuf, wsProtocolJSON} {
+		for _, p := range offered {
+			if p == protocol {
+				config.Protocol = []string{protocol}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("unsupported subprotocols %v", offered)
+}
+
+// wsCodec is the codec for the subprotocol the connection settled on
+func wsCodec(ws *websocket.Conn) websocket.Codec {
+	if protocol := ws.Config().Protocol; len(protocol) == 1 && protocol[0] == wsProtocolProtobuf {
+		return wsProtobuf
+	}
+	return websocket.JSON
+}
+
+// marshalWSFrame encodes a frame as a chatbot.v1.Frame. The text of a delta
+// goes in content, so clients can show it without parsing JSON.
+func marshalWSFrame(v interface{}) ([]byte, byte, error) {
+	frame, ok := v.(wsFrame)
+	if !ok {
+		return nil, 0, fmt.Errorf("cannot encode %T as a frame", v)
+	}
+	var b []byte
+	for i, t := range wsFrameTypes {
+		if t == frame.Type && i > 0 {
+			b = protowire.AppendTag(b, wsFieldType, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(i))
+		}
+	}
+	b = appendWSString(b, wsFieldStream, frame.Stream)
+	b = appendWSBytes(b, wsFieldRequest, frame.Request)
+	b = appendWSVarint(b, wsFieldCredits, frame.Credits)
+	b = appendWSString(b, wsFieldEvent, frame.Event)
+	var delta struct {
+		Content string `json:"content"`
+	}
+	if frame.Event == "delta" && json.Unmarshal(frame.Data, &delta) == nil {
+		b = appendWSString(b, wsFieldContent, delta.Content)
+	} else {
+		b = appendWSBytes(b, wsFieldData, frame.Data)
+	}
+	b = appendWSVarint(b, wsFieldStatus, frame.Status)
+	b = appendWSString(b, wsFieldError, frame.Error)
+	return b, websocket.BinaryFrame, nil
+}
+
+func appendWSString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return protowire.AppendString(protowire.AppendTag(b, num, protowire.BytesType), v)
+}
+
+func appendWSBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), v)
+}
+
+func appendWSVarint(b []byte, num protowire.Number, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	// int32 fields are sign-extended to 64 bits on the wire
+	return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), uint64(int64(int32(v))))
+}
+
+// unmarshalWSFrame decodes a chatbot.v1.Frame, skipping fields it does not
+// know so newer clients can talk to older servers
+func unmarshalWSFrame(data []byte, _ byte, v interface{}) error {
+	frame, ok := v.(*wsFrame)
+	if !ok {
+		return fmt.Errorf("cannot decode a frame into %T", v)
+	}
+	*frame = wsFrame{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errMalformedFrame
+		}
+		data = data[n:]
+		switch {
+		case typ == protowire.VarintType && (num == wsFieldType || num == wsFieldCredits || num == wsFieldStatus):
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return errMalformedFrame
+			}
+			data = data[n:]
+			switch num {
+			case wsFieldType:
+				frame.Type = fmt.Sprintf("unknown(%d)", value)
+				if value < uint64(len(wsFrameTypes)) {
+					frame.Type = wsFrameTypes[value]
+				}
+			case wsFieldCredits:
+				frame.Credits = int(int32(value))
+			case wsFieldStatus:
+				frame.Status = int(int32(value))
+			}
+		case typ == protowire.BytesType && num >= wsFieldStream && num <= wsFieldContent:
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return errMalformedFrame
+			}
+			data = data[n:]
+			switch num {
+			case wsFieldStream:
+				frame.Stream = string(value)
+			case wsFieldRequest:
+				frame.Request = append(json.RawMessage(nil), value...)
+			case wsFieldEvent:
+				frame.Event = string(value)
+			case wsFieldData:
+				frame.Data = append(json.RawMessage(nil), value...)
+			case wsFieldError:
+				frame.Error = string(value)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return errMalformedFrame
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}